@@ -0,0 +1,160 @@
+package rpcplugin
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"go.rpcplugin.org/rpcplugin/handshake"
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+	"google.golang.org/grpc/credentials"
+)
+
+// AttachConfig is used to configure a plugin client that connects to a plugin
+// server that is already running, using function Attach.
+type AttachConfig struct {
+	// Addr is the address where the plugin server is listening.
+	Addr net.Addr
+
+	// TLSConfig is the TLS configuration to use when connecting to the
+	// plugin server. The automatic TLS negotiation protocol requires a
+	// handshake, and so it isn't available when attaching.
+	//
+	// If TLSConfig is nil, the client will connect without TLS. That is
+	// appropriate only for debugging, with a server that was also configured
+	// not to use TLS.
+	TLSConfig *tls.Config
+
+	// PerRPCCredentials, if set, provides credentials to attach to every
+	// call, as for ClientConfig.PerRPCCredentials.
+	PerRPCCredentials credentials.PerRPCCredentials
+
+	// TraceCalls causes the client to report each RPC call to the tracer,
+	// as for ClientConfig.TraceCalls.
+	TraceCalls bool
+
+	// BlockUntilReady and WaitForReady control waiting for the connection
+	// to the plugin server to become ready, as for the ClientConfig fields
+	// of the same names.
+	BlockUntilReady bool
+	WaitForReady    bool
+
+	// Compressor, if set, is the name of a compressor to use for the
+	// messages the client sends, as for ClientConfig.Compressor.
+	Compressor string
+
+	// DefaultCallTimeout, if greater than zero, is a time limit for calls
+	// without a deadline, as for ClientConfig.DefaultCallTimeout.
+	DefaultCallTimeout time.Duration
+
+	// ProtoVersions gives a Client implementation for each major protocol
+	// version, as for ClientConfig.ProtoVersions.
+	ProtoVersions map[int]ClientVersion
+
+	// Dial, if set, opens the connections to the plugin server in place of
+	// dialing Addr directly, for servers reachable only through a tunnel
+	// such as a forwarded SSH channel. Addr is then used only to describe
+	// the server, and is passed to Dial.
+	Dial func(ctx context.Context, addr net.Addr) (net.Conn, error)
+
+	// OnClose, if set, is called when the returned plugin is closed, for
+	// callers that are responsible for stopping the server by some other
+	// means. Its error, if any, is returned from Plugin.Close.
+	OnClose func() error
+
+	// ProtoVersion is the protocol version the plugin server is serving.
+	// There is no version negotiation when attaching, so the client must
+	// know in advance which version to use.
+	//
+	// ProtoVersion may be left as zero if ProtoVersions has only one element,
+	// in which case that single version is selected.
+	ProtoVersion int
+}
+
+// Attach returns an object representing a plugin server that is already
+// running, either in a separate process that the caller is not responsible
+// for, such as a server in development mode (see ServerConfig.DevMode), or
+// on another computer.
+//
+// Because the client didn't launch the server, there is no handshake and no
+// child process. The returned plugin object can be used to obtain clients
+// in the usual way, but closing it doesn't terminate the server unless
+// AttachConfig.OnClose arranges that.
+//
+// Once an AttachConfig has been passed to this function, the caller must no
+// longer access it or modify it.
+func Attach(ctx context.Context, config *AttachConfig) (*Plugin, error) {
+	if config.Addr == nil {
+		return nil, fmt.Errorf("config field Addr must not be nil")
+	}
+
+	version := config.ProtoVersion
+	if version == 0 && len(config.ProtoVersions) == 1 {
+		for v := range config.ProtoVersions {
+			version = v
+		}
+	}
+	cv, ok := config.ProtoVersions[version]
+	if !ok {
+		return nil, fmt.Errorf("config field ProtoVersions has no client for protocol version %d", version)
+	}
+
+	if err := checkCompressor("Compressor", config.Compressor); err != nil {
+		return nil, err
+	}
+
+	tracer := plugintrace.ContextClientTracer(ctx)
+	inst := plugintrace.Instance{ID: nextPluginID()}
+	if tracer.TLSConfig != nil && config.TLSConfig != nil {
+		tracer.TLSConfig(inst, config.TLSConfig, false)
+	}
+
+	// An attached plugin has no child process, so we represent the "exit"
+	// of the process as an already-closed channel.
+	exitCh := make(chan struct{})
+	close(exitCh)
+
+	return &Plugin{
+		protoVersion: version,
+		rpcProtocol:  "grpc",
+		cv:           cv,
+		addr:         config.Addr,
+		tlsConfig:    config.TLSConfig,
+		perRPCCreds:  config.PerRPCCredentials,
+		traceCalls:   config.TraceCalls,
+		compressor:   config.Compressor,
+		callTimeout:  config.DefaultCallTimeout,
+		blockReady:   config.BlockUntilReady,
+		waitReady:    config.WaitForReady,
+		rpcStats:     newRPCStats(),
+		startedAt:    time.Now(),
+		exit:         exitCh,
+		tracer:       tracer,
+		instance:     inst,
+		dial:         config.Dial,
+		onClose:      config.OnClose,
+	}, nil
+}
+
+// ParseAttachLine parses a handshake line, such as the one a plugin server
+// running with ServerConfig.DevMode writes in its connection instructions,
+// and returns the address and protocol version it describes for use in an
+// AttachConfig.
+//
+// The line must not include a certificate, because Attach doesn't support
+// the automatic TLS negotiation protocol.
+func ParseAttachLine(line string) (addr net.Addr, protoVersion int, err error) {
+	hs, err := handshake.ParseLine(line)
+	if err != nil {
+		return nil, 0, err
+	}
+	if hs.RPCProtocol != "grpc" {
+		return nil, 0, &UnsupportedProtocolError{RPCProtocol: hs.RPCProtocol, Version: -1}
+	}
+	if hs.Certificate != nil {
+		return nil, 0, fmt.Errorf("cannot attach to a plugin server that uses automatic TLS negotiation")
+	}
+	return hs.Addr, hs.ProtoVersion, nil
+}
@@ -0,0 +1,109 @@
+package rpcplugin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// authorizationMetadataKey is the gRPC metadata key used to send bearer
+// tokens with each call.
+const authorizationMetadataKey = "authorization"
+
+// BearerToken returns per-RPC credentials that send the given token as a
+// bearer token in the "authorization" metadata of each call, for use with
+// ClientConfig.PerRPCCredentials.
+//
+// The token is sent even if TLS is disabled, so it is not protected from
+// eavesdropping in that case.
+func BearerToken(token string) credentials.PerRPCCredentials {
+	return bearerToken(token)
+}
+
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{
+		authorizationMetadataKey: "Bearer " + string(t),
+	}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return false
+}
+
+// authTokenEnvName is the environment variable the client uses to pass a
+// shared secret token to the server, which the client then sends with each
+// call so that the server can reject calls from anyone else.
+const authTokenEnvName = "PLUGIN_AUTH_TOKEN"
+
+// sharedTokenMetadataKey is the gRPC metadata key used to send the shared
+// token. It's separate from the "authorization" key so that the shared token
+// can be used alongside application-specific per-RPC credentials.
+const sharedTokenMetadataKey = "rpcplugin-token"
+
+// generateSharedToken returns a new random token for use with
+// ClientConfig.SharedToken.
+func generateSharedToken() (string, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf[:]), nil
+}
+
+// sharedToken is the per-RPC credentials that send a shared token.
+type sharedToken string
+
+func (t sharedToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{
+		sharedTokenMetadataKey: string(t),
+	}, nil
+}
+
+func (t sharedToken) RequireTransportSecurity() bool {
+	return false
+}
+
+// SharedTokenUnaryInterceptor returns a server interceptor that rejects any
+// call that doesn't include the given token in its metadata, as sent by
+// clients whose ClientConfig has SharedToken set.
+//
+// Serve installs this interceptor automatically when the client offers a
+// shared token, so this is needed only for servers that don't use Serve.
+func SharedTokenUnaryInterceptor(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := checkSharedToken(ctx, token); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// SharedTokenStreamInterceptor is the stream interceptor equivalent of
+// SharedTokenUnaryInterceptor.
+func SharedTokenStreamInterceptor(token string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkSharedToken(ss.Context(), token); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func checkSharedToken(ctx context.Context, token string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, got := range md.Get(sharedTokenMetadataKey) {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or incorrect plugin client token")
+}
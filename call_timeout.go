@@ -0,0 +1,21 @@
+package rpcplugin
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// clientCallTimeoutUnaryInterceptor returns a client interceptor that
+// applies the given timeout to each call whose context has no deadline.
+func clientCallTimeoutUnaryInterceptor(timeout time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
@@ -0,0 +1,173 @@
+package rpcplugin
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// The interceptors in this file report each call to the CallCompleted
+// function of a client or server tracer, when the client or server is
+// configured with TraceCalls set.
+
+// callCounter accumulates the message counts for a call in progress.
+type callCounter struct {
+	mu   sync.Mutex
+	info plugintrace.CallInfo
+}
+
+func (c *callCounter) sent(msg interface{}) {
+	c.mu.Lock()
+	c.info.SentMessages++
+	c.info.SentBytes += messageSize(msg)
+	c.mu.Unlock()
+}
+
+func (c *callCounter) received(msg interface{}) {
+	c.mu.Lock()
+	c.info.RecvMessages++
+	c.info.RecvBytes += messageSize(msg)
+	c.mu.Unlock()
+}
+
+// finish completes the call information with the call's outcome.
+func (c *callCounter) finish(start time.Time, err error) *plugintrace.CallInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := c.info
+	info.Duration = time.Since(start)
+	info.Code = status.Code(err)
+	info.Err = err
+	return &info
+}
+
+// messageSize returns the encoded size of the given message, or zero if it
+// isn't a protobuf message.
+func messageSize(msg interface{}) int {
+	if m, ok := msg.(proto.Message); ok {
+		return proto.Size(m)
+	}
+	return 0
+}
+
+func clientCallTraceUnaryInterceptor(report func(*plugintrace.CallInfo)) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		c := &callCounter{info: plugintrace.CallInfo{Method: method}}
+		start := time.Now()
+		c.sent(req)
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err == nil {
+			c.received(reply)
+		}
+		report(c.finish(start, err))
+		return err
+	}
+}
+
+func clientCallTraceStreamInterceptor(report func(*plugintrace.CallInfo)) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		c := &callCounter{info: plugintrace.CallInfo{Method: method, Stream: true}}
+		start := time.Now()
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			report(c.finish(start, err))
+			return nil, err
+		}
+		return &tracedClientStream{
+			ClientStream: cs,
+			counter:      c,
+			start:        start,
+			report:       report,
+		}, nil
+	}
+}
+
+// tracedClientStream counts the messages of a client stream, and reports
+// the call once the stream ends. A stream that the caller abandons without
+// receiving until the end is never reported.
+type tracedClientStream struct {
+	grpc.ClientStream
+	counter *callCounter
+	start   time.Time
+	report  func(*plugintrace.CallInfo)
+	once    sync.Once
+}
+
+func (s *tracedClientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err == nil {
+		s.counter.sent(m)
+	}
+	return err
+}
+
+func (s *tracedClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case err == nil:
+		s.counter.received(m)
+	case err == io.EOF:
+		s.done(nil)
+	default:
+		s.done(err)
+	}
+	return err
+}
+
+func (s *tracedClientStream) done(err error) {
+	s.once.Do(func() {
+		s.report(s.counter.finish(s.start, err))
+	})
+}
+
+func serverCallTraceUnaryInterceptor(report func(*plugintrace.CallInfo)) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		c := &callCounter{info: plugintrace.CallInfo{Method: info.FullMethod}}
+		start := time.Now()
+		c.received(req)
+		resp, err := handler(ctx, req)
+		if err == nil {
+			c.sent(resp)
+		}
+		report(c.finish(start, err))
+		return resp, err
+	}
+}
+
+func serverCallTraceStreamInterceptor(report func(*plugintrace.CallInfo)) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		c := &callCounter{info: plugintrace.CallInfo{Method: info.FullMethod, Stream: true}}
+		start := time.Now()
+		err := handler(srv, &tracedServerStream{ServerStream: ss, counter: c})
+		report(c.finish(start, err))
+		return err
+	}
+}
+
+// tracedServerStream counts the messages of a server stream.
+type tracedServerStream struct {
+	grpc.ServerStream
+	counter *callCounter
+}
+
+func (s *tracedServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.counter.sent(m)
+	}
+	return err
+}
+
+func (s *tracedServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.counter.received(m)
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+package rpcplugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc"
+)
+
+// internalMethodPrefixes are the prefixes of the full method names of the
+// services that rpcplugin servers offer for their own use, whose calls
+// CancelCalls leaves alone.
+var internalMethodPrefixes = []string{
+	"/rpcplugin.",
+	"/grpc.health.v1.",
+	"/grpc.reflection.",
+	"/plugin.",
+}
+
+func isInternalMethod(fullMethod string) bool {
+	for _, prefix := range internalMethodPrefixes {
+		if strings.HasPrefix(fullMethod, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// callCanceler tracks the contexts of the plugin's RPC handlers that are in
+// progress, so that the client can cancel them all at once using the
+// control service.
+type callCanceler struct {
+	mu      sync.Mutex
+	next    uint64
+	cancels map[uint64]context.CancelFunc
+}
+
+func newCallCanceler() *callCanceler {
+	return &callCanceler{
+		cancels: make(map[uint64]context.CancelFunc),
+	}
+}
+
+// track returns a cancellable child of the given handler context, and a
+// function to call once the handler returns.
+func (c *callCanceler) track(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	c.mu.Lock()
+	id := c.next
+	c.next++
+	c.cancels[id] = cancel
+	c.mu.Unlock()
+	return ctx, func() {
+		c.mu.Lock()
+		delete(c.cancels, id)
+		c.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancelAll cancels the contexts of all of the handlers in progress,
+// returning how many there were.
+func (c *callCanceler) cancelAll() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cancel := range c.cancels {
+		cancel()
+	}
+	n := len(c.cancels)
+	c.cancels = make(map[uint64]context.CancelFunc)
+	return n
+}
+
+// callCancelUnaryInterceptor and callCancelStreamInterceptor give each of the
+// plugin's RPC handlers a context that the given callCanceler can cancel.
+func callCancelUnaryInterceptor(c *callCanceler) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if isInternalMethod(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		ctx, done := c.track(ctx)
+		defer done()
+		return handler(ctx, req)
+	}
+}
+
+func callCancelStreamInterceptor(c *callCanceler) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if isInternalMethod(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		ctx, done := c.track(ss.Context())
+		defer done()
+		return handler(srv, &ctxServerStream{
+			ServerStream: ss,
+			ctx:          ctx,
+		})
+	}
+}
+
+// CancelCalls asks the plugin server to cancel the contexts of all of its
+// RPC handlers that are currently in progress, such as when the user has
+// asked the host application to abort what it is doing, and returns how
+// many it cancelled.
+//
+// Handlers for calls that begin afterwards are unaffected. The calls whose
+// handlers were cancelled typically fail with status Canceled, but that
+// depends on how each handler responds to its context being cancelled. The
+// host's own contexts for those calls are unaffected, so the host can still
+// wait for them to return.
+func (p *Plugin) CancelCalls(ctx context.Context) (int, error) {
+	if p.rpcProtocol != "grpc" {
+		return 0, fmt.Errorf("plugin server using RPC protocol %q does not support cancelling calls", p.rpcProtocol)
+	}
+
+	conn, err := p.dialGRPC(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to %s: %w", p.addr, err)
+	}
+	defer conn.Close()
+
+	client := &controlClient{cc: conn}
+	resp, err := client.CancelCalls(ctx, &empty.Empty{})
+	if err != nil {
+		return 0, fmt.Errorf("plugin server failed to cancel calls: %w", err)
+	}
+	return int(resp.GetValue()), nil
+}
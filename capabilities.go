@@ -0,0 +1,94 @@
+package rpcplugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/apparentlymart/go-ctxenv/ctxenv"
+)
+
+// Capabilities is a set of application-defined feature names that a plugin
+// client and server have agreed to use, in addition to their negotiated
+// protocol version.
+//
+// Capabilities allow a protocol to gain optional features without a new
+// major version: the client advertises the features it supports using
+// ClientConfig.Capabilities, and the server selects those it also supports
+// from ServerConfig.Capabilities. Each side can then check for a feature
+// before relying on it, using Plugin.Capabilities on the client and
+// ContextCapabilities on the server.
+type Capabilities []string
+
+// Has returns true if the set includes the given capability.
+func (c Capabilities) Has(name string) bool {
+	for _, have := range c {
+		if have == name {
+			return true
+		}
+	}
+	return false
+}
+
+// capabilitiesEnvName is the environment variable the client uses to
+// advertise the capabilities it supports, as a comma-separated list.
+//
+// The server responds with the capabilities it selected in the handshake
+// extensions, so this is meaningful only along with version 2 of the
+// handshake.
+const capabilitiesEnvName = "PLUGIN_CAPABILITIES"
+
+// checkCapabilities returns an error if any of the given capability names
+// cannot be advertised in the environment.
+func checkCapabilities(field string, names []string) error {
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, ",\x00") {
+			return fmt.Errorf("config field %s has invalid capability %q", field, name)
+		}
+	}
+	return nil
+}
+
+// serverSelectCapabilities returns the capabilities the client advertised
+// that are also in the given supported set, in the order the client listed
+// them.
+func serverSelectCapabilities(ctx context.Context, supported []string) Capabilities {
+	raw := ctxenv.Getenv(ctx, capabilitiesEnvName)
+	if raw == "" {
+		return nil
+	}
+	var ret Capabilities
+	for _, name := range strings.Split(raw, ",") {
+		if Capabilities(supported).Has(name) && !ret.Has(name) {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+// Capabilities returns the set of capabilities the client and plugin server
+// agreed to use, which is empty if either of them supports none of the
+// capabilities the other does, or if the server doesn't support capability
+// negotiation.
+//
+// A plugin obtained using Attach has no capabilities, because there is no
+// handshake to negotiate them.
+//
+// Callers must not modify the returned set.
+func (p *Plugin) Capabilities() Capabilities {
+	return p.capabilities
+}
+
+// ContextCapabilities returns the set of capabilities the plugin server
+// agreed with its client, for use in the implementation of a plugin RPC
+// method. It returns nil if the given context doesn't belong to an RPC
+// request to a plugin server, or if no capabilities were agreed.
+//
+// Callers must not modify the returned set.
+func ContextCapabilities(ctx context.Context) Capabilities {
+	sc := contextServerContext(ctx)
+	if sc == nil {
+		return nil
+	}
+	return sc.capabilities
+}
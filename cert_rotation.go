@@ -0,0 +1,82 @@
+package rpcplugin
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+// RotateCertificates replaces the temporary certificates that the client
+// and the plugin server negotiated automatically during the handshake with
+// new ones, so that long-lived plugins need not use the same credentials
+// indefinitely.
+//
+// Connections that are already established remain open, while any new
+// connections, including reconnections made automatically by existing
+// clients, will use the new certificates.
+//
+// RotateCertificates returns an error if the plugin was configured with an
+// explicit TLS configuration, in which case the caller is responsible for
+// rotating certificates itself, such as by using the GetCertificate and
+// GetClientCertificate callbacks of the TLS configurations.
+func (p *Plugin) RotateCertificates(ctx context.Context) error {
+	if p.auto == nil {
+		return fmt.Errorf("plugin is not using automatically-negotiated TLS certificates")
+	}
+
+	cert, err := generateCertificate(ctx, "localhost", p.auto.issuer)
+	if err != nil {
+		return fmt.Errorf("failed to generate new client TLS certificate: %s", err)
+	}
+
+	conn, err := p.dialGRPC(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %s", p.addr, err)
+	}
+	defer conn.Close()
+
+	client := &controlClient{conn}
+	resp, err := client.RotateCertificate(ctx, &wrappers.BytesValue{Value: cert.Certificate[0]})
+	if err != nil {
+		return fmt.Errorf("plugin server failed to rotate certificates: %s", err)
+	}
+
+	serverCert, err := x509.ParseCertificate(resp.GetValue())
+	if err != nil {
+		return fmt.Errorf("plugin server returned invalid certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(serverCert)
+	p.auto.TrustPeers(pool)
+	p.auto.SetCertificate(cert)
+
+	if p.tracer.CertificatesRotated != nil {
+		p.tracer.CertificatesRotated(p.instance)
+	}
+	return nil
+}
+
+// rotateAutoCredentials is the server side of certificate rotation. It
+// replaces the trusted peer certificates with the given certificate in DER
+// format, and replaces the current certificate with a new one, which it
+// returns in DER format.
+func rotateAutoCredentials(ctx context.Context, auto *autoCredentials, peerDER []byte) ([]byte, error) {
+	peerCert, err := x509.ParseCertificate(peerDER)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %s", err)
+	}
+
+	cert, err := generateCertificate(ctx, "localhost", auto.issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate new server TLS certificate: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(peerCert)
+	auto.TrustPeers(pool)
+	auto.SetCertificate(cert)
+
+	return cert.Certificate[0], nil
+}
@@ -0,0 +1,234 @@
+// Package chunkstream adapts io.Writer and io.Reader to gRPC streams of
+// byte chunks, for plugin protocols that transfer files or other payloads
+// too large to send as a single message.
+//
+// A protocol declares the stream using the well-known message type
+// google.protobuf.BytesValue, such as:
+//
+//	rpc Upload(stream google.protobuf.BytesValue) returns (UploadResult);
+//	rpc Download(DownloadRequest) returns (stream google.protobuf.BytesValue);
+//
+// The sending side then wraps its stream in a Writer and the receiving side
+// wraps its stream in a Reader. Both sides must use this package, because
+// the Writer ends the data with a trailer carrying a SHA-256 checksum of
+// everything it sent, which the Reader verifies before reporting the end of
+// the data. That way the receiver can distinguish a complete transfer from
+// one that was truncated or corrupted.
+//
+// There is no separate flow control protocol: SendMsg blocks while the
+// receiver is not keeping up, according to the gRPC flow control window, and
+// so a Writer never holds more than one chunk in memory.
+package chunkstream // import go.rpcplugin.org/rpcplugin/chunkstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+// DefaultChunkSize is the maximum number of bytes in each chunk sent by a
+// Writer created with NewWriter.
+const DefaultChunkSize = 32 * 1024
+
+// ErrChecksumMismatch is returned by Reader.Read if the data received does
+// not match the checksum the sender calculated.
+var ErrChecksumMismatch = errors.New("chunked stream checksum does not match the data received")
+
+// MsgSender is the subset of grpc.ClientStream and grpc.ServerStream that a
+// Writer uses. The generated client and server types for a streaming method
+// also implement it.
+type MsgSender interface {
+	SendMsg(m interface{}) error
+}
+
+// MsgReceiver is the subset of grpc.ClientStream and grpc.ServerStream that
+// a Reader uses. The generated client and server types for a streaming
+// method also implement it.
+type MsgReceiver interface {
+	RecvMsg(m interface{}) error
+}
+
+// Writer is an io.WriteCloser that sends the data written to it as chunks on
+// a gRPC stream.
+//
+// The caller must call Close once all of the data is written, to send the
+// trailer that the Reader on the other side expects. Close doesn't close the
+// stream itself, so a client sending chunks should also call CloseSend
+// afterwards.
+type Writer struct {
+	s    MsgSender
+	buf  []byte
+	hash hash.Hash
+	err  error
+}
+
+var _ io.WriteCloser = (*Writer)(nil)
+
+// NewWriter returns a Writer that sends chunks of at most DefaultChunkSize
+// bytes on the given stream.
+func NewWriter(s MsgSender) *Writer {
+	return NewWriterSize(s, DefaultChunkSize)
+}
+
+// NewWriterSize returns a Writer that sends chunks of at most the given
+// number of bytes on the given stream. It panics if size is not positive.
+//
+// The size must not exceed the receiver's maximum message size, which is
+// 4MiB by default, minus a few bytes for the message encoding.
+func NewWriterSize(s MsgSender, size int) *Writer {
+	if size <= 0 {
+		panic("chunk size must be positive")
+	}
+	return &Writer{
+		s:    s,
+		buf:  make([]byte, 0, size),
+		hash: sha256.New(),
+	}
+}
+
+// Write implements io.Writer, sending each chunk as soon as it is full.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for len(p) > 0 {
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		n += c
+		p = p[c:]
+		if len(w.buf) == cap(w.buf) {
+			if err := w.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush sends any buffered data as a chunk, even if it is not yet full.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	w.hash.Write(w.buf)
+	// SendMsg encodes the message before it returns, so we can safely reuse
+	// the buffer afterwards.
+	if err := w.s.SendMsg(&wrappers.BytesValue{Value: w.buf}); err != nil {
+		w.err = err
+		return err
+	}
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close sends any buffered data followed by the trailer that marks the end
+// of the data. Any later calls to Write fail.
+func (w *Writer) Close() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	w.err = errors.New("write to closed chunked stream")
+
+	// Data chunks are never empty, so an empty chunk introduces the trailer,
+	// whose only content is the checksum.
+	if err := w.s.SendMsg(&wrappers.BytesValue{}); err != nil {
+		return err
+	}
+	return w.s.SendMsg(&wrappers.BytesValue{Value: w.hash.Sum(nil)})
+}
+
+// Reader is an io.Reader that returns the data sent by a Writer on the other
+// side of a gRPC stream.
+//
+// Read returns io.EOF only once it has received the Writer's trailer and
+// verified the checksum. If the stream ends before the trailer, Read returns
+// io.ErrUnexpectedEOF, and if the checksum doesn't match it returns
+// ErrChecksumMismatch. Any error from the stream itself, such as an error
+// status returned by the sender's RPC handler, is returned as-is.
+type Reader struct {
+	s    MsgReceiver
+	buf  []byte
+	hash hash.Hash
+	err  error
+}
+
+var _ io.Reader = (*Reader)(nil)
+
+// NewReader returns a Reader that receives chunks from the given stream.
+func NewReader(s MsgReceiver) *Reader {
+	return &Reader{
+		s:    s,
+		hash: sha256.New(),
+	}
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.buf, r.err = r.recv()
+		r.hash.Write(r.buf)
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *Reader) recv() ([]byte, error) {
+	chunk, err := r.recvMsg()
+	if err != nil {
+		return nil, err
+	}
+	if len(chunk) != 0 {
+		return chunk, nil
+	}
+
+	sum, err := r.recvMsg()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sum, r.hash.Sum(nil)) {
+		return nil, ErrChecksumMismatch
+	}
+	return nil, io.EOF
+}
+
+func (r *Reader) recvMsg() ([]byte, error) {
+	var msg wrappers.BytesValue
+	err := r.s.RecvMsg(&msg)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg.Value, nil
+}
+
+// Send copies all of the data from the given reader to the given stream
+// using a Writer, and then closes the Writer. It returns the number of bytes
+// copied.
+func Send(s MsgSender, src io.Reader) (int64, error) {
+	w := NewWriter(s)
+	n, err := io.Copy(w, src)
+	if err != nil {
+		return n, err
+	}
+	return n, w.Close()
+}
+
+// Receive copies all of the data from the given stream to the given writer
+// using a Reader, returning the number of bytes copied.
+func Receive(s MsgReceiver, dst io.Writer) (int64, error) {
+	return io.Copy(dst, NewReader(s))
+}
@@ -3,12 +3,16 @@ package rpcplugin
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"io/ioutil"
+	"net"
+	"os"
 	"os/exec"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 // ClientVersion is the interface to implement to launch a client for a
@@ -47,23 +51,352 @@ type ClientConfig struct {
 	// as part of the handshake.
 	ProtoVersions map[int]ClientVersion
 
+	// ProtoMinorVersions optionally gives the greatest minor version the
+	// client supports for each major version in ProtoVersions. Major
+	// versions not in the map have minor version zero.
+	//
+	// The server selects the minor version to use along with the major
+	// version, which is then available from Plugin.ProtocolVersion.
+	ProtoMinorVersions map[int]int
+
+	// NetRPCProtoVersions optionally gives a NetRPCClientVersion
+	// implementation for each major protocol version, for use with legacy
+	// hashicorp/go-plugin servers that support only the net/rpc protocol.
+	//
+	// The protocol versions supported by both ProtoVersions and
+	// NetRPCProtoVersions are announced together to the server, which will
+	// select both a protocol version and an RPC protocol. Servers that
+	// comply with the rpcplugin specification will always select gRPC.
+	NetRPCProtoVersions map[int]NetRPCClientVersion
+
 	// Cmd is a not-yet-started exec.Cmd that is configured to launch a
 	// specific plugin server executable. The given object must not be
 	// used by the caller after it's been passed as part of a ClientConfig,
 	// and will be modified in undefined ways by the rpcplugin package.
 	Cmd *exec.Cmd
 
+	// InProcess, if set, runs the plugin server within the client process
+	// using the given server configuration, instead of launching Cmd in a
+	// child process. The client and server communicate using gRPC over
+	// in-memory connections without TLS, so that the plugin is used through
+	// Plugin.Client in the same way as an external plugin. This allows an
+	// application to include built-in plugins, or to be distributed as a
+	// single executable, while sharing plugin implementations with their
+	// separate plugin executables.
+	//
+	// Only the server settings that are meaningful within a single process
+	// are used: ProtoVersions, ProtoMinorVersions, VersionPolicy,
+	// Capabilities, Metadata, CommonServices, the interceptors and gRPC
+	// server options, Reflection, TraceCalls and DrainTimeout. The client
+	// settings that relate to the child process, the handshake and TLS are
+	// ignored.
+	//
+	// InProcess and Cmd are mutually exclusive.
+	InProcess *ServerConfig
+
+	// Runner, if set, launches and manages the plugin server in place of
+	// Cmd, for plugin servers that don't run as a child process of the
+	// client, such as on a remote host or in a container. The client passes
+	// the runner only the environment variables of the rpcplugin protocol,
+	// and otherwise speaks the protocol with the server exactly as it would
+	// with a child process. Set Dial too if the server's addresses are not
+	// reachable from the client directly.
+	//
+	// Runner is mutually exclusive with Cmd and InProcess. The settings that
+	// apply only to a child process, WrapCommand, Terminal, and Limiter,
+	// cannot be used with it, and the plugintrace.ClientTracer functions
+	// that describe an exec.Cmd or os.Process are not called for it.
+	// Managers and pools cannot restart plugins that use Runner, because a
+	// runner, like an exec.Cmd, runs only once.
+	Runner ProcessRunner
+
+	// WrapCommand, if set, is called with Cmd just before the client starts
+	// it, after the client has set its environment and standard I/O
+	// handles. The function may modify the command to launch the plugin
+	// through a sandbox or other launcher, such as by replacing Path and
+	// inserting the original Path at the start of Args, so that the plugin
+	// server still inherits the prepared environment and handles.
+	//
+	// The function must not change the command's Stdin, Stdout, or Stderr,
+	// and must retain the existing environment variables in Env, though it
+	// may add others. If it returns an error then New returns that error
+	// without starting the command.
+	WrapCommand func(cmd *exec.Cmd) error
+
+	// HostServices, if set, registers services on an additional RPC server
+	// that the client runs so that the plugin server can call back into the
+	// host application, for example to send log output or to look up data
+	// the host owns.
+	//
+	// The client conveys the address of this server to the plugin server
+	// automatically, and the plugin server can use function HostServicesConn
+	// to obtain a connection to it. The host services server is shut down
+	// when the plugin is closed.
+	HostServices ServerVersion
+
+	// Multiplex requests that the client and server exchange all of their RPC
+	// traffic, including calls to HostServices, over a single connection
+	// using the yamux multiplexing protocol, rather than making a separate
+	// connection for each RPC channel.
+	//
+	// Multiplexing is optional for servers, and so if the server doesn't
+	// support it the client will silently fall back to using separate
+	// connections. However, host services will then be unavailable to the
+	// server, because the client doesn't listen for them separately when
+	// multiplexing is requested.
+	Multiplex bool
+
+	// Capabilities are optional features, named by the application, that
+	// the client supports. The client advertises them to the server, which
+	// selects those it also supports, and the selected set is then
+	// available from Plugin.Capabilities. Capability names must not be
+	// empty or contain commas.
+	Capabilities []string
+
+	// GoPluginCompat makes the client behave more like a HashiCorp go-plugin
+	// client, so that it can launch plugin servers built with go-plugin
+	// rather than with an rpcplugin implementation.
+	//
+	// In this mode the client omits the environment variables that
+	// rpcplugin servers use to distinguish rpcplugin clients from go-plugin
+	// clients, accepts the shorter handshake line produced by older go-plugin
+	// servers, and asks gRPC servers to shut down using go-plugin's shutdown
+	// service before resorting to killing the server process.
+	//
+	// go-plugin servers often select the net/rpc protocol, so clients using
+	// this mode will usually also set NetRPCProtoVersions.
+	GoPluginCompat bool
+
+	// Transports is the set of transport protocols the client will accept
+	// from the server, in order of preference. The server will select the
+	// first one in this list that it is able to use.
+	//
+	// The transports defined by the rpcplugin specification are "unix" and
+	// "tcp". If this is nil, it defaults to both of those in that order.
+	Transports []string
+
+	// UnixSocketMode and UnixSocketGroup, if set, ask the server to give its
+	// Unix domain socket the given permissions and owning group, for
+	// situations where the client and server run as different users.
+	// The server may override these in its own configuration.
+	//
+	// The same settings apply to the socket the client creates for
+	// HostServices.
+	UnixSocketMode  os.FileMode
+	UnixSocketGroup string
+
+	// UnixSocketDir, if set, asks the server to create its Unix domain
+	// socket within the given directory, such as a tmpfs mount or a volume
+	// shared with a container, rather than in a default temporary location.
+	// The server may override this in its own configuration.
+	//
+	// The client also creates the socket for HostServices in this directory.
+	UnixSocketDir string
+
+	// TCPBindAddr, if set, asks the server to listen on the given IP address
+	// when it uses the TCP transport, rather than on 127.0.0.1, such as "::1"
+	// for IPv6-only environments. The server may override this in its own
+	// configuration. The client also listens on this address for
+	// HostServices if it can't use a Unix domain socket for them.
+	//
+	// Servers refuse addresses that are not loopback addresses unless
+	// AllowNonLoopbackTCP is also set, which is intended only for setups
+	// where the server is reachable from elsewhere by design.
+	TCPBindAddr         string
+	AllowNonLoopbackTCP bool
+
+	// ListenAllTransports asks the server to listen on each of the
+	// transports in Transports that it can use, rather than only the first,
+	// and to advertise all of their addresses. The client then connects
+	// using the first address it is able to reach, which helps in
+	// environments where, for example, a Unix domain socket created by the
+	// server is not visible to the client but TCP works.
+	//
+	// Checking which addresses are reachable opens and immediately closes a
+	// connection to the server for each address the client tries.
+	ListenAllTransports bool
+
+	// Dial, if set, opens the connections to the plugin server in place of
+	// dialing the address from the server's handshake directly, for servers
+	// reachable only through a tunnel or proxy, such as a port forwarded
+	// into a container or a Kubernetes pod. It is called with the address
+	// from the handshake.
+	Dial func(ctx context.Context, addr net.Addr) (net.Conn, error)
+
 	// TLSConfig is used to set an explicit TLS configuration on the RPC client.
 	// If this is nil, the client and server will negotiate temporary mutual
 	// TLS automatically as part of their handshake.
+	//
+	// Set this to ForceClientWithoutTLS to disable TLS entirely.
+	//
+	// The client's certificate may be given either in Certificates or by a
+	// GetClientCertificate function, which allows the client to select or
+	// rotate its certificate for each connection. The client also presents
+	// the same certificate to the plugin when it calls HostServices.
 	TLSConfig *tls.Config
 
+	// TLSConfigFunc, if set, is called during New to produce the TLS
+	// configuration for the plugin about to be launched with the given
+	// command, as an alternative to TLSConfig for applications that prefer
+	// to load certificates only at launch time, or that use different
+	// certificates for different plugins. The given context is the one
+	// passed to New.
+	//
+	// The command is nil if Runner is set, because the plugin server then
+	// isn't launched from a command, so a function used with Runner must not
+	// assume that it is set.
+	//
+	// The result is used in the same way as TLSConfig, including that a nil
+	// result selects automatic TLS negotiation. If TLSConfigFunc returns an
+	// error then New returns it without launching the plugin.
+	//
+	// TLSConfigFunc is mutually exclusive with TLSConfig and Credentials.
+	TLSConfigFunc func(ctx context.Context, cmd *exec.Cmd) (*tls.Config, error)
+
+	// Credentials, if set, is a source of TLS credentials for the client,
+	// as an alternative to TLSConfig for applications that keep their
+	// certificates in files or in a secret manager. The client consults the
+	// source for each new connection, so that it uses updated credentials
+	// without restarting.
+	//
+	// Credentials and TLSConfig are mutually exclusive.
+	Credentials CredentialSource
+
+	// TLSPolicy, if set, constrains the TLS protocol versions and
+	// algorithms used for all connections, including those for host
+	// services, whichever way the TLS configuration was produced.
+	TLSPolicy *TLSPolicy
+
+	// AutoCertIssuer, if set, is a certificate authority that signs the
+	// temporary certificate produced by the automatic TLS negotiation
+	// protocol, instead of that certificate being self-signed. It is not
+	// used if TLS is configured explicitly.
+	AutoCertIssuer *CertificateIssuer
+
+	// PerRPCCredentials, if set, provides credentials to attach to every
+	// call the client makes to the plugin server, such as a bearer token
+	// produced by function BearerToken, for plugins that make their own
+	// authorization decisions.
+	PerRPCCredentials credentials.PerRPCCredentials
+
+	// SharedToken causes the client to generate a random secret token, pass
+	// it to the server in its environment, and send it with every call.
+	// The rpcplugin server then rejects any call without the token, which
+	// protects the plugin server from other local processes that are able
+	// to connect to it, such as when using TCP without TLS.
+	//
+	// This is defense in depth, in addition to the mutual TLS authentication
+	// that rpcplugin uses by default.
+	SharedToken bool
+
+	// ClientCertFile causes the client to pass its automatically-negotiated
+	// certificate to the server in a temporary file, rather than directly
+	// in an environment variable. This avoids exceeding environment size
+	// limits on some platforms, and keeps the certificate out of process
+	// listings and diagnostic output that include the environment.
+	//
+	// The file is readable only by the user running the client, so the
+	// server must run as the same user. Servers built with HashiCorp's
+	// go-plugin library don't support this mode.
+	ClientCertFile bool
+
+	// Compressor, if set, is the name of a compressor that the client will
+	// use to compress the messages it sends to the plugin server, such as
+	// "gzip". The server compresses its responses using the same compressor.
+	//
+	// The gzip compressor is always available. Other compressors must be
+	// registered using package google.golang.org/grpc/encoding in both the
+	// client and the server. Compression is not used with the legacy net/rpc
+	// protocol.
+	Compressor string
+
+	// DefaultCallTimeout, if greater than zero, is a time limit applied to
+	// each unary RPC call the client makes to the plugin server whose
+	// context has no deadline, so that a plugin that hangs while handling a
+	// call can't also block the caller indefinitely.
+	//
+	// Streaming calls are not affected, because their lifetime is typically
+	// open-ended.
+	DefaultCallTimeout time.Duration
+
+	// TraceCalls causes the client to report each RPC call it makes to the
+	// plugin server to the CallCompleted function of the ClientTracer
+	// registered in the context passed to New, including the method name,
+	// duration, status code, and message sizes.
+	TraceCalls bool
+
+	// BlockUntilReady causes Plugin.Client and Plugin.ClientForVersion to
+	// wait until their connection to the plugin server is ready before
+	// returning, so that connection problems such as TLS failures are
+	// reported by those methods rather than by the first call. Failures that
+	// cannot resolve themselves, including a rejected TLS handshake, are
+	// returned immediately; others are retried until the context passed to
+	// those methods is done.
+	BlockUntilReady bool
+
+	// WaitForReady causes each RPC call made using a client from
+	// Plugin.Client or Plugin.ClientForVersion to wait for the connection to
+	// the plugin server to become ready, rather than failing immediately if
+	// the connection isn't ready yet or is temporarily unavailable. The
+	// wait is limited by the call's context.
+	WaitForReady bool
+
+	// VerifyPeer, if set, is called with the certificate chain presented by
+	// the server each time the client connects to it, after the chain has
+	// passed the usual verification, so that the client can make additional
+	// checks such as requiring a particular SPIFFE ID or organization. The
+	// first certificate in the chain is the server's own certificate.
+	//
+	// If VerifyPeer returns an error, the connection is rejected. The same
+	// function also checks the certificates presented by the plugin when it
+	// calls HostServices.
+	VerifyPeer func(chain []*x509.Certificate) error
+
+	// HealthCheck, if set, enables periodic checking of the plugin server's
+	// health service in the background, whose result is available from
+	// Plugin.Healthy. This allows detecting plugin servers that are still
+	// running but are no longer able to handle requests.
+	HealthCheck *HealthCheckConfig
+
+	// Limiter, if set, applies resource limits to the plugin server process
+	// by modifying Cmd just before the client starts it. ResourceLimits is an
+	// implementation for POSIX resource limits and Linux cgroups.
+	Limiter ProcessLimiter
+
+	// ShutdownGrace is how long Close waits for the plugin server to exit
+	// after asking it to shut down gracefully, before killing it. Servers
+	// use this time to finish the requests they have in progress.
+	//
+	// If ShutdownGrace is zero, Close waits for up to ten seconds, or up to
+	// two seconds for HashiCorp go-plugin servers in GoPluginCompat mode. If
+	// it is negative, Close kills the server immediately. The
+	// ProcessStopped function of the plugintrace.ClientTracer reports which
+	// of these happened.
+	ShutdownGrace time.Duration
+
 	// StartTimeout is a time limit on how long the plugin is allowed to wait
 	// before signalling that it is ready.
 	//
 	// If this is given as zero, it will default to one minute.
 	StartTimeout time.Duration
 
+	// MaxHandshakeLine is the maximum length in bytes, including the line
+	// terminator, of the handshake line and of any other line the plugin
+	// server writes before it. If the server writes a longer line, New
+	// returns a *HandshakeLimitError.
+	//
+	// If this is given as zero, it will default to 64 KiB.
+	MaxHandshakeLine int
+
+	// MaxHandshakePreamble is the maximum total length in bytes of other
+	// lines the client will skip if the plugin server writes them before
+	// its handshake line, such as messages from a wrapper script. If the
+	// server writes more, New returns a *HandshakeLimitError.
+	//
+	// If this is zero, the first line the server writes must be its
+	// handshake line.
+	MaxHandshakePreamble int
+
 	// Stderr, if non-nil, will recieve any data written by the child process
 	// to its stderr stream.
 	//
@@ -72,9 +405,81 @@ type ClientConfig struct {
 	// Stdout is not available because it's used exclusively by the plugin
 	// handshake protocol.
 	Stderr io.Writer
+
+	// StderrBufferSize is the number of bytes of the child process's most
+	// recent stderr output that the client retains, regardless of Stderr,
+	// for Plugin.LastStderr and for the errors New returns if the process
+	// exits during startup.
+	//
+	// If this is zero, it defaults to 16 KiB. If it is negative, the client
+	// doesn't retain any output.
+	StderrBufferSize int
+
+	// Terminal, if set, causes the client to allocate a pseudo-terminal for
+	// the plugin server process, copying data between it and the given
+	// input and output. See the Terminal type for details.
+	//
+	// The terminal is passed to the process as an additional file, after
+	// any already in Cmd.ExtraFiles.
+	Terminal *Terminal
+
+	// OnExit, if set, is called when the plugin server process exits
+	// unexpectedly after New has returned the Plugin and before the caller
+	// has called Close, such as if the plugin has crashed. This allows the
+	// caller to immediately mark the plugin as unavailable, rather than
+	// discovering the problem from errors returned by later RPC calls.
+	//
+	// OnExit is called from a separate goroutine, with the state of the
+	// exited process, which is nil if Runner doesn't report one. It is not
+	// called for exits caused by Close. By the time OnExit is called,
+	// Plugin.CrashInfo describes the exit in more detail, and OnExit may
+	// call Plugin.Close to release the plugin's other resources.
+	OnExit func(*os.ProcessState)
+}
+
+// unixSocketConfig returns the settings the client requests for the server's
+// Unix domain socket.
+func (c *ClientConfig) unixSocketConfig() unixSocketConfig {
+	return unixSocketConfig{
+		Dir:   c.UnixSocketDir,
+		Mode:  c.UnixSocketMode,
+		Group: c.UnixSocketGroup,
+	}
 }
 
+// tcpBindConfig returns the settings the client requests for the server's
+// TCP listener.
+func (c *ClientConfig) tcpBindConfig() tcpBindConfig {
+	return tcpBindConfig{
+		Addr:             c.TCPBindAddr,
+		AllowNonLoopback: c.AllowNonLoopbackTCP,
+	}
+}
+
+// ForceClientWithoutTLS is a predefined value for use with
+// ClientConfig.TLSConfig which makes a client not use TLS at all. This makes
+// the client non-compliant with the rpcplugin specification, but can be
+// useful for debugging or for launching servers built with HashiCorp's
+// go-plugin library that are not configured to use TLS. The server must then
+// also be configured not to use TLS, such as by ForceServerWithoutTLS.
+//
+// The client reports to its tracer that TLS is disabled, which the
+// ClientLogTracer logs prominently. Do not modify this object.
+var ForceClientWithoutTLS = &tls.Config{}
+
 func (c *ClientConfig) setDefaults() {
+	if len(c.Transports) == 0 {
+		c.Transports = []string{"unix", "tcp"}
+	}
+
+	if c.MaxHandshakeLine == 0 {
+		c.MaxHandshakeLine = defaultMaxHandshakeLine
+	}
+
+	if c.StderrBufferSize == 0 {
+		c.StderrBufferSize = defaultStderrBufferSize
+	}
+
 	if c.StartTimeout == 0 {
 		c.StartTimeout = 1 * time.Minute
 	}
@@ -0,0 +1,135 @@
+package rpcplugin
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// HandshakeTimeoutError is the error type returned from New if the plugin
+// server doesn't complete its handshake within ClientConfig.StartTimeout.
+type HandshakeTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *HandshakeTimeoutError) Error() string {
+	return fmt.Sprintf("timeout waiting for plugin server handshake message after %s", e.Timeout)
+}
+
+// ServerExitedError is the error type returned from New if the plugin
+// server process exits before completing its handshake, which often means
+// that the plugin executable is not a plugin server for the calling
+// application, or that it failed during startup.
+type ServerExitedError struct {
+	// State is the state of the exited process, if available.
+	State *os.ProcessState
+
+	// Stderr is the most recent output the process wrote to its stderr, as
+	// for Plugin.LastStderr, which often explains why it exited.
+	Stderr []byte
+
+	// Crash describes the exit in more detail.
+	Crash *CrashInfo
+}
+
+func (e *ServerExitedError) Error() string {
+	msg := "plugin server process exited without completing handshake"
+	if e.State != nil {
+		msg = fmt.Sprintf("%s (%s)", msg, e.State)
+	}
+	if line := lastLine(e.Stderr); line != "" {
+		msg = fmt.Sprintf("%s: %s", msg, line)
+	}
+	return msg
+}
+
+// HandshakeSyntaxError is the error type returned from New if the plugin
+// server produces an invalid handshake line.
+type HandshakeSyntaxError struct {
+	// Line is the raw handshake line, with surrounding whitespace removed.
+	Line string
+
+	// Err is the error describing the problem, which is a
+	// *handshake.SyntaxError, a *handshake.FieldError, or an error about
+	// the handshake extensions.
+	Err error
+}
+
+func (e *HandshakeSyntaxError) Error() string {
+	return fmt.Sprintf("invalid handshake from plugin server: %s", e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *HandshakeSyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// HandshakeLimitError is the error type returned from New if the plugin
+// server writes more output before its handshake line than the client
+// allows, which usually means that the plugin executable is not a plugin
+// server for the calling application.
+type HandshakeLimitError struct {
+	// Field is the name of the ClientConfig field whose limit the output
+	// exceeded, which is either "MaxHandshakeLine" or
+	// "MaxHandshakePreamble".
+	Field string
+
+	// Limit is the value of that field, in bytes.
+	Limit int
+
+	// Output is the start of the line of output that exceeded the limit,
+	// truncated to at most 256 bytes.
+	Output string
+}
+
+func (e *HandshakeLimitError) Error() string {
+	if e.Field == "MaxHandshakePreamble" {
+		return fmt.Sprintf("plugin server wrote more than %d bytes of output before its handshake, ending with %q", e.Limit, e.Output)
+	}
+	return fmt.Sprintf("plugin server wrote a line longer than %d bytes instead of a handshake, starting with %q", e.Limit, e.Output)
+}
+
+// UnsupportedProtocolError is the error type returned from New if the
+// plugin server selects an RPC protocol or protocol version that the client
+// doesn't support.
+type UnsupportedProtocolError struct {
+	// RPCProtocol is the RPC protocol the server selected, such as "grpc".
+	RPCProtocol string
+
+	// Version is the protocol version the server selected, or -1 if the
+	// client doesn't support RPCProtocol at all.
+	Version int
+}
+
+func (e *UnsupportedProtocolError) Error() string {
+	if e.Version < 0 {
+		return fmt.Sprintf("plugin server selected unsupported RPC protocol %q", e.RPCProtocol)
+	}
+	return fmt.Sprintf("plugin server selected unsupported %s protocol version %d", e.RPCProtocol, e.Version)
+}
+
+// CrashLoopError is the error type returned from Manager.Plugin if the
+// Manager stopped restarting a plugin because its server failed too often.
+type CrashLoopError struct {
+	// Name is the name of the plugin.
+	Name string
+
+	// Restarts and Window are the plugin's ManagedConfig.MaxRestarts and
+	// ManagedConfig.RestartWindow.
+	Restarts int
+	Window   time.Duration
+
+	// Crash describes the plugin server's last exit, if available.
+	Crash *CrashInfo
+}
+
+func (e *CrashLoopError) Error() string {
+	msg := fmt.Sprintf("plugin %q is crash-looping: it failed again after %d restarts within %s", e.Name, e.Restarts, e.Window)
+	if e.Crash != nil {
+		msg = fmt.Sprintf("%s; last %s", msg, e.Crash)
+		if line := lastLine(e.Crash.Stderr); line != "" {
+			msg = fmt.Sprintf("%s: %s", msg, line)
+		}
+	}
+	return msg
+}
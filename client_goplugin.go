@@ -0,0 +1,49 @@
+package rpcplugin
+
+import (
+	"context"
+	"time"
+
+	"go.rpcplugin.org/rpcplugin/internal/gopluginshim"
+)
+
+// goPluginShutdownTimeout is the default time we'll wait for a go-plugin
+// server to respond to a shutdown request and then exit before we'll kill
+// it. This matches the timeout used by go-plugin's own client.
+const goPluginShutdownTimeout = 2 * time.Second
+
+// goPluginShutdown asks a hashicorp/go-plugin server to exit gracefully using
+// go-plugin's shutdown service, and waits up to the given time for it to do
+// so.
+//
+// Returns true if the server process exited, or false if the caller must
+// still kill it.
+func (p *Plugin) goPluginShutdown(timeout time.Duration) bool {
+	if p.rpcProtocol != "grpc" {
+		// go-plugin's net/rpc servers exit once their connection is closed,
+		// so there's no equivalent shutdown request for us to make.
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := p.dialGRPC(ctx)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	client := gopluginshim.NewGRPCControllerClient(conn)
+	_, err = client.Shutdown(ctx, &gopluginshim.Empty{})
+	if err != nil {
+		return false
+	}
+
+	select {
+	case <-p.exit:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,201 @@
+package rpcplugin
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// HealthCheckConfig configures the optional background health checking of a
+// plugin server, which periodically calls the health service that all plugin
+// servers offer in order to detect servers that are still running but are
+// no longer able to handle requests.
+type HealthCheckConfig struct {
+	// Interval is the time between health checks. If it is zero, it
+	// defaults to ten seconds.
+	Interval time.Duration
+
+	// Timeout is the time limit for each health check. If it is zero, it
+	// defaults to five seconds or Interval, whichever is shorter.
+	Timeout time.Duration
+
+	// FailureThreshold is the number of consecutive health checks that must
+	// fail before the plugin is considered unhealthy. If it is zero, it
+	// defaults to three. A check in which the server reports that it is not
+	// serving makes the plugin unhealthy immediately, regardless of the
+	// threshold. A single successful check makes the plugin healthy again.
+	FailureThreshold int
+
+	// OnChange, if set, is called from a separate goroutine each time the
+	// plugin changes between healthy and unhealthy.
+	OnChange func(healthy bool)
+}
+
+const (
+	defaultHealthCheckInterval  = 10 * time.Second
+	defaultHealthCheckTimeout   = 5 * time.Second
+	defaultHealthCheckThreshold = 3
+)
+
+func (c HealthCheckConfig) withDefaults() HealthCheckConfig {
+	if c.Interval <= 0 {
+		c.Interval = defaultHealthCheckInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultHealthCheckTimeout
+		if c.Timeout > c.Interval {
+			c.Timeout = c.Interval
+		}
+	}
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = defaultHealthCheckThreshold
+	}
+	return c
+}
+
+// Healthy returns true if the plugin server is believed to be able to handle
+// requests.
+//
+// If health checking is enabled in ClientConfig.HealthCheck then the result
+// reflects the most recent health checks. Otherwise, and for servers using
+// the legacy net/rpc protocol, which have no health service, Healthy returns
+// true until the plugin server exits, or always for plugins created by
+// Attach.
+func (p *Plugin) Healthy() bool {
+	if p.runner != nil || p.inProcess != nil {
+		select {
+		case <-p.exit:
+			return false
+		default:
+		}
+	}
+	return atomic.LoadInt32(&p.unhealthy) == 0
+}
+
+// CheckHealth asks the plugin server whether it is currently able to handle
+// requests using the given protocol version, which should be one of those
+// returned by ServedVersions, returning true if it is.
+//
+// Unlike Healthy, CheckHealth makes a health check request immediately,
+// regardless of whether background health checking is enabled. Servers
+// built with older versions of rpcplugin report only the status of the
+// server as a whole, which CheckHealth returns instead in that case.
+func (p *Plugin) CheckHealth(ctx context.Context, version int) (bool, error) {
+	if p.rpcProtocol != "grpc" {
+		return false, fmt.Errorf("plugin server using RPC protocol %q does not support health checks", p.rpcProtocol)
+	}
+
+	conn, err := p.dialGRPC(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to %s: %w", p.addr, err)
+	}
+	defer conn.Close()
+
+	client := grpc_health_v1.NewHealthClient(conn)
+	resp, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{
+		Service: HealthServiceName(version),
+	})
+	if status.Code(err) == codes.NotFound {
+		resp, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{
+			Service: grpcServiceName,
+		})
+	}
+	if err != nil {
+		return false, fmt.Errorf("plugin health check failed: %w", err)
+	}
+	return resp.GetStatus() == grpc_health_v1.HealthCheckResponse_SERVING, nil
+}
+
+// startHealthCheck begins checking the health of the plugin server in the
+// background, until Close is called or the plugin server process exits.
+func (p *Plugin) startHealthCheck(config HealthCheckConfig) {
+	if p.rpcProtocol != "grpc" {
+		return
+	}
+	config = config.withDefaults()
+	p.healthStop = make(chan struct{})
+	go p.healthCheckLoop(config, p.healthStop)
+}
+
+func (p *Plugin) healthCheckLoop(config HealthCheckConfig, stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+		case <-p.exit:
+		}
+		cancel()
+	}()
+
+	conn, err := p.dialGRPC(ctx)
+	if err != nil {
+		// If we can't connect at all then the plugin can't handle requests
+		// either, but we have no way to recover from here.
+		p.setHealthy(false, config.OnChange)
+		return
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+	service := HealthServiceName(p.protoVersion)
+
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		checkCtx, checkCancel := context.WithTimeout(ctx, config.Timeout)
+		resp, err := client.Check(checkCtx, &grpc_health_v1.HealthCheckRequest{
+			Service: service,
+		})
+		if status.Code(err) == codes.NotFound && service != grpcServiceName {
+			// The server predates per-version health statuses, so we'll
+			// check the status of the server as a whole from now on.
+			service = grpcServiceName
+			resp, err = client.Check(checkCtx, &grpc_health_v1.HealthCheckRequest{
+				Service: service,
+			})
+		}
+		checkCancel()
+		if ctx.Err() != nil {
+			// The plugin is closing or has exited, so this check failing
+			// says nothing about its health.
+			return
+		}
+
+		if err == nil && resp.GetStatus() == grpc_health_v1.HealthCheckResponse_SERVING {
+			failures = 0
+			p.setHealthy(true, config.OnChange)
+			continue
+		}
+		failures++
+		// A server that reports that it isn't serving is unhealthy straight
+		// away, because there's no doubt about the result of its check.
+		notServing := err == nil && resp.GetStatus() == grpc_health_v1.HealthCheckResponse_NOT_SERVING
+		if failures >= config.FailureThreshold || notServing {
+			p.setHealthy(false, config.OnChange)
+		}
+	}
+}
+
+// setHealthy records whether the plugin is healthy, and calls onChange if
+// that differs from what was previously recorded.
+func (p *Plugin) setHealthy(healthy bool, onChange func(bool)) {
+	var v int32
+	if !healthy {
+		v = 1
+	}
+	if atomic.SwapInt32(&p.unhealthy, v) != v && onChange != nil {
+		onChange(healthy)
+	}
+}
@@ -0,0 +1,89 @@
+package rpcplugin
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/rpc"
+
+	"github.com/hashicorp/yamux"
+)
+
+// NetRPCClientVersion is the interface to implement to launch a client for a
+// particular protocol version of a legacy hashicorp/go-plugin server that
+// uses the net/rpc protocol, rather than gRPC. It is the net/rpc equivalent
+// of ClientVersion.
+//
+// The net/rpc protocol is not part of the rpcplugin specification, and is
+// supported only to help applications migrating from hashicorp/go-plugin to
+// continue to support older plugins.
+type NetRPCClientVersion interface {
+	// NetRPCClientProxy instantiates an application-specific client proxy
+	// that makes calls using the given net/rpc client, and returns that
+	// client proxy object ready to use.
+	//
+	// As with ClientVersion, there must be a single specific interface type
+	// that all returned client proxies implement.
+	NetRPCClientProxy(ctx context.Context, client *rpc.Client) (interface{}, error)
+}
+
+// NetRPCClientVersionFunc is a function type that implements interface
+// NetRPCClientVersion.
+type NetRPCClientVersionFunc func(ctx context.Context, client *rpc.Client) (interface{}, error)
+
+var _ NetRPCClientVersion = NetRPCClientVersionFunc(nil)
+
+// NetRPCClientProxy implements interface NetRPCClientVersion.
+func (fn NetRPCClientVersionFunc) NetRPCClientProxy(ctx context.Context, client *rpc.Client) (interface{}, error) {
+	return fn(ctx, client)
+}
+
+// netRPCClient is the net/rpc equivalent of Client.
+//
+// hashicorp/go-plugin's net/rpc servers expect the client to multiplex its
+// connection using yamux and to make its calls over the first stream it
+// opens, so we follow the same convention here.
+func (p *Plugin) netRPCClient(ctx context.Context) (protoVersion int, client interface{}, err error) {
+	tracer := p.tracer
+
+	if tracer.Connect != nil {
+		tracer.Connect(p.instance, p.addr)
+	}
+
+	conn, err := p.dialAddr(ctx, p.addr)
+	if err != nil {
+		if tracer.ConnectFailed != nil {
+			tracer.ConnectFailed(p.instance, p.addr, err)
+		}
+		return 0, nil, fmt.Errorf("failed to connect to %s: %s", p.addr, err)
+	}
+	if p.tlsConfig != nil {
+		conn = tls.Client(conn, p.tlsConfig)
+	}
+
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		conn.Close()
+		return 0, nil, fmt.Errorf("failed to start multiplexed session with %s: %s", p.addr, err)
+	}
+	stream, err := session.Open()
+	if err != nil {
+		session.Close()
+		if tracer.ConnectFailed != nil {
+			tracer.ConnectFailed(p.instance, p.addr, err)
+		}
+		return 0, nil, fmt.Errorf("failed to connect to %s: %s", p.addr, err)
+	}
+
+	client, err = p.ncv.NetRPCClientProxy(ctx, rpc.NewClient(stream))
+	if err != nil {
+		session.Close()
+		return 0, nil, fmt.Errorf("failed to create client proxy: %s", err)
+	}
+
+	if tracer.Connected != nil {
+		tracer.Connected(p.instance, p.addr)
+	}
+
+	return p.protoVersion, client, nil
+}
@@ -0,0 +1,147 @@
+// Command rpcplugin-debug launches a plugin server and interacts with it
+// without any knowledge of its protocol, to shorten the edit-debug loop for
+// plugin authors.
+//
+// The plugin server must have ServerConfig.Reflection set, so that the tool
+// can discover its services. With no -call flag, the tool lists the
+// services and their methods. With -call, it invokes the given method with
+// the JSON request given in -data and prints the JSON response:
+//
+//	rpcplugin-debug -cookie MY_PLUGIN_COOKIE=abc123 \
+//	    -call example.Service/Method -data '{"name": "x"}' my-plugin-server
+//
+// Set the environment variable RPCPLUGIN_TRACE to "stderr" to see the
+// details of the plugin's startup and shutdown.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.rpcplugin.org/rpcplugin"
+	"go.rpcplugin.org/rpcplugin/dynamic"
+)
+
+func main() {
+	cookie := flag.String("cookie", "", "handshake cookie the plugin expects, as `KEY=VALUE`")
+	versions := flag.String("versions", "1", "comma-separated protocol `versions` to offer the plugin")
+	call := flag.String("call", "", "`method` to call, such as package.Service/Method")
+	data := flag.String("data", "{}", "JSON request for -call, or @file to read it from a file, or - to read it from stdin")
+	timeout := flag.Duration("timeout", 30*time.Second, "time limit for the whole session")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] plugin-command [args...]\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(*cookie, *versions, *call, *data, *timeout, flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rpcplugin-debug: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(cookie, versions, call, data string, timeout time.Duration, cmdArgs []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	config := &rpcplugin.ClientConfig{
+		ProtoVersions: make(map[int]rpcplugin.ClientVersion),
+		Cmd:           exec.Command(cmdArgs[0], cmdArgs[1:]...),
+		Stderr:        os.Stderr,
+	}
+	if cookie != "" {
+		eq := strings.IndexByte(cookie, '=')
+		if eq < 1 {
+			return fmt.Errorf("invalid -cookie %q: must be KEY=VALUE", cookie)
+		}
+		config.Handshake.CookieKey = cookie[:eq]
+		config.Handshake.CookieValue = cookie[eq+1:]
+	}
+	for _, s := range strings.Split(versions, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid protocol version %q in -versions", s)
+		}
+		config.ProtoVersions[v] = dynamic.ClientVersion{}
+	}
+
+	var req []byte
+	if call != "" {
+		var err error
+		req, err = readRequest(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	plugin, err := rpcplugin.New(ctx, config)
+	if err != nil {
+		return fmt.Errorf("failed to start plugin: %w", err)
+	}
+	defer plugin.Close()
+	_, raw, err := plugin.Client(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create plugin client: %w", err)
+	}
+	client := raw.(*dynamic.Client)
+
+	if call == "" {
+		listServices(client)
+		return nil
+	}
+	resp, err := client.InvokeJSON(ctx, call, req)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, resp, "", "  "); err != nil {
+		buf.Reset()
+		buf.Write(resp)
+	}
+	buf.WriteByte('\n')
+	_, err = buf.WriteTo(os.Stdout)
+	return err
+}
+
+func readRequest(data string) ([]byte, error) {
+	switch {
+	case data == "-":
+		return ioutil.ReadAll(os.Stdin)
+	case strings.HasPrefix(data, "@"):
+		return ioutil.ReadFile(data[1:])
+	default:
+		return []byte(data), nil
+	}
+}
+
+func listServices(client *dynamic.Client) {
+	for _, svc := range client.Services() {
+		fmt.Printf("%s\n", svc.FullName())
+		methods := svc.Methods()
+		for i := 0; i < methods.Len(); i++ {
+			md := methods.Get(i)
+			in, out := string(md.Input().FullName()), string(md.Output().FullName())
+			if md.IsStreamingClient() {
+				in = "stream " + in
+			}
+			if md.IsStreamingServer() {
+				out = "stream " + out
+			}
+			fmt.Printf("  %s(%s) returns (%s)\n", md.Name(), in, out)
+		}
+	}
+}
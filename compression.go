@@ -0,0 +1,26 @@
+package rpcplugin
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc/encoding"
+
+	// The gzip compressor is always available, so that both clients and
+	// servers can decode messages compressed with it.
+	_ "google.golang.org/grpc/encoding/gzip"
+)
+
+// checkCompressor returns an error if the given name, taken from the field
+// of the given name in a configuration object, isn't the name of a
+// compressor registered with package google.golang.org/grpc/encoding.
+//
+// An empty name is valid, meaning that messages are not compressed.
+func checkCompressor(field, name string) error {
+	if name == "" {
+		return nil
+	}
+	if encoding.GetCompressor(name) == nil {
+		return fmt.Errorf("config field %s refers to unregistered compressor %q", field, name)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package rpcplugin
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+	"google.golang.org/grpc/credentials"
+)
+
+// connTraceCredentials wraps the gRPC transport credentials of a plugin
+// server, if any, to report each client connection to a tracer once any
+// handshake has completed, and again when the connection ends.
+//
+// We do this in the credentials rather than in a net.Listener because only
+// the credentials see both the connections that gRPC serves, which may be
+// streams within a multiplexed session, and the TLS state of each one.
+type connTraceCredentials struct {
+	// inner is the credentials to wrap, or nil if the server doesn't use
+	// TLS.
+	inner credentials.TransportCredentials
+
+	opened func(conn *plugintrace.ConnInfo)
+	ended  func(conn *plugintrace.ConnInfo, elapsed time.Duration)
+
+	// nextID is shared between clones, so that IDs are unique per server.
+	nextID *uint64
+}
+
+func newConnTraceCredentials(inner credentials.TransportCredentials, opened func(*plugintrace.ConnInfo), ended func(*plugintrace.ConnInfo, time.Duration)) credentials.TransportCredentials {
+	return &connTraceCredentials{
+		inner:  inner,
+		opened: opened,
+		ended:  ended,
+		nextID: new(uint64),
+	}
+}
+
+func (c *connTraceCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn := rawConn
+	var authInfo credentials.AuthInfo
+	if c.inner != nil {
+		var err error
+		conn, authInfo, err = c.inner.ServerHandshake(rawConn)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	info := &plugintrace.ConnInfo{
+		ID:         atomic.AddUint64(c.nextID, 1),
+		RemoteAddr: rawConn.RemoteAddr(),
+		LocalAddr:  rawConn.LocalAddr(),
+		Opened:     time.Now(),
+	}
+	if tlsInfo, ok := authInfo.(credentials.TLSInfo); ok {
+		info.TLS = plugintrace.NewTLSInfo(&tlsInfo.State)
+	}
+	if c.opened != nil {
+		c.opened(info)
+	}
+	if c.ended == nil {
+		return conn, authInfo, nil
+	}
+	return &connTraceConn{
+		Conn: conn,
+		ended: func() {
+			c.ended(info, time.Since(info.Opened))
+		},
+	}, authInfo, nil
+}
+
+func (c *connTraceCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	if c.inner == nil {
+		return rawConn, nil, nil
+	}
+	return c.inner.ClientHandshake(ctx, authority, rawConn)
+}
+
+func (c *connTraceCredentials) Info() credentials.ProtocolInfo {
+	if c.inner == nil {
+		return credentials.ProtocolInfo{}
+	}
+	return c.inner.Info()
+}
+
+func (c *connTraceCredentials) Clone() credentials.TransportCredentials {
+	ret := *c
+	if c.inner != nil {
+		ret.inner = c.inner.Clone()
+	}
+	return &ret
+}
+
+func (c *connTraceCredentials) OverrideServerName(name string) error {
+	if c.inner == nil {
+		return nil
+	}
+	return c.inner.OverrideServerName(name)
+}
+
+// connTraceConn is a net.Conn that calls a function the first time it is
+// closed.
+type connTraceConn struct {
+	net.Conn
+	ended func()
+	once  sync.Once
+}
+
+func (c *connTraceConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.ended)
+	return err
+}
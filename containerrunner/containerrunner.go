@@ -0,0 +1,307 @@
+// Package containerrunner launches rpcplugin plugin servers as containers
+// using the Docker or Podman command line tools, so that a host application
+// can isolate untrusted plugins from its own filesystem and namespaces
+// without any special support in the plugins themselves.
+//
+// The runner starts the container in the foreground so that the plugin
+// server's handshake arrives on the container's stdout in the usual way,
+// passes the variables of the rpcplugin protocol into the container's
+// environment, and bind-mounts a temporary directory at the same path
+// inside and outside of the container for the server's Unix domain socket.
+package containerrunner
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/apparentlymart/go-ctxenv/ctxenv"
+	"go.rpcplugin.org/rpcplugin"
+)
+
+// Runner describes how to run a plugin server as a container.
+type Runner struct {
+	// Engine is the container engine command to use, such as "docker" or
+	// "podman", or a path to such a program. If it is empty, it defaults to
+	// "docker". The engine must support the "run" and "rm" subcommands with
+	// the same options as Docker's.
+	Engine string
+
+	// Image is the container image to run.
+	Image string
+
+	// Command, if set, overrides the image's default command with the given
+	// program and arguments for running the plugin server.
+	Command []string
+
+	// Env gives additional environment variables for the container, in the
+	// "KEY=value" form of exec.Cmd.Env. The container doesn't inherit the
+	// environment of the host application.
+	Env []string
+
+	// RunArgs gives additional options for the engine's "run" subcommand,
+	// such as resource limits or "--read-only", which appear before the
+	// image name.
+	RunArgs []string
+
+	// HostNetwork runs the container in the host's network namespace, which
+	// allows the plugin server to use the TCP transport. Otherwise, the
+	// plugin server can use only a Unix domain socket, because its loopback
+	// interface is not reachable from the host.
+	HostNetwork bool
+}
+
+// New starts the plugin server container, using the given configuration
+// for everything other than launching the server, and returns an object
+// representing the plugin once the server has completed its handshake.
+//
+// The runner sets config.Runner itself, so it must be nil, as must
+// config.Cmd, and config.InProcess and config.Terminal are not supported.
+// Nor is config.Limiter, which would limit only the engine's client process,
+// or config.ClientCertFile, because the container cannot read the host's
+// temporary files; use RunArgs to set the container's resource limits. The
+// runner also sets config.UnixSocketDir to the temporary directory it mounts
+// into the container, and unless HostNetwork is set it restricts
+// config.Transports to "unix". If the container runs as a different user
+// than the host application, set config.UnixSocketMode so that the host
+// application can connect to the socket.
+//
+// Any config.WrapCommand function is called with the engine command, after
+// the runner has prepared its command line.
+//
+// The container and the temporary directory for its socket are removed once
+// the plugin server exits, including when the plugin is closed.
+//
+// As for rpcplugin.New, the caller must no longer access or modify config
+// once it has been passed to New.
+func (r *Runner) New(ctx context.Context, config *rpcplugin.ClientConfig) (*rpcplugin.Plugin, error) {
+	switch {
+	case r.Image == "":
+		return nil, fmt.Errorf("Runner.Image must be set")
+	case config.Cmd != nil:
+		return nil, fmt.Errorf("config field Cmd must be nil, because the runner runs the plugin server")
+	case config.Runner != nil:
+		return nil, fmt.Errorf("config field Runner must be nil, because the runner sets it")
+	case config.InProcess != nil:
+		return nil, fmt.Errorf("config field InProcess is not supported for containers")
+	case config.Terminal != nil:
+		return nil, fmt.Errorf("config field Terminal is not supported for containers")
+	case config.Limiter != nil:
+		return nil, fmt.Errorf("config field Limiter is not supported for containers")
+	case config.ClientCertFile:
+		return nil, fmt.Errorf("config field ClientCertFile is not supported for containers")
+	}
+	engine := r.Engine
+	if engine == "" {
+		engine = "docker"
+	}
+	enginePath, err := exec.LookPath(engine)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find container engine: %w", err)
+	}
+
+	name, err := containerName()
+	if err != nil {
+		return nil, err
+	}
+	// The container may run as a different user, which must be able to
+	// create its socket in the socket directory, so anyone may write to it.
+	// Only we can reach it on the host, though, because its parent directory
+	// is private to us, while the container sees only the socket directory
+	// itself.
+	tempDir, err := ioutil.TempDir("", "rpcplugin-container")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	socketDir := filepath.Join(tempDir, "socket")
+	err = os.Mkdir(socketDir, 0700)
+	if err == nil {
+		// Mkdir is subject to the umask, but Chmod is not.
+		err = os.Chmod(socketDir, 0777|os.ModeSticky)
+	}
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+
+	c := &container{
+		runner:    r,
+		engine:    enginePath,
+		name:      name,
+		tempDir:   tempDir,
+		socketDir: socketDir,
+		cookieKey: config.Handshake.CookieKey,
+		wrap:      config.WrapCommand,
+	}
+	config.Runner = c
+	config.WrapCommand = nil
+	config.UnixSocketDir = socketDir
+	if !r.HostNetwork {
+		config.Transports = []string{"unix"}
+	}
+
+	plugin, err := rpcplugin.New(ctx, config)
+	if err != nil {
+		// If the container started then it is being removed already, but
+		// we'd rather not return before it's gone.
+		c.remove()
+		return nil, err
+	}
+	return plugin, nil
+}
+
+// runArgs returns the engine command line for running the container.
+//
+// The environment variables for the plugin server are passed by name only,
+// so that their values, including the handshake cookie, are taken from the
+// engine's own environment rather than appearing in its command line.
+func (r *Runner) runArgs(engine, name, socketDir string, env []string, cookieKey string) []string {
+	args := []string{
+		engine, "run", "--rm",
+		"--name", name,
+		"--volume", socketDir + ":" + socketDir,
+	}
+	if r.HostNetwork {
+		args = append(args, "--network", "host")
+	}
+	seen := make(map[string]bool)
+	addEnv := func(kv string) {
+		k := kv
+		if i := strings.Index(kv, "="); i >= 0 {
+			k = kv[:i]
+		}
+		if !seen[k] {
+			seen[k] = true
+			args = append(args, "--env", k)
+		}
+	}
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PLUGIN_") || strings.HasPrefix(kv, cookieKey+"=") {
+			addEnv(kv)
+		}
+	}
+	for _, kv := range r.Env {
+		addEnv(kv)
+	}
+	args = append(args, r.RunArgs...)
+	args = append(args, r.Image)
+	return append(args, r.Command...)
+}
+
+// container is the rpcplugin.ProcessRunner for one plugin server container,
+// which it runs using the engine's client in a child process.
+type container struct {
+	runner    *Runner
+	engine    string
+	name      string
+	tempDir   string
+	socketDir string
+	cookieKey string
+	wrap      func(cmd *exec.Cmd) error
+
+	cmd        *exec.Cmd
+	removeOnce sync.Once
+}
+
+var _ rpcplugin.ProcessRunner = (*container)(nil)
+
+func (c *container) Start(ctx context.Context, env []string, stderr io.Writer) (io.ReadCloser, error) {
+	if c.cmd != nil {
+		return nil, fmt.Errorf("plugin server already started")
+	}
+	cmd := &exec.Cmd{
+		Path: c.engine,
+		Args: c.runner.runArgs(c.engine, c.name, c.socketDir, env, c.cookieKey),
+		// The engine needs its own environment, such as to find its
+		// daemon, and it passes only the named variables to the container.
+		Env:    append(append(ctxenv.Environ(ctx), env...), c.runner.Env...),
+		Stdin:  bytes.NewReader(nil),
+		Stderr: stderr,
+	}
+	// cmd.Wait would close the read end of a pipe from StdoutPipe, but the
+	// client may still be reading the handshake when the engine exits.
+	stdout, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("cannot create stdout pipe: %w", err)
+	}
+	defer stdoutW.Close()
+	cmd.Stdout = stdoutW
+	if c.wrap != nil {
+		if err := c.wrap(cmd); err != nil {
+			stdout.Close()
+			return nil, fmt.Errorf("failed to wrap engine command: %w", err)
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		stdout.Close()
+		return nil, fmt.Errorf("failed to start container engine: %w", err)
+	}
+	c.cmd = cmd
+	return stdout, nil
+}
+
+// Signal implements rpcplugin.ProcessRunner. For os.Kill it also removes the
+// container, because killing the engine's client process doesn't
+// necessarily stop the container.
+func (c *container) Signal(sig os.Signal) error {
+	if sig != os.Kill {
+		return c.cmd.Process.Signal(sig)
+	}
+	err := c.cmd.Process.Kill()
+	if rmErr := removeContainer(c.engine, c.name); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// Wait implements rpcplugin.ProcessRunner. The plugin server isn't a process
+// on the local host, and so Wait never returns a process state.
+func (c *container) Wait() (*os.ProcessState, error) {
+	// The command's Wait also finishes copying stderr, if the writer isn't
+	// a file, and closes our ends of its pipes. An unsuccessful exit of the
+	// engine isn't a failure to wait.
+	if err := c.cmd.Wait(); c.cmd.ProcessState == nil {
+		return nil, err
+	}
+	c.remove()
+	return nil, nil
+}
+
+// remove removes the container, if the engine hasn't already removed it,
+// and the temporary directory for its socket.
+func (c *container) remove() {
+	c.removeOnce.Do(func() {
+		if c.cmd != nil {
+			removeContainer(c.engine, c.name)
+		}
+		os.RemoveAll(c.tempDir)
+	})
+}
+
+// removeContainer forcibly removes the container with the given name, if it
+// still exists.
+func removeContainer(engine, name string) error {
+	out, err := exec.Command(engine, "rm", "--force", name).CombinedOutput()
+	if err != nil && !strings.Contains(strings.ToLower(string(out)), "no such container") {
+		return fmt.Errorf("failed to remove container %s: %s", name, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// containerName returns a new random name for a plugin server container.
+func containerName() (string, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", fmt.Errorf("failed to generate container name: %w", err)
+	}
+	return "rpcplugin-" + hex.EncodeToString(buf[:]), nil
+}
@@ -0,0 +1,248 @@
+package rpcplugin
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// controlServiceName is the name of the gRPC service that rpcplugin servers
+// offer alongside the caller's services, which the client uses to control
+// the server itself rather than to call plugin functionality.
+//
+// The service uses only the protobuf well-known types for its messages, so
+// that other implementations can offer it without sharing generated code.
+const controlServiceName = "rpcplugin.Control"
+
+// controlServer is the server API for the control service.
+type controlServer interface {
+	// RotateCertificate asks the server to trust the given new client
+	// certificate, in DER format, and to replace its own certificate with
+	// a new one, which it returns in DER format.
+	RotateCertificate(context.Context, *wrappers.BytesValue) (*wrappers.BytesValue, error)
+
+	// Shutdown asks the server to stop accepting new requests, finish the
+	// requests in progress, and then exit. It returns as soon as the server
+	// has begun draining, and the client learns that draining is complete
+	// when the server process exits.
+	Shutdown(context.Context, *empty.Empty) (*empty.Empty, error)
+
+	// GetMetadata returns the server's description of itself as a JSON
+	// object in the same format as the metadata in the handshake, or an
+	// empty string if the server has no metadata.
+	GetMetadata(context.Context, *empty.Empty) (*wrappers.StringValue, error)
+
+	// CancelCalls cancels the contexts of all of the plugin's RPC handlers
+	// that are in progress, other than those of rpcplugin's own services,
+	// and returns how many it cancelled.
+	CancelCalls(context.Context, *empty.Empty) (*wrappers.UInt32Value, error)
+}
+
+func registerControlServer(s *grpc.Server, srv controlServer) {
+	s.RegisterService(&controlServiceDesc, srv)
+}
+
+var controlServiceDesc = grpc.ServiceDesc{
+	ServiceName: controlServiceName,
+	HandlerType: (*controlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RotateCertificate",
+			Handler:    controlRotateCertificateHandler,
+		},
+		{
+			MethodName: "Shutdown",
+			Handler:    controlShutdownHandler,
+		},
+		{
+			MethodName: "GetMetadata",
+			Handler:    controlGetMetadataHandler,
+		},
+		{
+			MethodName: "CancelCalls",
+			Handler:    controlCancelCallsHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "rpcplugin/control",
+}
+
+func controlRotateCertificateHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wrappers.BytesValue)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(controlServer).RotateCertificate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + controlServiceName + "/RotateCertificate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(controlServer).RotateCertificate(ctx, req.(*wrappers.BytesValue))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func controlShutdownHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(empty.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(controlServer).Shutdown(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + controlServiceName + "/Shutdown",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(controlServer).Shutdown(ctx, req.(*empty.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func controlGetMetadataHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(empty.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(controlServer).GetMetadata(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + controlServiceName + "/GetMetadata",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(controlServer).GetMetadata(ctx, req.(*empty.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func controlCancelCallsHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(empty.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(controlServer).CancelCalls(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + controlServiceName + "/CancelCalls",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(controlServer).CancelCalls(ctx, req.(*empty.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// controlClient is the client API for the control service.
+type controlClient struct {
+	cc *grpc.ClientConn
+}
+
+func (c *controlClient) RotateCertificate(ctx context.Context, in *wrappers.BytesValue, opts ...grpc.CallOption) (*wrappers.BytesValue, error) {
+	out := new(wrappers.BytesValue)
+	err := c.cc.Invoke(ctx, "/"+controlServiceName+"/RotateCertificate", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) Shutdown(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*empty.Empty, error) {
+	out := new(empty.Empty)
+	err := c.cc.Invoke(ctx, "/"+controlServiceName+"/Shutdown", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) GetMetadata(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*wrappers.StringValue, error) {
+	out := new(wrappers.StringValue)
+	err := c.cc.Invoke(ctx, "/"+controlServiceName+"/GetMetadata", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) CancelCalls(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*wrappers.UInt32Value, error) {
+	out := new(wrappers.UInt32Value)
+	err := c.cc.Invoke(ctx, "/"+controlServiceName+"/CancelCalls", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// serverControl is the plugin server's implementation of the control
+// service.
+type serverControl struct {
+	// auto is the server's automatically-negotiated credentials, or nil if
+	// the server's TLS configuration came from elsewhere.
+	auto *autoCredentials
+
+	// rotated is called after the server has rotated its certificate.
+	rotated func()
+
+	// shutdown is called to make the server begin draining and then exit.
+	shutdown func()
+
+	// metadata is the server's description of itself, if any.
+	metadata *PluginMetadata
+
+	// calls tracks the plugin's RPC handlers in progress.
+	calls *callCanceler
+}
+
+var _ controlServer = (*serverControl)(nil)
+
+// RotateCertificate implements controlServer.
+func (s *serverControl) RotateCertificate(ctx context.Context, req *wrappers.BytesValue) (*wrappers.BytesValue, error) {
+	if s.auto == nil {
+		return nil, status.Error(codes.FailedPrecondition, "plugin server is not using automatically-negotiated TLS certificates")
+	}
+	der, err := rotateAutoCredentials(ctx, s.auto, req.GetValue())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if s.rotated != nil {
+		s.rotated()
+	}
+	return &wrappers.BytesValue{Value: der}, nil
+}
+
+// Shutdown implements controlServer.
+func (s *serverControl) Shutdown(ctx context.Context, req *empty.Empty) (*empty.Empty, error) {
+	// The server waits for requests in progress, including this one, to
+	// complete before it exits, so we must only start the shutdown here.
+	s.shutdown()
+	return &empty.Empty{}, nil
+}
+
+// GetMetadata implements controlServer.
+func (s *serverControl) GetMetadata(ctx context.Context, req *empty.Empty) (*wrappers.StringValue, error) {
+	if s.metadata == nil {
+		return &wrappers.StringValue{}, nil
+	}
+	buf, err := json.Marshal(s.metadata)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &wrappers.StringValue{Value: string(buf)}, nil
+}
+
+// CancelCalls implements controlServer.
+func (s *serverControl) CancelCalls(ctx context.Context, req *empty.Empty) (*wrappers.UInt32Value, error) {
+	return &wrappers.UInt32Value{Value: uint32(s.calls.cancelAll())}, nil
+}
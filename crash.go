@@ -0,0 +1,66 @@
+package rpcplugin
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+)
+
+// CrashInfo describes a plugin server process that exited unexpectedly:
+// either before completing its handshake, or while the client was still
+// using it.
+//
+// It is an alias for the type in package plugintrace, so that tracers can
+// receive the same information.
+type CrashInfo = plugintrace.CrashInfo
+
+// CrashPhase identifies the stage of a plugin's life when its server
+// process exited unexpectedly.
+type CrashPhase = plugintrace.CrashPhase
+
+const (
+	CrashDuringHandshake = plugintrace.CrashDuringHandshake
+	CrashDuringSession   = plugintrace.CrashDuringSession
+)
+
+// newCrashInfo builds the crash information for a plugin server process
+// that exited in the given phase, having started at the given time.
+func newCrashInfo(phase CrashPhase, state *os.ProcessState, started time.Time, stderr *stderrCapture) *CrashInfo {
+	ret := &CrashInfo{
+		Phase:    phase,
+		State:    state,
+		ExitCode: -1,
+		Runtime:  time.Since(started),
+	}
+	if state != nil {
+		ret.ExitCode = state.ExitCode()
+		// syscall.WaitStatus has these methods on all of the platforms we
+		// support, but we check dynamically so that others can still build.
+		if ws, ok := state.Sys().(interface {
+			Signaled() bool
+			Signal() syscall.Signal
+		}); ok && ws.Signaled() {
+			ret.Signal = ws.Signal().String()
+		}
+	}
+	if stderr != nil {
+		ret.Stderr = stderr.Bytes()
+	}
+	return ret
+}
+
+// CrashInfo returns information about the plugin server process exiting
+// while the client was still using it, or nil if the process is still
+// running, or if it exited only after the client called Close.
+//
+// The returned object must not be modified.
+func (p *Plugin) CrashInfo() *CrashInfo {
+	select {
+	case <-p.exit:
+		return p.crash
+	default:
+		return nil
+	}
+}
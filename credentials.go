@@ -0,0 +1,191 @@
+package rpcplugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// CredentialSource is the interface to implement to provide the TLS
+// credentials for one end of a plugin connection from some external source,
+// such as files on disk or a secret manager, as an alternative to providing
+// a complete TLS configuration.
+//
+// The client or server calls Credentials for each TLS handshake, so that
+// implementations can return updated credentials as they change without
+// restarting the plugin. Implementations that fetch credentials from a
+// remote system should therefore cache them rather than fetching them for
+// each call.
+type CredentialSource interface {
+	Credentials() (*Credentials, error)
+}
+
+// Credentials are the TLS credentials for one end of a plugin connection.
+type Credentials struct {
+	// Certificate is the certificate this end presents to the other, along
+	// with its private key. The private key can be any crypto.Signer, such
+	// as one backed by a hardware security module, as long as it supports
+	// the signature algorithms TLS requires.
+	Certificate tls.Certificate
+
+	// PeerCAs is the pool of certificate authorities trusted to have issued
+	// the certificate presented by the other end.
+	PeerCAs *x509.CertPool
+}
+
+// tlsCredentials is implemented by the types that produce TLS configurations
+// whose credentials can change over time, so that the same credentials can
+// also be used for the host services connection, with the client and server
+// roles reversed.
+type tlsCredentials interface {
+	ClientTLSConfig() *tls.Config
+	ServerTLSConfig() *tls.Config
+}
+
+var _ tlsCredentials = (*autoCredentials)(nil)
+var _ tlsCredentials = (*sourceCredentials)(nil)
+
+// sourceCredentials adapts a CredentialSource to produce TLS configurations.
+type sourceCredentials struct {
+	source CredentialSource
+
+	// verify is an optional additional check of the peer's certificate
+	// chain, and policy optionally constrains the TLS parameters.
+	verify func([]*x509.Certificate) error
+	policy *TLSPolicy
+}
+
+func (c *sourceCredentials) certificate() (*tls.Certificate, error) {
+	creds, err := c.source.Credentials()
+	if err != nil {
+		return nil, err
+	}
+	return &creds.Certificate, nil
+}
+
+func (c *sourceCredentials) verifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	creds, err := c.source.Credentials()
+	if err != nil {
+		return err
+	}
+	return verifyPeerCertChain(rawCerts, creds.PeerCAs, c.verify)
+}
+
+// ClientTLSConfig implements tlsCredentials.
+func (c *sourceCredentials) ClientTLSConfig() *tls.Config {
+	ret := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.certificate()
+		},
+
+		// We connect only to the address the server announced in the
+		// handshake, so the server's identity is established by its
+		// certificate being issued by one of the peer CAs, rather than by
+		// the usual host name verification.
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: c.verifyPeer,
+	}
+	c.policy.apply(ret)
+	return ret
+}
+
+// ServerTLSConfig implements tlsCredentials.
+func (c *sourceCredentials) ServerTLSConfig() *tls.Config {
+	ret := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.certificate()
+		},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: c.verifyPeer,
+	}
+	c.policy.apply(ret)
+	return ret
+}
+
+// FileCredentials is a CredentialSource that reads PEM-encoded credentials
+// from files, and reloads them whenever any of the files change.
+//
+// If reloading fails, such as if the files are being replaced
+// non-atomically, FileCredentials continues to use the credentials it
+// previously loaded and tries again on the next call.
+//
+// A FileCredentials object must not be copied after its first use.
+type FileCredentials struct {
+	// CertFile and KeyFile are the paths of the files containing the
+	// certificate chain and the private key, respectively.
+	CertFile, KeyFile string
+
+	// CAFile is the path of a file containing one or more certificates of
+	// authorities trusted to have issued the peer's certificate.
+	CAFile string
+
+	mu      sync.Mutex
+	current *Credentials
+	stamps  [3]fileStamp
+}
+
+var _ CredentialSource = (*FileCredentials)(nil)
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Credentials implements CredentialSource.
+func (f *FileCredentials) Credentials() (*Credentials, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var stamps [3]fileStamp
+	var statErr error
+	for i, path := range []string{f.CertFile, f.KeyFile, f.CAFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			statErr = err
+			break
+		}
+		stamps[i] = fileStamp{info.ModTime(), info.Size()}
+	}
+	if statErr == nil && f.current != nil && stamps == f.stamps {
+		return f.current, nil
+	}
+
+	creds, err := f.load()
+	if statErr != nil {
+		err = statErr
+	}
+	if err != nil {
+		if f.current != nil {
+			return f.current, nil
+		}
+		return nil, err
+	}
+	f.current = creds
+	f.stamps = stamps
+	return creds, nil
+}
+
+func (f *FileCredentials) load() (*Credentials, error) {
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %s", err)
+	}
+	caPEM, err := ioutil.ReadFile(f.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate authorities: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no valid certificates in %s", f.CAFile)
+	}
+	return &Credentials{
+		Certificate: cert,
+		PeerCAs:     pool,
+	}, nil
+}
@@ -0,0 +1,208 @@
+// Package dynamic provides a plugin client that can call the methods of a
+// plugin server without compiled client stubs, using protobuf descriptors
+// that it obtains from the server at runtime. It is intended for scripting
+// hosts and generic tools that don't know the plugin protocol in advance.
+//
+// The plugin server must enable the gRPC server reflection service by
+// setting ServerConfig.Reflection, because that's how the client obtains the
+// descriptors. Use ClientVersion as the ClientVersion for each protocol
+// version in ClientConfig.ProtoVersions, and then type-assert the client
+// returned from Plugin.Client to *Client.
+package dynamic
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	protov1 "github.com/golang/protobuf/proto"
+	"go.rpcplugin.org/rpcplugin"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// ClientVersion is an implementation of rpcplugin.ClientVersion whose client
+// proxies are *Client values, for use with any protocol version.
+type ClientVersion struct{}
+
+var _ rpcplugin.ClientVersion = ClientVersion{}
+
+// ClientProxy implements rpcplugin.ClientVersion.
+func (ClientVersion) ClientProxy(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
+	return NewClient(ctx, conn)
+}
+
+// Client calls the methods of a plugin server using descriptors obtained from
+// the server's reflection service.
+type Client struct {
+	conn     *grpc.ClientConn
+	files    *protoregistry.Files
+	services []protoreflect.ServiceDescriptor
+}
+
+// NewClient obtains the descriptors of the services the plugin server at the
+// other end of the given connection offers, and returns a client that can
+// call their methods.
+//
+// Most callers should use ClientVersion instead of calling NewClient
+// directly.
+func NewClient(ctx context.Context, conn *grpc.ClientConn) (*Client, error) {
+	files, names, err := fetchDescriptors(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	ret := &Client{
+		conn:  conn,
+		files: files,
+	}
+	for _, name := range names {
+		desc, err := files.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			return nil, fmt.Errorf("plugin server did not describe service %q: %w", name, err)
+		}
+		svc, ok := desc.(protoreflect.ServiceDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("plugin server described %q as something other than a service", name)
+		}
+		ret.services = append(ret.services, svc)
+	}
+	return ret, nil
+}
+
+// Services returns the descriptors of the services the plugin server offers,
+// in order by name, excluding those that rpcplugin and gRPC offer for their
+// own use.
+func (c *Client) Services() []protoreflect.ServiceDescriptor {
+	return c.services
+}
+
+// Files returns the registry of all of the descriptors obtained from the
+// plugin server, including those of the message types the services use.
+func (c *Client) Files() *protoregistry.Files {
+	return c.files
+}
+
+// Method returns the descriptor of the method with the given name, which
+// may be a full gRPC method name such as "/countplugin1.Counter/Count", or
+// the same without the leading slash, or a fully-qualified protobuf name
+// such as "countplugin1.Counter.Count".
+func (c *Client) Method(name string) (protoreflect.MethodDescriptor, error) {
+	name = strings.TrimPrefix(name, "/")
+	var svcName, methodName string
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		svcName, methodName = name[:i], name[i+1:]
+	} else if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		svcName, methodName = name[:i], name[i+1:]
+	} else {
+		return nil, fmt.Errorf("invalid method name %q: must include the service name", name)
+	}
+
+	for _, svc := range c.services {
+		if string(svc.FullName()) != svcName {
+			continue
+		}
+		method := svc.Methods().ByName(protoreflect.Name(methodName))
+		if method == nil {
+			return nil, fmt.Errorf("plugin service %s has no method %q", svcName, methodName)
+		}
+		return method, nil
+	}
+	return nil, fmt.Errorf("plugin server does not offer a service named %q", svcName)
+}
+
+// NewRequest returns a new, empty request message for the method with the
+// given name, for the caller to populate before passing it to Invoke or to
+// the Send method of a Stream.
+func (c *Client) NewRequest(method string) (*dynamicpb.Message, error) {
+	md, err := c.Method(method)
+	if err != nil {
+		return nil, err
+	}
+	return dynamicpb.NewMessage(md.Input()), nil
+}
+
+// Invoke calls the unary method with the given name, returning its response.
+//
+// The request may be a *dynamicpb.Message, such as one returned from
+// NewRequest, or a message of a compiled type, but in either case its
+// message type must be the method's input type.
+func (c *Client) Invoke(ctx context.Context, method string, req protov1.Message, opts ...grpc.CallOption) (*dynamicpb.Message, error) {
+	md, err := c.Method(method)
+	if err != nil {
+		return nil, err
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, fmt.Errorf("method %s is a streaming method, so must be called using NewStream", md.FullName())
+	}
+	if err := checkMessageType(req, md.Input()); err != nil {
+		return nil, err
+	}
+	resp := dynamicpb.NewMessage(md.Output())
+	err = c.conn.Invoke(ctx, fullMethodName(md), req, resp, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// NewStream begins a call to the method with the given name, which may be
+// a streaming method or a unary one.
+func (c *Client) NewStream(ctx context.Context, method string, opts ...grpc.CallOption) (*Stream, error) {
+	md, err := c.Method(method)
+	if err != nil {
+		return nil, err
+	}
+	desc := &grpc.StreamDesc{
+		StreamName:    string(md.Name()),
+		ClientStreams: md.IsStreamingClient(),
+		ServerStreams: md.IsStreamingServer(),
+	}
+	stream, err := c.conn.NewStream(ctx, desc, fullMethodName(md), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{ClientStream: stream, method: md}, nil
+}
+
+// Stream is a call in progress that was started using Client.NewStream.
+type Stream struct {
+	grpc.ClientStream
+	method protoreflect.MethodDescriptor
+}
+
+// Method returns the descriptor of the method being called.
+func (s *Stream) Method() protoreflect.MethodDescriptor {
+	return s.method
+}
+
+// Send sends a request message, which must be of the method's input type.
+func (s *Stream) Send(req protov1.Message) error {
+	if err := checkMessageType(req, s.method.Input()); err != nil {
+		return err
+	}
+	return s.SendMsg(req)
+}
+
+// Recv receives a response message. It returns io.EOF once a streaming
+// method has sent all of its responses.
+func (s *Stream) Recv() (*dynamicpb.Message, error) {
+	resp := dynamicpb.NewMessage(s.method.Output())
+	if err := s.RecvMsg(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func fullMethodName(md protoreflect.MethodDescriptor) string {
+	return "/" + string(md.Parent().FullName()) + "/" + string(md.Name())
+}
+
+func checkMessageType(msg protov1.Message, want protoreflect.MessageDescriptor) error {
+	got := protov1.MessageReflect(msg).Descriptor().FullName()
+	if got != want.FullName() {
+		return fmt.Errorf("request message is %s, but the method requires %s", got, want.FullName())
+	}
+	return nil
+}
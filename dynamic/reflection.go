@@ -0,0 +1,151 @@
+package dynamic
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// internalServicePrefixes are the prefixes of the names of the services that
+// rpcplugin and gRPC offer for their own use, which Client excludes.
+var internalServicePrefixes = []string{
+	"rpcplugin.",
+	"plugin.",
+	"grpc.",
+}
+
+func isInternalService(name string) bool {
+	for _, prefix := range internalServicePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchDescriptors uses the reflection service of the server at the other
+// end of the given connection to obtain the descriptors of its services,
+// returning them along with the names of the services.
+func fetchDescriptors(ctx context.Context, conn *grpc.ClientConn) (*protoregistry.Files, []string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, nil, reflectionError(err)
+	}
+	r := &descriptorFetcher{
+		stream: stream,
+		files:  make(map[string]*descriptorpb.FileDescriptorProto),
+	}
+
+	resp, err := r.roundTrip(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{ListServices: "*"},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	for _, svc := range resp.GetListServicesResponse().GetService() {
+		if isInternalService(svc.GetName()) {
+			continue
+		}
+		names = append(names, svc.GetName())
+		err := r.fetch(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: svc.GetName()},
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to obtain descriptor for service %s: %w", svc.GetName(), err)
+		}
+	}
+	stream.CloseSend()
+	sort.Strings(names)
+
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, fd := range r.files {
+		set.File = append(set.File, fd)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, nil, fmt.Errorf("plugin server returned invalid descriptors: %w", err)
+	}
+	return files, names, nil
+}
+
+// descriptorFetcher retrieves file descriptors and all of their
+// dependencies over a reflection stream.
+type descriptorFetcher struct {
+	stream rpb.ServerReflection_ServerReflectionInfoClient
+	files  map[string]*descriptorpb.FileDescriptorProto
+}
+
+func (r *descriptorFetcher) roundTrip(req *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+	if err := r.stream.Send(req); err != nil {
+		return nil, reflectionError(err)
+	}
+	resp, err := r.stream.Recv()
+	if err != nil {
+		return nil, reflectionError(err)
+	}
+	if errResp := resp.GetErrorResponse(); errResp != nil {
+		return nil, status.Error(codes.Code(errResp.GetErrorCode()), errResp.GetErrorMessage())
+	}
+	return resp, nil
+}
+
+// fetch makes the given request for file descriptors and then requests any
+// of their dependencies that it doesn't already have.
+func (r *descriptorFetcher) fetch(req *rpb.ServerReflectionRequest) error {
+	resp, err := r.roundTrip(req)
+	if err != nil {
+		return err
+	}
+	var deps []string
+	for _, raw := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+		fd := &descriptorpb.FileDescriptorProto{}
+		if err := proto.Unmarshal(raw, fd); err != nil {
+			return fmt.Errorf("plugin server returned invalid descriptor: %w", err)
+		}
+		if _, exists := r.files[fd.GetName()]; exists {
+			continue
+		}
+		r.files[fd.GetName()] = fd
+		deps = append(deps, fd.GetDependency()...)
+	}
+	for _, dep := range deps {
+		if _, exists := r.files[dep]; exists {
+			continue
+		}
+		err := r.fetch(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: dep},
+		})
+		if err == nil {
+			continue
+		}
+		// Servers don't always have descriptors for the well-known types and
+		// other common dependencies, so we'll use our own copy if we have one.
+		local, localErr := protoregistry.GlobalFiles.FindFileByPath(dep)
+		if localErr != nil {
+			return fmt.Errorf("failed to obtain descriptor for %s: %w", dep, err)
+		}
+		r.files[dep] = protodesc.ToFileDescriptorProto(local)
+	}
+	return nil
+}
+
+func reflectionError(err error) error {
+	if status.Code(err) == codes.Unimplemented {
+		return fmt.Errorf("plugin server does not offer the reflection service, so it must be started with ServerConfig.Reflection set")
+	}
+	return fmt.Errorf("reflection request failed: %w", err)
+}
@@ -0,0 +1,233 @@
+package rpcplugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// eventsServiceName is the name of the gRPC service that rpcplugin servers
+// offer so that clients can subscribe to the events the plugin publishes.
+//
+// Like the control service, it uses only the protobuf well-known types for
+// its messages.
+const eventsServiceName = "rpcplugin.Events"
+
+// eventBufferSize is the number of events the server queues for each
+// subscriber before it begins dropping events for that subscriber.
+const eventBufferSize = 64
+
+// ServerEvents allows plugin server code to publish events to the client,
+// such as to report the progress of a long-running operation, without the
+// plugin protocol having to define its own streaming RPC for the purpose.
+//
+// Events are delivered to clients that have subscribed using Plugin.Events
+// at the time they are published. Publishing never blocks: if a subscriber
+// isn't keeping up then the server drops the events it can't queue for that
+// subscriber.
+type ServerEvents struct {
+	mu     sync.Mutex
+	subs   map[chan *any.Any]struct{}
+	closed bool
+}
+
+func newServerEvents() *ServerEvents {
+	return &ServerEvents{
+		subs: make(map[chan *any.Any]struct{}),
+	}
+}
+
+// ContextServerEvents returns the ServerEvents object for the plugin server
+// that is handling the request the given context belongs to.
+//
+// The given context must be one passed by the RPC server to a handler
+// function in the plugin server; if not, the result is nil. The returned
+// object remains valid after the handler returns, so plugin code can retain
+// it to publish events later.
+func ContextServerEvents(ctx context.Context) *ServerEvents {
+	sc := contextServerContext(ctx)
+	if sc == nil {
+		return nil
+	}
+	return sc.events
+}
+
+// Publish sends the given event to all of the current subscribers.
+//
+// Subscribers receive the event as a google.protobuf.Any, so its message
+// type must be registered in the client program in order for the client to
+// decode it. Publish returns an error only if the event cannot be encoded.
+func (e *ServerEvents) Publish(event proto.Message) error {
+	msg, err := ptypes.MarshalAny(event)
+	if err != nil {
+		return fmt.Errorf("cannot encode event: %w", err)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ch := range e.subs {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+	return nil
+}
+
+func (e *ServerEvents) subscribe() (chan *any.Any, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, false
+	}
+	ch := make(chan *any.Any, eventBufferSize)
+	e.subs[ch] = struct{}{}
+	return ch, true
+}
+
+func (e *ServerEvents) unsubscribe(ch chan *any.Any) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.subs, ch)
+}
+
+// close ends all of the subscriptions, after delivering any events already
+// queued, and discards any events published afterwards. The server does
+// this when it begins shutting down, so that subscriptions don't prevent it
+// from draining.
+func (e *ServerEvents) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	for ch := range e.subs {
+		close(ch)
+	}
+	e.subs = nil
+}
+
+// eventsServer is the server API for the events service.
+type eventsServer interface {
+	// Subscribe sends each event the server publishes until the client
+	// cancels the call or the server shuts down.
+	Subscribe(*empty.Empty, grpc.ServerStream) error
+}
+
+func registerEventsServer(s *grpc.Server, srv eventsServer) {
+	s.RegisterService(&eventsServiceDesc, srv)
+}
+
+var eventsServiceDesc = grpc.ServiceDesc{
+	ServiceName: eventsServiceName,
+	HandlerType: (*eventsServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       eventsSubscribeHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "rpcplugin/events",
+}
+
+func eventsSubscribeHandler(srv interface{}, stream grpc.ServerStream) error {
+	in := new(empty.Empty)
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	return srv.(eventsServer).Subscribe(in, stream)
+}
+
+// serverEventsService implements the events service for a ServerEvents.
+type serverEventsService struct {
+	events *ServerEvents
+}
+
+func (s serverEventsService) Subscribe(_ *empty.Empty, stream grpc.ServerStream) error {
+	ch, ok := s.events.subscribe()
+	if !ok {
+		return status.Error(codes.Unavailable, "plugin server is shutting down")
+	}
+	defer s.events.unsubscribe(ch)
+
+	// We send the headers immediately so that the client knows the
+	// subscription is active before any events are published.
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	ctx := stream.Context()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := stream.SendMsg(msg); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Events subscribes to the events that the plugin server publishes using
+// ServerEvents, returning a channel that receives each event published
+// after Events returns.
+//
+// The channel is closed when the given context is cancelled, when the
+// server shuts down, or if the connection to the server fails. The caller
+// must keep receiving from the channel until it is closed or the context is
+// cancelled, or else the server will drop events.
+//
+// Each event is a google.protobuf.Any, which the caller can decode using
+// ptypes.UnmarshalAny.
+func (p *Plugin) Events(ctx context.Context) (<-chan *any.Any, error) {
+	if p.rpcProtocol != "grpc" {
+		return nil, fmt.Errorf("plugin server using RPC protocol %q does not support events", p.rpcProtocol)
+	}
+
+	conn, err := p.dialGRPC(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", p.addr, err)
+	}
+	stream, err := conn.NewStream(ctx, &eventsServiceDesc.Streams[0], "/"+eventsServiceName+"/Subscribe")
+	if err == nil {
+		err = stream.SendMsg(&empty.Empty{})
+	}
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	if err == nil {
+		_, err = stream.Header()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to subscribe to plugin events: %w", err)
+	}
+
+	ch := make(chan *any.Any)
+	go func() {
+		defer close(ch)
+		defer conn.Close()
+		for {
+			msg := new(any.Any)
+			if err := stream.RecvMsg(msg); err != nil {
+				return
+			}
+			select {
+			case ch <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -6,6 +6,8 @@ require (
 	github.com/apparentlymart/go-ctxenv v1.0.0
 	github.com/apparentlymart/go-shquot v0.0.1
 	github.com/golang/protobuf v1.5.0
+	github.com/hashicorp/yamux v0.0.0-20181012175058-2f1d1f20f75d
+	google.golang.org/genproto v0.0.0-20180817151627-c66870c02cf8
 	google.golang.org/grpc v1.19.1
-	google.golang.org/protobuf v1.28.1 // indirect
+	google.golang.org/protobuf v1.28.1
 )
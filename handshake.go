@@ -2,7 +2,15 @@ package rpcplugin
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/apparentlymart/go-ctxenv/ctxenv"
 )
@@ -29,6 +37,94 @@ type HandshakeConfig struct {
 	// server programs to give good user feedback if a user tries to launch
 	// them directly, rather than showing the user the plugin handshake line.
 	CookieKey, CookieValue string
+
+	// GenerateCookie and VerifyCookie optionally replace CookieValue with a
+	// value that differs for each launch of a plugin server, which reduces
+	// the chance that a stale environment, such as one inherited from an
+	// earlier plugin launch, will satisfy the server's check.
+	//
+	// If GenerateCookie is set, the client calls it each time it launches
+	// a plugin server, and uses the result as the cookie value instead of
+	// CookieValue. If VerifyCookie is set, the server calls it with the
+	// cookie value from its environment instead of comparing that value
+	// with CookieValue, and treats the cookie as valid if it returns true.
+	//
+	// HMACCookie returns an implementation of both functions that uses a
+	// secret shared between the client and server.
+	GenerateCookie func() (string, error)
+	VerifyCookie   func(value string) bool
+}
+
+// HMACCookie returns GenerateCookie and VerifyCookie functions for a
+// HandshakeConfig, which use the given secret to produce and verify a
+// cookie value that contains a random nonce, the time at which the client
+// generated it, and an HMAC-SHA256 signature of both.
+//
+// The server accepts the cookie only within five minutes of the time it
+// contains, so that a cookie from an earlier launch, such as one inherited
+// through the environment of a later process, soon stops being valid. The
+// plugin server must therefore start within that time, and the clocks of
+// the client and server hosts must roughly agree.
+//
+// As with the other handshake cookie settings, this is not a security
+// feature. The secret will typically be embedded in both the client and
+// server programs.
+func HMACCookie(secret []byte) (generate func() (string, error), verify func(string) bool) {
+	sign := func(nonce []byte, timestamp string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(nonce)
+		mac.Write([]byte(timestamp))
+		return mac.Sum(nil)
+	}
+	generate = func() (string, error) {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		return hex.EncodeToString(nonce) + "." + timestamp + "." + hex.EncodeToString(sign(nonce, timestamp)), nil
+	}
+	verify = func(value string) bool {
+		parts := strings.SplitN(value, ".", 3)
+		if len(parts) != 3 {
+			return false
+		}
+		nonce, err := hex.DecodeString(parts[0])
+		if err != nil {
+			return false
+		}
+		generated, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return false
+		}
+		sig, err := hex.DecodeString(parts[2])
+		if err != nil {
+			return false
+		}
+		if !hmac.Equal(sig, sign(nonce, parts[1])) {
+			return false
+		}
+		// We allow the same difference in either direction, because the
+		// server's clock may be behind the client's.
+		age := time.Since(time.Unix(generated, 0))
+		return age <= hmacCookieMaxAge && age >= -hmacCookieMaxAge
+	}
+	return generate, verify
+}
+
+// hmacCookieMaxAge is how long after the client generates a cookie from
+// HMACCookie the server will still accept it. It allows for plugin servers
+// that take a while to start, such as in a container whose image must first
+// be pulled.
+const hmacCookieMaxAge = 5 * time.Minute
+
+// cookieValue returns the cookie value the client should use for a new
+// plugin server launch.
+func (cfg *HandshakeConfig) cookieValue() (string, error) {
+	if cfg.GenerateCookie != nil {
+		return cfg.GenerateCookie()
+	}
+	return cfg.CookieValue, nil
 }
 
 // NotChildProcessError is the error value returned from Serve if it does not
@@ -51,5 +147,98 @@ func haveHandshakeCookie(ctx context.Context, cfg *HandshakeConfig) bool {
 		panic("no handshake cookie key is configured")
 	}
 	v := ctxenv.Getenv(ctx, cfg.CookieKey)
+	if cfg.VerifyCookie != nil {
+		return v != "" && cfg.VerifyCookie(v)
+	}
 	return v == cfg.CookieValue
 }
+
+// handshakeVersionEnvName is the environment variable the client uses to
+// announce that it supports version 2 of the handshake, which extends
+// the version 1 handshake line with an optional seventh field.
+//
+// The first field of the handshake line remains "1" in version 2, because
+// the extension is backward-compatible for clients that requested it.
+const handshakeVersionEnvName = "PLUGIN_HANDSHAKE_VERSION"
+
+// serverHandshakeV2 returns true if the client announced that it supports
+// version 2 of the handshake.
+func serverHandshakeV2(ctx context.Context) bool {
+	v, err := strconv.Atoi(ctxenv.Getenv(ctx, handshakeVersionEnvName))
+	return err == nil && v >= 2
+}
+
+// interruptShutdownEnvName is the environment variable the client uses to
+// announce that the server is isolated from interrupts sent to the client's
+// console, and so the server should treat an interrupt as a request from
+// the client to shut down, rather than ignoring it.
+const interruptShutdownEnvName = "PLUGIN_INTERRUPT_SHUTDOWN"
+
+// serverInterruptShutdown returns true if the client announced that the
+// server should shut down when interrupted.
+func serverInterruptShutdown(ctx context.Context) bool {
+	return ctxenv.Getenv(ctx, interruptShutdownEnvName) == "1"
+}
+
+// handshakeExtensions is the optional seventh field of the handshake line,
+// which is a JSON object describing the server's response to optional
+// features the client requested via environment variables, along with
+// other information about the server.
+//
+// The server includes this field only if the client announced support for
+// version 2 of the handshake or requested at least one feature that requires
+// a response, so that clients unaware of these extensions will never
+// encounter it.
+type handshakeExtensions struct {
+	// Multiplex is the name of the multiplexing protocol the server selected
+	// in response to the client's multiplexing request, if any.
+	Multiplex string `json:"multiplex,omitempty"`
+
+	// Metadata is the server's description of itself, if any.
+	Metadata *PluginMetadata `json:"metadata,omitempty"`
+
+	// Versions is the set of protocol versions the server is serving
+	// concurrently, if it's serving more than just the negotiated version.
+	Versions []int `json:"versions,omitempty"`
+
+	// Capabilities is the set of capabilities the server selected from
+	// those the client advertised, if any.
+	Capabilities Capabilities `json:"capabilities,omitempty"`
+
+	// MinorVersion is the minor version the server selected for the
+	// negotiated major protocol version, if not zero.
+	MinorVersion int `json:"minorVersion,omitempty"`
+
+	// Plugins is the set of plugin names the server is serving, if the
+	// negotiated protocol version uses a ServerPluginSet.
+	Plugins []string `json:"plugins,omitempty"`
+
+	// Addrs is the address of each of the transports the server is
+	// listening on, in order of the client's preference, if the server is
+	// listening on more than one. The first is the same as the address in
+	// the handshake line.
+	Addrs []handshakeAddr `json:"addrs,omitempty"`
+}
+
+func (e *handshakeExtensions) empty() bool {
+	return e.Multiplex == "" && e.Metadata == nil && len(e.Versions) == 0 && len(e.Capabilities) == 0 && e.MinorVersion == 0 && len(e.Plugins) == 0 && len(e.Addrs) == 0
+}
+
+func (e *handshakeExtensions) encode() string {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		// Should never happen, because our extensions contain only
+		// JSON-compatible values.
+		panic(err)
+	}
+	return string(buf)
+}
+
+func parseHandshakeExtensions(raw string) (handshakeExtensions, error) {
+	var ret handshakeExtensions
+	if raw == "" {
+		return ret, nil
+	}
+	err := json.Unmarshal([]byte(raw), &ret)
+	return ret, err
+}
@@ -0,0 +1,102 @@
+package handshake
+
+import (
+	"fmt"
+)
+
+// SyntaxError is the error returned by ParseLine when the line doesn't have
+// enough fields to be a handshake line at all, such as when a plugin program
+// writes something else to its stdout.
+type SyntaxError struct {
+	// Line is the invalid line, with surrounding whitespace removed.
+	Line string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Line == "" {
+		return "empty handshake line"
+	}
+	return fmt.Sprintf("invalid handshake line %q", e.Line)
+}
+
+// FieldError is the error returned by ParseLine when one of the fields of
+// the handshake line has an invalid value, and by FormatLine when the
+// content for one of the fields can't be represented in a handshake line.
+type FieldError struct {
+	// Field is the field whose value is invalid, and Value is that value.
+	Field Field
+	Value string
+
+	// Reason is a short description of the value the field should have.
+	Reason string
+
+	// Err is the underlying error that caused the value to be rejected, if
+	// any.
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("invalid %s %q in handshake line: %s (%s)", e.Field, e.Value, e.Reason, e.Err)
+	}
+	return fmt.Sprintf("invalid %s %q in handshake line: %s", e.Field, e.Value, e.Reason)
+}
+
+// Unwrap returns the underlying error, if any.
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Field identifies one of the fields of a handshake line.
+type Field int
+
+const (
+	// FieldCoreVersion is the first field, the version of the handshake line
+	// format itself, which is always "1".
+	FieldCoreVersion Field = iota
+
+	// FieldProtoVersion is the application protocol version the server
+	// selected, from Line.ProtoVersion.
+	FieldProtoVersion
+
+	// FieldNetwork is the network of the server's address, which is either
+	// "tcp" or "unix", from the Network method of Line.Addr.
+	FieldNetwork
+
+	// FieldAddr is the address where the server is listening, from the
+	// String method of Line.Addr.
+	FieldAddr
+
+	// FieldRPCProtocol is the RPC protocol the server uses, from
+	// Line.RPCProtocol.
+	FieldRPCProtocol
+
+	// FieldCertificate is the server's base64-encoded temporary certificate,
+	// from Line.Certificate.
+	FieldCertificate
+
+	// FieldExtensions is the JSON object describing optional features, from
+	// Line.Extensions.
+	FieldExtensions
+)
+
+func (f Field) String() string {
+	switch f {
+	case FieldCoreVersion:
+		return "handshake version"
+	case FieldProtoVersion:
+		return "protocol version"
+	case FieldNetwork:
+		return "network"
+	case FieldAddr:
+		return "address"
+	case FieldRPCProtocol:
+		return "RPC protocol"
+	case FieldCertificate:
+		return "certificate"
+	case FieldExtensions:
+		return "extensions"
+	default:
+		return fmt.Sprintf("field %d", int(f))
+	}
+}
@@ -0,0 +1,69 @@
+//go:build go1.18
+// +build go1.18
+
+package handshake_test
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.rpcplugin.org/rpcplugin/handshake"
+)
+
+// FuzzParseLine checks that ParseLine either returns one of its documented
+// error types or a line that FormatLine can format, and that parsing the
+// formatted line produces the same content again.
+func FuzzParseLine(f *testing.F) {
+	f.Add("1|1|tcp|127.0.0.1:1234|grpc")
+	f.Add("1|2|unix|/tmp/plugin.sock|grpc|\n")
+	f.Add(`1|1|unix|/tmp/plugin.sock|grpc||{"capabilities":["a"]}`)
+	f.Add("1|1|tcp|[::1]:80|netrpc|abc")
+	f.Add("1|1|tcp|127.0.0.1:1234|grpc|" + strings.Repeat("A", 64))
+	f.Add("hello world")
+
+	f.Fuzz(func(t *testing.T, s string) {
+		if resolvesName(s) {
+			// ParseLine would look the name up, which makes the result
+			// depend on the host the test runs on.
+			t.Skip()
+		}
+		line, err := handshake.ParseLine(s)
+		if err != nil {
+			var syntaxErr *handshake.SyntaxError
+			var fieldErr *handshake.FieldError
+			if !errors.As(err, &syntaxErr) && !errors.As(err, &fieldErr) {
+				t.Fatalf("wrong error type %T: %s", err, err)
+			}
+			return
+		}
+		formatted, err := handshake.FormatLine(line)
+		if err != nil {
+			t.Fatalf("can't format parsed line: %s", err)
+		}
+		again, err := handshake.ParseLine(formatted)
+		if err != nil {
+			t.Fatalf("can't parse formatted line: %s\nline: %s", err, formatted)
+		}
+		assertLinesEqual(t, again, line)
+	})
+}
+
+// resolvesName returns true if s looks like a handshake line with a TCP
+// address whose host or port is a name rather than a number.
+func resolvesName(s string) bool {
+	parts := strings.SplitN(strings.TrimSpace(s), "|", 5)
+	if len(parts) < 4 || parts[2] != "tcp" {
+		return false
+	}
+	host, port, err := net.SplitHostPort(parts[3])
+	if err != nil {
+		return false
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil && port != "" {
+		return true
+	}
+	return host != "" && net.ParseIP(host) == nil
+}
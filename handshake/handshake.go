@@ -0,0 +1,203 @@
+// Package handshake implements parsing and formatting of the handshake line
+// that an rpcplugin server writes to its stdout to tell the client where
+// and how to connect to it.
+//
+// Most applications don't need to use this package directly, because
+// package rpcplugin uses it internally. It's exposed for alternative client
+// and server implementations, test harnesses, and tools that need to
+// produce or validate handshake lines.
+//
+// The handshake line consists of fields separated by pipe characters:
+//
+//	1|<proto version>|<network>|<address>|<rpc protocol>|<certificate>|<extensions>
+//
+// The first field is always "1", the version of the handshake line format
+// itself. The certificate and extensions fields are optional.
+package handshake // import go.rpcplugin.org/rpcplugin/handshake
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Line is the content of a handshake line.
+type Line struct {
+	// ProtoVersion is the application protocol version the server selected.
+	ProtoVersion int
+
+	// Addr is the address where the server is listening, which is either a
+	// *net.TCPAddr or a *net.UnixAddr.
+	Addr net.Addr
+
+	// RPCProtocol is the RPC protocol the server uses, which is "grpc" for
+	// rpcplugin servers, or "netrpc" for some HashiCorp go-plugin servers.
+	RPCProtocol string
+
+	// Certificate is the server's temporary certificate for the automatic
+	// TLS negotiation protocol, or nil if the server isn't using it.
+	Certificate *x509.Certificate
+
+	// UnpaddedCertificate indicates that the certificate is encoded with
+	// unpadded base64, as HashiCorp go-plugin clients and servers expect,
+	// rather than the standard padded base64 that rpcplugin uses.
+	//
+	// The two encodings are the same for a certificate whose length is a
+	// multiple of three bytes, in which case ParseLine leaves this false.
+	UnpaddedCertificate bool
+
+	// Extensions is the optional JSON object describing optional features
+	// the server supports, from version 2 of the handshake, or nil if the
+	// line has no extensions.
+	Extensions json.RawMessage
+}
+
+// minCertificateLength is the minimum length of a certificate field value
+// for it to be treated as a certificate. Older versions of HashiCorp's
+// go-plugin use the same field for other purposes, with shorter values.
+const minCertificateLength = 50
+
+// ParseLine parses the given handshake line, which may have surrounding
+// whitespace, such as a trailing newline, but must not contain any other
+// line breaks.
+//
+// If the line is invalid, the returned error is either a *SyntaxError or a
+// *FieldError describing the problem.
+func ParseLine(line string) (*Line, error) {
+	line = strings.TrimSpace(line)
+	parts := strings.SplitN(line, "|", 7)
+	if len(parts) < 5 || strings.ContainsAny(line, "\r\n") {
+		return nil, &SyntaxError{Line: line}
+	}
+
+	if parts[0] != "1" {
+		return nil, &FieldError{Field: FieldCoreVersion, Value: parts[0], Reason: `must be "1"`}
+	}
+
+	ret := &Line{}
+
+	version, err := strconv.Atoi(parts[1])
+	if err != nil || version < 0 {
+		return nil, &FieldError{Field: FieldProtoVersion, Value: parts[1], Reason: "must be a non-negative integer"}
+	}
+	ret.ProtoVersion = version
+
+	switch network := parts[2]; network {
+	case "tcp":
+		addr, err := net.ResolveTCPAddr("tcp", parts[3])
+		if err != nil {
+			return nil, &FieldError{Field: FieldAddr, Value: parts[3], Reason: "must be a TCP socket address", Err: err}
+		}
+		ret.Addr = addr
+	case "unix":
+		addr, err := net.ResolveUnixAddr("unix", parts[3])
+		if err != nil {
+			return nil, &FieldError{Field: FieldAddr, Value: parts[3], Reason: "must be a Unix socket path", Err: err}
+		}
+		ret.Addr = addr
+	default:
+		return nil, &FieldError{Field: FieldNetwork, Value: network, Reason: `must be "tcp" or "unix"`}
+	}
+
+	if parts[4] == "" {
+		return nil, &FieldError{Field: FieldRPCProtocol, Value: parts[4], Reason: "must not be empty"}
+	}
+	ret.RPCProtocol = parts[4]
+
+	if len(parts) >= 6 && len(parts[5]) > minCertificateLength {
+		cert, unpadded, err := decodeCertificate(parts[5])
+		if err != nil {
+			return nil, &FieldError{Field: FieldCertificate, Value: parts[5], Reason: "must be a base64-encoded X.509 certificate", Err: err}
+		}
+		ret.Certificate = cert
+		ret.UnpaddedCertificate = unpadded
+	}
+
+	if len(parts) >= 7 && parts[6] != "" {
+		raw := json.RawMessage(parts[6])
+		if err := checkExtensions(raw); err != nil {
+			return nil, &FieldError{Field: FieldExtensions, Value: parts[6], Reason: "must be a JSON object", Err: err}
+		}
+		ret.Extensions = raw
+	}
+
+	return ret, nil
+}
+
+// FormatLine returns the handshake line describing the given content,
+// without a trailing newline.
+//
+// If the content can't be represented in a handshake line that ParseLine
+// would accept, such as if line.Addr is nil or line.Extensions isn't a JSON
+// object, the returned error is a *FieldError describing the problem.
+func FormatLine(line *Line) (string, error) {
+	if line.ProtoVersion < 0 {
+		return "", &FieldError{Field: FieldProtoVersion, Value: strconv.Itoa(line.ProtoVersion), Reason: "must be a non-negative integer"}
+	}
+	if line.Addr == nil {
+		return "", &FieldError{Field: FieldAddr, Reason: "must be set"}
+	}
+	if network := line.Addr.Network(); network != "tcp" && network != "unix" {
+		return "", &FieldError{Field: FieldNetwork, Value: network, Reason: `must be "tcp" or "unix"`}
+	}
+	if addr := line.Addr.String(); strings.ContainsAny(addr, "|\r\n") {
+		return "", &FieldError{Field: FieldAddr, Value: addr, Reason: "must not contain pipe characters or line breaks"}
+	}
+	if line.RPCProtocol == "" || strings.ContainsAny(line.RPCProtocol, "|\r\n") {
+		return "", &FieldError{Field: FieldRPCProtocol, Value: line.RPCProtocol, Reason: "must be non-empty, without pipe characters or line breaks"}
+	}
+
+	var certStr string
+	if line.Certificate != nil {
+		if line.UnpaddedCertificate {
+			certStr = base64.RawStdEncoding.EncodeToString(line.Certificate.Raw)
+		} else {
+			certStr = base64.StdEncoding.EncodeToString(line.Certificate.Raw)
+		}
+	}
+	ret := fmt.Sprintf("1|%d|%s|%s|%s|%s",
+		line.ProtoVersion,
+		line.Addr.Network(),
+		line.Addr.String(),
+		line.RPCProtocol,
+		certStr,
+	)
+	if len(line.Extensions) != 0 {
+		if err := checkExtensions(line.Extensions); err != nil {
+			return "", &FieldError{Field: FieldExtensions, Value: string(line.Extensions), Reason: "must be a JSON object", Err: err}
+		}
+		// Line breaks can appear in valid JSON only as whitespace between
+		// tokens, so compacting the object keeps it on a single line.
+		var buf bytes.Buffer
+		json.Compact(&buf, line.Extensions)
+		ret += "|" + buf.String()
+	}
+	return ret, nil
+}
+
+// checkExtensions returns an error if the given extensions field value isn't
+// a JSON object.
+func checkExtensions(raw json.RawMessage) error {
+	var obj map[string]json.RawMessage
+	return json.Unmarshal(raw, &obj)
+}
+
+// decodeCertificate decodes a certificate field, accepting either padded or
+// unpadded base64 for compatibility with HashiCorp's go-plugin.
+func decodeCertificate(src string) (cert *x509.Certificate, unpadded bool, err error) {
+	der, err := base64.StdEncoding.DecodeString(src)
+	if err != nil {
+		der, err = base64.RawStdEncoding.DecodeString(src)
+		if err != nil {
+			return nil, false, err
+		}
+		unpadded = true
+	}
+	cert, err = x509.ParseCertificate(der)
+	return cert, unpadded, err
+}
@@ -0,0 +1,322 @@
+package handshake_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"go.rpcplugin.org/rpcplugin/handshake"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := map[string]struct {
+		line string
+		want *handshake.Line
+	}{
+		"tcp": {
+			"1|2|tcp|127.0.0.1:1234|grpc\n",
+			&handshake.Line{
+				ProtoVersion: 2,
+				Addr:         &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+				RPCProtocol:  "grpc",
+			},
+		},
+		"unix with empty certificate": {
+			"1|1|unix|/tmp/plugin.sock|grpc|",
+			&handshake.Line{
+				ProtoVersion: 1,
+				Addr:         &net.UnixAddr{Net: "unix", Name: "/tmp/plugin.sock"},
+				RPCProtocol:  "grpc",
+			},
+		},
+		"short certificate field ignored": {
+			"1|1|tcp|127.0.0.1:1234|netrpc|abc",
+			&handshake.Line{
+				ProtoVersion: 1,
+				Addr:         &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+				RPCProtocol:  "netrpc",
+			},
+		},
+		"extensions": {
+			`1|1|unix|/tmp/plugin.sock|grpc||{"capabilities":["a|b"]}`,
+			&handshake.Line{
+				ProtoVersion: 1,
+				Addr:         &net.UnixAddr{Net: "unix", Name: "/tmp/plugin.sock"},
+				RPCProtocol:  "grpc",
+				Extensions:   json.RawMessage(`{"capabilities":["a|b"]}`),
+			},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := handshake.ParseLine(test.line)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			assertLinesEqual(t, got, test.want)
+		})
+	}
+}
+
+func TestParseLineErrors(t *testing.T) {
+	tests := map[string]struct {
+		line  string
+		field handshake.Field // -1 for a *SyntaxError
+	}{
+		"empty":                 {"", -1},
+		"not a handshake":       {"hello world", -1},
+		"too few fields":        {"1|1|tcp|127.0.0.1:1234", -1},
+		"interior line break":   {"1|1|unix|/tmp/a\nb|grpc", -1},
+		"core version":          {"2|1|tcp|127.0.0.1:1234|grpc", handshake.FieldCoreVersion},
+		"proto version":         {"1|x|tcp|127.0.0.1:1234|grpc", handshake.FieldProtoVersion},
+		"negative version":      {"1|-1|tcp|127.0.0.1:1234|grpc", handshake.FieldProtoVersion},
+		"network":               {"1|1|udp|127.0.0.1:1234|grpc", handshake.FieldNetwork},
+		"tcp address":           {"1|1|tcp|127.0.0.1|grpc", handshake.FieldAddr},
+		"rpc protocol":          {"1|1|tcp|127.0.0.1:1234|", handshake.FieldRPCProtocol},
+		"certificate":           {"1|1|tcp|127.0.0.1:1234|grpc|" + strings.Repeat("!", 60), handshake.FieldCertificate},
+		"extensions not json":   {"1|1|tcp|127.0.0.1:1234|grpc||{", handshake.FieldExtensions},
+		"extensions not object": {"1|1|tcp|127.0.0.1:1234|grpc||[]", handshake.FieldExtensions},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := handshake.ParseLine(test.line)
+			assertLineError(t, err, test.field)
+		})
+	}
+}
+
+func TestFormatLine(t *testing.T) {
+	cert := testCertificate(t)
+	tests := map[string]struct {
+		line *handshake.Line
+		want string
+	}{
+		"tcp": {
+			&handshake.Line{
+				ProtoVersion: 2,
+				Addr:         &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+				RPCProtocol:  "grpc",
+			},
+			"1|2|tcp|127.0.0.1:1234|grpc|",
+		},
+		"extensions compacted": {
+			&handshake.Line{
+				ProtoVersion: 1,
+				Addr:         &net.UnixAddr{Net: "unix", Name: "/tmp/plugin.sock"},
+				RPCProtocol:  "grpc",
+				Extensions:   json.RawMessage("{\n  \"capabilities\": [\"a\"]\n}"),
+			},
+			`1|1|unix|/tmp/plugin.sock|grpc||{"capabilities":["a"]}`,
+		},
+		"padded certificate": {
+			&handshake.Line{
+				ProtoVersion: 1,
+				Addr:         &net.UnixAddr{Net: "unix", Name: "/tmp/plugin.sock"},
+				RPCProtocol:  "grpc",
+				Certificate:  cert,
+			},
+			"1|1|unix|/tmp/plugin.sock|grpc|" + base64.StdEncoding.EncodeToString(cert.Raw),
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := handshake.FormatLine(test.line)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("wrong result\ngot:  %s\nwant: %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormatLineErrors(t *testing.T) {
+	unixAddr := &net.UnixAddr{Net: "unix", Name: "/tmp/plugin.sock"}
+	tests := map[string]struct {
+		line  *handshake.Line
+		field handshake.Field
+	}{
+		"negative version": {
+			&handshake.Line{ProtoVersion: -1, Addr: unixAddr, RPCProtocol: "grpc"},
+			handshake.FieldProtoVersion,
+		},
+		"no address": {
+			&handshake.Line{ProtoVersion: 1, RPCProtocol: "grpc"},
+			handshake.FieldAddr,
+		},
+		"unsupported network": {
+			&handshake.Line{ProtoVersion: 1, Addr: &net.UDPAddr{Port: 1234}, RPCProtocol: "grpc"},
+			handshake.FieldNetwork,
+		},
+		"line break in address": {
+			&handshake.Line{ProtoVersion: 1, Addr: &net.UnixAddr{Net: "unix", Name: "/tmp/a\nb"}, RPCProtocol: "grpc"},
+			handshake.FieldAddr,
+		},
+		"pipe in address": {
+			&handshake.Line{ProtoVersion: 1, Addr: &net.UnixAddr{Net: "unix", Name: "/tmp/a|b"}, RPCProtocol: "grpc"},
+			handshake.FieldAddr,
+		},
+		"empty rpc protocol": {
+			&handshake.Line{ProtoVersion: 1, Addr: unixAddr},
+			handshake.FieldRPCProtocol,
+		},
+		"line break in rpc protocol": {
+			&handshake.Line{ProtoVersion: 1, Addr: unixAddr, RPCProtocol: "grpc\n1|1|tcp|10.0.0.1:1|grpc"},
+			handshake.FieldRPCProtocol,
+		},
+		"invalid extensions": {
+			&handshake.Line{ProtoVersion: 1, Addr: unixAddr, RPCProtocol: "grpc", Extensions: json.RawMessage("{\n")},
+			handshake.FieldExtensions,
+		},
+		"extensions not object": {
+			&handshake.Line{ProtoVersion: 1, Addr: unixAddr, RPCProtocol: "grpc", Extensions: json.RawMessage(`"a"`)},
+			handshake.FieldExtensions,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := handshake.FormatLine(test.line)
+			assertLineError(t, err, test.field)
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	cert := testCertificate(t)
+	lines := map[string]*handshake.Line{
+		"tcp": {
+			ProtoVersion: 3,
+			Addr:         &net.TCPAddr{IP: net.ParseIP("::1"), Port: 4567},
+			RPCProtocol:  "grpc",
+		},
+		"unix with certificate and extensions": {
+			ProtoVersion: 1,
+			Addr:         &net.UnixAddr{Net: "unix", Name: "/tmp/plugin.sock"},
+			RPCProtocol:  "grpc",
+			Certificate:  cert,
+			Extensions:   json.RawMessage(`{"capabilities":["a"],"metadata":{"name":"x"}}`),
+		},
+		"unpadded certificate": {
+			ProtoVersion: 1,
+			Addr:         &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+			RPCProtocol:  "grpc",
+			Certificate:  cert,
+
+			UnpaddedCertificate: true,
+		},
+	}
+	for name, line := range lines {
+		t.Run(name, func(t *testing.T) {
+			formatted, err := handshake.FormatLine(line)
+			if err != nil {
+				t.Fatalf("format failed: %s", err)
+			}
+			got, err := handshake.ParseLine(formatted + "\n")
+			if err != nil {
+				t.Fatalf("parse failed: %s\nline: %s", err, formatted)
+			}
+			assertLinesEqual(t, got, line)
+		})
+	}
+}
+
+func assertLinesEqual(t *testing.T, got, want *handshake.Line) {
+	t.Helper()
+	if got.ProtoVersion != want.ProtoVersion {
+		t.Errorf("wrong ProtoVersion %d; want %d", got.ProtoVersion, want.ProtoVersion)
+	}
+	if got.Addr.Network() != want.Addr.Network() || got.Addr.String() != want.Addr.String() {
+		t.Errorf("wrong Addr %s (%s); want %s (%s)", got.Addr, got.Addr.Network(), want.Addr, want.Addr.Network())
+	}
+	if got.RPCProtocol != want.RPCProtocol {
+		t.Errorf("wrong RPCProtocol %q; want %q", got.RPCProtocol, want.RPCProtocol)
+	}
+	switch {
+	case (got.Certificate == nil) != (want.Certificate == nil):
+		t.Errorf("wrong Certificate %v; want %v", got.Certificate, want.Certificate)
+	case got.Certificate != nil && !got.Certificate.Equal(want.Certificate):
+		t.Errorf("wrong Certificate")
+	}
+	if got.UnpaddedCertificate != want.UnpaddedCertificate {
+		t.Errorf("wrong UnpaddedCertificate %t; want %t", got.UnpaddedCertificate, want.UnpaddedCertificate)
+	}
+	if !bytes.Equal(compactJSON(t, got.Extensions), compactJSON(t, want.Extensions)) {
+		t.Errorf("wrong Extensions %s; want %s", got.Extensions, want.Extensions)
+	}
+}
+
+// assertLineError fails the test unless err is a *handshake.FieldError for
+// the given field, or a *handshake.SyntaxError if field is -1.
+func assertLineError(t *testing.T, err error, field handshake.Field) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("unexpected success")
+	}
+	if field == -1 {
+		var syntaxErr *handshake.SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Fatalf("wrong error %T %q; want *SyntaxError", err, err)
+		}
+		return
+	}
+	var fieldErr *handshake.FieldError
+	if !errors.As(err, &fieldErr) {
+		t.Fatalf("wrong error %T %q; want *FieldError", err, err)
+	}
+	if fieldErr.Field != field {
+		t.Fatalf("error is for %s; want %s\nerror: %s", fieldErr.Field, field, err)
+	}
+}
+
+func compactJSON(t *testing.T, raw json.RawMessage) []byte {
+	t.Helper()
+	if len(raw) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		t.Fatalf("invalid JSON %s: %s", raw, err)
+	}
+	return buf.Bytes()
+}
+
+func testCertificate(t testing.TB) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	// The padded and unpadded encodings of a certificate are only distinct
+	// if its length isn't a multiple of three, and ECDSA signatures vary in
+	// length, so we retry until we get a certificate where they are.
+	var der []byte
+	for len(der)%3 == 0 {
+		der, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
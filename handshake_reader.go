@@ -0,0 +1,82 @@
+package rpcplugin
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// defaultMaxHandshakeLine is the default for ClientConfig.MaxHandshakeLine.
+const defaultMaxHandshakeLine = 64 * 1024
+
+// handshakeLimitOutputLen is the maximum length of the output included in
+// a HandshakeLimitError.
+const handshakeLimitOutputLen = 256
+
+// handshakeResult is the result of readHandshakeLine.
+type handshakeResult struct {
+	line string
+	err  error
+}
+
+// readHandshakeLine reads lines from the given plugin server stdout until
+// it finds one that might be a handshake line, enforcing the given limits.
+//
+// It returns an empty line and no error if stdout ends first.
+func readHandshakeLine(r *bufio.Reader, maxLine, maxPreamble int) (string, error) {
+	preamble := 0
+	for {
+		raw, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return "", newHandshakeLimitError("MaxHandshakeLine", maxLine, raw)
+		}
+		if len(raw) == 0 && err != nil {
+			return "", nil
+		}
+
+		// All handshake lines begin with the version of the handshake line
+		// format, which is always 1.
+		line := strings.TrimSpace(string(raw))
+		if maxPreamble <= 0 || strings.HasPrefix(line, "1|") || err != nil {
+			return line, nil
+		}
+		preamble += len(raw)
+		if preamble > maxPreamble {
+			return "", newHandshakeLimitError("MaxHandshakePreamble", maxPreamble, raw)
+		}
+	}
+}
+
+// awaitHandshakeLine reads the handshake line from the given plugin server
+// stdout in the background, sending the result on the returned channel or
+// closing it without a result if stdout ends first. Afterwards, it discards
+// any further output until stdout ends, so that the server can't block on
+// writing to it.
+func awaitHandshakeLine(stdout io.ReadCloser, maxLine, maxPreamble int) <-chan handshakeResult {
+	ch := make(chan handshakeResult, 1)
+	go func() {
+		defer stdout.Close()
+		r := bufio.NewReaderSize(stdout, maxLine)
+		line, err := readHandshakeLine(r, maxLine, maxPreamble)
+		if line != "" || err != nil {
+			ch <- handshakeResult{line: line, err: err}
+		}
+		close(ch)
+		io.Copy(ioutil.Discard, r)
+	}()
+	return ch
+}
+
+func newHandshakeLimitError(field string, limit int, output []byte) *HandshakeLimitError {
+	output = bytes.TrimRight(output, "\r\n")
+	if len(output) > handshakeLimitOutputLen {
+		output = output[:handshakeLimitOutputLen]
+	}
+	return &HandshakeLimitError{
+		Field:  field,
+		Limit:  limit,
+		Output: string(output),
+	}
+}
@@ -0,0 +1,136 @@
+package rpcplugin
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// ServerHealth allows plugin server code to report whether the server is
+// currently able to handle requests, via the health service that all plugin
+// servers offer to their clients.
+//
+// Plugin servers report that they are serving when they start, unless
+// plugin code has said otherwise. A plugin might report that it is not
+// serving while it is still initializing, during maintenance, or when it is
+// overloaded, so that the client can avoid sending it further requests.
+//
+// To report its status from before the server handles its first request,
+// plugin code creates a ServerHealth with NewServerHealth and passes it in
+// ServerConfig.Health. Otherwise, RPC handlers can obtain the server's
+// ServerHealth from ContextServerHealth.
+//
+// The health service reports the status of the server as a whole under the
+// service name "plugin", and the status of each protocol version the server
+// is serving under the name returned by HealthServiceName, so that a server
+// serving several versions at once can stop serving one of them without
+// appearing to its other clients to have failed.
+type ServerHealth struct {
+	server *health.Server
+
+	mu       sync.Mutex
+	serving  bool
+	versions map[int]bool
+}
+
+// NewServerHealth returns a ServerHealth for use as ServerConfig.Health,
+// which reports that the server and all of its protocol versions are
+// serving until plugin code says otherwise.
+//
+// Statuses set before the server starts take effect once it does. A
+// ServerHealth must not be used by more than one server at a time.
+func NewServerHealth() *ServerHealth {
+	return &ServerHealth{serving: true}
+}
+
+// bind connects h to the health service of a server serving the given
+// protocol versions, and reports its current statuses there.
+func (h *ServerHealth) bind(server *health.Server, versions []int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	served := make(map[int]bool, len(versions))
+	for _, v := range versions {
+		serving, ok := h.versions[v]
+		served[v] = serving || !ok
+	}
+	h.server = server
+	h.versions = served
+	h.update()
+}
+
+// HealthServiceName returns the service name under which the health service
+// of a plugin server reports the status of the given protocol version, for
+// use in health check requests made by tools other than rpcplugin clients.
+func HealthServiceName(version int) string {
+	return grpcServiceName + ".v" + strconv.Itoa(version)
+}
+
+// ContextServerHealth returns the ServerHealth object for the plugin server
+// that is handling the request the given context belongs to.
+//
+// The given context must be one passed by the RPC server to a handler
+// function in the plugin server; if not, the result is nil. The returned
+// object remains valid after the handler returns, so plugin code can retain
+// it to report its status later.
+func ContextServerHealth(ctx context.Context) *ServerHealth {
+	sc := contextServerContext(ctx)
+	if sc == nil {
+		return nil
+	}
+	return sc.health
+}
+
+// SetServing sets whether the plugin server is currently able to handle
+// requests. While it is not, all of its protocol versions are reported as
+// not serving too.
+func (h *ServerHealth) SetServing(serving bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.serving = serving
+	h.update()
+}
+
+// SetVersionServing sets whether the plugin server is currently able to
+// handle requests using the given protocol version, without affecting the
+// status of the server as a whole or of its other versions. It has no effect
+// if the server isn't serving the given version.
+func (h *ServerHealth) SetVersionServing(version int, serving bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.server == nil {
+		// The server hasn't started yet, so we don't know which versions
+		// it will serve. bind discards the others.
+		if h.versions == nil {
+			h.versions = make(map[int]bool)
+		}
+		h.versions[version] = serving
+		return
+	}
+	if _, ok := h.versions[version]; !ok {
+		return
+	}
+	h.versions[version] = serving
+	h.update()
+}
+
+// update reports the current statuses to the health service, if h is bound
+// to one yet. The caller must hold h.mu.
+func (h *ServerHealth) update() {
+	if h.server == nil {
+		return
+	}
+	h.server.SetServingStatus(grpcServiceName, healthStatus(h.serving))
+	for v, serving := range h.versions {
+		h.server.SetServingStatus(HealthServiceName(v), healthStatus(h.serving && serving))
+	}
+}
+
+func healthStatus(serving bool) grpc_health_v1.HealthCheckResponse_ServingStatus {
+	if serving {
+		return grpc_health_v1.HealthCheckResponse_SERVING
+	}
+	return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+}
@@ -0,0 +1,288 @@
+package rpcplugin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/apparentlymart/go-ctxenv/ctxenv"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// hostServicesEnvName is the environment variable the client uses to tell
+// the plugin server where to find the host services server, if any. Its
+// value is a network name and an address separated by a pipe character, in
+// the same way as those fields appear in the handshake line.
+const hostServicesEnvName = "PLUGIN_HOST_SERVICES"
+
+// HostServicesConn returns the connection to the services that the plugin
+// host offers for the plugin server to call back into, or nil if the host
+// didn't offer any.
+//
+// The given context must be one passed by the RPC server to a handler
+// function in the plugin server; the connection is not available in any
+// other context.
+func HostServicesConn(ctx context.Context) *grpc.ClientConn {
+	sc := contextServerContext(ctx)
+	if sc == nil {
+		return nil
+	}
+	return sc.hostConn
+}
+
+// hostServer is the client side of the host services mechanism: an RPC
+// server that the host runs alongside its plugin so that the plugin can
+// call back into it.
+type hostServer struct {
+	grpcServer *grpc.Server
+	listener   net.Listener
+
+	// clientCAs is the pool of certificates the plugin may use to
+	// authenticate when calling into host services, when the client has an
+	// explicit TLS configuration. (Automatically-negotiated credentials
+	// track the trusted certificates themselves.) If the client has no root
+	// certificates configured then this isn't known until the handshake is
+	// complete, so it's populated later and any connections made before
+	// that will fail and be retried by the plugin's RPC client.
+	clientCAs atomic.Value // *x509.CertPool
+}
+
+// startHostServer starts an RPC server for the host services described by
+// the given registration hook, and returns it along with the environment
+// variable that tells the plugin server how to reach it.
+//
+// If the server listens on a Unix domain socket then sock describes the
+// permissions and ownership to give it.
+//
+// If multiplexed is true then the server doesn't listen on a socket of its
+// own, and instead the caller must pass it each multiplexed session with
+// the plugin server using ServeSession.
+//
+// The host server uses the same certificates as the client uses for the main
+// RPC channel, with the roles reversed: the client's certificate becomes the
+// server certificate, and the plugin must present a certificate that would
+// be accepted as a server certificate on the main channel. If creds is not
+// nil then it is the source of these credentials, and is used instead of
+// tlsConfig so that the credentials remain current as they change. If both
+// are nil then TLS is disabled.
+// Otherwise, verifyPeer is an optional additional check of the plugin's
+// certificate chain.
+func startHostServer(ctx context.Context, services ServerVersion, tlsConfig *tls.Config, creds tlsCredentials, verifyPeer func([]*x509.Certificate) error, sock unixSocketConfig, bind tcpBindConfig, multiplexed bool) (*hostServer, string, error) {
+	ret := &hostServer{}
+	var serverTLS *tls.Config
+	switch {
+	case creds != nil:
+		serverTLS = creds.ServerTLSConfig()
+	case tlsConfig == nil:
+		// TLS is disabled, so the host services don't use it either.
+	default:
+		if tlsConfig.RootCAs != nil {
+			ret.clientCAs.Store(tlsConfig.RootCAs)
+		}
+		serverTLS = &tls.Config{
+			Certificates:     tlsConfig.Certificates,
+			GetCertificate:   clientCertAsServerCert(tlsConfig),
+			ClientAuth:       tls.RequireAnyClientCert,
+			MinVersion:       hostServicesMinTLSVersion(tlsConfig),
+			CipherSuites:     tlsConfig.CipherSuites,
+			CurvePreferences: tlsConfig.CurvePreferences,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				pool, _ := ret.clientCAs.Load().(*x509.CertPool)
+				if pool == nil {
+					return fmt.Errorf("plugin server handshake is not yet complete")
+				}
+				return verifyPeerCertChain(rawCerts, pool, verifyPeer)
+			},
+		}
+	}
+
+	var opts []grpc.ServerOption
+	if serverTLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(serverTLS)))
+	}
+	ret.grpcServer = grpc.NewServer(opts...)
+	err := services.RegisterServer(ret.grpcServer)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to register host services: %s", err)
+	}
+
+	if multiplexed {
+		env := fmt.Sprintf("%s=%s|", hostServicesEnvName, hostServicesMultiplexed)
+		return ret, env, nil
+	}
+
+	listener, err := hostServicesListen(ctx, sock, bind)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot start host services server: %s", err)
+	}
+	ret.listener = listener
+	go ret.grpcServer.Serve(listener)
+
+	env := fmt.Sprintf("%s=%s|%s", hostServicesEnvName, listener.Addr().Network(), listener.Addr().String())
+	return ret, env, nil
+}
+
+// ServeSession accepts connections from the plugin server via streams
+// it opens in the given multiplexed session.
+func (s *hostServer) ServeSession(session net.Listener) {
+	go s.grpcServer.Serve(session)
+}
+
+// TrustClientCAs sets the pool of certificates that the plugin server may
+// use to authenticate its calls to the host services.
+func (s *hostServer) TrustClientCAs(pool *x509.CertPool) {
+	s.clientCAs.Store(pool)
+}
+
+// Stop immediately terminates the host services server, closing any active
+// connections and its listen socket.
+func (s *hostServer) Stop() {
+	s.grpcServer.Stop()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+func hostServicesListen(ctx context.Context, sock unixSocketConfig, bind tcpBindConfig) (net.Listener, error) {
+	l, err := serverListenUnix(ctx, sock)
+	if err == nil {
+		return l, nil
+	}
+	return serverListenTCP(ctx, bind, false)
+}
+
+// hostServicesMinTLSVersion returns the minimum TLS version to use for host
+// services when the main RPC channel uses the given explicit configuration,
+// which is the greater of TLS 1.2 and the main channel's minimum version.
+func hostServicesMinTLSVersion(tlsConfig *tls.Config) uint16 {
+	if tlsConfig.MinVersion > tls.VersionTLS12 {
+		return tlsConfig.MinVersion
+	}
+	return tls.VersionTLS12
+}
+
+// verifyPeerCertChain verifies a raw certificate chain presented by a peer
+// against the given pool of trusted certificates.
+//
+// Host services reverse the client and server roles of the certificates
+// used on the main RPC channel, so this accepts any extended key usage
+// rather than requiring the usage that would be appropriate for each role.
+//
+// If verify is not nil, it is called with the peer's certificate chain once
+// the chain has been verified, to make any additional checks.
+func verifyPeerCertChain(rawCerts [][]byte, roots *x509.CertPool, verify func([]*x509.Certificate) error) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("peer did not present a certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("invalid peer certificate: %s", err)
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return err
+	}
+	if verify != nil {
+		return verify(certs)
+	}
+	return nil
+}
+
+// dialHostServices is the server side of the host services mechanism. If
+// the client announced host services in its environment, dialHostServices
+// returns a connection to them, or nil if there are none.
+//
+// The connection uses the server's own TLS configuration with the roles
+// reversed, so the server's certificate authenticates it to the host and
+// the certificates it would trust from clients are used to verify the host.
+//
+// If creds is not nil then it is the source of the server's credentials,
+// which is used instead of tlsConfig so that they remain current as they
+// change. Otherwise, verifyPeer is an optional additional
+// check of the host's certificate chain.
+//
+// If the client and server negotiated multiplexing then mux is the
+// multiplexing listener, which the client may ask us to use to reach the
+// host services. Otherwise, mux is nil.
+func dialHostServices(ctx context.Context, tlsConfig *tls.Config, creds tlsCredentials, verifyPeer func([]*x509.Certificate) error, compressor string, mux *muxListener) (*grpc.ClientConn, error) {
+	spec := ctxenv.Getenv(ctx, hostServicesEnvName)
+	if spec == "" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(spec, "|", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid %s value %q", hostServicesEnvName, spec)
+	}
+	var dial func(ctx context.Context) (net.Conn, error)
+	switch parts[0] {
+	case "tcp", "unix":
+		network := parts[0]
+		addr := parts[1]
+		dial = func(ctx context.Context) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		}
+	case hostServicesMultiplexed:
+		if mux == nil {
+			return nil, fmt.Errorf("host services require connection multiplexing, which was not negotiated")
+		}
+		dial = mux.OpenStream
+	default:
+		return nil, fmt.Errorf("unsupported host services transport %q", parts[0])
+	}
+
+	transportCreds := grpc.WithInsecure()
+	switch {
+	case creds != nil:
+		transportCreds = grpc.WithTransportCredentials(credentials.NewTLS(creds.ClientTLSConfig()))
+	case tlsConfig != nil:
+		roots := tlsConfig.ClientCAs
+		transportCreds = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			Certificates:         tlsConfig.Certificates,
+			GetClientCertificate: serverCertAsClientCert(tlsConfig),
+			MinVersion:           hostServicesMinTLSVersion(tlsConfig),
+			CipherSuites:         tlsConfig.CipherSuites,
+			CurvePreferences:     tlsConfig.CurvePreferences,
+
+			// The host's certificate was issued for use as a client
+			// certificate, so the standard verification for server
+			// certificates isn't appropriate. We verify it ourselves below.
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				return verifyPeerCertChain(rawCerts, roots, verifyPeer)
+			},
+		}))
+	}
+
+	opts := []grpc.DialOption{
+		transportCreds,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return dial(ctx)
+		}),
+	}
+	if compressor != "" {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.UseCompressor(compressor)))
+	}
+	return grpc.DialContext(
+		ctx, "", // address string is unused because dial selects the address
+		opts...,
+	)
+}
@@ -0,0 +1,219 @@
+package rpcplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// inProcessBufferSize is the size of the buffer of each in-memory connection
+// to an in-process plugin server.
+const inProcessBufferSize = 256 * 1024
+
+// inProcessAddr is the address reported for an in-process plugin server,
+// which has no real network address.
+type inProcessAddr struct{}
+
+func (inProcessAddr) Network() string { return "inprocess" }
+func (inProcessAddr) String() string  { return "in-process" }
+
+// inProcessServer is a plugin server running within the client process, for
+// a plugin created using ClientConfig.InProcess.
+type inProcessServer struct {
+	srv      *serverGRPC
+	listener *bufconn.Listener
+	drain    time.Duration
+
+	// host and hostConn serve the client's host services, if any.
+	host     *grpc.Server
+	hostConn *grpc.ClientConn
+
+	stopOnce sync.Once
+	exited   chan struct{}
+}
+
+// newInProcess is the implementation of New for a ClientConfig with
+// InProcess set.
+func newInProcess(ctx context.Context, config *ClientConfig) (*Plugin, error) {
+	srvConfig := config.InProcess
+	if config.Cmd != nil {
+		return nil, fmt.Errorf("config fields InProcess and Cmd are mutually exclusive")
+	}
+	if config.Runner != nil {
+		return nil, fmt.Errorf("config fields InProcess and Runner are mutually exclusive")
+	}
+	if config.Terminal != nil {
+		return nil, fmt.Errorf("config fields InProcess and Terminal are mutually exclusive")
+	}
+	if len(config.ProtoVersions) == 0 {
+		return nil, fmt.Errorf("config field ProtoVersions must have at least one version")
+	}
+	if err := checkCompressor("Compressor", config.Compressor); err != nil {
+		return nil, err
+	}
+
+	// There is no handshake, so we negotiate the protocol version directly
+	// in the same way that a separate server would.
+	accept := serverVersionAcceptor(srvConfig.VersionPolicy, config.ProtoMinorVersions, srvConfig.ProtoMinorVersions)
+	version := -1
+	for v := range config.ProtoVersions {
+		if _, ok := srvConfig.ProtoVersions[v]; ok && v > version && (accept == nil || accept(v)) {
+			version = v
+		}
+	}
+	if version < 0 {
+		clientVersions := make([]int, 0, len(config.ProtoVersions))
+		for v := range config.ProtoVersions {
+			clientVersions = append(clientVersions, v)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(clientVersions)))
+		serverVersions := make([]int, 0, len(srvConfig.ProtoVersions))
+		for v := range srvConfig.ProtoVersions {
+			serverVersions = append(serverVersions, v)
+		}
+		sort.Ints(serverVersions)
+		return nil, &NoCommonProtoVersionError{
+			ClientVersions: clientVersions,
+			ServerVersions: serverVersions,
+		}
+	}
+	minorVersion := selectMinorVersion(config.ProtoMinorVersions[version], srvConfig.ProtoMinorVersions[version])
+	var caps Capabilities
+	for _, name := range config.Capabilities {
+		if Capabilities(srvConfig.Capabilities).Has(name) && !caps.Has(name) {
+			caps = append(caps, name)
+		}
+	}
+
+	tracer := plugintrace.ContextClientTracer(ctx)
+	srvTracer := plugintrace.ContextServerTracer(ctx)
+	ip := &inProcessServer{
+		listener: bufconn.Listen(inProcessBufferSize),
+		drain:    srvConfig.DrainTimeout,
+		exited:   make(chan struct{}),
+	}
+	if ip.drain == 0 {
+		ip.drain = defaultDrainTimeout
+	}
+
+	if config.HostServices != nil {
+		ip.host = grpc.NewServer()
+		err := config.HostServices.RegisterServer(ip.host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to register host services: %s", err)
+		}
+		hostListener := bufconn.Listen(inProcessBufferSize)
+		go ip.host.Serve(hostListener)
+		ip.hostConn, err = grpc.DialContext(
+			ctx, "",
+			grpc.WithInsecure(),
+			grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+				return hostListener.Dial()
+			}),
+		)
+		if err != nil {
+			ip.host.Stop()
+			return nil, fmt.Errorf("cannot connect to host services: %s", err)
+		}
+	}
+
+	unaryInts := srvConfig.UnaryInterceptors
+	streamInts := srvConfig.StreamInterceptors
+	if srvConfig.RecoverPanics {
+		unaryInts = append([]grpc.UnaryServerInterceptor{RecoverPanicsUnaryInterceptor(srvTracer.HandlerPanicked)}, unaryInts...)
+		streamInts = append([]grpc.StreamServerInterceptor{RecoverPanicsStreamInterceptor(srvTracer.HandlerPanicked)}, streamInts...)
+	}
+	if srvConfig.TraceCalls && srvTracer.CallCompleted != nil {
+		unaryInts = append([]grpc.UnaryServerInterceptor{serverCallTraceUnaryInterceptor(srvTracer.CallCompleted)}, unaryInts...)
+		streamInts = append([]grpc.StreamServerInterceptor{serverCallTraceStreamInterceptor(srvTracer.CallCompleted)}, streamInts...)
+	}
+	ip.srv = &serverGRPC{
+		Server:   srvConfig.ProtoVersions[version],
+		Common:   srvConfig.CommonServices,
+		HostConn: ip.hostConn,
+		Tracer:   srvTracer,
+		Health:   srvConfig.Health,
+		Done: func() {
+			// The client asked the server to shut down, or the server has
+			// stopped for some other reason.
+			go ip.stop()
+		},
+
+		Options:            srvConfig.grpcServerOptions(),
+		UnaryInterceptors:  unaryInts,
+		StreamInterceptors: streamInts,
+		Reflection:         srvConfig.Reflection,
+		Metadata:           srvConfig.Metadata,
+		Capabilities:       caps,
+		ProtoVersion:       ProtocolVersion{Major: version, Minor: minorVersion},
+	}
+	err := ip.srv.Init(nil)
+	if err != nil {
+		if ip.host != nil {
+			ip.hostConn.Close()
+			ip.host.Stop()
+		}
+		return nil, fmt.Errorf("plugin server init failed: %s", err)
+	}
+	go func() {
+		ip.srv.Serve(ip.listener)
+		close(ip.exited)
+	}()
+	if srvTracer.Listening != nil {
+		srvTracer.Listening(inProcessAddr{}, nil, version)
+	}
+
+	ret := &Plugin{
+		protoVersion:      version,
+		rpcProtocol:       "grpc",
+		cv:                config.ProtoVersions[version],
+		addr:              inProcessAddr{},
+		inProcess:         ip,
+		exit:              ip.exited,
+		tracer:            tracer,
+		instance:          plugintrace.Instance{ID: nextPluginID()},
+		metadata:          srvConfig.Metadata,
+		metadataFetched:   true,
+		capabilities:      caps,
+		protoMinorVersion: minorVersion,
+		traceCalls:        config.TraceCalls,
+		compressor:        config.Compressor,
+		callTimeout:       config.DefaultCallTimeout,
+		blockReady:        config.BlockUntilReady,
+		waitReady:         config.WaitForReady,
+		rpcStats:          newRPCStats(),
+		startedAt:         time.Now(),
+	}
+	if set, ok := srvConfig.ProtoVersions[version].(ServerPluginSet); ok {
+		ret.plugins = set.names()
+	}
+	if config.HealthCheck != nil {
+		ret.startHealthCheck(*config.HealthCheck)
+	}
+	return ret, nil
+}
+
+// Dial opens a new in-memory connection to the server.
+func (s *inProcessServer) Dial() (net.Conn, error) {
+	return s.listener.Dial()
+}
+
+// stop stops the server, giving requests in progress a chance to complete,
+// and waits for it to exit.
+func (s *inProcessServer) stop() {
+	s.stopOnce.Do(func() {
+		s.srv.Stop(s.drain)
+		if s.host != nil {
+			s.hostConn.Close()
+			s.host.Stop()
+		}
+	})
+	<-s.exited
+}
@@ -0,0 +1,60 @@
+package rpcplugin
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// The version of grpc-go we depend on allows only a single interceptor of
+// each type per server or client connection, and so these helpers combine
+// several interceptors into one.
+
+// chainUnaryServerInterceptors returns a single interceptor that calls each
+// of the given interceptors in turn, with the first one outermost. Returns
+// nil if there are no interceptors.
+func chainUnaryServerInterceptors(interceptors []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	switch len(interceptors) {
+	case 0:
+		return nil
+	case 1:
+		return interceptors[0]
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return interceptors[0](ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return chainUnaryServerInterceptors(interceptors[1:])(ctx, req, info, handler)
+		})
+	}
+}
+
+// chainStreamServerInterceptors is the stream interceptor equivalent of
+// chainUnaryServerInterceptors.
+func chainStreamServerInterceptors(interceptors []grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	switch len(interceptors) {
+	case 0:
+		return nil
+	case 1:
+		return interceptors[0]
+	}
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return interceptors[0](srv, ss, info, func(srv interface{}, ss grpc.ServerStream) error {
+			return chainStreamServerInterceptors(interceptors[1:])(srv, ss, info, handler)
+		})
+	}
+}
+
+// chainUnaryClientInterceptors is the client interceptor equivalent of
+// chainUnaryServerInterceptors.
+func chainUnaryClientInterceptors(interceptors []grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+	switch len(interceptors) {
+	case 0:
+		return nil
+	case 1:
+		return interceptors[0]
+	}
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return interceptors[0](ctx, method, req, reply, cc, func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			return chainUnaryClientInterceptors(interceptors[1:])(ctx, method, req, reply, cc, invoker, opts...)
+		}, opts...)
+	}
+}
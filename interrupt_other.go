@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package rpcplugin
+
+import (
+	"os/exec"
+	"time"
+)
+
+// prepareInterruptShutdown configures the given not-yet-started command so
+// that the client can later ask it to shut down using interruptShutdown,
+// and returns the environment variables to set for it.
+//
+// This is currently implemented only on Windows, where the plugin server
+// has no other way to shut down gracefully if it doesn't support the
+// Shutdown method of the control service. On other platforms the command
+// is left unchanged.
+func prepareInterruptShutdown(cmd *exec.Cmd) []string {
+	return nil
+}
+
+// interruptShutdown asks the plugin server to shut down using an interrupt
+// signal. On this platform it always returns false, so that the caller will
+// kill the server.
+func (p *Plugin) interruptShutdown(timeout time.Duration) bool {
+	return false
+}
@@ -0,0 +1,54 @@
+package rpcplugin
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+var generateConsoleCtrlEvent = syscall.NewLazyDLL("kernel32.dll").NewProc("GenerateConsoleCtrlEvent")
+
+// prepareInterruptShutdown configures the given not-yet-started command so
+// that the client can later ask it to shut down using interruptShutdown,
+// and returns the environment variables to set for it.
+//
+// On Windows we start the server in its own process group so that we can
+// send a CTRL_BREAK_EVENT to it alone. That also means it won't receive
+// the interrupts a user sends to the host program's console, and so the
+// server can treat any interrupt as a request to shut down.
+func prepareInterruptShutdown(cmd *exec.Cmd) []string {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+	return []string{fmt.Sprintf("%s=1", interruptShutdownEnvName)}
+}
+
+// interruptShutdown asks the plugin server to shut down by sending a
+// CTRL_BREAK_EVENT to its process group, and waits up to the given time for
+// it to exit.
+//
+// Returns true if the server process exited, or false if the caller must
+// still kill it.
+func (p *Plugin) interruptShutdown(timeout time.Duration) bool {
+	if p.process == nil {
+		// Only a child process that we started shares our console.
+		return false
+	}
+	r, _, _ := generateConsoleCtrlEvent.Call(syscall.CTRL_BREAK_EVENT, uintptr(p.process.Pid))
+	if r == 0 {
+		// The call fails if the server doesn't share our console, such as
+		// if the client isn't running in a console at all.
+		return false
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.exit:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,100 @@
+package rpcplugin
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// staleSocketMinAge is the minimum age of the socket directories that a
+// Manager removes automatically, so that it never races with a server that
+// has created its directory but not yet started listening.
+const staleSocketMinAge = time.Minute
+
+// CleanStaleSockets removes the temporary directories that plugin servers
+// created for their Unix domain sockets but never removed, because the
+// servers were killed or crashed before they could clean up after
+// themselves. It returns the paths of the directories it removed.
+//
+// CleanStaleSockets looks for directories whose names begin with
+// "rpcplugin" in the given directory, or if dir is empty, in the default
+// locations that plugin servers use: $XDG_RUNTIME_DIR, if set, and the
+// system's temporary directory. It removes only directories older than
+// minAge that are empty or contain only a socket that no server is
+// listening on, and ignores any it cannot remove, such as those belonging
+// to other users.
+func CleanStaleSockets(dir string, minAge time.Duration) ([]string, error) {
+	dirs := []string{dir}
+	if dir == "" {
+		dirs = defaultSocketBaseDirs()
+	}
+	var removed []string
+	for _, base := range dirs {
+		entries, err := ioutil.ReadDir(base)
+		if err != nil {
+			if dir == "" && os.IsNotExist(err) {
+				continue
+			}
+			return removed, fmt.Errorf("failed to read %s: %w", base, err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "rpcplugin") {
+				continue
+			}
+			if time.Since(entry.ModTime()) < minAge {
+				continue
+			}
+			path := filepath.Join(base, entry.Name())
+			if !staleSocketDir(path) {
+				continue
+			}
+			if err := os.RemoveAll(path); err == nil {
+				removed = append(removed, path)
+			}
+		}
+	}
+	return removed, nil
+}
+
+// defaultSocketBaseDirs returns the directories in which plugin servers
+// create their socket directories when the client doesn't choose one.
+func defaultSocketBaseDirs() []string {
+	var ret []string
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" && filepath.IsAbs(runtimeDir) {
+		ret = append(ret, runtimeDir)
+	}
+	return append(ret, os.TempDir())
+}
+
+// staleSocketDir returns true if the given directory looks like one that a
+// plugin server created for its socket and is no longer using.
+func staleSocketDir(path string) bool {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return false
+	}
+	switch {
+	case len(entries) == 0:
+		return true
+	case len(entries) > 1:
+		return false
+	case entries[0].Name() != "server.sock" || entries[0].Mode()&os.ModeSocket == 0:
+		return false
+	}
+
+	conn, err := net.DialTimeout("unix", filepath.Join(path, "server.sock"), time.Second)
+	if err == nil {
+		// A server is still listening.
+		conn.Close()
+		return false
+	}
+	// Other errors, such as a lack of permission, say nothing about whether
+	// the socket is in use.
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
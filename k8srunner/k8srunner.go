@@ -0,0 +1,460 @@
+// Package k8srunner runs rpcplugin plugin servers as pods in a Kubernetes
+// cluster, using the kubectl command line tool, so that control-plane
+// applications can treat workloads in the cluster as plugins.
+//
+// The runner creates a pod that runs the plugin server, reads the server's
+// handshake from the pod's logs, and connects to the server through a port
+// forwarded from the local host to the pod by "kubectl port-forward". The
+// plugin server therefore needs no network exposure beyond the pod's own
+// loopback interface.
+package k8srunner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.rpcplugin.org/rpcplugin"
+)
+
+// Runner describes how to run a plugin server as a Kubernetes pod.
+type Runner struct {
+	// Kubectl is the kubectl program to use, either as a command name or a
+	// path. If it is empty, it defaults to "kubectl".
+	Kubectl string
+
+	// KubectlArgs gives options to pass to every kubectl command the runner
+	// runs, such as "--kubeconfig" or "--context".
+	KubectlArgs []string
+
+	// Namespace is the namespace in which to create the pod. If it is empty,
+	// kubectl uses the namespace of its current context.
+	Namespace string
+
+	// Image is the container image to run.
+	Image string
+
+	// Command, if set, overrides the image's entrypoint with the given
+	// program and arguments for running the plugin server.
+	Command []string
+
+	// Env gives additional environment variables for the pod, in the
+	// "KEY=value" form of exec.Cmd.Env. The pod doesn't inherit the
+	// environment of the host application.
+	Env []string
+
+	// RunArgs gives additional options for "kubectl run", such as
+	// "--labels" or "--overrides" to customize the pod specification. The
+	// runner uses "kubectl run" only to generate the pod's manifest, and
+	// creates the pod itself with "kubectl create".
+	RunArgs []string
+}
+
+// defaultHandshakePreamble is the value the runner uses for
+// ClientConfig.MaxHandshakePreamble if it isn't set, because the pod logs
+// include the plugin server's stderr output as well as its stdout.
+const defaultHandshakePreamble = 64 * 1024
+
+// New creates a pod to run the plugin server, using the given configuration
+// for everything other than launching the server, and returns an object
+// representing the plugin once the server has completed its handshake.
+//
+// The runner sets config.Runner and config.Dial itself, so they must be nil,
+// as must config.Cmd. It connects through a forwarded port, and so restricts
+// config.Transports to "tcp". config.InProcess, config.Terminal,
+// config.HostServices, and config.ClientCertFile are not supported, because
+// the pod cannot reach the host application's process or files.
+//
+// config.StartTimeout must allow for the time the cluster takes to
+// schedule the pod and pull its image. The environment variables for the
+// plugin server, including the handshake cookie, are part of the pod's
+// specification, and so are visible to anyone who can read the pod.
+//
+// The pod is deleted once the plugin server exits, including when the plugin
+// is closed.
+//
+// As for rpcplugin.New, the caller must no longer access or modify config
+// once it has been passed to New.
+func (r *Runner) New(ctx context.Context, config *rpcplugin.ClientConfig) (*rpcplugin.Plugin, error) {
+	switch {
+	case r.Image == "":
+		return nil, fmt.Errorf("Runner.Image must be set")
+	case config.Cmd != nil:
+		return nil, fmt.Errorf("config field Cmd must be nil, because the runner runs the plugin server")
+	case config.Runner != nil:
+		return nil, fmt.Errorf("config field Runner must be nil, because the runner sets it")
+	case config.Dial != nil:
+		return nil, fmt.Errorf("config field Dial must be nil, because the runner sets it")
+	case config.InProcess != nil:
+		return nil, fmt.Errorf("config field InProcess is not supported for pods")
+	case config.Terminal != nil:
+		return nil, fmt.Errorf("config field Terminal is not supported for pods")
+	case config.HostServices != nil:
+		return nil, fmt.Errorf("config field HostServices is not supported for pods")
+	case config.ClientCertFile:
+		return nil, fmt.Errorf("config field ClientCertFile is not supported for pods")
+	}
+	prog := r.Kubectl
+	if prog == "" {
+		prog = "kubectl"
+	}
+	path, err := exec.LookPath(prog)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find kubectl: %w", err)
+	}
+	k := &kubectl{path: path, args: r.KubectlArgs}
+	if r.Namespace != "" {
+		k.args = append(k.args[:len(k.args):len(k.args)], "--namespace", r.Namespace)
+	}
+	name, err := podName()
+	if err != nil {
+		return nil, err
+	}
+	startTimeout := config.StartTimeout
+	if startTimeout == 0 {
+		startTimeout = time.Minute
+	}
+
+	p := &pod{
+		runner:       r,
+		kubectl:      k,
+		name:         name,
+		cookieKey:    config.Handshake.CookieKey,
+		startTimeout: startTimeout,
+		forward:      &portForwarder{kubectl: k, pod: name},
+	}
+	config.Runner = p
+	config.Dial = p.forward.Dial
+	config.Transports = []string{"tcp"}
+	if config.MaxHandshakePreamble == 0 {
+		config.MaxHandshakePreamble = defaultHandshakePreamble
+	}
+
+	plugin, err := rpcplugin.New(ctx, config)
+	if err != nil {
+		// If the pod was created then it is being deleted already, but
+		// we'd rather not return before it's gone.
+		p.remove()
+		return nil, err
+	}
+	return plugin, nil
+}
+
+// runArgs returns the kubectl arguments for generating the pod's manifest,
+// to which the runner then adds the plugin server's environment variables.
+func (r *Runner) runArgs(pod string) []string {
+	args := []string{
+		"run", pod,
+		"--image", r.Image,
+		"--restart", "Never",
+		"--dry-run=client",
+		"--output", "json",
+	}
+	args = append(args, r.RunArgs...)
+	if len(r.Command) != 0 {
+		args = append(args, "--command", "--")
+		args = append(args, r.Command...)
+	}
+	return args
+}
+
+// pod is the rpcplugin.ProcessRunner for one plugin server pod. It reads the
+// server's handshake by following the pod's logs with kubectl in a child
+// process, which exits when the plugin server does.
+type pod struct {
+	runner       *Runner
+	kubectl      *kubectl
+	name         string
+	cookieKey    string
+	startTimeout time.Duration
+	forward      *portForwarder
+
+	created    bool
+	logs       *exec.Cmd
+	removeOnce sync.Once
+}
+
+var _ rpcplugin.ProcessRunner = (*pod)(nil)
+
+func (p *pod) Start(ctx context.Context, env []string, stderr io.Writer) (io.ReadCloser, error) {
+	if p.created {
+		return nil, fmt.Errorf("plugin server already started")
+	}
+	if err := p.create(env); err != nil {
+		return nil, err
+	}
+
+	logs := p.kubectl.command(
+		"logs", "--follow",
+		"--pod-running-timeout", p.startTimeout.String(),
+		"pod/"+p.name,
+	)
+	logs.Stderr = stderr
+	// The pipe is our own, rather than from StdoutPipe, because the client
+	// may still be reading the handshake when kubectl exits and Wait
+	// returns.
+	stdout, stdoutW, err := os.Pipe()
+	if err != nil {
+		p.remove()
+		return nil, fmt.Errorf("cannot create stdout pipe: %w", err)
+	}
+	defer stdoutW.Close()
+	logs.Stdout = stdoutW
+	if err := logs.Start(); err != nil {
+		stdout.Close()
+		p.remove()
+		return nil, fmt.Errorf("failed to start kubectl logs: %w", err)
+	}
+	p.logs = logs
+	return stdout, nil
+}
+
+// create creates the pod, with the rpcplugin protocol's variables from the
+// given environment.
+//
+// The environment variables are added to the manifest that "kubectl run"
+// generates, which then reaches "kubectl create" on its stdin, rather than
+// being given as "--env" options, so that their values, including the
+// handshake cookie, never appear in a kubectl command line.
+func (p *pod) create(env []string) error {
+	gen := p.kubectl.command(p.runner.runArgs(p.name)...)
+	var stderr bytes.Buffer
+	gen.Stderr = &stderr
+	out, err := gen.Output()
+	if err != nil {
+		return fmt.Errorf("failed to generate manifest for pod %s: %s", p.name, strings.TrimSpace(stderr.String()))
+	}
+	var manifest map[string]interface{}
+	if err := json.Unmarshal(out, &manifest); err != nil {
+		return fmt.Errorf("failed to parse manifest for pod %s: %w", p.name, err)
+	}
+	spec, _ := manifest["spec"].(map[string]interface{})
+	containers, _ := spec["containers"].([]interface{})
+	if len(containers) != 1 {
+		return fmt.Errorf("manifest for pod %s has %d containers, but must have exactly one", p.name, len(containers))
+	}
+	container, ok := containers[0].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("manifest for pod %s has an invalid container", p.name)
+	}
+	vars, _ := container["env"].([]interface{})
+	addEnv := func(kv string) {
+		k, v := kv, ""
+		if i := strings.Index(kv, "="); i >= 0 {
+			k, v = kv[:i], kv[i+1:]
+		}
+		vars = append(vars, map[string]interface{}{"name": k, "value": v})
+	}
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PLUGIN_") || strings.HasPrefix(kv, p.cookieKey+"=") {
+			addEnv(kv)
+		}
+	}
+	for _, kv := range p.runner.Env {
+		addEnv(kv)
+	}
+	container["env"] = vars
+	in, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to generate manifest for pod %s: %w", p.name, err)
+	}
+
+	create := p.kubectl.command("create", "--filename", "-")
+	create.Stdin = bytes.NewReader(in)
+	out, err = create.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to create pod %s: %s", p.name, strings.TrimSpace(string(out)))
+	}
+	p.created = true
+	return nil
+}
+
+// Signal implements rpcplugin.ProcessRunner. Kubernetes cannot deliver
+// signals to a pod's processes, so Signal supports only os.Kill, for which it
+// deletes the pod.
+func (p *pod) Signal(sig os.Signal) error {
+	if sig != os.Kill {
+		return fmt.Errorf("cannot send signal %s to a pod", sig)
+	}
+	err := p.logs.Process.Kill()
+	if delErr := p.kubectl.deletePod(p.name); delErr != nil && err == nil {
+		err = delErr
+	}
+	return err
+}
+
+// Wait implements rpcplugin.ProcessRunner. The plugin server isn't a process
+// on the local host, and so Wait never returns a process state.
+func (p *pod) Wait() (*os.ProcessState, error) {
+	// kubectl exiting unsuccessfully, as it does if the pod fails, isn't a
+	// failure to wait for it.
+	if err := p.logs.Wait(); p.logs.ProcessState == nil {
+		return nil, err
+	}
+	p.remove()
+	return nil, nil
+}
+
+// remove stops forwarding the plugin server's port and deletes its pod. The
+// plugin server has usually exited by now, but the pod remains until it's
+// deleted.
+func (p *pod) remove() {
+	p.removeOnce.Do(func() {
+		p.forward.Close()
+		if p.created {
+			p.kubectl.deletePod(p.name)
+		}
+	})
+}
+
+// kubectl runs kubectl commands with a fixed set of global options.
+type kubectl struct {
+	path string
+	args []string
+}
+
+func (k *kubectl) command(args ...string) *exec.Cmd {
+	all := make([]string, 0, len(k.args)+len(args))
+	all = append(all, k.args...)
+	all = append(all, args...)
+	return exec.Command(k.path, all...)
+}
+
+func (k *kubectl) deletePod(pod string) error {
+	out, err := k.command("delete", "pod", pod, "--ignore-not-found", "--wait=false").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to delete pod %s: %s", pod, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// forwardingRe matches the line "kubectl port-forward" writes once it is
+// listening, capturing the local address.
+var forwardingRe = regexp.MustCompile(`^Forwarding from (\S+) -> `)
+
+// portForwarder runs "kubectl port-forward" to forward a local port to the
+// plugin server's port in its pod, starting it when the client first
+// connects and restarting it if it exits.
+type portForwarder struct {
+	kubectl *kubectl
+	pod     string
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	port   int
+	local  string
+	exited chan struct{}
+	closed bool
+}
+
+// Dial connects to the given address in the pod through the forwarded port.
+func (f *portForwarder) Dial(ctx context.Context, addr net.Addr) (net.Conn, error) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("cannot forward a connection to %s address %s", addr.Network(), addr)
+	}
+	local, err := f.localAddr(ctx, tcpAddr.Port)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", local)
+}
+
+// localAddr returns the local address forwarded to the given port in the
+// pod, starting kubectl if necessary.
+func (f *portForwarder) localAddr(ctx context.Context, port int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return "", fmt.Errorf("port forwarding is closed")
+	}
+	if f.cmd != nil && f.port == port {
+		select {
+		case <-f.exited:
+		default:
+			return f.local, nil
+		}
+	}
+	f.stop()
+
+	cmd := f.kubectl.command("port-forward", "pod/"+f.pod, ":"+strconv.Itoa(port))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to start kubectl port-forward: %w", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	localCh := make(chan string, 1)
+	go func() {
+		sc := bufio.NewScanner(stdout)
+		for sc.Scan() {
+			if m := forwardingRe.FindStringSubmatch(sc.Text()); m != nil {
+				localCh <- m[1]
+				break
+			}
+		}
+		// Keep reading, so that kubectl never blocks writing its output.
+		ioutil.ReadAll(stdout)
+	}()
+
+	select {
+	case local := <-localCh:
+		f.cmd, f.port, f.local, f.exited = cmd, port, local, exited
+		return local, nil
+	case <-exited:
+		return "", fmt.Errorf("kubectl port-forward exited before forwarding port %d", port)
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		return "", ctx.Err()
+	}
+}
+
+// stop terminates kubectl, if it is running. It must be called with f.mu
+// held.
+func (f *portForwarder) stop() {
+	if f.cmd == nil {
+		return
+	}
+	f.cmd.Process.Kill()
+	<-f.exited
+	f.cmd = nil
+}
+
+// Close stops forwarding the port.
+func (f *portForwarder) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	f.stop()
+}
+
+// podName returns a new random name for a plugin server pod.
+func podName() (string, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", fmt.Errorf("failed to generate pod name: %w", err)
+	}
+	return "rpcplugin-" + hex.EncodeToString(buf[:]), nil
+}
@@ -0,0 +1,557 @@
+package rpcplugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+)
+
+// Manager supervises a set of named plugins, restarting their server
+// processes according to a RestartPolicy if they exit unexpectedly or, if
+// health checking is enabled, become unhealthy.
+//
+// Because a restart replaces the plugin's Plugin object, callers should
+// obtain the current Plugin from Manager.Plugin each time they need it,
+// rather than retaining it.
+type Manager struct {
+	// Registry, if set, is used to find how to run each plugin whose
+	// ManagedConfig.Client has neither Cmd nor InProcess set, by the name
+	// given to Start. The Manager resolves the name again for each restart,
+	// so that a restart uses the current registration.
+	//
+	// Registry must be set, if at all, before the first call to Start.
+	Registry *Registry
+
+	// CleanStaleSockets, if set, makes the Manager remove the socket
+	// directories left behind by plugin servers that exited abruptly, as for
+	// the function CleanStaleSockets, in the background when it first starts
+	// a plugin. It cleans the default locations, and the UnixSocketDir of
+	// the first plugin's client configuration if that is set.
+	CleanStaleSockets bool
+
+	mu      sync.Mutex
+	plugins map[string]*managedPlugin
+	closed  bool
+	cleaned bool
+}
+
+// NewManager returns a new Manager with no plugins.
+func NewManager() *Manager {
+	return &Manager{
+		plugins: make(map[string]*managedPlugin),
+	}
+}
+
+// ManagedConfig is the configuration for a plugin supervised by a Manager.
+type ManagedConfig struct {
+	// Client is the configuration for starting each instance of the plugin
+	// server. The Manager starts each instance using a copy of Client whose
+	// Cmd is a new exec.Cmd with the same path, arguments, environment,
+	// directory, extra files and system attributes as Client.Cmd, because
+	// an exec.Cmd can run only once.
+	//
+	// If neither Client.Cmd nor Client.InProcess is set then the Manager
+	// finds the plugin in its Registry instead.
+	//
+	// Client.OnExit, if set, is called for each unexpected exit, including
+	// those after which the Manager restarts the plugin.
+	Client ClientConfig
+
+	// Restart decides whether the Manager restarts the plugin server if it
+	// exits unexpectedly. The default is RestartNever.
+	//
+	// If Client.HealthCheck is set then the Manager also treats the plugin
+	// becoming unhealthy as a failure: unless Restart is RestartNever, it
+	// closes the plugin, giving the server a chance to finish its requests
+	// in progress, and then restarts it. Client.HealthCheck.OnChange, if
+	// set, is still called for each change.
+	Restart RestartPolicy
+
+	// MaxRestarts is the most times the Manager will restart the plugin
+	// within any period of RestartWindow. If the plugin needs more restarts
+	// than that, the Manager considers it to be crash-looping and stops
+	// restarting it. If they are zero, MaxRestarts defaults to five and
+	// RestartWindow defaults to one minute.
+	MaxRestarts   int
+	RestartWindow time.Duration
+
+	// RestartDelay is how long the Manager waits before each restart. If it
+	// is zero, it defaults to one second.
+	RestartDelay time.Duration
+
+	// OnCrashLoop, if set, is called from a separate goroutine when the
+	// Manager stops restarting the plugin because it is crash-looping, with
+	// the name of the plugin and a description of its last crash.
+	OnCrashLoop func(name string, crash *CrashInfo)
+}
+
+const (
+	defaultManagedMaxRestarts   = 5
+	defaultManagedRestartWindow = time.Minute
+	defaultManagedRestartDelay  = time.Second
+)
+
+func (c ManagedConfig) withDefaults() ManagedConfig {
+	if c.MaxRestarts <= 0 {
+		c.MaxRestarts = defaultManagedMaxRestarts
+	}
+	if c.RestartWindow <= 0 {
+		c.RestartWindow = defaultManagedRestartWindow
+	}
+	if c.RestartDelay <= 0 {
+		c.RestartDelay = defaultManagedRestartDelay
+	}
+	return c
+}
+
+// RestartPolicy decides whether a Manager restarts a plugin server process
+// that exits while the Manager is still supervising it.
+type RestartPolicy int
+
+const (
+	// RestartNever leaves a plugin stopped after its server exits.
+	RestartNever RestartPolicy = iota
+
+	// RestartOnFailure restarts a plugin whose server exits with a non-zero
+	// status or is terminated by a signal, but not one that exits
+	// successfully.
+	RestartOnFailure
+
+	// RestartAlways restarts a plugin whenever its server exits.
+	RestartAlways
+)
+
+// restarts returns true if the policy calls for a restart after the given
+// crash.
+func (r RestartPolicy) restarts(crash *CrashInfo) bool {
+	switch r {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return crash == nil || crash.ExitCode != 0
+	default:
+		return false
+	}
+}
+
+// ManagedState is the state of a plugin supervised by a Manager.
+//
+// It is an alias for the type in package plugintrace, so that tracers can
+// report changes of state.
+type ManagedState = plugintrace.ManagedState
+
+const (
+	ManagedStopped      = plugintrace.ManagedStopped
+	ManagedRunning      = plugintrace.ManagedRunning
+	ManagedRestarting   = plugintrace.ManagedRestarting
+	ManagedExited       = plugintrace.ManagedExited
+	ManagedCrashLooping = plugintrace.ManagedCrashLooping
+)
+
+// Start starts the plugin server for a new plugin with the given name, and
+// then supervises it according to the given configuration until the plugin
+// is stopped using Stop or Close.
+//
+// The given context is used for starting the plugin server, as for New, and
+// also for any later restarts, so it must not be cancelled while the
+// Manager is supervising the plugin.
+//
+// If the first start fails then Start returns the error from New, and the
+// Manager does not retain the plugin.
+func (m *Manager) Start(ctx context.Context, name string, config *ManagedConfig) (*Plugin, error) {
+	if config.Client.Cmd == nil && config.Client.InProcess == nil && (m.Registry == nil || !m.Registry.has(name)) {
+		return nil, fmt.Errorf("config field Client.Cmd must not be nil unless the plugin manager's registry includes %q", name)
+	}
+	mp := &managedPlugin{
+		name:     name,
+		registry: m.Registry,
+		config:   config.withDefaults(),
+		ctx:      ctx,
+		tracer:   plugintrace.ContextClientTracer(ctx),
+		stop:     make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("plugin manager is closed")
+	}
+	if _, exists := m.plugins[name]; exists {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("plugin manager already has a plugin named %q", name)
+	}
+	m.plugins[name] = mp
+	clean := m.CleanStaleSockets && !m.cleaned
+	m.cleaned = m.cleaned || clean
+	m.mu.Unlock()
+
+	if clean {
+		go func(dir string) {
+			CleanStaleSockets("", staleSocketMinAge)
+			if dir != "" {
+				CleanStaleSockets(dir, staleSocketMinAge)
+			}
+		}(config.Client.UnixSocketDir)
+	}
+
+	mp.mu.Lock()
+	p, err := mp.launch()
+	if err != nil {
+		mp.mu.Unlock()
+		m.mu.Lock()
+		delete(m.plugins, name)
+		m.mu.Unlock()
+		return nil, err
+	}
+	mp.current = p
+	report := mp.setState(ManagedRunning, "started")
+	mp.mu.Unlock()
+	report()
+	return p, nil
+}
+
+// Plugin returns the current Plugin for the plugin of the given name.
+//
+// If the Manager is restarting the plugin then Plugin waits for the restart
+// to complete or for the given context to be cancelled. Plugin returns a
+// *CrashLoopError if the Manager stopped restarting the plugin because it
+// is crash-looping.
+func (m *Manager) Plugin(ctx context.Context, name string) (*Plugin, error) {
+	mp := m.lookup(name)
+	if mp == nil {
+		return nil, fmt.Errorf("plugin manager has no plugin named %q", name)
+	}
+	for {
+		mp.mu.Lock()
+		state, p, ready, crash := mp.state, mp.current, mp.ready, mp.crash
+		mp.mu.Unlock()
+
+		switch state {
+		case ManagedRunning:
+			return p, nil
+		case ManagedRestarting:
+			select {
+			case <-ready:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		case ManagedCrashLooping:
+			return nil, &CrashLoopError{
+				Name:     name,
+				Restarts: mp.config.MaxRestarts,
+				Window:   mp.config.RestartWindow,
+				Crash:    crash,
+			}
+		case ManagedExited:
+			return nil, fmt.Errorf("plugin %q has exited", name)
+		default:
+			return nil, fmt.Errorf("plugin %q is stopped", name)
+		}
+	}
+}
+
+// State returns the state of the plugin of the given name, or
+// ManagedStopped if the Manager has no plugin of that name.
+func (m *Manager) State(name string) ManagedState {
+	mp := m.lookup(name)
+	if mp == nil {
+		return ManagedStopped
+	}
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.state
+}
+
+// Names returns the names of the plugins the Manager is supervising, in
+// lexical order.
+func (m *Manager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.plugins))
+	for name := range m.plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Stop closes the plugin of the given name, as for Plugin.Close, and stops
+// supervising it.
+func (m *Manager) Stop(name string) error {
+	m.mu.Lock()
+	mp := m.plugins[name]
+	delete(m.plugins, name)
+	m.mu.Unlock()
+	if mp == nil {
+		return fmt.Errorf("plugin manager has no plugin named %q", name)
+	}
+	return mp.shutdown()
+}
+
+// Close stops all of the Manager's plugins, as for Stop, and prevents
+// starting any more. It returns the first error from closing a plugin, if
+// any.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	plugins := m.plugins
+	m.plugins = make(map[string]*managedPlugin)
+	m.closed = true
+	m.mu.Unlock()
+
+	var firstErr error
+	for name, mp := range plugins {
+		if err := mp.shutdown(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to close plugin %q: %w", name, err)
+		}
+	}
+	return firstErr
+}
+
+func (m *Manager) lookup(name string) *managedPlugin {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.plugins[name]
+}
+
+// managedPlugin is the state of one plugin supervised by a Manager.
+type managedPlugin struct {
+	name     string
+	registry *Registry
+	config   ManagedConfig
+	ctx      context.Context
+	tracer   *plugintrace.ClientTracer
+	stop     chan struct{} // closed by shutdown
+
+	// mu guards the remaining fields. ready is closed when the state
+	// changes from ManagedRestarting. crash describes the most recent
+	// unexpected exit, and restarts records the times of recent restarts.
+	mu       sync.Mutex
+	state    ManagedState
+	current  *Plugin
+	ready    chan struct{}
+	crash    *CrashInfo
+	restarts []time.Time
+
+	// restartCount is the total number of successful restarts.
+	restartCount int
+}
+
+// setState changes the state of the plugin for the given reason. It must be
+// called with mp.mu held, and returns a function that reports the change to
+// the tracer, which the caller must call after releasing mp.mu.
+func (mp *managedPlugin) setState(to ManagedState, reason string) func() {
+	from := mp.state
+	mp.state = to
+	var inst plugintrace.Instance
+	if mp.current != nil {
+		inst = mp.current.instance
+	}
+	return func() {
+		if mp.tracer.ManagedStateChanged != nil {
+			mp.tracer.ManagedStateChanged(inst, mp.name, from, to, reason)
+		}
+	}
+}
+
+// launch starts a new instance of the plugin server.
+func (mp *managedPlugin) launch() (*Plugin, error) {
+	config := mp.config.Client
+	switch {
+	case config.Cmd != nil:
+		config.Cmd = cloneCmd(config.Cmd)
+	case config.InProcess == nil:
+		resolved, err := mp.registry.Resolve(mp.name, config)
+		if err != nil {
+			return nil, err
+		}
+		config = *resolved
+	}
+
+	var p *Plugin
+	started := make(chan struct{})
+	userOnExit := config.OnExit
+	config.OnExit = func(state *os.ProcessState) {
+		if userOnExit != nil {
+			userOnExit(state)
+		}
+		<-started
+		mp.exited(p)
+	}
+	if config.HealthCheck != nil {
+		hc := *config.HealthCheck
+		userOnChange := hc.OnChange
+		hc.OnChange = func(healthy bool) {
+			if userOnChange != nil {
+				userOnChange(healthy)
+			}
+			if !healthy {
+				go func() {
+					<-started
+					mp.unhealthy(p)
+				}()
+			}
+		}
+		config.HealthCheck = &hc
+	}
+
+	p, err := New(mp.ctx, &config)
+	close(started)
+	return p, err
+}
+
+// exited handles the unexpected exit of the given plugin instance. It is
+// called from the instance's OnExit callback, and so after the instance's
+// exit channel is closed.
+func (mp *managedPlugin) exited(p *Plugin) {
+	mp.mu.Lock()
+	if mp.current != p || mp.state != ManagedRunning {
+		// The plugin is being stopped or restarted.
+		mp.mu.Unlock()
+		return
+	}
+
+	// p.crash is set before OnExit is called, so it's safe to read here.
+	mp.crash = p.crash
+
+	var report func()
+	if mp.config.Restart.restarts(mp.crash) {
+		mp.ready = make(chan struct{})
+		report = mp.setState(ManagedRestarting, "crashed")
+		go mp.restartLoop()
+	} else {
+		report = mp.setState(ManagedExited, "exited")
+	}
+	mp.mu.Unlock()
+	p.Close()
+	report()
+}
+
+// unhealthy handles the given plugin instance becoming unhealthy, by
+// draining and restarting it if the restart policy allows restarting after
+// a failure.
+func (mp *managedPlugin) unhealthy(p *Plugin) {
+	mp.mu.Lock()
+	if mp.current != p || mp.state != ManagedRunning || !mp.config.Restart.restarts(nil) {
+		mp.mu.Unlock()
+		return
+	}
+	mp.ready = make(chan struct{})
+	report := mp.setState(ManagedRestarting, "unhealthy")
+	mp.mu.Unlock()
+	report()
+
+	// Close asks the server to finish its requests in progress before it
+	// exits, and kills it if it doesn't exit in time.
+	p.Close()
+	mp.restartLoop()
+}
+
+// restartLoop tries to restart the plugin until it succeeds, the plugin is
+// found to be crash-looping, or the plugin is stopped.
+func (mp *managedPlugin) restartLoop() {
+	for {
+		mp.mu.Lock()
+		if mp.state != ManagedRestarting {
+			// The plugin was stopped.
+			mp.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		recent := mp.restarts[:0]
+		for _, t := range mp.restarts {
+			if now.Sub(t) < mp.config.RestartWindow {
+				recent = append(recent, t)
+			}
+		}
+		mp.restarts = recent
+		if len(mp.restarts) >= mp.config.MaxRestarts {
+			report := mp.setState(ManagedCrashLooping, "crash loop")
+			close(mp.ready)
+			crash := mp.crash
+			mp.mu.Unlock()
+			report()
+			if mp.config.OnCrashLoop != nil {
+				mp.config.OnCrashLoop(mp.name, crash)
+			}
+			return
+		}
+		mp.restarts = append(mp.restarts, now)
+		mp.mu.Unlock()
+
+		select {
+		case <-time.After(mp.config.RestartDelay):
+		case <-mp.stop:
+			return
+		}
+
+		p, err := mp.launch()
+
+		mp.mu.Lock()
+		if mp.state != ManagedRestarting {
+			// The plugin was stopped while we were starting it.
+			mp.mu.Unlock()
+			if p != nil {
+				p.Close()
+			}
+			return
+		}
+		if err == nil {
+			mp.restartCount++
+			p.restarts = mp.restartCount
+			if mp.crash != nil {
+				p.lastExit = mp.crash.State
+			}
+			mp.current = p
+			report := mp.setState(ManagedRunning, "restarted")
+			close(mp.ready)
+			mp.mu.Unlock()
+			report()
+			return
+		}
+		// A failed start is another failure, so we'll keep trying until the
+		// plugin is considered to be crash-looping.
+		if exitErr, ok := err.(*ServerExitedError); ok {
+			mp.crash = exitErr.Crash
+		}
+		mp.mu.Unlock()
+	}
+}
+
+// shutdown stops supervising the plugin and closes its current instance.
+func (mp *managedPlugin) shutdown() error {
+	mp.mu.Lock()
+	p := mp.current
+	running := mp.state == ManagedRunning
+	if mp.state == ManagedRestarting {
+		close(mp.ready)
+	}
+	report := mp.setState(ManagedStopped, "stopped")
+	mp.current = nil
+	close(mp.stop)
+	mp.mu.Unlock()
+	report()
+
+	if running {
+		return p.Close()
+	}
+	return nil
+}
+
+// cloneCmd returns a new command that will run the same program as the
+// given command, which may already have run.
+func cloneCmd(cmd *exec.Cmd) *exec.Cmd {
+	return &exec.Cmd{
+		Path:        cmd.Path,
+		Args:        cmd.Args,
+		Env:         cmd.Env,
+		Dir:         cmd.Dir,
+		ExtraFiles:  cmd.ExtraFiles,
+		SysProcAttr: cmd.SysProcAttr,
+	}
+}
@@ -0,0 +1,77 @@
+package rpcplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// PluginMetadata is a description of a plugin server that the server can
+// send to the client during the handshake, so that the host application can
+// show information about the plugins it has installed.
+//
+// All of the fields are optional. The rpcplugin implementation does not
+// interpret them in any way.
+type PluginMetadata struct {
+	// Name is the name of the plugin, as it might be shown to a user.
+	Name string `json:"name,omitempty"`
+
+	// Version is the version of the plugin itself, rather than of the
+	// plugin protocol. By convention this is a semantic version string.
+	Version string `json:"version,omitempty"`
+
+	// Build is arbitrary information about how the plugin was built, such
+	// as a source revision, build time, or compiler version.
+	Build map[string]string `json:"build,omitempty"`
+
+	// Features is a set of application-defined feature flags the plugin
+	// supports.
+	Features []string `json:"features,omitempty"`
+}
+
+// Metadata returns the plugin server's description of itself, or nil if
+// it has none.
+//
+// If the server sent metadata during the handshake then Metadata returns it
+// immediately. Otherwise, such as for a plugin obtained using Attach or a
+// server that supports only version 1 of the handshake, Metadata requests
+// it from the server and remembers the result. A server that doesn't
+// support that request is treated as having no metadata.
+//
+// Callers must not modify the returned object.
+func (p *Plugin) Metadata(ctx context.Context) (*PluginMetadata, error) {
+	p.metadataMu.Lock()
+	defer p.metadataMu.Unlock()
+	if p.metadata != nil || p.metadataFetched || p.rpcProtocol != "grpc" {
+		return p.metadata, nil
+	}
+
+	conn, err := p.dialGRPC(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", p.addr, err)
+	}
+	defer conn.Close()
+
+	client := &controlClient{cc: conn}
+	resp, err := client.GetMetadata(ctx, &empty.Empty{})
+	if status.Code(err) == codes.Unimplemented {
+		p.metadataFetched = true
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to request plugin metadata: %w", err)
+	}
+	if raw := resp.GetValue(); raw != "" {
+		var metadata PluginMetadata
+		if err := json.Unmarshal([]byte(raw), &metadata); err != nil {
+			return nil, fmt.Errorf("plugin server returned invalid metadata: %w", err)
+		}
+		p.metadata = &metadata
+	}
+	p.metadataFetched = true
+	return p.metadata, nil
+}
@@ -0,0 +1,178 @@
+package rpcplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apparentlymart/go-ctxenv/ctxenv"
+)
+
+// listenAllEnvName is the environment variable the client sets to "1" to ask
+// the server to listen on all of the transports in PLUGIN_TRANSPORTS that it
+// is able to use, rather than only the first, and to advertise the address
+// of each in the handshake extensions.
+//
+// The server can advertise the additional addresses only in version 2 of
+// the handshake, so it ignores this variable if the client didn't also
+// announce support for that.
+const listenAllEnvName = "PLUGIN_LISTEN_ALL"
+
+// probeTimeout is how long the client waits for each address a server
+// advertised when choosing the first one it can reach.
+const probeTimeout = 2 * time.Second
+
+// serverListenAll returns true if the server should listen on all of the
+// transports it can use, according to its own configuration or that
+// requested by the client.
+func serverListenAll(ctx context.Context, config *ServerConfig) bool {
+	if !serverHandshakeV2(ctx) {
+		return false
+	}
+	return config.ListenAllTransports || ctxenv.Getenv(ctx, listenAllEnvName) == "1"
+}
+
+// handshakeAddr is the representation of a network address in the
+// handshake extensions.
+type handshakeAddr struct {
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+}
+
+func newHandshakeAddrs(addrs []net.Addr) []handshakeAddr {
+	ret := make([]handshakeAddr, len(addrs))
+	for i, addr := range addrs {
+		ret[i] = handshakeAddr{Network: addr.Network(), Addr: addr.String()}
+	}
+	return ret
+}
+
+// netAddr returns the address as a net.Addr, or an error if its network is
+// not one of the transports the rpcplugin protocol defines.
+func (a handshakeAddr) netAddr() (net.Addr, error) {
+	switch a.Network {
+	case "tcp":
+		return net.ResolveTCPAddr("tcp", a.Addr)
+	case "unix":
+		return net.ResolveUnixAddr("unix", a.Addr)
+	default:
+		return nil, fmt.Errorf("unsupported transport %q", a.Network)
+	}
+}
+
+// firstReachableAddr returns the first of the given addresses whose network
+// is one of the allowed transports and that the client can connect to using
+// the given dial function, or the error from the last address it tried if
+// none are reachable.
+//
+// Each attempt opens a connection that is then closed immediately, and so
+// the server sees it as a client connection that sends nothing.
+func firstReachableAddr(ctx context.Context, addrs []handshakeAddr, transports []string, dial func(context.Context, net.Addr) (net.Conn, error)) (net.Addr, error) {
+	allowed := make(map[string]bool, len(transports))
+	for _, t := range transports {
+		allowed[t] = true
+	}
+	var lastErr error
+	for _, ha := range addrs {
+		if !allowed[ha.Network] {
+			continue
+		}
+		addr, err := ha.netAddr()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+		conn, err := dial(probeCtx, addr)
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		conn.Close()
+		return addr, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("none of the advertised addresses use an allowed transport")
+	}
+	return nil, lastErr
+}
+
+// multiListener is an implementation of net.Listener that accepts
+// connections from several listeners at once, for a server listening on
+// more than one transport. Its Addr is the address of the first listener.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan multiAccept
+	done      chan struct{}
+	once      sync.Once
+}
+
+type multiAccept struct {
+	conn net.Conn
+	err  error
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	ret := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan multiAccept),
+		done:      make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go ret.acceptLoop(l)
+	}
+	return ret
+}
+
+func (l *multiListener) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		select {
+		case l.accepted <- multiAccept{conn, err}:
+		case <-l.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if ne, ok := err.(net.Error); err != nil && !(ok && ne.Temporary()) {
+			return
+		}
+	}
+}
+
+func (l *multiListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-l.accepted:
+		return a.conn, a.err
+	case <-l.done:
+		return nil, fmt.Errorf("listener is closed")
+	}
+}
+
+func (l *multiListener) Addr() net.Addr {
+	return l.listeners[0].Addr()
+}
+
+// Addrs returns the addresses of all of the listeners, in order.
+func (l *multiListener) Addrs() []net.Addr {
+	ret := make([]net.Addr, len(l.listeners))
+	for i, listener := range l.listeners {
+		ret[i] = listener.Addr()
+	}
+	return ret
+}
+
+func (l *multiListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	var firstErr error
+	for _, listener := range l.listeners {
+		if err := listener.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,229 @@
+package rpcplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/apparentlymart/go-ctxenv/ctxenv"
+	"github.com/hashicorp/yamux"
+)
+
+// multiplexEnvName is the environment variable the client uses to request
+// that the server multiplex all RPC traffic over a single connection. Its
+// value is a comma-separated list of multiplexing protocols the client
+// supports, in order of preference. The only protocol currently defined
+// is "yamux".
+const multiplexEnvName = "PLUGIN_MULTIPLEX"
+
+// multiplexYamux is the name of the yamux multiplexing protocol, used both in
+// the multiplexing request from the client and in the server's confirmation
+// in the handshake extensions.
+const multiplexYamux = "yamux"
+
+// hostServicesMultiplexed is the network name used in the host services
+// environment variable to indicate that the plugin server should reach
+// the host services by opening a stream on the multiplexed connection,
+// rather than by making a separate connection.
+const hostServicesMultiplexed = "multiplex"
+
+// serverMultiplexRequested returns true if the client asked the server to
+// multiplex its connections using a protocol the server supports.
+func serverMultiplexRequested(ctx context.Context) bool {
+	for _, proto := range strings.Split(ctxenv.Getenv(ctx, multiplexEnvName), ",") {
+		if proto == multiplexYamux {
+			return true
+		}
+	}
+	return false
+}
+
+// muxListener is the server side of the multiplexing mechanism. It is a
+// net.Listener that treats each connection accepted by a wrapped listener
+// as a yamux session, and then in turn returns each stream the client
+// opens in any of those sessions as a separate connection.
+type muxListener struct {
+	net.Listener
+
+	streams chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+
+	mu       sync.Mutex
+	sessions []*yamux.Session
+	// sessionReady is closed and replaced each time a new session is
+	// established, so that OpenStream can wait for one.
+	sessionReady chan struct{}
+}
+
+var _ net.Listener = (*muxListener)(nil)
+
+func newMuxListener(l net.Listener) *muxListener {
+	ret := &muxListener{
+		Listener:     l,
+		streams:      make(chan net.Conn),
+		closed:       make(chan struct{}),
+		sessionReady: make(chan struct{}),
+	}
+	go ret.acceptSessions()
+	return ret
+}
+
+func (l *muxListener) acceptSessions() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.Close()
+			return
+		}
+		session, err := yamux.Server(conn, nil)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+
+		l.mu.Lock()
+		l.sessions = append(l.sessions, session)
+		close(l.sessionReady)
+		l.sessionReady = make(chan struct{})
+		l.mu.Unlock()
+
+		go l.acceptStreams(session)
+	}
+}
+
+func (l *muxListener) acceptStreams(session *yamux.Session) {
+	defer l.forgetSession(session)
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- stream:
+		case <-l.closed:
+			stream.Close()
+			return
+		}
+	}
+}
+
+func (l *muxListener) forgetSession(session *yamux.Session) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, s := range l.sessions {
+		if s == session {
+			l.sessions = append(l.sessions[:i], l.sessions[i+1:]...)
+			break
+		}
+	}
+}
+
+// Accept returns the next stream opened by the client in any of the active
+// sessions.
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-l.streams:
+		return stream, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("listener is closed")
+	}
+}
+
+// OpenStream opens a new stream to the client in the most recently
+// established session, waiting until the client connects if there is no
+// session yet.
+func (l *muxListener) OpenStream(ctx context.Context) (net.Conn, error) {
+	for {
+		l.mu.Lock()
+		var session *yamux.Session
+		if len(l.sessions) != 0 {
+			session = l.sessions[len(l.sessions)-1]
+		}
+		ready := l.sessionReady
+		l.mu.Unlock()
+
+		if session != nil && !session.IsClosed() {
+			return session.Open()
+		}
+
+		select {
+		case <-ready:
+		case <-l.closed:
+			return nil, fmt.Errorf("listener is closed")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Close closes the wrapped listener and all of the active sessions.
+func (l *muxListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+
+		l.mu.Lock()
+		for _, session := range l.sessions {
+			session.Close()
+		}
+		l.sessions = nil
+		l.mu.Unlock()
+	})
+	return err
+}
+
+// muxDialer is the client side of the multiplexing mechanism. It maintains
+// a single yamux session with the server, establishing a new one whenever
+// the previous one has failed, and opens a new stream in that session for
+// each connection.
+type muxDialer struct {
+	addr net.Addr
+	dial func(ctx context.Context, addr net.Addr) (net.Conn, error)
+
+	// onSession, if set, is called for each new session, so that the caller
+	// can accept streams opened by the server.
+	onSession func(*yamux.Session)
+
+	mu      sync.Mutex
+	session *yamux.Session
+}
+
+func (d *muxDialer) Dial(ctx context.Context) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.session == nil || d.session.IsClosed() {
+		conn, err := d.dial(ctx, d.addr)
+		if err != nil {
+			return nil, err
+		}
+		session, err := yamux.Client(conn, nil)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		d.session = session
+		if d.onSession != nil {
+			d.onSession(session)
+		}
+	}
+
+	return d.session.Open()
+}
+
+// Close closes the current session, if any.
+func (d *muxDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.session == nil {
+		return nil
+	}
+	err := d.session.Close()
+	d.session = nil
+	return err
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package rpcplugin
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// parentPollInterval is how often watchParent checks whether the parent
+// process has exited.
+const parentPollInterval = time.Second
+
+// watchParent calls exited if the parent of the current process exits
+// before the given context is cancelled.
+//
+// On Unix systems an orphaned process is adopted by another process, such
+// as init, so we detect that the parent has exited by polling for a change
+// to the parent process ID.
+func watchParent(ctx context.Context, exited func()) {
+	ppid := os.Getppid()
+	ticker := time.NewTicker(parentPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if os.Getppid() != ppid {
+				exited()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
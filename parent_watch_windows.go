@@ -0,0 +1,39 @@
+package rpcplugin
+
+import (
+	"context"
+	"os"
+	"syscall"
+)
+
+// watchParent calls exited if the parent of the current process exits
+// before the given context is cancelled.
+//
+// On Windows we open a handle to the parent process and wait for it to be
+// signalled, which happens when the process exits.
+func watchParent(ctx context.Context, exited func()) {
+	h, err := syscall.OpenProcess(syscall.SYNCHRONIZE, false, uint32(os.Getppid()))
+	if err != nil {
+		// If we can't open the parent process then it has probably already
+		// exited, but it might also be that we lack permission to watch it,
+		// so we conservatively assume the latter.
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer syscall.CloseHandle(h)
+		ev, err := syscall.WaitForSingleObject(h, syscall.INFINITE)
+		if err == nil && ev == syscall.WAIT_OBJECT_0 {
+			close(done)
+		}
+	}()
+
+	select {
+	case <-done:
+		exited()
+	case <-ctx.Done():
+		// The waiting goroutine remains blocked until the parent exits,
+		// but the server process is about to exit anyway.
+	}
+}
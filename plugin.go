@@ -1,22 +1,28 @@
 package rpcplugin
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"net"
 	"os"
+	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apparentlymart/go-ctxenv/ctxenv"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/hashicorp/yamux"
+	"go.rpcplugin.org/rpcplugin/handshake"
 	"go.rpcplugin.org/rpcplugin/plugintrace"
 	"google.golang.org/grpc"
 	grpcCreds "google.golang.org/grpc/credentials"
@@ -24,14 +30,82 @@ import (
 
 // Plugin represents a currently-active plugin instance, with an associated
 // child process that is running an RPC server.
+//
+// A Plugin created using ClientConfig.Runner instead has a server managed
+// by that runner, which may not be a process on the local host.
+//
+// A Plugin returned from Attach instead represents a plugin server running
+// elsewhere, and has no associated child process. A Plugin created using
+// ClientConfig.InProcess has a server running within the current process.
 type Plugin struct {
-	protoVersion int
-	cv           ClientVersion
-	process      *os.Process
-	addr         net.Addr
-	tlsConfig    *tls.Config
-	exit         <-chan struct{}
-	tracer       *plugintrace.ClientTracer
+	protoVersion      int
+	rpcProtocol       string
+	cv                ClientVersion
+	cvs               map[int]ClientVersion
+	versions          []int
+	ncv               NetRPCClientVersion
+	process           *os.Process
+	addr              net.Addr
+	tlsConfig         *tls.Config
+	auto              *autoCredentials
+	perRPCCreds       grpcCreds.PerRPCCredentials
+	sharedToken       grpcCreds.PerRPCCredentials
+	traceCalls        bool
+	compressor        string
+	callTimeout       time.Duration
+	blockReady        bool
+	waitReady         bool
+	shutdownGrace     time.Duration
+	rpcStats          *rpcStats
+	hostServer        *hostServer
+	mux               *muxDialer
+	inProcess         *inProcessServer
+	exit              <-chan struct{}
+	exitState         *os.ProcessState // set before exit is closed
+	crash             *CrashInfo       // set before exit is closed
+	exitedAt          time.Time        // set before exit is closed
+	startedAt         time.Time
+	stderr            *stderrCapture
+	terminal          *clientTerminal
+	tracer            *plugintrace.ClientTracer
+	instance          plugintrace.Instance
+	metadata          *PluginMetadata
+	capabilities      Capabilities
+	protoMinorVersion int
+	plugins           []string // names from a ServerPluginSet, if announced
+
+	// metadataMu guards metadata once the plugin has been returned to the
+	// caller. metadataFetched is true if the client has already requested
+	// metadata from the server.
+	metadataMu      sync.Mutex
+	metadataFetched bool
+
+	// unhealthy is 1 if background health checking has found the plugin
+	// server to be unhealthy, and 0 otherwise. It is accessed atomically.
+	// healthStop is closed to stop the health checking, if it's running.
+	unhealthy  int32
+	healthStop chan struct{}
+
+	// held is 1 while the caller holds the Plugin returned from New and
+	// hasn't yet called Close, and 0 otherwise. It is accessed atomically.
+	held int32
+
+	// restarts and lastExit are set by a Manager before it makes a
+	// restarted plugin available to callers, and are zero otherwise.
+	restarts int
+	lastExit *os.ProcessState
+
+	// runner manages the plugin server for a plugin created by New without
+	// InProcess, and is nil otherwise. process is the server's child process
+	// if runner launched it from ClientConfig.Cmd.
+	runner ProcessRunner
+
+	// dial is the ClientConfig or AttachConfig field Dial, if set. onClose
+	// is the AttachConfig field OnClose, for a plugin created by Attach.
+	dial    func(ctx context.Context, addr net.Addr) (net.Conn, error)
+	onClose func() error
+
+	goPluginCompat bool
 }
 
 // New launches a plugin server in a child process and returns an object
@@ -51,103 +125,337 @@ type Plugin struct {
 func New(ctx context.Context, config *ClientConfig) (plugin *Plugin, err error) {
 	config.setDefaults()
 
-	if len(config.ProtoVersions) == 0 {
+	if config.InProcess != nil {
+		return newInProcess(ctx, config)
+	}
+	if len(config.ProtoVersions) == 0 && len(config.NetRPCProtoVersions) == 0 {
 		return nil, fmt.Errorf("config field ProtoVersions must have at least one version")
 	}
 	if config.Handshake.CookieKey == "" {
 		return nil, fmt.Errorf("config field Handshake.CookieKey must not be empty")
 	}
-	if config.Handshake.CookieValue == "" {
+	if config.Handshake.CookieValue == "" && config.Handshake.GenerateCookie == nil {
 		return nil, fmt.Errorf("config field Handshake.CookieValue must not be empty")
 	}
-	if config.Cmd == nil {
+	if config.Cmd == nil && config.Runner == nil {
 		return nil, fmt.Errorf("config field Cmd must not be nil")
 	}
+	if config.Runner != nil {
+		switch {
+		case config.Cmd != nil:
+			return nil, fmt.Errorf("config fields Runner and Cmd are mutually exclusive")
+		case config.WrapCommand != nil:
+			return nil, fmt.Errorf("config field WrapCommand requires Cmd, and cannot be used with Runner")
+		case config.Terminal != nil:
+			return nil, fmt.Errorf("config field Terminal requires Cmd, and cannot be used with Runner")
+		case config.Limiter != nil:
+			return nil, fmt.Errorf("config field Limiter requires Cmd, and cannot be used with Runner")
+		}
+	}
+	if err := checkCompressor("Compressor", config.Compressor); err != nil {
+		return nil, err
+	}
+	if err := checkCapabilities("Capabilities", config.Capabilities); err != nil {
+		return nil, err
+	}
+	if err := checkProtoMinorVersions("ProtoMinorVersions", config.ProtoMinorVersions, func(v int) bool {
+		_, ok := config.ProtoVersions[v]
+		return ok
+	}); err != nil {
+		return nil, err
+	}
 
 	var versionStrings []string
 	for v := range config.ProtoVersions {
 		versionStrings = append(versionStrings, strconv.Itoa(v))
 	}
+	for v := range config.NetRPCProtoVersions {
+		if _, exists := config.ProtoVersions[v]; exists {
+			continue
+		}
+		versionStrings = append(versionStrings, strconv.Itoa(v))
+	}
 
+	cookie, err := config.Handshake.cookieValue()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate handshake cookie: %w", err)
+	}
 	environ := []string{
-		fmt.Sprintf("%s=%s", config.Handshake.CookieKey, config.Handshake.CookieValue),
+		fmt.Sprintf("%s=%s", config.Handshake.CookieKey, cookie),
 		fmt.Sprintf("PLUGIN_PROTOCOL_VERSIONS=%s", strings.Join(versionStrings, ",")),
-		"PLUGIN_TRANSPORTS=unix,tcp",
 
 		// Client-selected port range is a hashicorp/go-plugin thing that
-		// rpcplugin doesn't actually support, but we'll set these variables
-		// anyway so that Go rpcplugin clients can interop with
-		// hashicorp/go-plugin servers. This is not part of the rpcplugin
-		// protocol, so other client implementations may not set these.
+		// isn't part of the rpcplugin protocol, so other client
+		// implementations may not set these. The Go rpcplugin server honors
+		// them when listening on TCP, as do hashicorp/go-plugin servers.
 		"PLUGIN_MIN_PORT=10000",
 		"PLUGIN_MAX_PORT=25000",
 	}
+	if !config.GoPluginCompat {
+		// hashicorp/go-plugin clients don't set this, and so servers use
+		// its absence to detect that they should behave like go-plugin
+		// servers.
+		environ = append(environ, fmt.Sprintf("PLUGIN_TRANSPORTS=%s", strings.Join(config.Transports, ",")))
+
+		environ = append(environ, fmt.Sprintf("%s=2", handshakeVersionEnvName))
+		if config.ListenAllTransports {
+			environ = append(environ, fmt.Sprintf("%s=1", listenAllEnvName))
+		}
+	}
+	if config.Multiplex {
+		environ = append(environ, fmt.Sprintf("%s=%s", multiplexEnvName, multiplexYamux))
+	}
+	if minors := protoMinorVersionsEnv(config.ProtoMinorVersions); minors != "" {
+		environ = append(environ, fmt.Sprintf("%s=%s", protoMinorVersionsEnvName, minors))
+	}
+	if len(config.Capabilities) != 0 {
+		environ = append(environ, fmt.Sprintf("%s=%s", capabilitiesEnvName, strings.Join(config.Capabilities, ",")))
+	}
+	environ = append(environ, config.unixSocketConfig().environ()...)
+	environ = append(environ, config.tcpBindConfig().environ()...)
+
+	var sharedTok grpcCreds.PerRPCCredentials
+	if config.SharedToken {
+		token, err := generateSharedToken()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate shared token: %w", err)
+		}
+		sharedTok = sharedToken(token)
+		environ = append(environ, fmt.Sprintf("%s=%s", authTokenEnvName, token))
+	}
 
 	tlsConfig := config.TLSConfig
-	autoTLS := false
-	if tlsConfig == nil {
-		// A nil TLSConfig means to use the auto-negotiation protocol.
-		cert, err := generateCertificate(ctx, "localhost")
+	if config.TLSConfigFunc != nil {
+		if tlsConfig != nil {
+			return nil, fmt.Errorf("config fields TLSConfigFunc and TLSConfig are mutually exclusive")
+		}
+		if config.Credentials != nil {
+			return nil, fmt.Errorf("config fields TLSConfigFunc and Credentials are mutually exclusive")
+		}
+		tlsConfig, err = config.TLSConfigFunc(ctx, config.Cmd)
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate client TLS certificate: %s", err)
+			return nil, fmt.Errorf("failed to prepare TLS configuration: %w", err)
+		}
+	}
+	var auto *autoCredentials
+	var creds tlsCredentials
+	if tlsConfig == ForceClientWithoutTLS {
+		if config.Credentials != nil {
+			return nil, fmt.Errorf("config field Credentials cannot be used with ForceClientWithoutTLS")
 		}
-		tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			ServerName:   "localhost",
+		tlsConfig = nil
+	} else if config.Credentials != nil {
+		if tlsConfig != nil {
+			return nil, fmt.Errorf("config fields Credentials and TLSConfig are mutually exclusive")
 		}
+		creds = &sourceCredentials{
+			source: config.Credentials,
+			verify: config.VerifyPeer,
+			policy: config.TLSPolicy,
+		}
+		tlsConfig = creds.ClientTLSConfig()
+	} else if tlsConfig == nil {
+		// A nil TLSConfig means to use the auto-negotiation protocol.
+		cert, err := generateCertificate(ctx, "localhost", config.AutoCertIssuer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate client TLS certificate: %w", err)
+		}
+		auto = newAutoCredentials(cert)
+		auto.verify = config.VerifyPeer
+		auto.policy = config.TLSPolicy
+		auto.issuer = config.AutoCertIssuer
+		creds = auto
+		tlsConfig = auto.ClientTLSConfig()
 		certPEM := pem.EncodeToMemory(&pem.Block{
 			Type:  "CERTIFICATE",
 			Bytes: cert.Certificate[0],
 		})
-		environ = append(environ, fmt.Sprintf("PLUGIN_CLIENT_CERT=%s", certPEM))
-		autoTLS = true
+		if config.ClientCertFile {
+			// The server reads the file before it completes the handshake,
+			// so we can remove it as soon as New returns.
+			certFile, err := writeClientCertFile(certPEM)
+			if err != nil {
+				return nil, err
+			}
+			defer os.Remove(certFile)
+			environ = append(environ, fmt.Sprintf("%s=%s", clientCertFileEnvName, certFile))
+		} else {
+			environ = append(environ, fmt.Sprintf("PLUGIN_CLIENT_CERT=%s", certPEM))
+		}
 	}
 
-	config.Cmd.Env = append(environ, ctxenv.Environ(ctx)...)
-	config.Cmd.Stdin = bytes.NewReader(nil)
-	config.Cmd.Stderr = config.Stderr
-	cmdStdout, err := config.Cmd.StdoutPipe()
-	if err != nil {
-		return nil, fmt.Errorf("cannot create stdout pipe: %s", err)
+	if tlsConfig != nil && creds == nil && config.VerifyPeer != nil {
+		tlsConfig = withPeerVerifier(tlsConfig, config.VerifyPeer)
+	}
+	if tlsConfig != nil && creds == nil && config.TLSPolicy != nil {
+		tlsConfig = withTLSPolicy(tlsConfig, config.TLSPolicy)
+	}
+
+	var hostSrv *hostServer
+	if config.HostServices != nil {
+		srv, env, err := startHostServer(ctx, config.HostServices, tlsConfig, creds, config.VerifyPeer, config.unixSocketConfig(), config.tcpBindConfig(), config.Multiplex)
+		if err != nil {
+			return nil, err
+		}
+		hostSrv = srv
+		environ = append(environ, env)
+		defer func() {
+			if err != nil {
+				hostSrv.Stop()
+			}
+		}()
+	}
+
+	var term *clientTerminal
+	if config.Terminal != nil {
+		term, err = newClientTerminal(config.Terminal)
+		if err != nil {
+			return nil, err
+		}
+		// The child's extra files start at descriptor 3, after stdio. We
+		// take a full slice expression so that we never append to a backing
+		// array shared with another command, such as one the Manager cloned.
+		extra := config.Cmd.ExtraFiles
+		environ = append(environ, fmt.Sprintf("%s=%d", terminalFDEnvName, 3+len(extra)))
+		config.Cmd.ExtraFiles = append(extra[:len(extra):len(extra)], term.File())
 	}
 
 	tracer := plugintrace.ContextClientTracer(ctx)
+	inst := plugintrace.Instance{ID: nextPluginID()}
+
+	// A child process inherits our environment, but other runners choose
+	// what their servers inherit.
+	runner := config.Runner
+	var cmdR *cmdRunner
+	if runner == nil {
+		environ = append(environ, prepareInterruptShutdown(config.Cmd)...)
+		environ = append(environ, ctxenv.Environ(ctx)...)
+		cmdR = &cmdRunner{
+			cmd:     config.Cmd,
+			wrap:    config.WrapCommand,
+			limiter: config.Limiter,
+		}
+		if tracer.ProcessStart != nil {
+			cmdR.starting = func(cmd *exec.Cmd) {
+				tracer.ProcessStart(inst, cmd)
+			}
+		}
+		runner = cmdR
+	}
 
-	if tracer.ProcessStart != nil {
-		tracer.ProcessStart(config.Cmd)
+	var stderrW io.Writer = config.Stderr
+	var stderr *stderrCapture
+	if config.StderrBufferSize > 0 {
+		stderr, err = newStderrCapture(config.Stderr, config.StderrBufferSize)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create stderr pipe: %w", err)
+		}
+		stderrW = stderr.File()
+	}
+	cmdStdout, err := runner.Start(ctx, environ, stderrW)
+	if stderr != nil {
+		switch {
+		case err != nil:
+			stderr.Abort()
+		case cmdR != nil:
+			stderr.Start()
+		default:
+			stderr.StartShared()
+		}
+	}
+	if term != nil {
+		if err != nil {
+			term.Abort()
+		} else {
+			term.Start()
+		}
 	}
-	err = config.Cmd.Start()
 	if err != nil {
-		if tracer.ProcessStartFailed != nil {
-			tracer.ProcessStartFailed(config.Cmd, err)
+		if cmdR == nil {
+			return nil, fmt.Errorf("failed to start plugin server: %w", err)
+		}
+		if cmdR.started && tracer.ProcessStartFailed != nil {
+			tracer.ProcessStartFailed(inst, cmdR.cmd, errors.Unwrap(err))
 		}
-		return nil, fmt.Errorf("failed to start child process: %s", err)
+		return nil, err
 	}
-	if tracer.ProcessRunning != nil {
-		tracer.ProcessRunning(config.Cmd.Process)
+	startedAt := time.Now()
+	var process *os.Process
+	if cmdR != nil {
+		process = config.Cmd.Process
+		inst.PID = process.Pid
+		if tracer.ProcessRunning != nil {
+			tracer.ProcessRunning(inst, process)
+		}
+		if tracer.StderrAttached != nil {
+			tracer.StderrAttached(inst, process, config.Stderr == ioutil.Discard)
+		}
 	}
 
 	exitCh := make(chan struct{})
 	ret := &Plugin{
-		process:   config.Cmd.Process,
-		exit:      exitCh,
-		tracer:    tracer,
-		tlsConfig: tlsConfig,
+		process:    process,
+		runner:     runner,
+		exit:       exitCh,
+		tracer:     tracer,
+		instance:   inst,
+		tlsConfig:  tlsConfig,
+		auto:       auto,
+		hostServer: hostSrv,
+		stderr:     stderr,
+		terminal:   term,
+
+		perRPCCreds:    config.PerRPCCredentials,
+		sharedToken:    sharedTok,
+		traceCalls:     config.TraceCalls,
+		compressor:     config.Compressor,
+		callTimeout:    config.DefaultCallTimeout,
+		blockReady:     config.BlockUntilReady,
+		waitReady:      config.WaitForReady,
+		shutdownGrace:  config.ShutdownGrace,
+		rpcStats:       newRPCStats(),
+		startedAt:      startedAt,
+		dial:           config.Dial,
+		goPluginCompat: config.GoPluginCompat,
 	}
 
 	go func(exit chan<- struct{}) {
-		state, _ := ret.process.Wait()
+		state, waitErr := runner.Wait()
+		if stderr != nil {
+			if cmdR == nil {
+				stderr.CloseWriter()
+			}
+			stderr.Wait(stderrDrainTimeout)
+		}
+		if term != nil {
+			term.Close(stderrDrainTimeout)
+		}
+		ret.exitState = state
+		ret.exitedAt = time.Now()
 		if state != nil && tracer.ProcessExited != nil {
-			tracer.ProcessExited(state)
+			tracer.ProcessExited(inst, state)
+		}
+		crashed := waitErr == nil && atomic.CompareAndSwapInt32(&ret.held, 1, 0)
+		if crashed {
+			// The caller still holds the plugin, so this exit is a crash.
+			ret.crash = newCrashInfo(CrashDuringSession, state, startedAt, stderr)
+			if tracer.ProcessCrashed != nil {
+				tracer.ProcessCrashed(inst, ret.crash)
+			}
 		}
 		close(exit)
+		// OnExit runs only once the plugin knows the server has exited, so
+		// that it can call Close without trying to stop the server again.
+		if crashed && config.OnExit != nil {
+			config.OnExit(state)
+		}
 	}(exitCh)
 
 	defer func() {
 		p := recover()
 
 		if err != nil || p != nil {
-			ret.process.Kill()
+			runner.Signal(os.Kill)
 		}
 
 		if p != nil {
@@ -157,167 +465,527 @@ func New(ctx context.Context, config *ClientConfig) (plugin *Plugin, err error)
 
 	// We'll use a goroutine to read stdout lines so that we can also watch
 	// for our timeout to elapse.
-	stdoutCh := make(chan string)
-	go func(stdout io.ReadCloser) {
-		sc := bufio.NewScanner(stdout)
-		for sc.Scan() {
-			stdoutCh <- sc.Text()
-		}
-		close(stdoutCh)
-		stdout.Close()
-	}(cmdStdout)
+	stdoutCh := awaitHandshakeLine(cmdStdout, config.MaxHandshakeLine, config.MaxHandshakePreamble)
 
 	timeout := time.After(config.StartTimeout)
+	timedOut := func() error {
+		if tracer.ServerStartTimeout != nil && ret.process != nil {
+			tracer.ServerStartTimeout(inst, ret.process, config.StartTimeout)
+		}
+		return &HandshakeTimeoutError{Timeout: config.StartTimeout}
+	}
 	select {
 	case <-timeout:
-		if tracer.ServerStartTimeout != nil {
-			tracer.ServerStartTimeout(ret.process, config.StartTimeout)
-		}
-		return nil, fmt.Errorf("timeout waiting for plugin server handshake message")
+		return nil, timedOut()
 	case <-exitCh:
-		return nil, fmt.Errorf("plugin server process exited without completing handshake")
-	case line := <-stdoutCh:
-		line = strings.TrimSpace(line)
-		parts := strings.SplitN(line, "|", 6)
-		if len(parts) < 5 {
-			return nil, fmt.Errorf("invalid handshake message %q from plugin server", line)
+		return nil, ret.handshakeCrashed(startedAt)
+	case result, ok := <-stdoutCh:
+		if !ok {
+			// The server closed its stdout without writing a handshake,
+			// which usually means it is exiting, and if so then the
+			// exit is the more useful error to report.
+			select {
+			case <-exitCh:
+				return nil, ret.handshakeCrashed(startedAt)
+			case <-timeout:
+				return nil, timedOut()
+			}
 		}
-
-		// Verify the rpcplugin handshake version
-		if parts[0] != "1" {
-			return nil, fmt.Errorf("invalid handshake version %q from plugin server; want \"1\"", parts[0])
+		if result.err != nil {
+			return nil, result.err
+		}
+		line := result.line
+		if tracer.HandshakeReceived != nil {
+			tracer.HandshakeReceived(inst, line)
+		}
+		if len(strings.Split(line, "|")) == 4 && config.GoPluginCompat {
+			// Older versions of hashicorp/go-plugin don't include the RPC
+			// protocol field, implying net/rpc.
+			line += "|netrpc"
+		}
+		hs, err := handshake.ParseLine(line)
+		if err != nil {
+			return nil, &HandshakeSyntaxError{Line: line, Err: err}
 		}
 
 		// Verify the RPC protocol selection
-		if parts[4] != "grpc" {
-			return nil, fmt.Errorf("invalid RPC protocol %q from plugin server; want \"grpc\"", parts[0])
+		rpcProtocol := hs.RPCProtocol
+		switch rpcProtocol {
+		case "grpc":
+			// The standard rpcplugin RPC protocol
+		case "netrpc":
+			// Legacy protocol supported only for hashicorp/go-plugin servers
+			if len(config.NetRPCProtoVersions) == 0 {
+				return nil, &UnsupportedProtocolError{RPCProtocol: rpcProtocol, Version: -1}
+			}
+		default:
+			return nil, &UnsupportedProtocolError{RPCProtocol: rpcProtocol, Version: -1}
 		}
+		ret.rpcProtocol = rpcProtocol
 
 		// Verify the selected protocol version
 		{
-			version, err := strconv.Atoi(parts[1])
-			if err != nil {
-				return nil, fmt.Errorf("invalid protocol version %q from plugin server", parts[1])
+			version := hs.ProtoVersion
+			ok := false
+			if rpcProtocol == "netrpc" {
+				ret.ncv, ok = config.NetRPCProtoVersions[version]
+			} else {
+				ret.cv, ok = config.ProtoVersions[version]
 			}
-
-			cv, ok := config.ProtoVersions[version]
 			if !ok {
-				return nil, fmt.Errorf("plugin server selected unsupported protocol version %d", version)
+				return nil, &UnsupportedProtocolError{RPCProtocol: rpcProtocol, Version: version}
 			}
 			ret.protoVersion = version
-			ret.cv = cv
 		}
 
-		// Verify transport protocol and address
-		switch parts[2] {
-		case "tcp":
-			addr, err := net.ResolveTCPAddr("tcp", parts[3])
-			if err != nil {
-				return nil, fmt.Errorf("plugin server provided invalid TCP socket address %q", parts[3])
-			}
-			ret.addr = addr
-		case "unix":
-			addr, err := net.ResolveUnixAddr("unix", parts[3])
-			if err != nil {
-				return nil, fmt.Errorf("plugin server provided invalid Unix socket address %q", parts[3])
+		// Verify transport protocol
+		transportAllowed := false
+		for _, t := range config.Transports {
+			if t == hs.Addr.Network() {
+				transportAllowed = true
+				break
 			}
-			ret.addr = addr
-		default:
-			return nil, fmt.Errorf("plugin server selected unsupported transport protocol %q", parts[2])
+		}
+		if !transportAllowed {
+			return nil, fmt.Errorf("plugin server selected transport protocol %q, which is not allowed", hs.Addr.Network())
+		}
+		ret.addr = hs.Addr
+		if tracer.HandshakeParsed != nil {
+			tracer.HandshakeParsed(inst, rpcProtocol, ret.protoVersion, ret.addr)
 		}
 
-		// parts[5] is the optional auto-generated server TLS certificate.
-		// It must be at least 50 characters long to distinguish it from
-		// other uses of this field in older hashicorp/go-plugin versions,
-		// though rpcplugin's server does not ever produce such things.
-		if len(parts) >= 6 && len(parts[5]) > 50 {
-			certStr := parts[5]
-			certPool := x509.NewCertPool()
-			x509Cert, err := decodeRawBase64Cert(certStr)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse plugin server's temporary certificate: %s", err)
+		if hs.Certificate != nil {
+			if ret.tlsConfig == nil {
+				return nil, fmt.Errorf("plugin server requires TLS, but the client is configured with ForceClientWithoutTLS")
 			}
-
-			certPool.AddCert(x509Cert)
+			certPool := x509.NewCertPool()
+			certPool.AddCert(hs.Certificate)
 
 			// The client will accept only this temporary certificate.
-			ret.tlsConfig.RootCAs = certPool
+			if ret.auto != nil {
+				ret.auto.TrustPeers(certPool)
+			} else {
+				ret.tlsConfig.RootCAs = certPool
+				if ret.hostServer != nil {
+					ret.hostServer.TrustClientCAs(certPool)
+				}
+			}
+			if tracer.ServerCertificatePinned != nil {
+				tracer.ServerCertificatePinned(inst, hs.Certificate)
+			}
+		}
+
+		// The extensions are from version 2 of the handshake, which the
+		// server includes only if we announced that we support it.
+		if hs.Extensions != nil {
+			ext, err := parseHandshakeExtensions(string(hs.Extensions))
+			if err != nil {
+				return nil, &HandshakeSyntaxError{Line: line, Err: fmt.Errorf("invalid extensions: %w", err)}
+			}
+			ret.metadata = ext.Metadata
+			ret.capabilities = ext.Capabilities
+			ret.protoMinorVersion = ext.MinorVersion
+			ret.plugins = ext.Plugins
+			if len(ext.Versions) != 0 {
+				ret.versions = ext.Versions
+				ret.cvs = config.ProtoVersions
+			}
+			if len(ext.Addrs) > 1 {
+				// The server is listening on more than one transport, so
+				// we'll use the first of them that we can actually reach.
+				addr, err := firstReachableAddr(ctx, ext.Addrs, config.Transports, ret.dialAddr)
+				if err != nil {
+					return nil, fmt.Errorf("cannot reach any of the plugin server's addresses: %w", err)
+				}
+				ret.addr = addr
+			}
+			if config.Multiplex && ext.Multiplex == multiplexYamux {
+				ret.mux = &muxDialer{
+					addr: ret.addr,
+					dial: ret.dialAddr,
+				}
+				if ret.hostServer != nil {
+					ret.mux.onSession = func(session *yamux.Session) {
+						ret.hostServer.ServeSession(session)
+					}
+				}
+			}
 		}
 
 		if tracer.TLSConfig != nil {
-			tracer.TLSConfig(ret.tlsConfig, autoTLS)
+			tracer.TLSConfig(inst, ret.tlsConfig, ret.auto != nil)
 		}
 
-		if tracer.ServerStarted != nil {
-			tracer.ServerStarted(ret.process, ret.addr, ret.protoVersion)
+		if tracer.ServerStarted != nil && ret.process != nil {
+			tracer.ServerStarted(inst, ret.process, ret.addr, ret.protoVersion)
 		}
 
+		if config.HealthCheck != nil {
+			ret.startHealthCheck(*config.HealthCheck)
+		}
+
+		atomic.StoreInt32(&ret.held, 1)
 		return ret, nil
 	}
 }
 
+// handshakeCrashed returns the error for the plugin server process exiting
+// before completing its handshake, having started at the given time. It
+// must be called only after the process has exited.
+func (p *Plugin) handshakeCrashed(started time.Time) error {
+	p.crash = newCrashInfo(CrashDuringHandshake, p.exitState, started, p.stderr)
+	if p.tracer.ProcessCrashed != nil {
+		p.tracer.ProcessCrashed(p.instance, p.crash)
+	}
+	return &ServerExitedError{State: p.exitState, Stderr: p.crash.Stderr, Crash: p.crash}
+}
+
 // Client returns a client object that can be used to call plugin functions.
 //
 // The protoVersion return value is the protocol version negotiated with the
 // plugin server. The client return value must be type-asserted by the caller
 // to the appropriate GRPC client interface type for the negotiated protocol
 // version.
+//
+// If the ClientVersion for the negotiated protocol version is a
+// ClientPluginSet then the client return value is a *PluginDispenser.
+//
+// If the server selected the legacy net/rpc protocol then the client return
+// value is instead the result of the NetRPCClientVersion for the negotiated
+// protocol version.
 func (p *Plugin) Client(ctx context.Context) (protoVersion int, client interface{}, err error) {
+	if p.rpcProtocol == "netrpc" {
+		return p.netRPCClient(ctx)
+	}
+
+	client, err = p.clientProxy(ctx, p.cv)
+	if err != nil {
+		return 0, nil, err
+	}
+	// The server announces the plugins in its ServerPluginSet only for
+	// the negotiated version.
+	if d, ok := client.(*PluginDispenser); ok && p.plugins != nil {
+		d.served = make(map[string]bool, len(p.plugins))
+		for _, name := range p.plugins {
+			d.served[name] = true
+		}
+	}
+	return p.protoVersion, client, nil
+}
+
+// ID returns a number that uniquely identifies the plugin instance within
+// the current process, which is also passed to all of the plugin's client
+// trace events so that the events of concurrent plugins can be told apart.
+func (p *Plugin) ID() uint64 {
+	return p.instance.ID
+}
+
+// ServedVersions returns the protocol versions the plugin server is serving
+// concurrently, if it was configured to serve all of its supported versions
+// rather than only the negotiated version. Otherwise, it returns only the
+// negotiated version.
+//
+// Callers must not modify the returned slice.
+func (p *Plugin) ServedVersions() []int {
+	if len(p.versions) == 0 {
+		return []int{p.protoVersion}
+	}
+	return p.versions
+}
+
+// ClientForVersion is like Client, but returns a client for a specific
+// protocol version rather than the negotiated version. The version must be
+// one of those returned by ServedVersions, and the client must have a
+// ClientVersion for it in its ProtoVersions.
+func (p *Plugin) ClientForVersion(ctx context.Context, version int) (interface{}, error) {
+	if version == p.protoVersion {
+		_, client, err := p.Client(ctx)
+		return client, err
+	}
+	served := false
+	for _, v := range p.versions {
+		if v == version {
+			served = true
+			break
+		}
+	}
+	if !served {
+		return nil, fmt.Errorf("plugin server does not serve protocol version %d", version)
+	}
+	cv, ok := p.cvs[version]
+	if !ok {
+		return nil, fmt.Errorf("client does not support protocol version %d", version)
+	}
+	return p.clientProxy(ctx, cv)
+}
+
+// clientProxy connects to the plugin server and returns the client object
+// produced by the given ClientVersion.
+func (p *Plugin) clientProxy(ctx context.Context, cv ClientVersion) (interface{}, error) {
 	tracer := p.tracer
 
 	if tracer.Connect != nil {
-		tracer.Connect(p.addr)
+		tracer.Connect(p.instance, p.addr)
 	}
 
-	conn, err := grpc.DialContext(
-		ctx, "", // address string is unused because we access p.addr for that
-		grpc.FailOnNonTempDialError(true),
-		grpc.WithTransportCredentials(grpcCreds.NewTLS(p.tlsConfig)),
-		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(math.MaxInt32)),
-		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(math.MaxInt32)),
-		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
-			addr := p.addr
-			return net.Dial(addr.Network(), addr.String())
-		}),
-	)
+	var opts []grpc.DialOption
+	if p.blockReady {
+		opts = append(opts, grpc.WithBlock())
+	}
+	if p.waitReady {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.WaitForReady(true)))
+	}
+	conn, err := p.dialGRPC(ctx, opts...)
 	if err != nil {
 		if tracer.ConnectFailed != nil {
-			tracer.ConnectFailed(p.addr, err)
+			tracer.ConnectFailed(p.instance, p.addr, err)
 		}
-		return 0, nil, fmt.Errorf("failed to connect to %s: %s", p.addr, err)
+		return nil, fmt.Errorf("failed to connect to %s: %w", p.addr, err)
 	}
 
-	client, err = p.cv.ClientProxy(ctx, conn)
+	client, err := cv.ClientProxy(ctx, conn)
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed to create client proxy: %s", err)
+		return nil, fmt.Errorf("failed to create client proxy: %w", err)
 	}
 
 	if tracer.Connected != nil {
-		tracer.Connected(p.addr)
+		tracer.Connected(p.instance, p.addr)
 	}
 
-	return p.protoVersion, client, nil
+	return client, nil
+}
+
+// dialGRPC opens a new gRPC client connection to the plugin server, using
+// the given options in addition to the usual ones.
+func (p *Plugin) dialGRPC(ctx context.Context, extra ...grpc.DialOption) (*grpc.ClientConn, error) {
+	creds := grpc.WithInsecure()
+	if p.tlsConfig != nil {
+		var report func(*plugintrace.TLSInfo)
+		if p.tracer.TLSHandshake != nil {
+			report = func(info *plugintrace.TLSInfo) {
+				p.tracer.TLSHandshake(p.instance, info)
+			}
+		}
+		creds = grpc.WithTransportCredentials(newClientTLSCredentials(p.tlsConfig, report))
+	}
+	opts := []grpc.DialOption{
+		grpc.FailOnNonTempDialError(true),
+		creds,
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(math.MaxInt32)),
+		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(math.MaxInt32)),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			if p.inProcess != nil {
+				return p.inProcess.Dial()
+			}
+			if p.mux != nil {
+				return p.mux.Dial(ctx)
+			}
+			return p.dialAddr(ctx, p.addr)
+		}),
+	}
+	if p.perRPCCreds != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(p.perRPCCreds))
+	}
+	if p.sharedToken != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(p.sharedToken))
+	}
+	if p.compressor != "" {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.UseCompressor(p.compressor)))
+	}
+	if p.rpcStats != nil {
+		opts = append(opts, grpc.WithStatsHandler(p.rpcStats))
+	}
+	var unaryInts []grpc.UnaryClientInterceptor
+	if p.traceCalls && p.tracer.CallCompleted != nil {
+		// Call tracing is outermost so that the reported durations include
+		// any time spent in the other interceptors.
+		report := func(call *plugintrace.CallInfo) {
+			p.tracer.CallCompleted(p.instance, call)
+		}
+		unaryInts = append(unaryInts, clientCallTraceUnaryInterceptor(report))
+		opts = append(opts, grpc.WithStreamInterceptor(clientCallTraceStreamInterceptor(report)))
+	}
+	if p.callTimeout > 0 {
+		unaryInts = append(unaryInts, clientCallTimeoutUnaryInterceptor(p.callTimeout))
+	}
+	if len(unaryInts) != 0 {
+		opts = append(opts, grpc.WithUnaryInterceptor(chainUnaryClientInterceptors(unaryInts)))
+	}
+	opts = append(opts, extra...)
+	return grpc.DialContext(
+		ctx, "", // address string is unused because we access p.addr for that
+		opts...,
+	)
+}
+
+// dialAddr opens a new connection to the given address of the plugin server,
+// using ClientConfig.Dial or AttachConfig.Dial if set.
+func (p *Plugin) dialAddr(ctx context.Context, addr net.Addr) (net.Conn, error) {
+	if p.dial != nil {
+		return p.dial(ctx, addr)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, addr.Network(), addr.String())
 }
 
 // Close terminates the plugin child process.
 //
+// If the plugin was created by Attach then there is no child process, and
+// so Close only releases resources held by the client.
+//
 // After this function returns, the recieving plugin object is no longer valid
 // and calling any methods on it will lead to undefined behavior, possibly
 // including panics.
 func (p *Plugin) Close() error {
 	tracer := p.tracer
+	atomic.StoreInt32(&p.held, 0)
+	if p.healthStop != nil {
+		close(p.healthStop)
+	}
 
-	if tracer.Closing != nil {
-		tracer.Closing(p.process)
+	if tracer.Closing != nil && p.process != nil {
+		tracer.Closing(p.instance, p.process)
+	}
+	if tracer.Closed != nil {
+		start := time.Now()
+		defer func() {
+			tracer.Closed(p.instance, time.Since(start))
+		}()
 	}
 
-	err := p.process.Kill()
+	if p.hostServer != nil {
+		defer p.hostServer.Stop()
+	}
+	if p.mux != nil {
+		defer p.mux.Close()
+	}
+
+	if p.inProcess != nil {
+		p.inProcess.stop()
+		return nil
+	}
+	if p.runner == nil {
+		// Attached plugins have no child process to terminate, but the
+		// caller that attached may have its own cleanup to do.
+		if p.onClose != nil {
+			return p.onClose()
+		}
+		return nil
+	}
+
+	select {
+	case <-p.exit:
+		// The server process already exited by itself, such as if it
+		// crashed, so there's nothing left to terminate.
+		return nil
+	default:
+	}
+
+	if p.gracefulShutdown() {
+		if tracer.ProcessStopped != nil && p.process != nil {
+			tracer.ProcessStopped(p.instance, p.process, true)
+		}
+		return nil
+	}
+
+	err := p.runner.Signal(os.Kill)
 	if err != nil {
-		return fmt.Errorf("failed to kill pid %d: %s", p.process.Pid, err)
+		if p.process == nil {
+			return fmt.Errorf("failed to kill plugin server: %w", err)
+		}
+		if tracer.KillFailed != nil {
+			tracer.KillFailed(p.instance, p.process, err)
+		}
+		return fmt.Errorf("failed to kill pid %d: %w", p.process.Pid, err)
 	}
 
 	// Wait for the process to actually exit
 	<-p.exit
+	if tracer.ProcessStopped != nil && p.process != nil {
+		tracer.ProcessStopped(p.instance, p.process, false)
+	}
 
 	return nil
 }
+
+// gracefulShutdown asks the plugin server to exit, using whichever method
+// the server supports, and waits for it to do so.
+//
+// Returns true if the server process exited, or false if the caller must
+// still kill it.
+func (p *Plugin) gracefulShutdown() bool {
+	if p.shutdownGrace < 0 {
+		return false
+	}
+	timeout := p.shutdownGrace
+	if timeout == 0 {
+		timeout = controlShutdownTimeout
+		if p.goPluginCompat {
+			timeout = goPluginShutdownTimeout
+		}
+	}
+	// The methods share a single grace period, so that a server that is
+	// still draining after one method has asked it to shut down doesn't get
+	// another full period from the next.
+	deadline := time.Now().Add(timeout)
+	if p.goPluginCompat && p.goPluginShutdown(timeout) {
+		return true
+	}
+	for _, shutdown := range []func(time.Duration) bool{p.controlShutdown, p.interruptShutdown} {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+		if shutdown(remaining) {
+			return true
+		}
+	}
+	return false
+}
+
+// controlShutdownTimeout is the default time we'll wait for an rpcplugin
+// server to respond to a shutdown request, drain its requests in progress,
+// and then exit before we'll kill it. It exceeds the server's default drain
+// timeout.
+const controlShutdownTimeout = 10 * time.Second
+
+// controlShutdown asks an rpcplugin server to exit gracefully using the
+// control service, and waits up to the given time for it to do so.
+//
+// Returns true if the server process exited, or false if the caller must
+// still kill it, such as if the server predates the Shutdown method.
+func (p *Plugin) controlShutdown(timeout time.Duration) bool {
+	if p.rpcProtocol != "grpc" {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := p.dialGRPC(ctx)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	client := &controlClient{cc: conn}
+	_, err = client.Shutdown(ctx, &empty.Empty{})
+	if err != nil {
+		return false
+	}
+
+	select {
+	case <-p.exit:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// lastPluginID is the most recent ID assigned to a plugin instance, updated
+// atomically.
+var lastPluginID uint64
+
+func nextPluginID() uint64 {
+	return atomic.AddUint64(&lastPluginID, 1)
+}
@@ -0,0 +1,147 @@
+package rpcplugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"google.golang.org/grpc"
+)
+
+// ServerPluginSet is a ServerVersion that serves several named plugins from
+// a single plugin server, so that one plugin process can offer more than
+// one independent RPC interface.
+//
+// Each element registers the services of the plugin of the given name. All
+// of the plugins share the same gRPC server and connection, so they must
+// not register services with the same names.
+//
+// Clients use a ClientPluginSet with the same names to obtain a client for
+// each plugin.
+type ServerPluginSet map[string]ServerVersion
+
+var _ ServerVersion = ServerPluginSet(nil)
+
+// RegisterServer implements ServerVersion.
+//
+// If the set has more than one plugin then RegisterServer first calls the
+// RegisterServer method of each plugin with a temporary server, which it then
+// discards, in order to report conflicts between them as errors rather than
+// letting gRPC treat them as fatal.
+func (s ServerPluginSet) RegisterServer(srv *grpc.Server) error {
+	checked := len(s) > 1
+	if checked {
+		if _, err := s.serviceOwners(); err != nil {
+			return err
+		}
+	}
+	return s.register(srv, checked)
+}
+
+// serviceOwners returns the name of the plugin that registers each service,
+// or an error if two plugins register the same service.
+func (s ServerPluginSet) serviceOwners() (map[string]string, error) {
+	owners := make(map[string]string)
+	for _, name := range s.names() {
+		svcs, err := registeredServices(s[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to register server for plugin %q: %s", name, err)
+		}
+		for _, svc := range svcs {
+			if other, exists := owners[svc]; exists {
+				return nil, fmt.Errorf("plugins %q and %q both register service %q, so they cannot be served together", other, name, svc)
+			}
+			owners[svc] = name
+		}
+	}
+	return owners, nil
+}
+
+// register registers the services of each plugin in srv. If checked is true
+// then serviceOwners has already checked the plugins.
+func (s ServerPluginSet) register(srv *grpc.Server, checked bool) error {
+	for _, name := range s.names() {
+		err := registerServer(srv, s[name], checked)
+		if err != nil {
+			return fmt.Errorf("plugin %q: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func (s ServerPluginSet) names() []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ClientPluginSet is a ClientVersion for a protocol version whose server
+// uses a ServerPluginSet. Each element produces a client for the plugin of
+// the given name.
+//
+// The client object that Plugin.Client returns for a ClientPluginSet is a
+// *PluginDispenser, which creates the client for each plugin on request.
+type ClientPluginSet map[string]ClientVersion
+
+var _ ClientVersion = ClientPluginSet(nil)
+
+// ClientProxy implements ClientVersion.
+func (s ClientPluginSet) ClientProxy(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
+	return &PluginDispenser{
+		plugins: s,
+		conn:    conn,
+	}, nil
+}
+
+// PluginDispenser creates clients for the named plugins of a plugin server
+// that uses a ServerPluginSet. All of the clients from the same dispenser
+// share a single connection to the server.
+type PluginDispenser struct {
+	plugins ClientPluginSet
+	conn    *grpc.ClientConn
+
+	// served is the set of plugin names the server announced during the
+	// handshake, or nil if it didn't announce any.
+	served map[string]bool
+}
+
+// Dispense returns a client for the plugin of the given name, which the
+// caller must type-assert to the appropriate client interface type for
+// that plugin.
+//
+// Dispense returns an error if the client's ClientPluginSet has no element
+// of the given name, or if the server announced the plugins it serves and
+// the given name is not among them. Servers that don't announce their
+// plugins return an "unimplemented" error from any call to a plugin they
+// don't serve.
+func (d *PluginDispenser) Dispense(ctx context.Context, name string) (interface{}, error) {
+	cv, ok := d.plugins[name]
+	if !ok {
+		return nil, fmt.Errorf("client does not support plugin %q", name)
+	}
+	if d.served != nil && !d.served[name] {
+		return nil, fmt.Errorf("plugin server does not serve plugin %q", name)
+	}
+	client, err := cv.ClientProxy(ctx, d.conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client proxy for plugin %q: %w", name, err)
+	}
+	return client, nil
+}
+
+// Names returns the names of the plugins that both the client and server
+// support, in lexical order. If the server didn't announce the plugins it
+// serves, Names returns all of the names in the client's ClientPluginSet.
+func (d *PluginDispenser) Names() []string {
+	names := make([]string, 0, len(d.plugins))
+	for name := range d.plugins {
+		if d.served == nil || d.served[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,35 @@
+package plugintrace
+
+import (
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// CallInfo describes a single completed RPC call between a plugin client
+// and server, as reported to the CallCompleted functions of ClientTracer and
+// ServerTracer.
+type CallInfo struct {
+	// Method is the full name of the gRPC method that was called, like
+	// "/example.Service/Method".
+	Method string
+
+	// Stream is true if the method is a streaming method.
+	Stream bool
+
+	// Duration is the time between the call starting and completing. For a
+	// streaming call on the client side, the call completes when the client
+	// receives the end of the response stream.
+	Duration time.Duration
+
+	// Code is the gRPC status code the call completed with, and Err is the
+	// corresponding error, which is nil if Code is codes.OK.
+	Code codes.Code
+	Err  error
+
+	// SentMessages and RecvMessages are the number of messages sent and
+	// received by the reporting side of the call, and SentBytes and
+	// RecvBytes are their total encoded sizes, excluding gRPC framing.
+	SentMessages, RecvMessages int
+	SentBytes, RecvBytes       int
+}
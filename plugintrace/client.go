@@ -3,6 +3,7 @@ package plugintrace
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"os"
 	"os/exec"
@@ -13,6 +14,15 @@ import (
 // certain events occur in a plugin client whose context has this object
 // registered.
 //
+// The first argument to each function identifies the plugin instance that
+// the event relates to.
+//
+// The functions with an *exec.Cmd, *os.Process, or *os.ProcessState argument
+// are called only for plugin servers that run in a child process launched
+// from rpcplugin.ClientConfig.Cmd, and so those arguments are never nil. The
+// client doesn't call them for a server launched by a
+// rpcplugin.ClientConfig.Runner, which might not be a local process at all.
+//
 // Some trace functions recieve mutable data structures via pointers for
 // efficiency. Making any modifications to those data structures is forbidden,
 // and these pointers must be discarded before each function returns.
@@ -20,46 +30,103 @@ type ClientTracer struct {
 	// ProcessStart is called just before the client launches the child process
 	// where the plugin server will run. The argument is the command definition
 	// it will use.
-	ProcessStart func(cmd *exec.Cmd)
+	ProcessStart func(inst Instance, cmd *exec.Cmd)
 
 	// ProcessRunning is called after after the server process is started.
-	ProcessRunning func(proc *os.Process)
+	ProcessRunning func(inst Instance, proc *os.Process)
 
 	// ProcessStartFailed is called if the server process failed to start,
 	// giving the error value describing the failure.
-	ProcessStartFailed func(cmd *exec.Cmd, err error)
+	ProcessStartFailed func(inst Instance, cmd *exec.Cmd, err error)
 
 	// ProcessExited is called when a server process terminates.
-	ProcessExited func(state *os.ProcessState)
+	ProcessExited func(inst Instance, state *os.ProcessState)
+
+	// StderrAttached is called once the client is forwarding the server
+	// process's stderr stream. If discarded is true, the client was not
+	// configured with a destination for stderr and so discards it.
+	StderrAttached func(inst Instance, proc *os.Process, discarded bool)
+
+	// HandshakeReceived is called when the client reads the handshake line
+	// from the server process's stdout, before parsing it. The argument is
+	// the raw line with surrounding whitespace removed.
+	HandshakeReceived func(inst Instance, line string)
+
+	// HandshakeParsed is called once the client has successfully parsed
+	// and validated the main fields of the handshake line, giving the RPC
+	// protocol, protocol version, and server address it selected.
+	HandshakeParsed func(inst Instance, rpcProtocol string, protoVersion int, addr net.Addr)
+
+	// ServerCertificatePinned is called if the server included a temporary
+	// certificate in its handshake, once the client has parsed it and
+	// configured itself to accept only that certificate from the server.
+	ServerCertificatePinned func(inst Instance, cert *x509.Certificate)
 
 	// TLSConfig is called when client TLS configuration is complete. If and
 	// only if the auto-negotiation protocol was used to produce a single-use
-	// certificate, auto is true.
-	TLSConfig func(config *tls.Config, auto bool)
+	// certificate, auto is true. If TLS is disabled, config is nil.
+	TLSConfig func(inst Instance, config *tls.Config, auto bool)
 
 	// ServerStarted is called once the server process has successfully
 	// completed the handshake protocol and is ready to be used.
-	ServerStarted func(proc *os.Process, addr net.Addr, protoVersion int)
+	ServerStarted func(inst Instance, proc *os.Process, addr net.Addr, protoVersion int)
 
 	// ServerStartTimeout is called if the server program doesn't complete
 	// the handshake before the configured timeout.
-	ServerStartTimeout func(proc *os.Process, timeout time.Duration)
+	ServerStartTimeout func(inst Instance, proc *os.Process, timeout time.Duration)
 
 	// Connect is called just before the client opens a connection to the
 	// server's listen socket.
-	Connect func(addr net.Addr)
+	Connect func(inst Instance, addr net.Addr)
 
 	// Connected is called once a connection to the server's listen socket
 	// is successfully established.
-	Connected func(addr net.Addr)
+	Connected func(inst Instance, addr net.Addr)
 
 	// ConnectFailed is called if connecting to the server's listen socket
 	// returned an error.
-	ConnectFailed func(addr net.Addr, err error)
+	ConnectFailed func(inst Instance, addr net.Addr, err error)
+
+	// CallCompleted is called after each RPC call the client makes to the
+	// plugin server, if the client was configured with TraceCalls set.
+	CallCompleted func(inst Instance, call *CallInfo)
 
 	// Closing is called when a plugin instance is asked to shut down, before
-	// the child process is killed.
-	Closing func(proc *os.Process)
+	// the client asks the server to exit or kills the child process.
+	Closing func(inst Instance, proc *os.Process)
+
+	// Closed is called when Close has finished shutting down the plugin,
+	// whether or not it succeeded, giving the time that took.
+	Closed func(inst Instance, elapsed time.Duration)
+
+	// KillFailed is called if the client was unable to kill the server
+	// process while closing the plugin.
+	KillFailed func(inst Instance, proc *os.Process, err error)
+
+	// ProcessStopped is called when the server process has exited while
+	// closing the plugin. graceful is true if the server exited on request,
+	// or false if the client had to kill it.
+	ProcessStopped func(inst Instance, proc *os.Process, graceful bool)
+
+	// CertificatesRotated is called after the client and server have
+	// replaced their automatically-negotiated TLS certificates.
+	CertificatesRotated func(inst Instance)
+
+	// ProcessCrashed is called when a server process exits unexpectedly,
+	// either before completing its handshake or while the client is still
+	// using it, after ProcessExited.
+	ProcessCrashed func(inst Instance, crash *CrashInfo)
+
+	// ManagedStateChanged is called when a plugin supervised by an
+	// rpcplugin.Manager changes state, with the plugin's name, its old and new
+	// states, and a short reason such as "crashed", "unhealthy" or "restarted".
+	// The instance is the plugin's current instance, if it has one.
+	ManagedStateChanged func(inst Instance, name string, from, to ManagedState, reason string)
+
+	// TLSHandshake is called each time the client completes a TLS handshake
+	// with the plugin server, describing the negotiated TLS version, cipher
+	// suite and server certificate.
+	TLSHandshake func(inst Instance, info *TLSInfo)
 }
 
 type clientCtxKeyType int
@@ -80,11 +147,20 @@ func WithClientTracer(ctx context.Context, tracer *ClientTracer) context.Context
 // ContextClientTracer retrieves the ClientTracer object associated with the
 // given context. If none is associated, a no-op tracer is returned.
 //
+// If the environment variable named by TraceEnvName enables the built-in
+// tracing, the result also passes each event to the built-in tracer.
+//
 // Do not modify any part of the returned tracer.
 func ContextClientTracer(ctx context.Context) *ClientTracer {
 	tracer, ok := ctx.Value(clientCtxKey).(*ClientTracer)
-	if !ok {
+	env := envClientTracer()
+	switch {
+	case !ok && env == nil:
 		return noopClientTrace
+	case !ok:
+		return env
+	case env != nil:
+		return MultiClientTracer(tracer, env)
 	}
 	return tracer
 }
@@ -2,6 +2,7 @@ package plugintrace
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"log"
 	"net"
 	"os"
@@ -19,58 +20,122 @@ import (
 // build log messages yourself.
 func ClientLogTracer(logger *log.Logger) *ClientTracer {
 	return &ClientTracer{
-		ProcessStart: func(cmd *exec.Cmd) {
+		ProcessStart: func(inst Instance, cmd *exec.Cmd) {
 			// We use POSIX shell quoting here just to get a nice readable
 			// string representation of the args. We won't actually be running
 			// this, so it doesn't matter that we'll be using POSIX-style
 			// quoting on non-POSIX platforms.
 			execStr := shquot.POSIXShell(cmd.Args)
-			logger.Printf("launching plugin server %s", execStr)
+			logger.Printf("%s: launching plugin server %s", inst, execStr)
 		},
 
-		ProcessRunning: func(proc *os.Process) {
-			logger.Printf("plugin server process has pid %d", proc.Pid)
+		ProcessRunning: func(inst Instance, proc *os.Process) {
+			logger.Printf("%s: plugin server process has pid %d", inst, proc.Pid)
 		},
 
-		ProcessStartFailed: func(cmd *exec.Cmd, err error) {
+		ProcessStartFailed: func(inst Instance, cmd *exec.Cmd, err error) {
 			execStr, _ := shquot.POSIXShellSplit(cmd.Args)
-			logger.Printf("failed to start plugin server %s: %s", execStr, err)
+			logger.Printf("%s: failed to start plugin server %s: %s", inst, execStr, err)
 		},
 
-		ProcessExited: func(state *os.ProcessState) {
-			logger.Printf("plugin server process exited: %s", state)
+		ProcessExited: func(inst Instance, state *os.ProcessState) {
+			logger.Printf("%s: plugin server process exited: %s", inst, state)
 		},
 
-		TLSConfig: func(config *tls.Config, auto bool) {
+		StderrAttached: func(inst Instance, proc *os.Process, discarded bool) {
+			if discarded {
+				logger.Printf("%s: discarding stderr from pid %d", inst, proc.Pid)
+			} else {
+				logger.Printf("%s: forwarding stderr from pid %d", inst, proc.Pid)
+			}
+		},
+
+		HandshakeReceived: func(inst Instance, line string) {
+			logger.Printf("%s: received handshake %q", inst, line)
+		},
+
+		HandshakeParsed: func(inst Instance, rpcProtocol string, protoVersion int, addr net.Addr) {
+			logger.Printf("%s: server selected %s protocol version %d at %s address %s", inst, rpcProtocol, protoVersion, addr.Network(), addr)
+		},
+
+		ServerCertificatePinned: func(inst Instance, cert *x509.Certificate) {
+			logger.Printf("%s: pinned server's temporary TLS certificate with serial number %s", inst, cert.SerialNumber)
+		},
+
+		TLSConfig: func(inst Instance, config *tls.Config, auto bool) {
+			if config == nil {
+				logger.Printf("%s: WARNING: TLS is entirely disabled, so plugin RPC traffic is neither authenticated nor encrypted", inst)
+				return
+			}
 			if auto {
-				logger.Println("auto-negotiated TLS configuration")
+				logger.Printf("%s: auto-negotiated TLS configuration", inst)
 			} else {
-				logger.Println("TLS configuration from custom configuration function")
+				logger.Printf("%s: TLS configuration from custom configuration function", inst)
 			}
 		},
 
-		ServerStarted: func(proc *os.Process, addr net.Addr, protoVersion int) {
-			logger.Printf("server process (pid %d) is listening at %s address %s for protocol version %d", proc.Pid, addr.Network(), addr, protoVersion)
+		ServerStarted: func(inst Instance, proc *os.Process, addr net.Addr, protoVersion int) {
+			logger.Printf("%s: server process (pid %d) is listening at %s address %s for protocol version %d", inst, proc.Pid, addr.Network(), addr, protoVersion)
+		},
+
+		ServerStartTimeout: func(inst Instance, proc *os.Process, timeout time.Duration) {
+			logger.Printf("%s: timeout (%s) waiting for handshake from pid %d", inst, timeout, proc.Pid)
+		},
+
+		Connect: func(inst Instance, addr net.Addr) {
+			logger.Printf("%s: connecting to plugin server at %s address %s", inst, addr.Network(), addr)
 		},
 
-		ServerStartTimeout: func(proc *os.Process, timeout time.Duration) {
-			logger.Printf("timeout (%s) waiting for handshake from pid %d", timeout, proc.Pid)
+		Connected: func(inst Instance, addr net.Addr) {
+			logger.Printf("%s: connected to plugin server at %s address %s", inst, addr.Network(), addr)
+		},
+
+		ConnectFailed: func(inst Instance, addr net.Addr, err error) {
+			logger.Printf("%s: failed to connect to %s address %s: %s", inst, addr.Network(), addr, err)
+		},
+
+		CallCompleted: func(inst Instance, call *CallInfo) {
+			if call.Err != nil {
+				logger.Printf("%s: call to %s failed after %s: %s", inst, call.Method, call.Duration, call.Err)
+				return
+			}
+			logger.Printf("%s: call to %s completed in %s", inst, call.Method, call.Duration)
+		},
+
+		Closing: func(inst Instance, proc *os.Process) {
+			logger.Printf("%s: closing plugin server with pid %d", inst, proc.Pid)
+		},
+
+		Closed: func(inst Instance, elapsed time.Duration) {
+			logger.Printf("%s: plugin closed after %s", inst, elapsed)
+		},
+
+		KillFailed: func(inst Instance, proc *os.Process, err error) {
+			logger.Printf("%s: failed to kill pid %d: %s", inst, proc.Pid, err)
+		},
+
+		ProcessStopped: func(inst Instance, proc *os.Process, graceful bool) {
+			if graceful {
+				logger.Printf("%s: plugin server with pid %d exited gracefully", inst, proc.Pid)
+				return
+			}
+			logger.Printf("%s: plugin server with pid %d was killed", inst, proc.Pid)
 		},
 
-		Connect: func(addr net.Addr) {
-			logger.Printf("connecting to plugin server at %s address %s", addr.Network(), addr)
+		CertificatesRotated: func(inst Instance) {
+			logger.Printf("%s: rotated auto-negotiated TLS certificates", inst)
 		},
 
-		Connected: func(addr net.Addr) {
-			logger.Printf("connected to plugin server at %s address %s", addr.Network(), addr)
+		ProcessCrashed: func(inst Instance, crash *CrashInfo) {
+			logger.Printf("%s: plugin server process crashed: %s", inst, crash)
 		},
 
-		ConnectFailed: func(addr net.Addr, err error) {
-			logger.Printf("failed to connect to %s address %s: %s", addr.Network(), addr, err)
+		ManagedStateChanged: func(inst Instance, name string, from, to ManagedState, reason string) {
+			logger.Printf("%s: managed plugin %q changed from %s to %s: %s", inst, name, from, to, reason)
 		},
 
-		Closing: func(proc *os.Process) {
-			logger.Printf("closing plugin server with pid %d", proc.Pid)
+		TLSHandshake: func(inst Instance, info *TLSInfo) {
+			logger.Printf("%s: TLS connection established: %s", inst, info)
 		},
 	}
 }
@@ -0,0 +1,39 @@
+package plugintrace
+
+import (
+	"net"
+	"time"
+)
+
+// ConnInfo describes a connection that a plugin server has accepted from a
+// client, as reported to the ClientConnAccepted and ClientConnClosed functions
+// of ServerTracer.
+type ConnInfo struct {
+	// ID distinguishes the connection from the others the same server has
+	// accepted, so that the events for each connection can be correlated.
+	// IDs start at 1 and increase with each connection.
+	ID uint64
+
+	RemoteAddr, LocalAddr net.Addr
+
+	// TLS describes the negotiated TLS parameters, including the client's
+	// certificate if it presented one, or is nil if the connection doesn't
+	// use TLS.
+	TLS *TLSInfo
+
+	// Opened is when the server finished setting up the connection.
+	Opened time.Time
+}
+
+// Peer returns a short description of the client on the other end of the
+// connection: the subject of the certificate it presented, if any, or
+// otherwise its address.
+func (c *ConnInfo) Peer() string {
+	if c.TLS != nil && c.TLS.Mutual() {
+		return c.TLS.PeerCertificates[0].Subject
+	}
+	if c.RemoteAddr == nil || c.RemoteAddr.String() == "" {
+		return "unknown client"
+	}
+	return c.RemoteAddr.String()
+}
@@ -0,0 +1,64 @@
+package plugintrace
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// CrashInfo describes a plugin server process that exited unexpectedly, as
+// reported to the ProcessCrashed function of ClientTracer.
+type CrashInfo struct {
+	// Phase is the stage of the plugin's life when the process exited.
+	Phase CrashPhase
+
+	// State is the state of the exited process.
+	State *os.ProcessState
+
+	// ExitCode is the exit code of the process, or -1 if it was terminated
+	// by a signal. Signal is the name of that signal, if so.
+	ExitCode int
+	Signal   string
+
+	// Runtime is the time between the process starting and exiting.
+	Runtime time.Duration
+
+	// Stderr is the most recent output the process wrote to its stderr, or
+	// nil if the client wasn't retaining its output.
+	Stderr []byte
+}
+
+// String returns a short description of the crash, suitable for including
+// in log messages.
+func (c *CrashInfo) String() string {
+	how := fmt.Sprintf("exit code %d", c.ExitCode)
+	if c.Signal != "" {
+		how = fmt.Sprintf("signal %s", c.Signal)
+	}
+	return fmt.Sprintf("exited %s with %s after %s", c.Phase, how, c.Runtime)
+}
+
+// CrashPhase identifies the stage of a plugin's life when its server
+// process exited unexpectedly.
+type CrashPhase int
+
+const (
+	// CrashDuringHandshake means that the process exited before completing
+	// its handshake.
+	CrashDuringHandshake CrashPhase = iota
+
+	// CrashDuringSession means that the process exited after completing its
+	// handshake but before the client closed the plugin.
+	CrashDuringSession
+)
+
+func (p CrashPhase) String() string {
+	switch p {
+	case CrashDuringHandshake:
+		return "during handshake"
+	case CrashDuringSession:
+		return "during session"
+	default:
+		return fmt.Sprintf("CrashPhase(%d)", int(p))
+	}
+}
@@ -0,0 +1,91 @@
+package plugintrace
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// TraceEnvName is the name of the environment variable that enables the
+// built-in diagnostic tracing, so that end users can produce debug output
+// from any application that uses rpcplugin, whether or not the application
+// itself registers tracers.
+//
+// If the variable is set to "stderr" or "1", ContextClientTracer and
+// ContextServerTracer include tracers that log to the process's stderr
+// using ClientLogTracer and ServerLogTracer, in addition to any tracer
+// registered in the context. If it is set to an absolute path, the tracers
+// instead append to the file at that path, creating it if necessary.
+//
+// If the setting begins with "json", the tracers instead write one JSON
+// object per event using ClientJSONTracer and ServerJSONTracer: "json"
+// alone writes to stderr, and "json:" followed by an absolute path appends
+// to that file.
+//
+// Plugin server processes inherit the variable from their clients' own
+// environments, so setting it when running the host application traces
+// both sides. Because plugin clients pass on their servers' stderr output
+// only through ClientConfig.Stderr, an absolute path is the more reliable
+// choice for applications that discard it.
+const TraceEnvName = "RPCPLUGIN_TRACE"
+
+var envTracers struct {
+	once   sync.Once
+	client *ClientTracer
+	server *ServerTracer
+}
+
+// envClientTracer and envServerTracer return the tracers enabled by
+// TraceEnvName, or nil if it is not set.
+func envClientTracer() *ClientTracer {
+	envTracers.once.Do(initEnvTracers)
+	return envTracers.client
+}
+
+func envServerTracer() *ServerTracer {
+	envTracers.once.Do(initEnvTracers)
+	return envTracers.server
+}
+
+func initEnvTracers() {
+	setting := os.Getenv(TraceEnvName)
+	if setting == "json" || strings.HasPrefix(setting, "json:") {
+		w := envTraceWriter(strings.TrimPrefix(strings.TrimPrefix(setting, "json"), ":"))
+		if w == nil {
+			w = os.Stderr
+		}
+		envTracers.client = ClientJSONTracer(w)
+		envTracers.server = ServerJSONTracer(w)
+		return
+	}
+	w := envTraceWriter(setting)
+	if w == nil {
+		return
+	}
+	flags := log.LstdFlags | log.Lmicroseconds
+	envTracers.client = ClientLogTracer(log.New(w, "rpcplugin client: ", flags))
+	envTracers.server = ServerLogTracer(log.New(w, "rpcplugin server: ", flags))
+}
+
+func envTraceWriter(setting string) io.Writer {
+	switch strings.ToLower(setting) {
+	case "", "0", "off", "false":
+		return nil
+	case "stderr", "1", "on", "true":
+		return os.Stderr
+	}
+	if !filepath.IsAbs(setting) {
+		fmt.Fprintf(os.Stderr, "rpcplugin: %s must be \"stderr\" or an absolute path; tracing to stderr instead\n", TraceEnvName)
+		return os.Stderr
+	}
+	f, err := os.OpenFile(setting, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rpcplugin: cannot open trace file from %s: %s; tracing to stderr instead\n", TraceEnvName, err)
+		return os.Stderr
+	}
+	return f
+}
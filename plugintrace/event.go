@@ -0,0 +1,385 @@
+package plugintrace
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Event is a single trace event from a plugin client or server, as an
+// alternative to the individual functions of ClientTracer and ServerTracer
+// for applications that want to handle all events in the same way, such as
+// by forwarding them to an event bus or collecting them in tests.
+//
+// Kind says which event occurred, and therefore which of the other fields
+// are populated. The documentation for each kind gives the corresponding
+// ClientTracer or ServerTracer function, whose arguments are stored in the
+// fields of the same names or meanings. The other fields are zero.
+//
+// As with the tracer functions, the data structures referred to by pointers
+// in an event must not be modified.
+type Event struct {
+	Kind EventKind
+	Time time.Time
+
+	// Instance identifies the plugin instance for client events. It is zero
+	// for server events.
+	Instance Instance
+
+	Cmd          *exec.Cmd
+	Process      *os.Process
+	ProcessState *os.ProcessState
+	Addr         net.Addr
+	TLSConfig    *tls.Config
+	Certificate  *x509.Certificate
+	Call         *CallInfo
+	Crash        *CrashInfo
+	TLS          *TLSInfo
+	Conn         *ConnInfo
+	Err          error
+
+	// Auto is the "auto" argument of the TLSConfig events.
+	Auto bool
+
+	// RPCProtocol and ProtoVersion describe the negotiated protocol.
+	RPCProtocol  string
+	ProtoVersion int
+
+	// Line is the handshake line, or the invalid version string for
+	// ServerInvalidClientHandshakeVersion.
+	Line string
+
+	// Duration is the timeout or the elapsed time, depending on the event.
+	Duration time.Duration
+
+	// Flag is the boolean argument of events that have one: "discarded" for
+	// ClientStderrAttached, "graceful" for ClientProcessStopped, "present"
+	// for ServerHandshakeCookieInvalid, "forced" for ServerDrainFinished, and
+	// "connected" for ServerClientTimeout.
+	Flag bool
+
+	// Count is the interrupt count for ServerInterruptIgnored.
+	Count int
+
+	// Versions are the client's versions for ServerVersionNegotationFailed.
+	Versions []int
+
+	// From and To are the transports for ServerTransportFallback.
+	From, To string
+
+	// Name is the plugin name, PrevState and State the old and new states,
+	// and Reason the explanation for ClientManagedStateChanged.
+	Name             string
+	PrevState, State ManagedState
+	Reason           string
+
+	// Method is the full method name, Panic the value passed to panic, and
+	// Stack the stack trace for ServerHandlerPanicked.
+	Method string
+	Panic  interface{}
+	Stack  []byte
+}
+
+// EventKind identifies the kind of an Event.
+type EventKind int
+
+const (
+	invalidEventKind EventKind = iota
+
+	ClientProcessStart            // ClientTracer.ProcessStart
+	ClientProcessRunning          // ClientTracer.ProcessRunning
+	ClientProcessStartFailed      // ClientTracer.ProcessStartFailed
+	ClientProcessExited           // ClientTracer.ProcessExited
+	ClientStderrAttached          // ClientTracer.StderrAttached
+	ClientHandshakeReceived       // ClientTracer.HandshakeReceived
+	ClientHandshakeParsed         // ClientTracer.HandshakeParsed
+	ClientServerCertificatePinned // ClientTracer.ServerCertificatePinned
+	ClientTLSConfig               // ClientTracer.TLSConfig
+	ClientServerStarted           // ClientTracer.ServerStarted
+	ClientServerStartTimeout      // ClientTracer.ServerStartTimeout
+	ClientConnect                 // ClientTracer.Connect
+	ClientConnected               // ClientTracer.Connected
+	ClientConnectFailed           // ClientTracer.ConnectFailed
+	ClientCallCompleted           // ClientTracer.CallCompleted
+	ClientClosing                 // ClientTracer.Closing
+	ClientClosed                  // ClientTracer.Closed
+	ClientKillFailed              // ClientTracer.KillFailed
+	ClientCertificatesRotated     // ClientTracer.CertificatesRotated
+	ClientProcessStopped          // ClientTracer.ProcessStopped
+	ClientProcessCrashed          // ClientTracer.ProcessCrashed
+	ClientManagedStateChanged     // ClientTracer.ManagedStateChanged
+	ClientTLSHandshake            // ClientTracer.TLSHandshake
+
+	ServerHandshakeCookieInvalid        // ServerTracer.HandshakeCookieInvalid
+	ServerTLSConfig                     // ServerTracer.TLSConfig
+	ServerListening                     // ServerTracer.Listening
+	ServerTransportFallback             // ServerTracer.TransportFallback
+	ServerStdioRedirected               // ServerTracer.StdioRedirected
+	ServerHandshakeWritten              // ServerTracer.HandshakeWritten
+	ServerClientConnAccepted            // ServerTracer.ClientConnAccepted
+	ServerClientConnClosed              // ServerTracer.ClientConnClosed
+	ServerInterruptIgnored              // ServerTracer.InterruptIgnored
+	ServerInvalidClientHandshakeVersion // ServerTracer.InvalidClientHandshakeVersion
+	ServerVersionNegotationFailed       // ServerTracer.VersionNegotationFailed
+	ServerCallCompleted                 // ServerTracer.CallCompleted
+	ServerGRPCServeError                // ServerTracer.GRPCServeError
+	ServerDrainStarted                  // ServerTracer.DrainStarted
+	ServerDrainFinished                 // ServerTracer.DrainFinished
+	ServerGracefulStopStarted           // ServerTracer.GracefulStopStarted
+	ServerGracefulStopFinished          // ServerTracer.GracefulStopFinished
+	ServerCertificatesRotated           // ServerTracer.CertificatesRotated
+	ServerParentExited                  // ServerTracer.ParentExited
+	ServerClientTimeout                 // ServerTracer.ClientTimeout
+	ServerHandlerPanicked               // ServerTracer.HandlerPanicked
+	ServerTLSHandshake                  // ServerTracer.TLSHandshake
+
+	eventKindCount
+)
+
+var eventKindNames = [...]string{
+	ClientProcessStart:            "ClientProcessStart",
+	ClientProcessRunning:          "ClientProcessRunning",
+	ClientProcessStartFailed:      "ClientProcessStartFailed",
+	ClientProcessExited:           "ClientProcessExited",
+	ClientStderrAttached:          "ClientStderrAttached",
+	ClientHandshakeReceived:       "ClientHandshakeReceived",
+	ClientHandshakeParsed:         "ClientHandshakeParsed",
+	ClientServerCertificatePinned: "ClientServerCertificatePinned",
+	ClientTLSConfig:               "ClientTLSConfig",
+	ClientServerStarted:           "ClientServerStarted",
+	ClientServerStartTimeout:      "ClientServerStartTimeout",
+	ClientConnect:                 "ClientConnect",
+	ClientConnected:               "ClientConnected",
+	ClientConnectFailed:           "ClientConnectFailed",
+	ClientCallCompleted:           "ClientCallCompleted",
+	ClientClosing:                 "ClientClosing",
+	ClientClosed:                  "ClientClosed",
+	ClientKillFailed:              "ClientKillFailed",
+	ClientCertificatesRotated:     "ClientCertificatesRotated",
+	ClientProcessStopped:          "ClientProcessStopped",
+
+	ClientProcessCrashed:                "ClientProcessCrashed",
+	ClientManagedStateChanged:           "ClientManagedStateChanged",
+	ClientTLSHandshake:                  "ClientTLSHandshake",
+	ServerHandshakeCookieInvalid:        "ServerHandshakeCookieInvalid",
+	ServerTLSConfig:                     "ServerTLSConfig",
+	ServerListening:                     "ServerListening",
+	ServerTransportFallback:             "ServerTransportFallback",
+	ServerStdioRedirected:               "ServerStdioRedirected",
+	ServerHandshakeWritten:              "ServerHandshakeWritten",
+	ServerClientConnAccepted:            "ServerClientConnAccepted",
+	ServerClientConnClosed:              "ServerClientConnClosed",
+	ServerInterruptIgnored:              "ServerInterruptIgnored",
+	ServerInvalidClientHandshakeVersion: "ServerInvalidClientHandshakeVersion",
+	ServerVersionNegotationFailed:       "ServerVersionNegotationFailed",
+	ServerCallCompleted:                 "ServerCallCompleted",
+	ServerGRPCServeError:                "ServerGRPCServeError",
+	ServerDrainStarted:                  "ServerDrainStarted",
+	ServerDrainFinished:                 "ServerDrainFinished",
+	ServerGracefulStopStarted:           "ServerGracefulStopStarted",
+	ServerGracefulStopFinished:          "ServerGracefulStopFinished",
+	ServerCertificatesRotated:           "ServerCertificatesRotated",
+	ServerParentExited:                  "ServerParentExited",
+	ServerClientTimeout:                 "ServerClientTimeout",
+	ServerHandlerPanicked:               "ServerHandlerPanicked",
+	ServerTLSHandshake:                  "ServerTLSHandshake",
+}
+
+func (k EventKind) String() string {
+	if k <= invalidEventKind || k >= eventKindCount {
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+	return eventKindNames[k]
+}
+
+// EventHandler is the interface implemented by objects that receive trace
+// events from ClientEventTracer and ServerEventTracer.
+//
+// HandleEvent is called synchronously as each event occurs, possibly
+// concurrently from several goroutines, so implementations must be safe for
+// concurrent use and should return quickly.
+type EventHandler interface {
+	HandleEvent(Event)
+}
+
+// EventHandlerFunc is an adapter to allow the use of an ordinary function as
+// an EventHandler.
+type EventHandlerFunc func(Event)
+
+// HandleEvent implements EventHandler.
+func (f EventHandlerFunc) HandleEvent(e Event) {
+	f(e)
+}
+
+// EventChannel returns an EventHandler that sends each event to the given
+// channel.
+//
+// Sending blocks until the channel has room, which delays the plugin client
+// or server, so the caller must either receive from the channel promptly or
+// give it a buffer large enough for all of the events it expects.
+func EventChannel(ch chan<- Event) EventHandler {
+	return EventHandlerFunc(func(e Event) {
+		ch <- e
+	})
+}
+
+// ClientEventTracer returns a ClientTracer that delivers every client event
+// to the given handler as an Event.
+func ClientEventTracer(h EventHandler) *ClientTracer {
+	emit := func(e Event) {
+		e.Time = time.Now()
+		h.HandleEvent(e)
+	}
+	return &ClientTracer{
+		ProcessStart: func(inst Instance, cmd *exec.Cmd) {
+			emit(Event{Kind: ClientProcessStart, Instance: inst, Cmd: cmd})
+		},
+		ProcessRunning: func(inst Instance, proc *os.Process) {
+			emit(Event{Kind: ClientProcessRunning, Instance: inst, Process: proc})
+		},
+		ProcessStartFailed: func(inst Instance, cmd *exec.Cmd, err error) {
+			emit(Event{Kind: ClientProcessStartFailed, Instance: inst, Cmd: cmd, Err: err})
+		},
+		ProcessExited: func(inst Instance, state *os.ProcessState) {
+			emit(Event{Kind: ClientProcessExited, Instance: inst, ProcessState: state})
+		},
+		StderrAttached: func(inst Instance, proc *os.Process, discarded bool) {
+			emit(Event{Kind: ClientStderrAttached, Instance: inst, Process: proc, Flag: discarded})
+		},
+		HandshakeReceived: func(inst Instance, line string) {
+			emit(Event{Kind: ClientHandshakeReceived, Instance: inst, Line: line})
+		},
+		HandshakeParsed: func(inst Instance, rpcProtocol string, protoVersion int, addr net.Addr) {
+			emit(Event{Kind: ClientHandshakeParsed, Instance: inst, RPCProtocol: rpcProtocol, ProtoVersion: protoVersion, Addr: addr})
+		},
+		ServerCertificatePinned: func(inst Instance, cert *x509.Certificate) {
+			emit(Event{Kind: ClientServerCertificatePinned, Instance: inst, Certificate: cert})
+		},
+		TLSConfig: func(inst Instance, config *tls.Config, auto bool) {
+			emit(Event{Kind: ClientTLSConfig, Instance: inst, TLSConfig: config, Auto: auto})
+		},
+		ServerStarted: func(inst Instance, proc *os.Process, addr net.Addr, protoVersion int) {
+			emit(Event{Kind: ClientServerStarted, Instance: inst, Process: proc, Addr: addr, ProtoVersion: protoVersion})
+		},
+		ServerStartTimeout: func(inst Instance, proc *os.Process, timeout time.Duration) {
+			emit(Event{Kind: ClientServerStartTimeout, Instance: inst, Process: proc, Duration: timeout})
+		},
+		Connect: func(inst Instance, addr net.Addr) {
+			emit(Event{Kind: ClientConnect, Instance: inst, Addr: addr})
+		},
+		Connected: func(inst Instance, addr net.Addr) {
+			emit(Event{Kind: ClientConnected, Instance: inst, Addr: addr})
+		},
+		ConnectFailed: func(inst Instance, addr net.Addr, err error) {
+			emit(Event{Kind: ClientConnectFailed, Instance: inst, Addr: addr, Err: err})
+		},
+		CallCompleted: func(inst Instance, call *CallInfo) {
+			emit(Event{Kind: ClientCallCompleted, Instance: inst, Call: call})
+		},
+		Closing: func(inst Instance, proc *os.Process) {
+			emit(Event{Kind: ClientClosing, Instance: inst, Process: proc})
+		},
+		Closed: func(inst Instance, elapsed time.Duration) {
+			emit(Event{Kind: ClientClosed, Instance: inst, Duration: elapsed})
+		},
+		KillFailed: func(inst Instance, proc *os.Process, err error) {
+			emit(Event{Kind: ClientKillFailed, Instance: inst, Process: proc, Err: err})
+		},
+		ProcessStopped: func(inst Instance, proc *os.Process, graceful bool) {
+			emit(Event{Kind: ClientProcessStopped, Instance: inst, Process: proc, Flag: graceful})
+		},
+		CertificatesRotated: func(inst Instance) {
+			emit(Event{Kind: ClientCertificatesRotated, Instance: inst})
+		},
+		ProcessCrashed: func(inst Instance, crash *CrashInfo) {
+			emit(Event{Kind: ClientProcessCrashed, Instance: inst, ProcessState: crash.State, Crash: crash})
+		},
+		ManagedStateChanged: func(inst Instance, name string, from, to ManagedState, reason string) {
+			emit(Event{Kind: ClientManagedStateChanged, Instance: inst, Name: name, PrevState: from, State: to, Reason: reason})
+		},
+		TLSHandshake: func(inst Instance, info *TLSInfo) {
+			emit(Event{Kind: ClientTLSHandshake, Instance: inst, TLS: info})
+		},
+	}
+}
+
+// ServerEventTracer returns a ServerTracer that delivers every server event
+// to the given handler as an Event.
+func ServerEventTracer(h EventHandler) *ServerTracer {
+	emit := func(e Event) {
+		e.Time = time.Now()
+		h.HandleEvent(e)
+	}
+	return &ServerTracer{
+		HandshakeCookieInvalid: func(present bool) {
+			emit(Event{Kind: ServerHandshakeCookieInvalid, Flag: present})
+		},
+		TLSConfig: func(config *tls.Config, auto bool) {
+			emit(Event{Kind: ServerTLSConfig, TLSConfig: config, Auto: auto})
+		},
+		Listening: func(addr net.Addr, tlsConfig *tls.Config, protoVersion int) {
+			emit(Event{Kind: ServerListening, Addr: addr, TLSConfig: tlsConfig, ProtoVersion: protoVersion})
+		},
+		TransportFallback: func(from, to string, err error) {
+			emit(Event{Kind: ServerTransportFallback, From: from, To: to, Err: err})
+		},
+		StdioRedirected: func() {
+			emit(Event{Kind: ServerStdioRedirected})
+		},
+		HandshakeWritten: func(line string) {
+			emit(Event{Kind: ServerHandshakeWritten, Line: line})
+		},
+		ClientConnAccepted: func(conn *ConnInfo) {
+			emit(Event{Kind: ServerClientConnAccepted, Conn: conn, Addr: conn.RemoteAddr, TLS: conn.TLS})
+		},
+		ClientConnClosed: func(conn *ConnInfo, elapsed time.Duration) {
+			emit(Event{Kind: ServerClientConnClosed, Conn: conn, Addr: conn.RemoteAddr, TLS: conn.TLS, Duration: elapsed})
+		},
+		InterruptIgnored: func(count int) {
+			emit(Event{Kind: ServerInterruptIgnored, Count: count})
+		},
+		InvalidClientHandshakeVersion: func(invalid string) {
+			emit(Event{Kind: ServerInvalidClientHandshakeVersion, Line: invalid})
+		},
+		VersionNegotationFailed: func(clientVersions []int) {
+			emit(Event{Kind: ServerVersionNegotationFailed, Versions: clientVersions})
+		},
+		CallCompleted: func(call *CallInfo) {
+			emit(Event{Kind: ServerCallCompleted, Call: call})
+		},
+		GRPCServeError: func(err error) {
+			emit(Event{Kind: ServerGRPCServeError, Err: err})
+		},
+		DrainStarted: func(timeout time.Duration) {
+			emit(Event{Kind: ServerDrainStarted, Duration: timeout})
+		},
+		DrainFinished: func(elapsed time.Duration, forced bool) {
+			emit(Event{Kind: ServerDrainFinished, Duration: elapsed, Flag: forced})
+		},
+		GracefulStopStarted: func() {
+			emit(Event{Kind: ServerGracefulStopStarted})
+		},
+		GracefulStopFinished: func(elapsed time.Duration) {
+			emit(Event{Kind: ServerGracefulStopFinished, Duration: elapsed})
+		},
+		CertificatesRotated: func() {
+			emit(Event{Kind: ServerCertificatesRotated})
+		},
+		ParentExited: func() {
+			emit(Event{Kind: ServerParentExited})
+		},
+		ClientTimeout: func(connected bool, timeout time.Duration) {
+			emit(Event{Kind: ServerClientTimeout, Duration: timeout, Flag: connected})
+		},
+		HandlerPanicked: func(method string, value interface{}, stack []byte) {
+			emit(Event{Kind: ServerHandlerPanicked, Method: method, Panic: value, Stack: stack})
+		},
+		TLSHandshake: func(remoteAddr net.Addr, info *TLSInfo) {
+			emit(Event{Kind: ServerTLSHandshake, Addr: remoteAddr, TLS: info})
+		},
+	}
+}
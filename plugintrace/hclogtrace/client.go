@@ -0,0 +1,175 @@
+package hclogtrace
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+)
+
+// ClientHCLogTracer constructs a plugintrace.ClientTracer that will emit
+// log entries into the given logger when trace events occur.
+//
+// Each entry has a short, fixed message describing the event, with the
+// details of the event as key/value pairs such as "pid", "addr", and
+// "proto_version". Entries about a particular plugin instance come from a
+// sub-logger with "plugin_id" and "plugin_pid" pairs identifying it. The set
+// of pairs may grow in future versions.
+func ClientHCLogTracer(logger hclog.Logger) *plugintrace.ClientTracer {
+	return &plugintrace.ClientTracer{
+		ProcessStart: func(inst plugintrace.Instance, cmd *exec.Cmd) {
+			instLogger(logger, inst).Info("launching plugin server", "path", cmd.Path, "args", cmd.Args)
+		},
+
+		ProcessRunning: func(inst plugintrace.Instance, proc *os.Process) {
+			instLogger(logger, inst).Debug("plugin server process started", "pid", proc.Pid)
+		},
+
+		ProcessStartFailed: func(inst plugintrace.Instance, cmd *exec.Cmd, err error) {
+			instLogger(logger, inst).Error("failed to start plugin server", "path", cmd.Path, "error", err)
+		},
+
+		ProcessExited: func(inst plugintrace.Instance, state *os.ProcessState) {
+			instLogger(logger, inst).Info("plugin server process exited",
+				"pid", state.Pid(),
+				"exit_code", state.ExitCode(),
+				"state", state.String(),
+			)
+		},
+
+		StderrAttached: func(inst plugintrace.Instance, proc *os.Process, discarded bool) {
+			instLogger(logger, inst).Debug("plugin server stderr attached", "pid", proc.Pid, "discarded", discarded)
+		},
+
+		HandshakeReceived: func(inst plugintrace.Instance, line string) {
+			instLogger(logger, inst).Debug("received plugin server handshake", "line", line)
+		},
+
+		HandshakeParsed: func(inst plugintrace.Instance, rpcProtocol string, protoVersion int, addr net.Addr) {
+			instLogger(logger, inst).Debug("parsed plugin server handshake",
+				"rpc_protocol", rpcProtocol,
+				"proto_version", protoVersion,
+				"network", addr.Network(), "addr", addr.String(),
+			)
+		},
+
+		ServerCertificatePinned: func(inst plugintrace.Instance, cert *x509.Certificate) {
+			instLogger(logger, inst).Debug("pinned plugin server certificate", "serial", cert.SerialNumber.String())
+		},
+
+		TLSConfig: func(inst plugintrace.Instance, config *tls.Config, auto bool) {
+			if config == nil {
+				instLogger(logger, inst).Warn("TLS is entirely disabled")
+				return
+			}
+			instLogger(logger, inst).Debug("TLS configuration ready", "auto", auto)
+		},
+
+		ServerStarted: func(inst plugintrace.Instance, proc *os.Process, addr net.Addr, protoVersion int) {
+			instLogger(logger, inst).Info("plugin server started",
+				"pid", proc.Pid,
+				"network", addr.Network(), "addr", addr.String(),
+				"proto_version", protoVersion,
+			)
+		},
+
+		ServerStartTimeout: func(inst plugintrace.Instance, proc *os.Process, timeout time.Duration) {
+			instLogger(logger, inst).Error("timeout waiting for plugin server handshake",
+				"pid", proc.Pid,
+				"timeout", timeout,
+			)
+		},
+
+		Connect: func(inst plugintrace.Instance, addr net.Addr) {
+			instLogger(logger, inst).Debug("connecting to plugin server", "network", addr.Network(), "addr", addr.String())
+		},
+
+		Connected: func(inst plugintrace.Instance, addr net.Addr) {
+			instLogger(logger, inst).Debug("connected to plugin server", "network", addr.Network(), "addr", addr.String())
+		},
+
+		ConnectFailed: func(inst plugintrace.Instance, addr net.Addr, err error) {
+			instLogger(logger, inst).Error("failed to connect to plugin server", "network", addr.Network(), "addr", addr.String(), "error", err)
+		},
+
+		CallCompleted: func(inst plugintrace.Instance, call *plugintrace.CallInfo) {
+			instLogger(logger, inst).Debug("plugin call completed", callArgs(call)...)
+		},
+
+		Closing: func(inst plugintrace.Instance, proc *os.Process) {
+			instLogger(logger, inst).Info("closing plugin server", "pid", proc.Pid)
+		},
+
+		Closed: func(inst plugintrace.Instance, elapsed time.Duration) {
+			instLogger(logger, inst).Info("plugin closed", "elapsed", elapsed)
+		},
+
+		KillFailed: func(inst plugintrace.Instance, proc *os.Process, err error) {
+			instLogger(logger, inst).Error("failed to kill plugin server", "pid", proc.Pid, "error", err)
+		},
+
+		ProcessStopped: func(inst plugintrace.Instance, proc *os.Process, graceful bool) {
+			instLogger(logger, inst).Info("plugin server stopped", "pid", proc.Pid, "graceful", graceful)
+		},
+
+		CertificatesRotated: func(inst plugintrace.Instance) {
+			instLogger(logger, inst).Info("rotated auto-negotiated TLS certificates")
+		},
+
+		ProcessCrashed: func(inst plugintrace.Instance, crash *plugintrace.CrashInfo) {
+			instLogger(logger, inst).Error("plugin server process crashed",
+				"phase", crash.Phase.String(),
+				"exit_code", crash.ExitCode,
+				"signal", crash.Signal,
+				"runtime", crash.Runtime,
+			)
+		},
+
+		ManagedStateChanged: func(inst plugintrace.Instance, name string, from, to plugintrace.ManagedState, reason string) {
+			instLogger(logger, inst).Info("managed plugin changed state",
+				"name", name,
+				"from", from.String(),
+				"to", to.String(),
+				"reason", reason,
+			)
+		},
+
+		TLSHandshake: func(inst plugintrace.Instance, info *plugintrace.TLSInfo) {
+			args := []interface{}{"tls_version", info.Version, "cipher_suite", info.CipherSuite}
+			if info.Mutual() {
+				peer := info.PeerCertificates[0]
+				args = append(args, "peer_subject", peer.Subject, "peer_sha256", peer.SHA256)
+			}
+			instLogger(logger, inst).Debug("TLS connection established", args...)
+		},
+	}
+}
+
+// instLogger returns a logger that includes pairs identifying the given
+// plugin instance in each entry.
+func instLogger(logger hclog.Logger, inst plugintrace.Instance) hclog.Logger {
+	return logger.With("plugin_id", inst.ID, "plugin_pid", inst.PID)
+}
+
+// callArgs returns the key/value pairs describing the given completed call.
+func callArgs(call *plugintrace.CallInfo) []interface{} {
+	args := []interface{}{
+		"method", call.Method,
+		"stream", call.Stream,
+		"duration", call.Duration,
+		"code", call.Code.String(),
+		"sent_messages", call.SentMessages,
+		"recv_messages", call.RecvMessages,
+		"sent_bytes", call.SentBytes,
+		"recv_bytes", call.RecvBytes,
+	}
+	if call.Err != nil {
+		args = append(args, "error", call.Err)
+	}
+	return args
+}
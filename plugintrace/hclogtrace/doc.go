@@ -0,0 +1,8 @@
+// Package hclogtrace provides tracers for rpcplugin clients and servers that
+// write their lifecycle events to a HashiCorp hclog logger, for applications
+// whose logging is already based on hclog, such as those migrating from
+// HashiCorp's go-plugin library.
+//
+// This package is a separate Go module so that applications using rpcplugin
+// without hclog do not depend on it.
+package hclogtrace // import go.rpcplugin.org/rpcplugin/plugintrace/hclogtrace
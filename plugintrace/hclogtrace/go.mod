@@ -0,0 +1,19 @@
+module go.rpcplugin.org/rpcplugin/plugintrace/hclogtrace
+
+go 1.20
+
+replace go.rpcplugin.org/rpcplugin => ../..
+
+require (
+	github.com/hashicorp/go-hclog v1.6.3
+	go.rpcplugin.org/rpcplugin v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/apparentlymart/go-shquot v0.0.1 // indirect
+	github.com/fatih/color v1.13.0 // indirect
+	github.com/mattn/go-colorable v0.1.12 // indirect
+	github.com/mattn/go-isatty v0.0.14 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+	google.golang.org/grpc v1.19.1 // indirect
+)
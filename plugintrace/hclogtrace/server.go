@@ -0,0 +1,146 @@
+package hclogtrace
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+)
+
+// ServerHCLogTracer constructs a plugintrace.ServerTracer that will emit
+// log entries into the given logger when trace events occur.
+//
+// Each entry has a short, fixed message describing the event, with the
+// details of the event as key/value pairs such as "addr" and
+// "proto_version". The set of pairs may grow in future versions.
+func ServerHCLogTracer(logger hclog.Logger) *plugintrace.ServerTracer {
+	return &plugintrace.ServerTracer{
+		HandshakeCookieInvalid: func(present bool) {
+			logger.Error("invalid handshake cookie", "present", present)
+		},
+
+		TLSConfig: func(config *tls.Config, auto bool) {
+			if config == nil {
+				logger.Warn("TLS is entirely disabled")
+				return
+			}
+			logger.Debug("TLS configuration ready", "auto", auto)
+		},
+
+		Listening: func(addr net.Addr, tlsConfig *tls.Config, protoVersion int) {
+			logger.Info("plugin server listening",
+				"network", addr.Network(), "addr", addr.String(),
+				"proto_version", protoVersion,
+				"tls", tlsConfig != nil,
+			)
+		},
+
+		TransportFallback: func(from, to string, err error) {
+			logger.Warn("falling back to another transport",
+				"from", from,
+				"to", to,
+				"error", err,
+			)
+		},
+
+		StdioRedirected: func() {
+			logger.Debug("redirected stdout and stderr")
+		},
+
+		HandshakeWritten: func(line string) {
+			logger.Debug("wrote handshake", "line", line)
+		},
+
+		ClientConnAccepted: func(conn *plugintrace.ConnInfo) {
+			logger.Debug("accepted client connection", connArgs(conn)...)
+		},
+
+		ClientConnClosed: func(conn *plugintrace.ConnInfo, elapsed time.Duration) {
+			logger.Debug("client connection closed", append(connArgs(conn), "elapsed", elapsed)...)
+		},
+
+		InterruptIgnored: func(count int) {
+			logger.Debug("ignored interrupt signal", "count", count)
+		},
+
+		InvalidClientHandshakeVersion: func(invalid string) {
+			logger.Warn("invalid version in client handshake", "version", invalid)
+		},
+
+		VersionNegotationFailed: func(clientVersions []int) {
+			logger.Error("protocol version negotiation failed", "client_versions", clientVersions)
+		},
+
+		CallCompleted: func(call *plugintrace.CallInfo) {
+			logger.Debug("plugin call completed", callArgs(call)...)
+		},
+
+		GRPCServeError: func(err error) {
+			logger.Error("gRPC server failed", "error", err)
+		},
+
+		DrainStarted: func(timeout time.Duration) {
+			logger.Info("shutting down", "timeout", timeout)
+		},
+
+		DrainFinished: func(elapsed time.Duration, forced bool) {
+			logger.Info("shutdown complete",
+				"elapsed", elapsed,
+				"forced", forced,
+			)
+		},
+
+		GracefulStopStarted: func() {
+			logger.Debug("graceful stop started")
+		},
+
+		GracefulStopFinished: func(elapsed time.Duration) {
+			logger.Debug("graceful stop finished", "elapsed", elapsed)
+		},
+
+		CertificatesRotated: func() {
+			logger.Info("rotated auto-negotiated TLS certificate")
+		},
+
+		ParentExited: func() {
+			logger.Warn("client process has exited; shutting down")
+		},
+
+		ClientTimeout: func(connected bool, timeout time.Duration) {
+			logger.Warn("client timeout; shutting down",
+				"timeout", timeout,
+				"connected", connected,
+			)
+		},
+
+		HandlerPanicked: func(method string, value interface{}, stack []byte) {
+			logger.Error("panic in RPC handler",
+				"method", method,
+				"panic", value,
+				"stack", string(stack),
+			)
+		},
+
+		TLSHandshake: func(remoteAddr net.Addr, info *plugintrace.TLSInfo) {
+			args := []interface{}{"remote_addr", remoteAddr.String(), "tls_version", info.Version, "cipher_suite", info.CipherSuite}
+			if !info.Mutual() {
+				logger.Warn("TLS connection is not mutually authenticated", args...)
+				return
+			}
+			peer := info.PeerCertificates[0]
+			args = append(args, "peer_subject", peer.Subject, "peer_sha256", peer.SHA256)
+			logger.Debug("TLS connection established", args...)
+		},
+	}
+}
+
+// connArgs returns the arguments that identify a client connection.
+func connArgs(conn *plugintrace.ConnInfo) []interface{} {
+	args := []interface{}{"conn_id", conn.ID, "peer", conn.Peer()}
+	if conn.TLS != nil && conn.TLS.Mutual() {
+		args = append(args, "peer_sha256", conn.TLS.PeerCertificates[0].SHA256)
+	}
+	return args
+}
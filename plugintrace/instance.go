@@ -0,0 +1,28 @@
+package plugintrace
+
+import (
+	"fmt"
+)
+
+// Instance identifies the plugin instance that a client trace event relates
+// to, so that the events of several plugins running concurrently can be
+// told apart even when they are all reported to the same tracer.
+type Instance struct {
+	// ID is a number that uniquely identifies the plugin instance within
+	// the client process for the whole of its life.
+	ID uint64
+
+	// PID is the process ID of the plugin server's child process, or zero
+	// if the process hasn't started yet or if the plugin was created by
+	// rpcplugin.Attach and so has no child process.
+	PID int
+}
+
+// String returns a short description of the instance, suitable for
+// including in log messages.
+func (i Instance) String() string {
+	if i.PID == 0 {
+		return fmt.Sprintf("plugin %d", i.ID)
+	}
+	return fmt.Sprintf("plugin %d (pid %d)", i.ID, i.PID)
+}
@@ -0,0 +1,210 @@
+package plugintrace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ClientJSONTracer returns a ClientTracer that writes each client event to
+// the given writer as a single line containing a JSON object, for ingestion
+// by log pipelines or for making assertions in integration tests.
+//
+// Each object has at least the properties "time", in RFC 3339 format with
+// nanoseconds, "event", which is the name of the event's EventKind, such as
+// "ClientProcessStart", and "plugin_id", which is the ID of the plugin
+// instance. Other properties describe the event's arguments as for the
+// fields of Event, using names in snake_case, and are omitted when not
+// relevant to the event. Durations are in milliseconds.
+//
+// The property names are stable, but future versions may add properties.
+// The tracer writes each line using a single call to the writer's Write
+// method, and never makes concurrent calls.
+func ClientJSONTracer(w io.Writer) *ClientTracer {
+	return ClientEventTracer(newJSONEmitter(w))
+}
+
+// ServerJSONTracer returns a ServerTracer that writes each server event to
+// the given writer as a single line containing a JSON object, in the same
+// way as ClientJSONTracer except that there is no "plugin_id" property.
+func ServerJSONTracer(w io.Writer) *ServerTracer {
+	return ServerEventTracer(newJSONEmitter(w))
+}
+
+func newJSONEmitter(w io.Writer) EventHandler {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return EventHandlerFunc(func(e Event) {
+		obj := newJSONEvent(e)
+		mu.Lock()
+		defer mu.Unlock()
+		// A tracer has nowhere to report its own errors, so we ignore them.
+		enc.Encode(obj)
+	})
+}
+
+// jsonEvent is the JSON representation of an Event.
+type jsonEvent struct {
+	Time     string `json:"time"`
+	Event    string `json:"event"`
+	PluginID uint64 `json:"plugin_id,omitempty"`
+	PID      int    `json:"pid,omitempty"`
+
+	Path     string   `json:"path,omitempty"`
+	Args     []string `json:"args,omitempty"`
+	ExitCode *int     `json:"exit_code,omitempty"`
+	Network  string   `json:"network,omitempty"`
+	Addr     string   `json:"addr,omitempty"`
+	Error    string   `json:"error,omitempty"`
+
+	ConnID         uint64 `json:"conn_id,omitempty"`
+	TLSAuto        *bool  `json:"tls_auto,omitempty"`
+	TLSVersion     string `json:"tls_version,omitempty"`
+	TLSCipherSuite string `json:"tls_cipher_suite,omitempty"`
+	PeerSubject    string `json:"peer_subject,omitempty"`
+	PeerSHA256     string `json:"peer_sha256,omitempty"`
+	CertSubject    string `json:"cert_subject,omitempty"`
+	CertNotAfter   string `json:"cert_not_after,omitempty"`
+
+	Method       string   `json:"method,omitempty"`
+	Stream       bool     `json:"stream,omitempty"`
+	Code         string   `json:"code,omitempty"`
+	SentMessages *int     `json:"sent_messages,omitempty"`
+	RecvMessages *int     `json:"recv_messages,omitempty"`
+	SentBytes    *int     `json:"sent_bytes,omitempty"`
+	RecvBytes    *int     `json:"recv_bytes,omitempty"`
+	DurationMS   *float64 `json:"duration_ms,omitempty"`
+
+	CrashPhase string   `json:"crash_phase,omitempty"`
+	Signal     string   `json:"signal,omitempty"`
+	RuntimeMS  *float64 `json:"runtime_ms,omitempty"`
+	Stderr     string   `json:"stderr,omitempty"`
+
+	RPCProtocol  string `json:"rpc_protocol,omitempty"`
+	ProtoVersion *int   `json:"proto_version,omitempty"`
+	Line         string `json:"line,omitempty"`
+	Flag         *bool  `json:"flag,omitempty"`
+	Count        int    `json:"count,omitempty"`
+	Versions     []int  `json:"versions,omitempty"`
+	From         string `json:"from,omitempty"`
+	To           string `json:"to,omitempty"`
+
+	Name      string `json:"name,omitempty"`
+	PrevState string `json:"prev_state,omitempty"`
+	State     string `json:"state,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+
+	Panic string `json:"panic,omitempty"`
+	Stack string `json:"stack,omitempty"`
+}
+
+// jsonFlagKinds are the event kinds whose Flag field is meaningful even when
+// false, and so is always included.
+var jsonFlagKinds = map[EventKind]bool{
+	ClientStderrAttached:         true,
+	ClientProcessStopped:         true,
+	ServerHandshakeCookieInvalid: true,
+	ServerDrainFinished:          true,
+	ServerClientTimeout:          true,
+}
+
+func newJSONEvent(e Event) *jsonEvent {
+	ret := &jsonEvent{
+		Time:     e.Time.Format(time.RFC3339Nano),
+		Event:    e.Kind.String(),
+		PluginID: e.Instance.ID,
+		PID:      e.Instance.PID,
+
+		Line:     e.Line,
+		Count:    e.Count,
+		Versions: e.Versions,
+		From:     e.From,
+		To:       e.To,
+		Name:     e.Name,
+		Reason:   e.Reason,
+		Method:   e.Method,
+		Stack:    string(e.Stack),
+	}
+	if e.Cmd != nil {
+		ret.Path = e.Cmd.Path
+		ret.Args = e.Cmd.Args
+	}
+	if e.Process != nil && ret.PID == 0 {
+		ret.PID = e.Process.Pid
+	}
+	if e.ProcessState != nil {
+		code := e.ProcessState.ExitCode()
+		ret.ExitCode = &code
+	}
+	if e.Addr != nil {
+		ret.Network = e.Addr.Network()
+		ret.Addr = e.Addr.String()
+	}
+	if e.Err != nil {
+		ret.Error = e.Err.Error()
+	}
+	if e.Certificate != nil {
+		ret.CertSubject = e.Certificate.Subject.String()
+		ret.CertNotAfter = e.Certificate.NotAfter.Format(time.RFC3339)
+	}
+	if e.Conn != nil {
+		ret.ConnID = e.Conn.ID
+	}
+	if t := e.TLS; t != nil {
+		ret.TLSVersion = t.Version
+		ret.TLSCipherSuite = t.CipherSuite
+		if t.Mutual() {
+			ret.PeerSubject = t.PeerCertificates[0].Subject
+			ret.PeerSHA256 = t.PeerCertificates[0].SHA256
+		}
+	}
+	if c := e.Call; c != nil {
+		ret.Method = c.Method
+		ret.Stream = c.Stream
+		ret.Code = c.Code.String()
+		ret.SentMessages = &c.SentMessages
+		ret.RecvMessages = &c.RecvMessages
+		ret.SentBytes = &c.SentBytes
+		ret.RecvBytes = &c.RecvBytes
+		ret.DurationMS = jsonMillis(c.Duration)
+		if c.Err != nil {
+			ret.Error = c.Err.Error()
+		}
+	}
+	if c := e.Crash; c != nil {
+		ret.CrashPhase = c.Phase.String()
+		ret.ExitCode = &c.ExitCode
+		ret.Signal = c.Signal
+		ret.RuntimeMS = jsonMillis(c.Runtime)
+		ret.Stderr = string(c.Stderr)
+	}
+	ret.RPCProtocol = e.RPCProtocol
+	switch e.Kind {
+	case ClientHandshakeParsed, ClientServerStarted, ServerListening:
+		ret.ProtoVersion = &e.ProtoVersion
+	}
+	if e.Duration != 0 {
+		ret.DurationMS = jsonMillis(e.Duration)
+	}
+	if e.Kind == ClientTLSConfig || e.Kind == ServerTLSConfig {
+		ret.TLSAuto = &e.Auto
+	}
+	if jsonFlagKinds[e.Kind] {
+		ret.Flag = &e.Flag
+	}
+	if e.Kind == ClientManagedStateChanged {
+		ret.PrevState = e.PrevState.String()
+		ret.State = e.State.String()
+	}
+	if e.Panic != nil {
+		ret.Panic = fmt.Sprint(e.Panic)
+	}
+	return ret
+}
+
+func jsonMillis(d time.Duration) *float64 {
+	ms := float64(d) / float64(time.Millisecond)
+	return &ms
+}
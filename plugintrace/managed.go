@@ -0,0 +1,48 @@
+package plugintrace
+
+import (
+	"fmt"
+)
+
+// ManagedState is the state of a plugin supervised by an
+// rpcplugin.Manager, as reported to the ManagedStateChanged function of
+// ClientTracer.
+type ManagedState int
+
+const (
+	// ManagedStopped means that the plugin is not running because it was
+	// stopped using the Manager's Stop or Close methods, or was never started.
+	ManagedStopped ManagedState = iota
+
+	// ManagedRunning means that the plugin server is running.
+	ManagedRunning
+
+	// ManagedRestarting means that the plugin server exited and the Manager
+	// is starting a new one.
+	ManagedRestarting
+
+	// ManagedExited means that the plugin server exited and its restart
+	// policy didn't call for a restart.
+	ManagedExited
+
+	// ManagedCrashLooping means that the plugin server failed too often
+	// within its restart window, and so the Manager stopped restarting it.
+	ManagedCrashLooping
+)
+
+func (s ManagedState) String() string {
+	switch s {
+	case ManagedStopped:
+		return "stopped"
+	case ManagedRunning:
+		return "running"
+	case ManagedRestarting:
+		return "restarting"
+	case ManagedExited:
+		return "exited"
+	case ManagedCrashLooping:
+		return "crash-looping"
+	default:
+		return fmt.Sprintf("ManagedState(%d)", int(s))
+	}
+}
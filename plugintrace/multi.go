@@ -0,0 +1,359 @@
+package plugintrace
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// MultiClientTracer returns a ClientTracer that passes each event to all of
+// the given tracers in turn, so that a client can, for example, log events
+// and record metrics about them at the same time.
+//
+// Nil tracers, and nil functions within the given tracers, are ignored.
+func MultiClientTracer(tracers ...*ClientTracer) *ClientTracer {
+	var ts []*ClientTracer
+	for _, t := range tracers {
+		if t != nil {
+			ts = append(ts, t)
+		}
+	}
+
+	return &ClientTracer{
+		ProcessStart: func(inst Instance, cmd *exec.Cmd) {
+			for _, t := range ts {
+				if t.ProcessStart != nil {
+					t.ProcessStart(inst, cmd)
+				}
+			}
+		},
+		ProcessRunning: func(inst Instance, proc *os.Process) {
+			for _, t := range ts {
+				if t.ProcessRunning != nil {
+					t.ProcessRunning(inst, proc)
+				}
+			}
+		},
+		ProcessStartFailed: func(inst Instance, cmd *exec.Cmd, err error) {
+			for _, t := range ts {
+				if t.ProcessStartFailed != nil {
+					t.ProcessStartFailed(inst, cmd, err)
+				}
+			}
+		},
+		ProcessExited: func(inst Instance, state *os.ProcessState) {
+			for _, t := range ts {
+				if t.ProcessExited != nil {
+					t.ProcessExited(inst, state)
+				}
+			}
+		},
+		StderrAttached: func(inst Instance, proc *os.Process, discarded bool) {
+			for _, t := range ts {
+				if t.StderrAttached != nil {
+					t.StderrAttached(inst, proc, discarded)
+				}
+			}
+		},
+		HandshakeReceived: func(inst Instance, line string) {
+			for _, t := range ts {
+				if t.HandshakeReceived != nil {
+					t.HandshakeReceived(inst, line)
+				}
+			}
+		},
+		HandshakeParsed: func(inst Instance, rpcProtocol string, protoVersion int, addr net.Addr) {
+			for _, t := range ts {
+				if t.HandshakeParsed != nil {
+					t.HandshakeParsed(inst, rpcProtocol, protoVersion, addr)
+				}
+			}
+		},
+		ServerCertificatePinned: func(inst Instance, cert *x509.Certificate) {
+			for _, t := range ts {
+				if t.ServerCertificatePinned != nil {
+					t.ServerCertificatePinned(inst, cert)
+				}
+			}
+		},
+		TLSConfig: func(inst Instance, config *tls.Config, auto bool) {
+			for _, t := range ts {
+				if t.TLSConfig != nil {
+					t.TLSConfig(inst, config, auto)
+				}
+			}
+		},
+		ServerStarted: func(inst Instance, proc *os.Process, addr net.Addr, protoVersion int) {
+			for _, t := range ts {
+				if t.ServerStarted != nil {
+					t.ServerStarted(inst, proc, addr, protoVersion)
+				}
+			}
+		},
+		ServerStartTimeout: func(inst Instance, proc *os.Process, timeout time.Duration) {
+			for _, t := range ts {
+				if t.ServerStartTimeout != nil {
+					t.ServerStartTimeout(inst, proc, timeout)
+				}
+			}
+		},
+		Connect: func(inst Instance, addr net.Addr) {
+			for _, t := range ts {
+				if t.Connect != nil {
+					t.Connect(inst, addr)
+				}
+			}
+		},
+		Connected: func(inst Instance, addr net.Addr) {
+			for _, t := range ts {
+				if t.Connected != nil {
+					t.Connected(inst, addr)
+				}
+			}
+		},
+		ConnectFailed: func(inst Instance, addr net.Addr, err error) {
+			for _, t := range ts {
+				if t.ConnectFailed != nil {
+					t.ConnectFailed(inst, addr, err)
+				}
+			}
+		},
+		CallCompleted: func(inst Instance, call *CallInfo) {
+			for _, t := range ts {
+				if t.CallCompleted != nil {
+					t.CallCompleted(inst, call)
+				}
+			}
+		},
+		Closing: func(inst Instance, proc *os.Process) {
+			for _, t := range ts {
+				if t.Closing != nil {
+					t.Closing(inst, proc)
+				}
+			}
+		},
+		Closed: func(inst Instance, elapsed time.Duration) {
+			for _, t := range ts {
+				if t.Closed != nil {
+					t.Closed(inst, elapsed)
+				}
+			}
+		},
+		KillFailed: func(inst Instance, proc *os.Process, err error) {
+			for _, t := range ts {
+				if t.KillFailed != nil {
+					t.KillFailed(inst, proc, err)
+				}
+			}
+		},
+		ProcessStopped: func(inst Instance, proc *os.Process, graceful bool) {
+			for _, t := range ts {
+				if t.ProcessStopped != nil {
+					t.ProcessStopped(inst, proc, graceful)
+				}
+			}
+		},
+		CertificatesRotated: func(inst Instance) {
+			for _, t := range ts {
+				if t.CertificatesRotated != nil {
+					t.CertificatesRotated(inst)
+				}
+			}
+		},
+		ProcessCrashed: func(inst Instance, crash *CrashInfo) {
+			for _, t := range ts {
+				if t.ProcessCrashed != nil {
+					t.ProcessCrashed(inst, crash)
+				}
+			}
+		},
+		ManagedStateChanged: func(inst Instance, name string, from, to ManagedState, reason string) {
+			for _, t := range ts {
+				if t.ManagedStateChanged != nil {
+					t.ManagedStateChanged(inst, name, from, to, reason)
+				}
+			}
+		},
+		TLSHandshake: func(inst Instance, info *TLSInfo) {
+			for _, t := range ts {
+				if t.TLSHandshake != nil {
+					t.TLSHandshake(inst, info)
+				}
+			}
+		},
+	}
+}
+
+// MultiServerTracer returns a ServerTracer that passes each event to all of
+// the given tracers in turn, so that a server can, for example, log events
+// and record metrics about them at the same time.
+//
+// Nil tracers, and nil functions within the given tracers, are ignored.
+func MultiServerTracer(tracers ...*ServerTracer) *ServerTracer {
+	var ts []*ServerTracer
+	for _, t := range tracers {
+		if t != nil {
+			ts = append(ts, t)
+		}
+	}
+
+	return &ServerTracer{
+		HandshakeCookieInvalid: func(present bool) {
+			for _, t := range ts {
+				if t.HandshakeCookieInvalid != nil {
+					t.HandshakeCookieInvalid(present)
+				}
+			}
+		},
+		TLSConfig: func(config *tls.Config, auto bool) {
+			for _, t := range ts {
+				if t.TLSConfig != nil {
+					t.TLSConfig(config, auto)
+				}
+			}
+		},
+		Listening: func(addr net.Addr, tlsConfig *tls.Config, protoVersion int) {
+			for _, t := range ts {
+				if t.Listening != nil {
+					t.Listening(addr, tlsConfig, protoVersion)
+				}
+			}
+		},
+		TransportFallback: func(from, to string, err error) {
+			for _, t := range ts {
+				if t.TransportFallback != nil {
+					t.TransportFallback(from, to, err)
+				}
+			}
+		},
+		StdioRedirected: func() {
+			for _, t := range ts {
+				if t.StdioRedirected != nil {
+					t.StdioRedirected()
+				}
+			}
+		},
+		HandshakeWritten: func(line string) {
+			for _, t := range ts {
+				if t.HandshakeWritten != nil {
+					t.HandshakeWritten(line)
+				}
+			}
+		},
+		ClientConnAccepted: func(conn *ConnInfo) {
+			for _, t := range ts {
+				if t.ClientConnAccepted != nil {
+					t.ClientConnAccepted(conn)
+				}
+			}
+		},
+		ClientConnClosed: func(conn *ConnInfo, elapsed time.Duration) {
+			for _, t := range ts {
+				if t.ClientConnClosed != nil {
+					t.ClientConnClosed(conn, elapsed)
+				}
+			}
+		},
+		InterruptIgnored: func(count int) {
+			for _, t := range ts {
+				if t.InterruptIgnored != nil {
+					t.InterruptIgnored(count)
+				}
+			}
+		},
+		InvalidClientHandshakeVersion: func(invalid string) {
+			for _, t := range ts {
+				if t.InvalidClientHandshakeVersion != nil {
+					t.InvalidClientHandshakeVersion(invalid)
+				}
+			}
+		},
+		VersionNegotationFailed: func(clientVersions []int) {
+			for _, t := range ts {
+				if t.VersionNegotationFailed != nil {
+					t.VersionNegotationFailed(clientVersions)
+				}
+			}
+		},
+		CallCompleted: func(call *CallInfo) {
+			for _, t := range ts {
+				if t.CallCompleted != nil {
+					t.CallCompleted(call)
+				}
+			}
+		},
+		GRPCServeError: func(err error) {
+			for _, t := range ts {
+				if t.GRPCServeError != nil {
+					t.GRPCServeError(err)
+				}
+			}
+		},
+		DrainStarted: func(timeout time.Duration) {
+			for _, t := range ts {
+				if t.DrainStarted != nil {
+					t.DrainStarted(timeout)
+				}
+			}
+		},
+		DrainFinished: func(elapsed time.Duration, forced bool) {
+			for _, t := range ts {
+				if t.DrainFinished != nil {
+					t.DrainFinished(elapsed, forced)
+				}
+			}
+		},
+		GracefulStopStarted: func() {
+			for _, t := range ts {
+				if t.GracefulStopStarted != nil {
+					t.GracefulStopStarted()
+				}
+			}
+		},
+		GracefulStopFinished: func(elapsed time.Duration) {
+			for _, t := range ts {
+				if t.GracefulStopFinished != nil {
+					t.GracefulStopFinished(elapsed)
+				}
+			}
+		},
+		CertificatesRotated: func() {
+			for _, t := range ts {
+				if t.CertificatesRotated != nil {
+					t.CertificatesRotated()
+				}
+			}
+		},
+		ParentExited: func() {
+			for _, t := range ts {
+				if t.ParentExited != nil {
+					t.ParentExited()
+				}
+			}
+		},
+		ClientTimeout: func(connected bool, timeout time.Duration) {
+			for _, t := range ts {
+				if t.ClientTimeout != nil {
+					t.ClientTimeout(connected, timeout)
+				}
+			}
+		},
+		HandlerPanicked: func(method string, value interface{}, stack []byte) {
+			for _, t := range ts {
+				if t.HandlerPanicked != nil {
+					t.HandlerPanicked(method, value, stack)
+				}
+			}
+		},
+		TLSHandshake: func(remoteAddr net.Addr, info *TLSInfo) {
+			for _, t := range ts {
+				if t.TLSHandshake != nil {
+					t.TLSHandshake(remoteAddr, info)
+				}
+			}
+		},
+	}
+}
@@ -0,0 +1,192 @@
+package oteltrace
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+)
+
+// ClientTracer returns a plugintrace.ClientTracer that records the lifecycle
+// of a single plugin as OpenTelemetry spans created by the given tracer.
+//
+// The tracer creates a root span named "rpcplugin.plugin" as a child of
+// any span in the given context when the plugin process is launched, and
+// ends it when the process exits. Beneath that root span it creates spans
+// for launching the process, waiting for the handshake, each connection to
+// the plugin server, and closing the plugin.
+//
+// Because the root span represents a single plugin, callers must create a
+// separate tracer for each call to rpcplugin.New.
+func ClientTracer(ctx context.Context, tracer trace.Tracer) *plugintrace.ClientTracer {
+	s := &clientSpans{
+		ctx:    ctx,
+		tracer: tracer,
+	}
+	return &plugintrace.ClientTracer{
+		ProcessStart: func(inst plugintrace.Instance, cmd *exec.Cmd) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.rootCtx, s.root = tracer.Start(ctx, "rpcplugin.plugin", trace.WithAttributes(
+				attribute.Int64("rpcplugin.instance.id", int64(inst.ID)),
+				attribute.String("process.executable.path", cmd.Path),
+			))
+			_, s.launch = tracer.Start(s.rootCtx, "rpcplugin.launch")
+		},
+
+		ProcessRunning: func(inst plugintrace.Instance, proc *os.Process) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			pid := attribute.Int("process.pid", proc.Pid)
+			s.root.SetAttributes(pid)
+			s.launch.SetAttributes(pid)
+			s.launch.End()
+			_, s.handshake = tracer.Start(s.rootCtx, "rpcplugin.handshake")
+		},
+
+		ProcessStartFailed: func(inst plugintrace.Instance, cmd *exec.Cmd, err error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			endWithError(s.launch, err)
+			endWithError(s.root, err)
+		},
+
+		ProcessExited: func(inst plugintrace.Instance, state *os.ProcessState) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.closing != nil {
+				s.closing.End()
+			}
+			if s.root != nil {
+				s.root.SetAttributes(attribute.Int("process.exit.code", state.ExitCode()))
+				s.root.End()
+			}
+		},
+
+		TLSConfig: func(inst plugintrace.Instance, config *tls.Config, auto bool) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			span := s.handshake
+			if span == nil {
+				// Attached plugins have no handshake, or even a root span.
+				return
+			}
+			span.AddEvent("rpcplugin.tls", trace.WithAttributes(
+				attribute.Bool("rpcplugin.tls.enabled", config != nil),
+				attribute.Bool("rpcplugin.tls.auto", auto),
+			))
+		},
+
+		ServerStarted: func(inst plugintrace.Instance, proc *os.Process, addr net.Addr, protoVersion int) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			attrs := []attribute.KeyValue{
+				attribute.String("network.transport", addr.Network()),
+				attribute.String("server.address", addr.String()),
+				attribute.Int("rpcplugin.proto_version", protoVersion),
+			}
+			s.root.SetAttributes(attrs...)
+			s.handshake.SetAttributes(attrs...)
+			s.handshake.End()
+		},
+
+		ServerStartTimeout: func(inst plugintrace.Instance, proc *os.Process, timeout time.Duration) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.handshake.SetAttributes(attribute.String("rpcplugin.timeout", timeout.String()))
+			s.handshake.SetStatus(codes.Error, "timeout waiting for plugin server handshake")
+			s.handshake.End()
+		},
+
+		Connect: func(inst plugintrace.Instance, addr net.Addr) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			_, span := tracer.Start(s.parentCtx(), "rpcplugin.connect", trace.WithAttributes(
+				attribute.String("network.transport", addr.Network()),
+				attribute.String("server.address", addr.String()),
+			))
+			s.connects = append(s.connects, span)
+		},
+
+		Connected: func(inst plugintrace.Instance, addr net.Addr) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if span := s.nextConnect(); span != nil {
+				span.End()
+			}
+		},
+
+		ConnectFailed: func(inst plugintrace.Instance, addr net.Addr, err error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if span := s.nextConnect(); span != nil {
+				endWithError(span, err)
+			}
+		},
+
+		Closing: func(inst plugintrace.Instance, proc *os.Process) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			_, s.closing = tracer.Start(s.parentCtx(), "rpcplugin.close")
+		},
+
+		CertificatesRotated: func(inst plugintrace.Instance) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.root != nil {
+				s.root.AddEvent("rpcplugin.certificates_rotated")
+			}
+		},
+	}
+}
+
+type clientSpans struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	tracer trace.Tracer
+
+	root    trace.Span
+	rootCtx context.Context
+
+	launch    trace.Span
+	handshake trace.Span
+	closing   trace.Span
+
+	// connects are the spans for connections in progress, in the order
+	// they began. Concurrent connections to the same plugin can't be
+	// distinguished in the trace events, so we assume they complete in the
+	// same order.
+	connects []trace.Span
+}
+
+// parentCtx returns the context to use as the parent of new spans, which is
+// the root span's context if there is a root span.
+func (s *clientSpans) parentCtx() context.Context {
+	if s.rootCtx != nil {
+		return s.rootCtx
+	}
+	return s.ctx
+}
+
+func (s *clientSpans) nextConnect() trace.Span {
+	if len(s.connects) == 0 {
+		return nil
+	}
+	span := s.connects[0]
+	s.connects = s.connects[1:]
+	return span
+}
+
+func endWithError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	span.End()
+}
@@ -0,0 +1,6 @@
+// Package oteltrace provides tracers for rpcplugin clients and servers that
+// record their lifecycle events as OpenTelemetry spans.
+//
+// This package is a separate Go module so that applications using rpcplugin
+// without OpenTelemetry do not depend on the OpenTelemetry libraries.
+package oteltrace // import go.rpcplugin.org/rpcplugin/plugintrace/oteltrace
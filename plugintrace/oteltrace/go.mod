@@ -0,0 +1,16 @@
+module go.rpcplugin.org/rpcplugin/plugintrace/oteltrace
+
+go 1.20
+
+require (
+	go.opentelemetry.io/otel v1.21.0
+	go.opentelemetry.io/otel/trace v1.21.0
+	go.rpcplugin.org/rpcplugin v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/apparentlymart/go-shquot v0.0.1 // indirect
+	google.golang.org/grpc v1.19.1 // indirect
+)
+
+replace go.rpcplugin.org/rpcplugin => ../..
@@ -0,0 +1,90 @@
+package oteltrace
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+)
+
+// ServerTracer returns a plugintrace.ServerTracer that records the lifecycle
+// of a plugin server as OpenTelemetry spans created by the given tracer.
+//
+// The tracer immediately creates a root span named "rpcplugin.server" as a
+// child of any span in the given context, and ends it once the server has
+// shut down. Beneath that root span it creates a span for shutting down,
+// and it records other events in the server's lifecycle as span events.
+func ServerTracer(ctx context.Context, tracer trace.Tracer) *plugintrace.ServerTracer {
+	rootCtx, root := tracer.Start(ctx, "rpcplugin.server")
+	var mu sync.Mutex
+	var drain trace.Span
+
+	return &plugintrace.ServerTracer{
+		TLSConfig: func(config *tls.Config, auto bool) {
+			root.AddEvent("rpcplugin.tls", trace.WithAttributes(
+				attribute.Bool("rpcplugin.tls.enabled", config != nil),
+				attribute.Bool("rpcplugin.tls.auto", auto),
+			))
+		},
+
+		Listening: func(addr net.Addr, tlsConfig *tls.Config, protoVersion int) {
+			root.SetAttributes(
+				attribute.String("network.transport", addr.Network()),
+				attribute.String("server.address", addr.String()),
+				attribute.Int("rpcplugin.proto_version", protoVersion),
+			)
+			root.AddEvent("rpcplugin.listening")
+		},
+
+		InterruptIgnored: func(count int) {
+			root.AddEvent("rpcplugin.interrupt_ignored", trace.WithAttributes(
+				attribute.Int("rpcplugin.interrupt.count", count),
+			))
+		},
+
+		InvalidClientHandshakeVersion: func(invalid string) {
+			root.AddEvent("rpcplugin.invalid_client_version", trace.WithAttributes(
+				attribute.String("rpcplugin.version", invalid),
+			))
+		},
+
+		VersionNegotationFailed: func(clientVersions []int) {
+			root.SetAttributes(attribute.IntSlice("rpcplugin.client_versions", clientVersions))
+			endWithError(root, fmt.Errorf("no protocol versions in common with the client"))
+		},
+
+		GRPCServeError: func(err error) {
+			root.RecordError(err)
+			root.SetStatus(codes.Error, err.Error())
+		},
+
+		DrainStarted: func(timeout time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			_, drain = tracer.Start(rootCtx, "rpcplugin.drain", trace.WithAttributes(
+				attribute.String("rpcplugin.timeout", timeout.String()),
+			))
+		},
+
+		DrainFinished: func(elapsed time.Duration, forced bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			if drain != nil {
+				drain.SetAttributes(attribute.Bool("rpcplugin.drain.forced", forced))
+				drain.End()
+			}
+			root.End()
+		},
+
+		CertificatesRotated: func() {
+			root.AddEvent("rpcplugin.certificates_rotated")
+		},
+	}
+}
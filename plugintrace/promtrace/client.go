@@ -0,0 +1,132 @@
+package promtrace
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+)
+
+// ClientMetrics is a set of Prometheus metrics describing the plugins
+// launched by a client application.
+//
+// Use NewClientMetrics to create and register the metrics, and then use
+// Tracer to create a tracer for each plugin. All of the tracers created from
+// the same ClientMetrics contribute to the same metrics.
+type ClientMetrics struct {
+	starts            prometheus.Counter
+	startFailures     prometheus.Counter
+	restarts          prometheus.Counter
+	handshakeTimeouts prometheus.Counter
+	handshakeDuration prometheus.Histogram
+	connectFailures   prometheus.Counter
+}
+
+// NewClientMetrics creates a ClientMetrics and registers its metrics with
+// the given registerer, returning an error if registration fails.
+//
+// All of the metric names begin with "rpcplugin_client_".
+func NewClientMetrics(reg prometheus.Registerer) (*ClientMetrics, error) {
+	m := &ClientMetrics{
+		starts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "rpcplugin",
+			Subsystem: "client",
+			Name:      "plugin_starts_total",
+			Help:      "Number of plugin processes launched.",
+		}),
+		startFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "rpcplugin",
+			Subsystem: "client",
+			Name:      "plugin_start_failures_total",
+			Help:      "Number of plugin processes that could not be launched.",
+		}),
+		restarts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "rpcplugin",
+			Subsystem: "client",
+			Name:      "plugin_restarts_total",
+			Help:      "Number of plugin processes launched to replace an earlier process.",
+		}),
+		handshakeTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "rpcplugin",
+			Subsystem: "client",
+			Name:      "handshake_timeouts_total",
+			Help:      "Number of plugin processes that did not complete the handshake in time.",
+		}),
+		handshakeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "rpcplugin",
+			Subsystem: "client",
+			Name:      "handshake_duration_seconds",
+			Help:      "Time from launching a plugin process until it completed the handshake.",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}),
+		connectFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "rpcplugin",
+			Subsystem: "client",
+			Name:      "connect_failures_total",
+			Help:      "Number of failed attempts to connect to a plugin server.",
+		}),
+	}
+
+	for _, c := range []prometheus.Collector{
+		m.starts,
+		m.startFailures,
+		m.restarts,
+		m.handshakeTimeouts,
+		m.handshakeDuration,
+		m.connectFailures,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Tracer returns a new plugintrace.ClientTracer that updates the metrics.
+//
+// A tracer that observes more than one plugin process being launched counts
+// each launch after the first as a restart, so applications that relaunch a
+// plugin after it exits should reuse the same tracer for the new process,
+// while using a separate tracer for each distinct plugin.
+func (m *ClientMetrics) Tracer() *plugintrace.ClientTracer {
+	var mu sync.Mutex
+	var launched bool
+	var startTime time.Time
+
+	return &plugintrace.ClientTracer{
+		ProcessStart: func(inst plugintrace.Instance, cmd *exec.Cmd) {
+			mu.Lock()
+			defer mu.Unlock()
+			if launched {
+				m.restarts.Inc()
+			}
+			launched = true
+			startTime = time.Now()
+			m.starts.Inc()
+		},
+
+		ProcessStartFailed: func(inst plugintrace.Instance, cmd *exec.Cmd, err error) {
+			m.startFailures.Inc()
+		},
+
+		ServerStarted: func(inst plugintrace.Instance, proc *os.Process, addr net.Addr, protoVersion int) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !startTime.IsZero() {
+				m.handshakeDuration.Observe(time.Since(startTime).Seconds())
+			}
+		},
+
+		ServerStartTimeout: func(inst plugintrace.Instance, proc *os.Process, timeout time.Duration) {
+			m.handshakeTimeouts.Inc()
+		},
+
+		ConnectFailed: func(inst plugintrace.Instance, addr net.Addr, err error) {
+			m.connectFailures.Inc()
+		},
+	}
+}
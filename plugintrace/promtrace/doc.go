@@ -0,0 +1,6 @@
+// Package promtrace provides tracers for rpcplugin clients and servers that
+// record their lifecycle events as Prometheus metrics.
+//
+// This package is a separate Go module so that applications using rpcplugin
+// without Prometheus do not depend on the Prometheus client libraries.
+package promtrace // import go.rpcplugin.org/rpcplugin/plugintrace/promtrace
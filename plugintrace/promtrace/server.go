@@ -0,0 +1,109 @@
+package promtrace
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+)
+
+// ServerMetrics is a set of Prometheus metrics describing a plugin server.
+//
+// Use NewServerMetrics to create and register the metrics, and then use
+// Tracer to create a tracer for the server.
+type ServerMetrics struct {
+	interruptsIgnored  prometheus.Counter
+	negotiationFailure prometheus.Counter
+	serveErrors        prometheus.Counter
+	drainDuration      prometheus.Histogram
+	forcedDrains       prometheus.Counter
+	handlerPanics      prometheus.Counter
+}
+
+// NewServerMetrics creates a ServerMetrics and registers its metrics with
+// the given registerer, returning an error if registration fails.
+//
+// All of the metric names begin with "rpcplugin_server_".
+func NewServerMetrics(reg prometheus.Registerer) (*ServerMetrics, error) {
+	m := &ServerMetrics{
+		interruptsIgnored: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "rpcplugin",
+			Subsystem: "server",
+			Name:      "interrupts_ignored_total",
+			Help:      "Number of interrupt signals the server ignored.",
+		}),
+		negotiationFailure: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "rpcplugin",
+			Subsystem: "server",
+			Name:      "version_negotiation_failures_total",
+			Help:      "Number of times the server had no protocol versions in common with the client.",
+		}),
+		serveErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "rpcplugin",
+			Subsystem: "server",
+			Name:      "serve_errors_total",
+			Help:      "Number of errors returned from the gRPC server.",
+		}),
+		drainDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "rpcplugin",
+			Subsystem: "server",
+			Name:      "drain_duration_seconds",
+			Help:      "Time taken to drain in-flight requests during shutdown.",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}),
+		forcedDrains: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "rpcplugin",
+			Subsystem: "server",
+			Name:      "forced_drains_total",
+			Help:      "Number of shutdowns where in-flight requests were cancelled after the drain timeout.",
+		}),
+		handlerPanics: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "rpcplugin",
+			Subsystem: "server",
+			Name:      "handler_panics_total",
+			Help:      "Number of RPC handler panics the server recovered from.",
+		}),
+	}
+
+	for _, c := range []prometheus.Collector{
+		m.interruptsIgnored,
+		m.negotiationFailure,
+		m.serveErrors,
+		m.drainDuration,
+		m.forcedDrains,
+		m.handlerPanics,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Tracer returns a new plugintrace.ServerTracer that updates the metrics.
+func (m *ServerMetrics) Tracer() *plugintrace.ServerTracer {
+	return &plugintrace.ServerTracer{
+		InterruptIgnored: func(count int) {
+			m.interruptsIgnored.Inc()
+		},
+
+		VersionNegotationFailed: func(clientVersions []int) {
+			m.negotiationFailure.Inc()
+		},
+
+		GRPCServeError: func(err error) {
+			m.serveErrors.Inc()
+		},
+
+		DrainFinished: func(elapsed time.Duration, forced bool) {
+			m.drainDuration.Observe(elapsed.Seconds())
+			if forced {
+				m.forcedDrains.Inc()
+			}
+		},
+
+		HandlerPanicked: func(method string, value interface{}, stack []byte) {
+			m.handlerPanics.Inc()
+		},
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"net"
+	"time"
 )
 
 // ServerTracer contains function pointers that, if set, will be called when
@@ -13,6 +14,12 @@ import (
 // Some trace functions recieve mutable data structures via pointers for
 // efficiency. Making any modifications to those data structures is forbidden.
 type ServerTracer struct {
+	// HandshakeCookieInvalid is called if the server's environment does not
+	// contain the expected handshake cookie, which usually means that the
+	// plugin program was run directly rather than by a plugin client. If
+	// present is true, the cookie variable was set but had the wrong value.
+	HandshakeCookieInvalid func(present bool)
+
 	// TLSConfig is called when server TLS configuration is complete. If and
 	// only if the auto-negotiation protocol was used to produce a single-use
 	// certificate, auto is true.
@@ -22,6 +29,32 @@ type ServerTracer struct {
 	// address where it is listening and other negotiated parameters.
 	Listening func(addr net.Addr, tlsConfig *tls.Config, protoVersion int)
 
+	// TransportFallback is called if the server could not listen using one
+	// of the transports the client supports, and so is trying the next one
+	// in the client's order of preference, such as "tcp" after "unix".
+	TransportFallback func(from, to string, err error)
+
+	// StdioRedirected is called once the server has redirected os.Stdout
+	// and os.Stderr to pipes, so that the real stdout is reserved for the
+	// handshake.
+	StdioRedirected func()
+
+	// HandshakeWritten is called once the server has written the handshake
+	// line to its real stdout, giving the line without its trailing newline.
+	HandshakeWritten func(line string)
+
+	// ClientConnAccepted and ClientConnClosed are called when a connection
+	// from a client becomes ready for RPC calls and when it is closed,
+	// respectively. ClientConnAccepted is called only after any TLS
+	// handshake has completed, so that conn can identify the client by its
+	// certificate, and it is called for each connection an in-process server
+	// or a multiplexed session carries, too.
+	//
+	// The elapsed argument of ClientConnClosed is how long the connection was
+	// open.
+	ClientConnAccepted func(conn *ConnInfo)
+	ClientConnClosed   func(conn *ConnInfo, elapsed time.Duration)
+
 	// InterruptIgnored is called if the server is monitoring interrupt
 	// signals and such a signal is received. The count argument is how many
 	// interrupts have been received since the server started.
@@ -40,8 +73,56 @@ type ServerTracer struct {
 	// The argument is the set of version numbers the client supports.
 	VersionNegotationFailed func(clientVersions []int)
 
+	// CallCompleted is called after the server handles each RPC call from
+	// the client, if the server was configured with TraceCalls set.
+	CallCompleted func(call *CallInfo)
+
 	// GRPCServeError is called if the GRPC server exits with an error.
 	GRPCServeError func(error)
+
+	// DrainStarted is called when the server begins shutting down, before
+	// it waits for requests in progress to complete. The timeout argument
+	// is the maximum time it will wait.
+	DrainStarted func(timeout time.Duration)
+
+	// DrainFinished is called once the server has finished shutting down.
+	// If forced is true, the drain timeout elapsed and so any requests
+	// still in progress were terminated.
+	DrainFinished func(elapsed time.Duration, forced bool)
+
+	// GracefulStopStarted is called when the gRPC server stops accepting new
+	// requests during shutdown, and GracefulStopFinished is called once all
+	// of the requests in progress at that time have completed, or were
+	// terminated because the drain timeout elapsed.
+	GracefulStopStarted  func()
+	GracefulStopFinished func(elapsed time.Duration)
+
+	// CertificatesRotated is called after the server has replaced its
+	// automatically-negotiated TLS certificate at the client's request.
+	CertificatesRotated func()
+
+	// ParentExited is called if ServerConfig.ExitWithParent is set and the
+	// server detects that the client process has exited, before the server
+	// begins shutting down.
+	ParentExited func()
+
+	// ClientTimeout is called if the server is shutting down because no
+	// client connected within ServerConfig.ConnectTimeout after the handshake,
+	// in which case connected is false, or because all client connections
+	// remained closed for ServerConfig.IdleTimeout, in which case connected is
+	// true.
+	ClientTimeout func(connected bool, timeout time.Duration)
+
+	// HandlerPanicked is called if the server was configured with RecoverPanics
+	// set and the handler for an RPC call panicked, giving the full method name,
+	// the value passed to panic, and the stack trace of the panicking goroutine.
+	// The client receives only an Internal status without these details.
+	HandlerPanicked func(method string, value interface{}, stack []byte)
+
+	// TLSHandshake is called each time the server completes a TLS handshake
+	// with a client, giving the client's address and describing the negotiated
+	// TLS version, cipher suite and client certificate, if any.
+	TLSHandshake func(remoteAddr net.Addr, info *TLSInfo)
 }
 
 type serverCtxKeyType int
@@ -62,11 +143,20 @@ func WithServerTracer(ctx context.Context, tracer *ServerTracer) context.Context
 // ContextServerTracer retrieves the ServerTracer object associated with the
 // given context. If none is associated, a no-op tracer is returned.
 //
+// If the environment variable named by TraceEnvName enables the built-in
+// tracing, the result also passes each event to the built-in tracer.
+//
 // Do not modify any part of the returned tracer.
 func ContextServerTracer(ctx context.Context) *ServerTracer {
 	tracer, ok := ctx.Value(serverCtxKey).(*ServerTracer)
-	if !ok {
+	env := envServerTracer()
+	switch {
+	case !ok && env == nil:
 		return noopServerTrace
+	case !ok:
+		return env
+	case env != nil:
+		return MultiServerTracer(tracer, env)
 	}
 	return tracer
 }
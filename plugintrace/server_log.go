@@ -6,6 +6,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // ServerLogTracer constructs a ServerTracer that will emit human-oriented log entries
@@ -16,6 +17,14 @@ import (
 // build log messages yourself.
 func ServerLogTracer(logger *log.Logger) *ServerTracer {
 	return &ServerTracer{
+		HandshakeCookieInvalid: func(present bool) {
+			if present {
+				logger.Println("handshake cookie has incorrect value")
+			} else {
+				logger.Println("handshake cookie is not set")
+			}
+		},
+
 		TLSConfig: func(config *tls.Config, auto bool) {
 			if config == nil {
 				logger.Println("TLS is entirely disabled")
@@ -32,6 +41,26 @@ func ServerLogTracer(logger *log.Logger) *ServerTracer {
 			logger.Printf("protocol version %d listening on %s", protoVersion, addr)
 		},
 
+		TransportFallback: func(from, to string, err error) {
+			logger.Printf("cannot listen using %s, so trying %s: %s", from, to, err)
+		},
+
+		StdioRedirected: func() {
+			logger.Println("redirected stdout and stderr")
+		},
+
+		HandshakeWritten: func(line string) {
+			logger.Printf("wrote handshake %q", line)
+		},
+
+		ClientConnAccepted: func(conn *ConnInfo) {
+			logger.Printf("accepted connection %d from %s", conn.ID, conn.Peer())
+		},
+
+		ClientConnClosed: func(conn *ConnInfo, elapsed time.Duration) {
+			logger.Printf("connection %d from %s closed after %s", conn.ID, conn.Peer(), elapsed)
+		},
+
 		InterruptIgnored: func(count int) {
 			logger.Printf("ignored interrupt signal (attempt %d)", count)
 		},
@@ -52,8 +81,68 @@ func ServerLogTracer(logger *log.Logger) *ServerTracer {
 			logger.Printf("version negotiation failed: client supports only %s", strings.Join(vStrs, ", "))
 		},
 
+		CallCompleted: func(call *CallInfo) {
+			if call.Err != nil {
+				logger.Printf("call to %s failed after %s: %s", call.Method, call.Duration, call.Err)
+				return
+			}
+			logger.Printf("call to %s completed in %s", call.Method, call.Duration)
+		},
+
 		GRPCServeError: func(err error) {
 			logger.Printf("failed to start GRPC server: %s", err)
 		},
+
+		DrainStarted: func(timeout time.Duration) {
+			if timeout <= 0 {
+				logger.Println("shutting down; terminating any requests in progress")
+				return
+			}
+			logger.Printf("shutting down; waiting up to %s for requests in progress", timeout)
+		},
+
+		DrainFinished: func(elapsed time.Duration, forced bool) {
+			if forced {
+				logger.Printf("terminated remaining requests after %s", elapsed)
+				return
+			}
+			logger.Printf("all requests completed after %s", elapsed)
+		},
+
+		GracefulStopStarted: func() {
+			logger.Println("no longer accepting new requests")
+		},
+
+		GracefulStopFinished: func(elapsed time.Duration) {
+			logger.Printf("graceful stop finished after %s", elapsed)
+		},
+
+		CertificatesRotated: func() {
+			logger.Println("rotated auto-negotiated TLS certificate")
+		},
+
+		ParentExited: func() {
+			logger.Println("client process has exited; shutting down")
+		},
+
+		ClientTimeout: func(connected bool, timeout time.Duration) {
+			if connected {
+				logger.Printf("no client connections for %s; shutting down", timeout)
+				return
+			}
+			logger.Printf("no client connected within %s; shutting down", timeout)
+		},
+
+		HandlerPanicked: func(method string, value interface{}, stack []byte) {
+			logger.Printf("panic in handler for %s: %v\n%s", method, value, stack)
+		},
+
+		TLSHandshake: func(remoteAddr net.Addr, info *TLSInfo) {
+			if !info.Mutual() {
+				logger.Printf("WARNING: TLS connection from %s is not mutually authenticated: %s", remoteAddr, info)
+				return
+			}
+			logger.Printf("TLS connection from %s established: %s", remoteAddr, info)
+		},
 	}
 }
@@ -0,0 +1,187 @@
+package slogtrace
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+)
+
+// ClientSlogTracer constructs a plugintrace.ClientTracer that will emit
+// structured log records into the given logger when trace events occur.
+//
+// Each record has a short, fixed message describing the event, with the
+// details of the event in attributes such as "pid", "addr", and
+// "proto_version", so that the records are suitable for machine processing.
+// The set of attributes may grow in future versions.
+func ClientSlogTracer(logger *slog.Logger) *plugintrace.ClientTracer {
+	ctx := context.Background()
+	return &plugintrace.ClientTracer{
+		ProcessStart: func(inst plugintrace.Instance, cmd *exec.Cmd) {
+			logger.InfoContext(ctx, "launching plugin server", slogInstance(inst), slog.String("path", cmd.Path), slog.Any("args", cmd.Args))
+		},
+
+		ProcessRunning: func(inst plugintrace.Instance, proc *os.Process) {
+			logger.DebugContext(ctx, "plugin server process started", slogInstance(inst), slog.Int("pid", proc.Pid))
+		},
+
+		ProcessStartFailed: func(inst plugintrace.Instance, cmd *exec.Cmd, err error) {
+			logger.ErrorContext(ctx, "failed to start plugin server", slogInstance(inst), slog.String("path", cmd.Path), slog.Any("error", err))
+		},
+
+		ProcessExited: func(inst plugintrace.Instance, state *os.ProcessState) {
+			logger.InfoContext(ctx, "plugin server process exited", slogInstance(inst),
+				slog.Int("pid", state.Pid()),
+				slog.Int("exit_code", state.ExitCode()),
+				slog.String("state", state.String()),
+			)
+		},
+
+		StderrAttached: func(inst plugintrace.Instance, proc *os.Process, discarded bool) {
+			logger.DebugContext(ctx, "plugin server stderr attached", slogInstance(inst), slog.Int("pid", proc.Pid), slog.Bool("discarded", discarded))
+		},
+
+		HandshakeReceived: func(inst plugintrace.Instance, line string) {
+			logger.DebugContext(ctx, "received plugin server handshake", slogInstance(inst), slog.String("line", line))
+		},
+
+		HandshakeParsed: func(inst plugintrace.Instance, rpcProtocol string, protoVersion int, addr net.Addr) {
+			logger.DebugContext(ctx, "parsed plugin server handshake", slogInstance(inst),
+				slog.String("rpc_protocol", rpcProtocol),
+				slog.Int("proto_version", protoVersion),
+				slogAddr(addr),
+			)
+		},
+
+		ServerCertificatePinned: func(inst plugintrace.Instance, cert *x509.Certificate) {
+			logger.DebugContext(ctx, "pinned plugin server certificate", slogInstance(inst), slog.String("serial", cert.SerialNumber.String()))
+		},
+
+		TLSConfig: func(inst plugintrace.Instance, config *tls.Config, auto bool) {
+			if config == nil {
+				logger.WarnContext(ctx, "TLS is entirely disabled", slogInstance(inst))
+				return
+			}
+			logger.DebugContext(ctx, "TLS configuration ready", slogInstance(inst), slog.Bool("auto", auto))
+		},
+
+		ServerStarted: func(inst plugintrace.Instance, proc *os.Process, addr net.Addr, protoVersion int) {
+			logger.InfoContext(ctx, "plugin server started", slogInstance(inst),
+				slog.Int("pid", proc.Pid),
+				slogAddr(addr),
+				slog.Int("proto_version", protoVersion),
+			)
+		},
+
+		ServerStartTimeout: func(inst plugintrace.Instance, proc *os.Process, timeout time.Duration) {
+			logger.ErrorContext(ctx, "timeout waiting for plugin server handshake", slogInstance(inst),
+				slog.Int("pid", proc.Pid),
+				slog.Duration("timeout", timeout),
+			)
+		},
+
+		Connect: func(inst plugintrace.Instance, addr net.Addr) {
+			logger.DebugContext(ctx, "connecting to plugin server", slogInstance(inst), slogAddr(addr))
+		},
+
+		Connected: func(inst plugintrace.Instance, addr net.Addr) {
+			logger.DebugContext(ctx, "connected to plugin server", slogInstance(inst), slogAddr(addr))
+		},
+
+		ConnectFailed: func(inst plugintrace.Instance, addr net.Addr, err error) {
+			logger.ErrorContext(ctx, "failed to connect to plugin server", slogInstance(inst), slogAddr(addr), slog.Any("error", err))
+		},
+
+		CallCompleted: func(inst plugintrace.Instance, call *plugintrace.CallInfo) {
+			logger.DebugContext(ctx, "plugin call completed", append([]any{slogInstance(inst)}, slogCall(call)...)...)
+		},
+
+		Closing: func(inst plugintrace.Instance, proc *os.Process) {
+			logger.InfoContext(ctx, "closing plugin server", slogInstance(inst), slog.Int("pid", proc.Pid))
+		},
+
+		Closed: func(inst plugintrace.Instance, elapsed time.Duration) {
+			logger.InfoContext(ctx, "plugin closed", slogInstance(inst), slog.Duration("elapsed", elapsed))
+		},
+
+		KillFailed: func(inst plugintrace.Instance, proc *os.Process, err error) {
+			logger.ErrorContext(ctx, "failed to kill plugin server", slogInstance(inst), slog.Int("pid", proc.Pid), slog.Any("error", err))
+		},
+
+		ProcessStopped: func(inst plugintrace.Instance, proc *os.Process, graceful bool) {
+			logger.InfoContext(ctx, "plugin server stopped", slogInstance(inst), slog.Int("pid", proc.Pid), slog.Bool("graceful", graceful))
+		},
+
+		CertificatesRotated: func(inst plugintrace.Instance) {
+			logger.InfoContext(ctx, "rotated auto-negotiated TLS certificates", slogInstance(inst))
+		},
+
+		ProcessCrashed: func(inst plugintrace.Instance, crash *plugintrace.CrashInfo) {
+			logger.ErrorContext(ctx, "plugin server process crashed", slogInstance(inst),
+				slog.String("phase", crash.Phase.String()),
+				slog.Int("exit_code", crash.ExitCode),
+				slog.String("signal", crash.Signal),
+				slog.Duration("runtime", crash.Runtime),
+			)
+		},
+
+		ManagedStateChanged: func(inst plugintrace.Instance, name string, from, to plugintrace.ManagedState, reason string) {
+			logger.InfoContext(ctx, "managed plugin changed state", slogInstance(inst),
+				slog.String("name", name),
+				slog.String("from", from.String()),
+				slog.String("to", to.String()),
+				slog.String("reason", reason),
+			)
+		},
+
+		TLSHandshake: func(inst plugintrace.Instance, info *plugintrace.TLSInfo) {
+			attrs := []any{slogInstance(inst), slog.String("tls_version", info.Version), slog.String("cipher_suite", info.CipherSuite)}
+			if info.Mutual() {
+				peer := info.PeerCertificates[0]
+				attrs = append(attrs, slog.String("peer_subject", peer.Subject), slog.String("peer_sha256", peer.SHA256))
+			}
+			logger.DebugContext(ctx, "TLS connection established", attrs...)
+		},
+	}
+}
+
+// slogInstance returns a group attribute identifying the given plugin
+// instance.
+func slogInstance(inst plugintrace.Instance) slog.Attr {
+	return slog.Group("plugin",
+		slog.Uint64("id", inst.ID),
+		slog.Int("pid", inst.PID),
+	)
+}
+
+// slogAddr returns a group attribute describing the given network address.
+func slogAddr(addr net.Addr) slog.Attr {
+	return slog.Group("addr",
+		slog.String("network", addr.Network()),
+		slog.String("address", addr.String()),
+	)
+}
+
+// slogCall returns the attributes describing the given completed call.
+func slogCall(call *plugintrace.CallInfo) []any {
+	attrs := []any{
+		slog.String("method", call.Method),
+		slog.Bool("stream", call.Stream),
+		slog.Duration("duration", call.Duration),
+		slog.String("code", call.Code.String()),
+		slog.Int("sent_messages", call.SentMessages),
+		slog.Int("recv_messages", call.RecvMessages),
+		slog.Int("sent_bytes", call.SentBytes),
+		slog.Int("recv_bytes", call.RecvBytes),
+	}
+	if call.Err != nil {
+		attrs = append(attrs, slog.Any("error", call.Err))
+	}
+	return attrs
+}
@@ -0,0 +1,6 @@
+// Package slogtrace provides tracers for rpcplugin clients and servers that
+// write their lifecycle events as structured records to a log/slog logger.
+//
+// This package is a separate Go module because log/slog requires Go 1.21,
+// which is newer than the rpcplugin module itself requires.
+package slogtrace // import go.rpcplugin.org/rpcplugin/plugintrace/slogtrace
@@ -0,0 +1,12 @@
+module go.rpcplugin.org/rpcplugin/plugintrace/slogtrace
+
+go 1.21
+
+replace go.rpcplugin.org/rpcplugin => ../..
+
+require go.rpcplugin.org/rpcplugin v0.0.0-00010101000000-000000000000
+
+require (
+	github.com/apparentlymart/go-shquot v0.0.1 // indirect
+	google.golang.org/grpc v1.19.1 // indirect
+)
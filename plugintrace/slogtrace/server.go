@@ -0,0 +1,149 @@
+package slogtrace
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"time"
+
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+)
+
+// ServerSlogTracer constructs a plugintrace.ServerTracer that will emit
+// structured log records into the given logger when trace events occur.
+//
+// Each record has a short, fixed message describing the event, with the
+// details of the event in attributes such as "addr" and "proto_version",
+// so that the records are suitable for machine processing. The set of
+// attributes may grow in future versions.
+func ServerSlogTracer(logger *slog.Logger) *plugintrace.ServerTracer {
+	ctx := context.Background()
+	return &plugintrace.ServerTracer{
+		HandshakeCookieInvalid: func(present bool) {
+			logger.ErrorContext(ctx, "invalid handshake cookie", slog.Bool("present", present))
+		},
+
+		TLSConfig: func(config *tls.Config, auto bool) {
+			if config == nil {
+				logger.WarnContext(ctx, "TLS is entirely disabled")
+				return
+			}
+			logger.DebugContext(ctx, "TLS configuration ready", slog.Bool("auto", auto))
+		},
+
+		Listening: func(addr net.Addr, tlsConfig *tls.Config, protoVersion int) {
+			logger.InfoContext(ctx, "plugin server listening",
+				slogAddr(addr),
+				slog.Int("proto_version", protoVersion),
+				slog.Bool("tls", tlsConfig != nil),
+			)
+		},
+
+		TransportFallback: func(from, to string, err error) {
+			logger.WarnContext(ctx, "falling back to another transport",
+				slog.String("from", from),
+				slog.String("to", to),
+				slog.Any("error", err),
+			)
+		},
+
+		StdioRedirected: func() {
+			logger.DebugContext(ctx, "redirected stdout and stderr")
+		},
+
+		HandshakeWritten: func(line string) {
+			logger.DebugContext(ctx, "wrote handshake", slog.String("line", line))
+		},
+
+		ClientConnAccepted: func(conn *plugintrace.ConnInfo) {
+			logger.DebugContext(ctx, "accepted client connection", connAttrs(conn)...)
+		},
+
+		ClientConnClosed: func(conn *plugintrace.ConnInfo, elapsed time.Duration) {
+			logger.DebugContext(ctx, "client connection closed", append(connAttrs(conn), slog.Duration("elapsed", elapsed))...)
+		},
+
+		InterruptIgnored: func(count int) {
+			logger.DebugContext(ctx, "ignored interrupt signal", slog.Int("count", count))
+		},
+
+		InvalidClientHandshakeVersion: func(invalid string) {
+			logger.WarnContext(ctx, "invalid version in client handshake", slog.String("version", invalid))
+		},
+
+		VersionNegotationFailed: func(clientVersions []int) {
+			logger.ErrorContext(ctx, "protocol version negotiation failed", slog.Any("client_versions", clientVersions))
+		},
+
+		CallCompleted: func(call *plugintrace.CallInfo) {
+			logger.DebugContext(ctx, "plugin call completed", slogCall(call)...)
+		},
+
+		GRPCServeError: func(err error) {
+			logger.ErrorContext(ctx, "gRPC server failed", slog.Any("error", err))
+		},
+
+		DrainStarted: func(timeout time.Duration) {
+			logger.InfoContext(ctx, "shutting down", slog.Duration("timeout", timeout))
+		},
+
+		DrainFinished: func(elapsed time.Duration, forced bool) {
+			logger.InfoContext(ctx, "shutdown complete",
+				slog.Duration("elapsed", elapsed),
+				slog.Bool("forced", forced),
+			)
+		},
+
+		GracefulStopStarted: func() {
+			logger.DebugContext(ctx, "graceful stop started")
+		},
+
+		GracefulStopFinished: func(elapsed time.Duration) {
+			logger.DebugContext(ctx, "graceful stop finished", slog.Duration("elapsed", elapsed))
+		},
+
+		CertificatesRotated: func() {
+			logger.InfoContext(ctx, "rotated auto-negotiated TLS certificate")
+		},
+
+		ParentExited: func() {
+			logger.WarnContext(ctx, "client process has exited; shutting down")
+		},
+
+		ClientTimeout: func(connected bool, timeout time.Duration) {
+			logger.WarnContext(ctx, "client timeout; shutting down",
+				slog.Duration("timeout", timeout),
+				slog.Bool("connected", connected),
+			)
+		},
+
+		HandlerPanicked: func(method string, value interface{}, stack []byte) {
+			logger.ErrorContext(ctx, "panic in RPC handler",
+				slog.String("method", method),
+				slog.Any("panic", value),
+				slog.String("stack", string(stack)),
+			)
+		},
+
+		TLSHandshake: func(remoteAddr net.Addr, info *plugintrace.TLSInfo) {
+			attrs := []any{slog.String("remote_addr", remoteAddr.String()), slog.String("tls_version", info.Version), slog.String("cipher_suite", info.CipherSuite)}
+			if !info.Mutual() {
+				logger.WarnContext(ctx, "TLS connection is not mutually authenticated", attrs...)
+				return
+			}
+			peer := info.PeerCertificates[0]
+			attrs = append(attrs, slog.String("peer_subject", peer.Subject), slog.String("peer_sha256", peer.SHA256))
+			logger.DebugContext(ctx, "TLS connection established", attrs...)
+		},
+	}
+}
+
+// connAttrs returns the attributes that identify a client connection.
+func connAttrs(conn *plugintrace.ConnInfo) []any {
+	attrs := []any{slog.Uint64("conn_id", conn.ID), slog.String("peer", conn.Peer())}
+	if conn.TLS != nil && conn.TLS.Mutual() {
+		attrs = append(attrs, slog.String("peer_sha256", conn.TLS.PeerCertificates[0].SHA256))
+	}
+	return attrs
+}
@@ -0,0 +1,79 @@
+package plugintrace
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// TLSInfo describes the negotiated parameters of a TLS connection between a
+// plugin client and server, as reported to the TLSHandshake functions of
+// ClientTracer and ServerTracer.
+type TLSInfo struct {
+	// Version and CipherSuite are the names of the negotiated TLS version
+	// and cipher suite, such as "TLS 1.3" and "TLS_AES_128_GCM_SHA256".
+	Version     string
+	CipherSuite string
+
+	// PeerCertificates summarizes the certificates the other side of the
+	// connection presented, starting with its own certificate. It is empty
+	// if the peer presented no certificate, which on the server side means
+	// that the client was not authenticated by TLS.
+	PeerCertificates []CertificateSummary
+
+	// State is the full connection state.
+	State *tls.ConnectionState
+}
+
+// CertificateSummary summarizes an X.509 certificate.
+type CertificateSummary struct {
+	Subject, Issuer     string
+	NotBefore, NotAfter time.Time
+
+	// SHA256 is the SHA-256 fingerprint of the certificate's DER encoding,
+	// in lowercase hexadecimal.
+	SHA256 string
+}
+
+// NewTLSInfo summarizes the given TLS connection state.
+func NewTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	ret := &TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		State:       state,
+	}
+	for _, cert := range state.PeerCertificates {
+		ret.PeerCertificates = append(ret.PeerCertificates, summarizeCertificate(cert))
+	}
+	return ret
+}
+
+func summarizeCertificate(cert *x509.Certificate) CertificateSummary {
+	sum := sha256.Sum256(cert.Raw)
+	return CertificateSummary{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		SHA256:    hex.EncodeToString(sum[:]),
+	}
+}
+
+// Mutual returns true if the peer presented a certificate. On the server
+// side, that means the connection uses mutual TLS authentication.
+func (i *TLSInfo) Mutual() bool {
+	return len(i.PeerCertificates) != 0
+}
+
+// String returns a short description of the connection parameters,
+// suitable for including in log messages.
+func (i *TLSInfo) String() string {
+	if len(i.PeerCertificates) == 0 {
+		return fmt.Sprintf("%s with %s, no peer certificate", i.Version, i.CipherSuite)
+	}
+	peer := i.PeerCertificates[0]
+	return fmt.Sprintf("%s with %s, peer %q (sha256 %s)", i.Version, i.CipherSuite, peer.Subject, peer.SHA256)
+}
@@ -0,0 +1,175 @@
+package zaptrace
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+	"go.uber.org/zap"
+)
+
+// ClientZapTracer constructs a plugintrace.ClientTracer that will emit
+// structured log entries into the given logger when trace events occur.
+//
+// Each entry has a short, fixed message describing the event, with the
+// details of the event in fields such as "pid", "addr", and
+// "proto_version". Entries about a particular plugin instance also have
+// "plugin_id" and "plugin_pid" fields identifying it. The set of fields may
+// grow in future versions.
+func ClientZapTracer(logger *zap.Logger) *plugintrace.ClientTracer {
+	return &plugintrace.ClientTracer{
+		ProcessStart: func(inst plugintrace.Instance, cmd *exec.Cmd) {
+			instLogger(logger, inst).Info("launching plugin server", zap.String("path", cmd.Path), zap.Strings("args", cmd.Args))
+		},
+
+		ProcessRunning: func(inst plugintrace.Instance, proc *os.Process) {
+			instLogger(logger, inst).Debug("plugin server process started", zap.Int("pid", proc.Pid))
+		},
+
+		ProcessStartFailed: func(inst plugintrace.Instance, cmd *exec.Cmd, err error) {
+			instLogger(logger, inst).Error("failed to start plugin server", zap.String("path", cmd.Path), zap.Error(err))
+		},
+
+		ProcessExited: func(inst plugintrace.Instance, state *os.ProcessState) {
+			instLogger(logger, inst).Info("plugin server process exited",
+				zap.Int("pid", state.Pid()),
+				zap.Int("exit_code", state.ExitCode()),
+				zap.String("state", state.String()),
+			)
+		},
+
+		StderrAttached: func(inst plugintrace.Instance, proc *os.Process, discarded bool) {
+			instLogger(logger, inst).Debug("plugin server stderr attached", zap.Int("pid", proc.Pid), zap.Bool("discarded", discarded))
+		},
+
+		HandshakeReceived: func(inst plugintrace.Instance, line string) {
+			instLogger(logger, inst).Debug("received plugin server handshake", zap.String("line", line))
+		},
+
+		HandshakeParsed: func(inst plugintrace.Instance, rpcProtocol string, protoVersion int, addr net.Addr) {
+			instLogger(logger, inst).Debug("parsed plugin server handshake",
+				zap.String("rpc_protocol", rpcProtocol),
+				zap.Int("proto_version", protoVersion),
+				zap.String("network", addr.Network()), zap.String("addr", addr.String()),
+			)
+		},
+
+		ServerCertificatePinned: func(inst plugintrace.Instance, cert *x509.Certificate) {
+			instLogger(logger, inst).Debug("pinned plugin server certificate", zap.String("serial", cert.SerialNumber.String()))
+		},
+
+		TLSConfig: func(inst plugintrace.Instance, config *tls.Config, auto bool) {
+			if config == nil {
+				instLogger(logger, inst).Warn("TLS is entirely disabled")
+				return
+			}
+			instLogger(logger, inst).Debug("TLS configuration ready", zap.Bool("auto", auto))
+		},
+
+		ServerStarted: func(inst plugintrace.Instance, proc *os.Process, addr net.Addr, protoVersion int) {
+			instLogger(logger, inst).Info("plugin server started",
+				zap.Int("pid", proc.Pid),
+				zap.String("network", addr.Network()), zap.String("addr", addr.String()),
+				zap.Int("proto_version", protoVersion),
+			)
+		},
+
+		ServerStartTimeout: func(inst plugintrace.Instance, proc *os.Process, timeout time.Duration) {
+			instLogger(logger, inst).Error("timeout waiting for plugin server handshake",
+				zap.Int("pid", proc.Pid),
+				zap.Duration("timeout", timeout),
+			)
+		},
+
+		Connect: func(inst plugintrace.Instance, addr net.Addr) {
+			instLogger(logger, inst).Debug("connecting to plugin server", zap.String("network", addr.Network()), zap.String("addr", addr.String()))
+		},
+
+		Connected: func(inst plugintrace.Instance, addr net.Addr) {
+			instLogger(logger, inst).Debug("connected to plugin server", zap.String("network", addr.Network()), zap.String("addr", addr.String()))
+		},
+
+		ConnectFailed: func(inst plugintrace.Instance, addr net.Addr, err error) {
+			instLogger(logger, inst).Error("failed to connect to plugin server", zap.String("network", addr.Network()), zap.String("addr", addr.String()), zap.Error(err))
+		},
+
+		CallCompleted: func(inst plugintrace.Instance, call *plugintrace.CallInfo) {
+			instLogger(logger, inst).Debug("plugin call completed", callFields(call)...)
+		},
+
+		Closing: func(inst plugintrace.Instance, proc *os.Process) {
+			instLogger(logger, inst).Info("closing plugin server", zap.Int("pid", proc.Pid))
+		},
+
+		Closed: func(inst plugintrace.Instance, elapsed time.Duration) {
+			instLogger(logger, inst).Info("plugin closed", zap.Duration("elapsed", elapsed))
+		},
+
+		KillFailed: func(inst plugintrace.Instance, proc *os.Process, err error) {
+			instLogger(logger, inst).Error("failed to kill plugin server", zap.Int("pid", proc.Pid), zap.Error(err))
+		},
+
+		ProcessStopped: func(inst plugintrace.Instance, proc *os.Process, graceful bool) {
+			instLogger(logger, inst).Info("plugin server stopped", zap.Int("pid", proc.Pid), zap.Bool("graceful", graceful))
+		},
+
+		CertificatesRotated: func(inst plugintrace.Instance) {
+			instLogger(logger, inst).Info("rotated auto-negotiated TLS certificates")
+		},
+
+		ProcessCrashed: func(inst plugintrace.Instance, crash *plugintrace.CrashInfo) {
+			instLogger(logger, inst).Error("plugin server process crashed",
+				zap.String("phase", crash.Phase.String()),
+				zap.Int("exit_code", crash.ExitCode),
+				zap.String("signal", crash.Signal),
+				zap.Duration("runtime", crash.Runtime),
+			)
+		},
+
+		ManagedStateChanged: func(inst plugintrace.Instance, name string, from, to plugintrace.ManagedState, reason string) {
+			instLogger(logger, inst).Info("managed plugin changed state",
+				zap.String("name", name),
+				zap.String("from", from.String()),
+				zap.String("to", to.String()),
+				zap.String("reason", reason),
+			)
+		},
+
+		TLSHandshake: func(inst plugintrace.Instance, info *plugintrace.TLSInfo) {
+			fields := []zap.Field{zap.String("tls_version", info.Version), zap.String("cipher_suite", info.CipherSuite)}
+			if info.Mutual() {
+				peer := info.PeerCertificates[0]
+				fields = append(fields, zap.String("peer_subject", peer.Subject), zap.String("peer_sha256", peer.SHA256))
+			}
+			instLogger(logger, inst).Debug("TLS connection established", fields...)
+		},
+	}
+}
+
+// instLogger returns a logger that includes fields identifying the given
+// plugin instance in each entry.
+func instLogger(logger *zap.Logger, inst plugintrace.Instance) *zap.Logger {
+	return logger.With(zap.Uint64("plugin_id", inst.ID), zap.Int("plugin_pid", inst.PID))
+}
+
+// callFields returns the fields describing the given completed call.
+func callFields(call *plugintrace.CallInfo) []zap.Field {
+	fields := []zap.Field{
+		zap.String("method", call.Method),
+		zap.Bool("stream", call.Stream),
+		zap.Duration("duration", call.Duration),
+		zap.String("code", call.Code.String()),
+		zap.Int("sent_messages", call.SentMessages),
+		zap.Int("recv_messages", call.RecvMessages),
+		zap.Int("sent_bytes", call.SentBytes),
+		zap.Int("recv_bytes", call.RecvBytes),
+	}
+	if call.Err != nil {
+		fields = append(fields, zap.Error(call.Err))
+	}
+	return fields
+}
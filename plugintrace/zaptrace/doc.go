@@ -0,0 +1,6 @@
+// Package zaptrace provides tracers for rpcplugin clients and servers that
+// write their lifecycle events to a zap logger.
+//
+// This package is a separate Go module so that applications using rpcplugin
+// without zap do not depend on it.
+package zaptrace // import go.rpcplugin.org/rpcplugin/plugintrace/zaptrace
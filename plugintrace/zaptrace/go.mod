@@ -0,0 +1,16 @@
+module go.rpcplugin.org/rpcplugin/plugintrace/zaptrace
+
+go 1.20
+
+replace go.rpcplugin.org/rpcplugin => ../..
+
+require (
+	go.rpcplugin.org/rpcplugin v0.0.0-00010101000000-000000000000
+	go.uber.org/zap v1.26.0
+)
+
+require (
+	github.com/apparentlymart/go-shquot v0.0.1 // indirect
+	go.uber.org/multierr v1.10.0 // indirect
+	google.golang.org/grpc v1.19.1 // indirect
+)
@@ -0,0 +1,146 @@
+package zaptrace
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+	"go.uber.org/zap"
+)
+
+// ServerZapTracer constructs a plugintrace.ServerTracer that will emit
+// structured log entries into the given logger when trace events occur.
+//
+// Each entry has a short, fixed message describing the event, with the
+// details of the event in fields such as "addr" and "proto_version". The
+// set of fields may grow in future versions.
+func ServerZapTracer(logger *zap.Logger) *plugintrace.ServerTracer {
+	return &plugintrace.ServerTracer{
+		HandshakeCookieInvalid: func(present bool) {
+			logger.Error("invalid handshake cookie", zap.Bool("present", present))
+		},
+
+		TLSConfig: func(config *tls.Config, auto bool) {
+			if config == nil {
+				logger.Warn("TLS is entirely disabled")
+				return
+			}
+			logger.Debug("TLS configuration ready", zap.Bool("auto", auto))
+		},
+
+		Listening: func(addr net.Addr, tlsConfig *tls.Config, protoVersion int) {
+			logger.Info("plugin server listening",
+				zap.String("network", addr.Network()), zap.String("addr", addr.String()),
+				zap.Int("proto_version", protoVersion),
+				zap.Bool("tls", tlsConfig != nil),
+			)
+		},
+
+		TransportFallback: func(from, to string, err error) {
+			logger.Warn("falling back to another transport",
+				zap.String("from", from),
+				zap.String("to", to),
+				zap.Error(err),
+			)
+		},
+
+		StdioRedirected: func() {
+			logger.Debug("redirected stdout and stderr")
+		},
+
+		HandshakeWritten: func(line string) {
+			logger.Debug("wrote handshake", zap.String("line", line))
+		},
+
+		ClientConnAccepted: func(conn *plugintrace.ConnInfo) {
+			logger.Debug("accepted client connection", connFields(conn)...)
+		},
+
+		ClientConnClosed: func(conn *plugintrace.ConnInfo, elapsed time.Duration) {
+			logger.Debug("client connection closed", append(connFields(conn), zap.Duration("elapsed", elapsed))...)
+		},
+
+		InterruptIgnored: func(count int) {
+			logger.Debug("ignored interrupt signal", zap.Int("count", count))
+		},
+
+		InvalidClientHandshakeVersion: func(invalid string) {
+			logger.Warn("invalid version in client handshake", zap.String("version", invalid))
+		},
+
+		VersionNegotationFailed: func(clientVersions []int) {
+			logger.Error("protocol version negotiation failed", zap.Ints("client_versions", clientVersions))
+		},
+
+		CallCompleted: func(call *plugintrace.CallInfo) {
+			logger.Debug("plugin call completed", callFields(call)...)
+		},
+
+		GRPCServeError: func(err error) {
+			logger.Error("gRPC server failed", zap.Error(err))
+		},
+
+		DrainStarted: func(timeout time.Duration) {
+			logger.Info("shutting down", zap.Duration("timeout", timeout))
+		},
+
+		DrainFinished: func(elapsed time.Duration, forced bool) {
+			logger.Info("shutdown complete",
+				zap.Duration("elapsed", elapsed),
+				zap.Bool("forced", forced),
+			)
+		},
+
+		GracefulStopStarted: func() {
+			logger.Debug("graceful stop started")
+		},
+
+		GracefulStopFinished: func(elapsed time.Duration) {
+			logger.Debug("graceful stop finished", zap.Duration("elapsed", elapsed))
+		},
+
+		CertificatesRotated: func() {
+			logger.Info("rotated auto-negotiated TLS certificate")
+		},
+
+		ParentExited: func() {
+			logger.Warn("client process has exited; shutting down")
+		},
+
+		ClientTimeout: func(connected bool, timeout time.Duration) {
+			logger.Warn("client timeout; shutting down",
+				zap.Duration("timeout", timeout),
+				zap.Bool("connected", connected),
+			)
+		},
+
+		HandlerPanicked: func(method string, value interface{}, stack []byte) {
+			logger.Error("panic in RPC handler",
+				zap.String("method", method),
+				zap.Any("panic", value),
+				zap.ByteString("stack", stack),
+			)
+		},
+
+		TLSHandshake: func(remoteAddr net.Addr, info *plugintrace.TLSInfo) {
+			fields := []zap.Field{zap.String("remote_addr", remoteAddr.String()), zap.String("tls_version", info.Version), zap.String("cipher_suite", info.CipherSuite)}
+			if !info.Mutual() {
+				logger.Warn("TLS connection is not mutually authenticated", fields...)
+				return
+			}
+			peer := info.PeerCertificates[0]
+			fields = append(fields, zap.String("peer_subject", peer.Subject), zap.String("peer_sha256", peer.SHA256))
+			logger.Debug("TLS connection established", fields...)
+		},
+	}
+}
+
+// connFields returns the fields that identify a client connection.
+func connFields(conn *plugintrace.ConnInfo) []zap.Field {
+	fields := []zap.Field{zap.Uint64("conn_id", conn.ID), zap.String("peer", conn.Peer())}
+	if conn.TLS != nil && conn.TLS.Mutual() {
+		fields = append(fields, zap.String("peer_sha256", conn.TLS.PeerCertificates[0].SHA256))
+	}
+	return fields
+}
@@ -0,0 +1,217 @@
+package rpcplugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Pool keeps a number of instances of a plugin started and ready for use, so
+// that latency-sensitive callers, such as a command line program that needs
+// a plugin as soon as it starts, can take a ready instance without waiting
+// for its server to start and complete the handshake.
+//
+// Each instance is used only once: the caller that takes an instance from
+// the pool using Get owns it and must close it, and the pool starts another
+// instance in the background to replace it.
+type Pool struct {
+	config PoolConfig
+	ctx    context.Context
+	stop   chan struct{} // closed by Close
+
+	// mu guards the remaining fields. changed is closed and replaced each
+	// time an instance becomes ready or fails to start, and lastErr is the
+	// error from the most recent failed start, if the pool hasn't started
+	// an instance successfully since.
+	mu       sync.Mutex
+	idle     []*Plugin
+	starting int
+	changed  chan struct{}
+	lastErr  error
+	closed   bool
+}
+
+// PoolConfig is the configuration for a Pool.
+type PoolConfig struct {
+	// Client is the configuration for starting each instance of the plugin
+	// server. As for ManagedConfig.Client, the pool starts each instance
+	// using a copy of Client with a new exec.Cmd that runs the same program
+	// as Client.Cmd. Either Client.Cmd or Client.InProcess must be set.
+	Client ClientConfig
+
+	// Size is the number of ready instances the pool tries to keep. If it
+	// is zero, it defaults to one.
+	Size int
+
+	// RetryDelay is how long the pool waits after an instance fails to
+	// start before it tries again. If it is zero, it defaults to one second.
+	RetryDelay time.Duration
+}
+
+const (
+	defaultPoolSize       = 1
+	defaultPoolRetryDelay = time.Second
+)
+
+func (c PoolConfig) withDefaults() PoolConfig {
+	if c.Size <= 0 {
+		c.Size = defaultPoolSize
+	}
+	if c.RetryDelay <= 0 {
+		c.RetryDelay = defaultPoolRetryDelay
+	}
+	return c
+}
+
+// NewPool returns a new Pool that begins starting instances of the plugin
+// in the background, without waiting for them to be ready.
+//
+// The given context is used for starting every instance, as for New, so it
+// must not be cancelled while the pool is in use.
+func NewPool(ctx context.Context, config *PoolConfig) (*Pool, error) {
+	if config.Client.Cmd == nil && config.Client.InProcess == nil {
+		return nil, fmt.Errorf("config field Client.Cmd must not be nil")
+	}
+	ret := &Pool{
+		config:  config.withDefaults(),
+		ctx:     ctx,
+		stop:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	ret.mu.Lock()
+	ret.fill()
+	ret.mu.Unlock()
+	return ret, nil
+}
+
+// Get takes a ready instance from the pool, waiting for one to become ready
+// if necessary, and begins starting another to replace it. The caller owns
+// the returned Plugin, and must close it once finished with it.
+//
+// If the pool has no ready instance because its most recent attempt to
+// start one failed, Get returns the error from that attempt rather than
+// waiting for the pool to try again.
+func (p *Pool) Get(ctx context.Context) (*Plugin, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("plugin pool is closed")
+		}
+		for len(p.idle) > 0 {
+			plugin := p.idle[0]
+			p.idle = p.idle[1:]
+			p.fill()
+			if plugin.Healthy() {
+				p.mu.Unlock()
+				return plugin, nil
+			}
+			// The instance exited or became unhealthy while it was waiting
+			// in the pool, so we'll discard it and try the next.
+			go plugin.Close()
+		}
+		if p.lastErr != nil {
+			err := p.lastErr
+			p.mu.Unlock()
+			return nil, err
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Idle returns the number of ready instances currently in the pool.
+func (p *Pool) Idle() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// Close closes all of the ready instances in the pool and stops starting
+// new ones. Instances already taken from the pool are unaffected. Close
+// returns the first error from closing an instance, if any.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	close(p.stop)
+	close(p.changed)
+	p.mu.Unlock()
+
+	var firstErr error
+	for _, plugin := range idle {
+		if err := plugin.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// fill begins starting enough instances to bring the pool up to its size.
+// It must be called with p.mu held.
+func (p *Pool) fill() {
+	for !p.closed && len(p.idle)+p.starting < p.config.Size {
+		p.starting++
+		go p.launch()
+	}
+}
+
+// notify wakes any callers of Get that are waiting for the pool to change.
+// It must be called with p.mu held.
+func (p *Pool) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// launch starts a new instance and adds it to the pool.
+func (p *Pool) launch() {
+	config := p.config.Client
+	if config.Cmd != nil {
+		config.Cmd = cloneCmd(config.Cmd)
+	}
+	plugin, err := New(p.ctx, &config)
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		if plugin != nil {
+			plugin.Close()
+		}
+		return
+	}
+	if err == nil {
+		p.starting--
+		p.idle = append(p.idle, plugin)
+		p.lastErr = nil
+		p.notify()
+		p.mu.Unlock()
+		return
+	}
+	p.lastErr = fmt.Errorf("failed to start plugin for pool: %w", err)
+	p.notify()
+	p.mu.Unlock()
+
+	// We keep counting this attempt as starting until after the delay, so
+	// that a Get in the meantime doesn't cause another attempt straight away.
+	select {
+	case <-time.After(p.config.RetryDelay):
+	case <-p.stop:
+		return
+	}
+	p.mu.Lock()
+	p.starting--
+	p.fill()
+	p.mu.Unlock()
+}
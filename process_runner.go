@@ -0,0 +1,174 @@
+package rpcplugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// ProcessRunner launches and manages a plugin server on behalf of New, for
+// plugin servers that run somewhere other than in a child process started
+// from an exec.Cmd, such as on a remote host, in a container, or in a
+// WebAssembly runtime. The client uses the runner only to start and stop the
+// server and to read its handshake, and so everything else about the
+// protocol, including TLS negotiation, works the same as for a child
+// process.
+//
+// A ProcessRunner runs a single plugin server once, in the same way as an
+// exec.Cmd, so it cannot be shared between plugins.
+type ProcessRunner interface {
+	// Start launches the plugin server with the given environment variables,
+	// which are the variables of the rpcplugin protocol in the "KEY=value"
+	// form of exec.Cmd.Env. The client doesn't add its own environment, so
+	// the runner decides what else the server inherits.
+	//
+	// The runner must copy everything the server writes to its stderr
+	// stream to the given writer, finishing before Wait returns. It returns
+	// a reader for the server's stdout stream, on which the server writes
+	// its handshake. The client reads it until it reaches the end, and then
+	// closes it.
+	Start(ctx context.Context, env []string, stderr io.Writer) (io.ReadCloser, error)
+
+	// Signal sends the given signal to the plugin server. The client uses
+	// only os.Kill, to which the runner must respond by terminating the
+	// server immediately. A runner that cannot deliver other signals may
+	// return an error for them.
+	Signal(sig os.Signal) error
+
+	// Wait waits for the plugin server to exit. It returns the state of the
+	// exited process if the server ran as a process on the local host, or
+	// nil otherwise. The error reports only a failure to wait, so a server
+	// that exits unsuccessfully is not an error.
+	Wait() (*os.ProcessState, error)
+}
+
+// cmdRunner is the ProcessRunner for a plugin server launched from an
+// exec.Cmd in a child process, which New uses when ClientConfig.Cmd is set.
+type cmdRunner struct {
+	cmd     *exec.Cmd
+	wrap    func(cmd *exec.Cmd) error
+	limiter ProcessLimiter
+
+	// release, if set, releases the limiter's resources once the process
+	// has exited.
+	release func()
+
+	// stderr, if set, is the read end of a pipe for the child's stderr,
+	// whose output the runner copies to the writer given to Start until
+	// stderrDone is closed, or for at most stderrDrainTimeout after the
+	// process exits.
+	stderr     *os.File
+	stderrDone chan struct{}
+
+	// starting, if set, is called just before the command starts, after
+	// wrap. started records whether the runner attempted to start it.
+	starting func(cmd *exec.Cmd)
+	started  bool
+}
+
+var _ ProcessRunner = (*cmdRunner)(nil)
+
+func (r *cmdRunner) Start(ctx context.Context, env []string, stderr io.Writer) (io.ReadCloser, error) {
+	r.cmd.Env = env
+	r.cmd.Stdin = bytes.NewReader(nil)
+	r.cmd.Stderr = stderr
+	if _, isFile := stderr.(*os.File); stderr != nil && !isFile {
+		// exec.Cmd would copy stderr to the writer itself, but then Wait
+		// would wait indefinitely for any descendant of the server that
+		// holds the pipe open, so we copy it ourselves instead.
+		stderrR, stderrW, err := os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("cannot create stderr pipe: %w", err)
+		}
+		defer stderrW.Close()
+		r.cmd.Stderr = stderrW
+		r.stderr = stderrR
+		r.stderrDone = make(chan struct{})
+		go func() {
+			io.Copy(stderr, stderrR)
+			close(r.stderrDone)
+		}()
+	}
+	// We make our own pipe for stdout rather than using StdoutPipe, because
+	// Wait would close the read end of that one, but the client may carry
+	// on reading stdout after the process exits.
+	stdout, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("cannot create stdout pipe: %w", err)
+	}
+	defer stdoutW.Close()
+	r.cmd.Stdout = stdoutW
+	if r.wrap != nil {
+		err = r.wrap(r.cmd)
+		if err != nil {
+			r.abort(stdout)
+			return nil, fmt.Errorf("failed to wrap plugin command: %w", err)
+		}
+	}
+	// The limiter comes after wrap, so that its limits also apply to any
+	// launcher that wrap added.
+	if r.limiter != nil {
+		r.release, err = r.limiter.LimitCommand(r.cmd)
+		if err != nil {
+			r.abort(stdout)
+			return nil, fmt.Errorf("failed to limit plugin server resources: %w", err)
+		}
+	}
+	if r.starting != nil {
+		r.starting(r.cmd)
+	}
+	r.started = true
+	err = r.cmd.Start()
+	if err != nil {
+		r.abort(stdout)
+		if r.release != nil {
+			r.release()
+		}
+		return nil, fmt.Errorf("failed to start child process: %w", err)
+	}
+	return stdout, nil
+}
+
+// abort closes the read ends of the pipes Start created, if the command
+// didn't start.
+func (r *cmdRunner) abort(stdout *os.File) {
+	stdout.Close()
+	if r.stderr != nil {
+		r.stderr.Close()
+	}
+}
+
+func (r *cmdRunner) Signal(sig os.Signal) error {
+	if sig == os.Kill {
+		return r.cmd.Process.Kill()
+	}
+	return r.cmd.Process.Signal(sig)
+}
+
+func (r *cmdRunner) Wait() (*os.ProcessState, error) {
+	// Waiting for the command, rather than just its process, releases the
+	// resources the command holds. Its stdout and stderr are both files, so
+	// this doesn't wait for any copying.
+	err := r.cmd.Wait()
+	if r.release != nil {
+		r.release()
+	}
+	if r.stderr != nil {
+		select {
+		case <-r.stderrDone:
+		case <-time.After(stderrDrainTimeout):
+		}
+		r.stderr.Close()
+	}
+	if r.cmd.ProcessState != nil {
+		// The process exited, so any error describes either its exit
+		// status or a failure to copy its stderr, neither of which is a
+		// failure to wait.
+		return r.cmd.ProcessState, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,144 @@
+package rpcplugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apparentlymart/go-ctxenv/ctxenv"
+)
+
+// ProtocolVersion is a version of an application's plugin protocol,
+// consisting of a major version, which is negotiated as described for
+// ClientConfig.ProtoVersions, and an optional minor version.
+//
+// Minor versions allow a protocol to evolve additively without a new major
+// version. By default, a client and server that support different minor
+// versions of the same major version use the lesser of the two, on the
+// assumption that each minor version supports everything the earlier
+// minor versions did.
+type ProtocolVersion struct {
+	Major, Minor int
+}
+
+func (v ProtocolVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// VersionPolicy is the type of ServerConfig.VersionPolicy, which decides
+// whether a client and server supporting the given versions are compatible.
+// The Major fields of both arguments are always equal, and the Minor fields
+// are the greatest minor version each side supports.
+type VersionPolicy func(client, server ProtocolVersion) bool
+
+// protoMinorVersionsEnvName is the environment variable the client uses to
+// advertise the greatest minor version it supports for each of its major
+// versions, as a comma-separated list of "major.minor" pairs.
+//
+// Major versions not listed have minor version zero. This is separate from
+// PLUGIN_PROTOCOL_VERSIONS so that servers unaware of minor versions can
+// still parse that variable.
+const protoMinorVersionsEnvName = "PLUGIN_PROTOCOL_MINOR_VERSIONS"
+
+// checkProtoMinorVersions returns an error if the given minor versions are
+// not valid for the given set of major versions.
+func checkProtoMinorVersions(field string, minors map[int]int, hasMajor func(int) bool) error {
+	for major, minor := range minors {
+		if !hasMajor(major) {
+			return fmt.Errorf("config field %s has minor version for unsupported major version %d", field, major)
+		}
+		if minor < 0 {
+			return fmt.Errorf("config field %s has invalid minor version %d for major version %d", field, minor, major)
+		}
+	}
+	return nil
+}
+
+// protoMinorVersionsEnv returns the value for the protoMinorVersionsEnvName
+// environment variable for the given minor versions, or an empty string if
+// all of them are zero.
+func protoMinorVersionsEnv(minors map[int]int) string {
+	majors := make([]int, 0, len(minors))
+	for major, minor := range minors {
+		if minor != 0 {
+			majors = append(majors, major)
+		}
+	}
+	sort.Ints(majors)
+	parts := make([]string, len(majors))
+	for i, major := range majors {
+		parts[i] = ProtocolVersion{Major: major, Minor: minors[major]}.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// serverClientMinorVersions returns the minor versions the client
+// advertised, ignoring any that are invalid.
+func serverClientMinorVersions(ctx context.Context) map[int]int {
+	ret := make(map[int]int)
+	raw := ctxenv.Getenv(ctx, protoMinorVersionsEnvName)
+	if raw == "" {
+		return ret
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		parts := strings.SplitN(pair, ".", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		major, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		minor, err := strconv.Atoi(parts[1])
+		if err != nil || minor < 0 {
+			continue
+		}
+		ret[major] = minor
+	}
+	return ret
+}
+
+// serverVersionAcceptor returns a function for negotiateServerProtoVersion
+// that applies the given policy to each candidate major version, or nil if
+// there is no policy.
+func serverVersionAcceptor(policy VersionPolicy, clientMinors, serverMinors map[int]int) func(major int) bool {
+	if policy == nil {
+		return nil
+	}
+	return func(major int) bool {
+		return policy(
+			ProtocolVersion{Major: major, Minor: clientMinors[major]},
+			ProtocolVersion{Major: major, Minor: serverMinors[major]},
+		)
+	}
+}
+
+// selectMinorVersion returns the minor version to use given the greatest
+// minor versions the client and server support.
+func selectMinorVersion(client, server int) int {
+	if client < server {
+		return client
+	}
+	return server
+}
+
+// ProtocolVersion returns the major and minor protocol version the client
+// and plugin server agreed to use. The minor version is zero if the server
+// doesn't support minor versions, or for a plugin obtained using Attach.
+func (p *Plugin) ProtocolVersion() ProtocolVersion {
+	return ProtocolVersion{Major: p.protoVersion, Minor: p.protoMinorVersion}
+}
+
+// ContextProtocolVersion returns the major and minor protocol version the
+// plugin server agreed with its client, for use in the implementation of a
+// plugin RPC method. It returns the zero value if the given context doesn't
+// belong to an RPC request to a plugin server.
+func ContextProtocolVersion(ctx context.Context) ProtocolVersion {
+	sc := contextServerContext(ctx)
+	if sc == nil {
+		return ProtocolVersion{}
+	}
+	return sc.protoVersion
+}
@@ -0,0 +1,57 @@
+package rpcplugin
+
+import (
+	"context"
+	"runtime/debug"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recoveredPanicMessage is the status message the client receives for a
+// call whose handler panicked. It deliberately says nothing about the panic
+// itself, which might include sensitive data from the server.
+const recoveredPanicMessage = "plugin server encountered an internal error"
+
+// RecoverPanicsUnaryInterceptor returns a server interceptor that recovers
+// from any panic in the handlers it wraps, returning an Internal status to
+// the client instead of crashing the server process.
+//
+// If report is not nil, it is called for each recovered panic with the full
+// method name, the value passed to panic, and the stack trace of the
+// panicking goroutine.
+//
+// Serve installs this interceptor automatically when ServerConfig has
+// RecoverPanics set, reporting to the ServerTracer's HandlerPanicked
+// function, so this is needed only for servers that don't use Serve.
+func RecoverPanicsUnaryInterceptor(report func(method string, value interface{}, stack []byte)) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				resp, err = nil, recoveredPanic(info.FullMethod, r, report)
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+// RecoverPanicsStreamInterceptor is the stream interceptor equivalent of
+// RecoverPanicsUnaryInterceptor.
+func RecoverPanicsStreamInterceptor(report func(method string, value interface{}, stack []byte)) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = recoveredPanic(info.FullMethod, r, report)
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
+
+func recoveredPanic(method string, value interface{}, report func(string, interface{}, []byte)) error {
+	if report != nil {
+		report(method, value, debug.Stack())
+	}
+	return status.Error(codes.Internal, recoveredPanicMessage)
+}
@@ -0,0 +1,118 @@
+package rpcplugin
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"sync"
+)
+
+// Registry maps plugin names to the ways of running them: either an
+// external plugin executable, or a plugin server compiled into the host
+// application that runs in-process, as for ClientConfig.InProcess.
+//
+// A Registry allows an application to use the same code to start both its
+// built-in plugins and any that users install separately. A Manager whose
+// Registry field is set resolves plugin names using the registry, and
+// callers of New can use Resolve.
+//
+// A Registry is safe for concurrent use.
+type Registry struct {
+	mu      sync.RWMutex
+	entries map[string]registryEntry
+}
+
+type registryEntry struct {
+	cmd     *exec.Cmd
+	builtin func() *ServerConfig
+}
+
+// NewRegistry returns a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		entries: make(map[string]registryEntry),
+	}
+}
+
+// RegisterCommand registers an external plugin executable under the given
+// name, replacing any existing registration of that name, such as so that
+// a plugin the user installed can replace a built-in plugin.
+//
+// The registry never starts the given command itself. Instead, each plugin
+// resolved from it uses a new command with the same path, arguments,
+// environment, directory, extra files and system attributes, as for
+// ManagedConfig.Client.
+func (r *Registry) RegisterCommand(name string, cmd *exec.Cmd) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[name] = registryEntry{cmd: cmd}
+}
+
+// RegisterBuiltin registers a plugin server that runs in-process under the
+// given name, replacing any existing registration of that name.
+//
+// The registry calls the given function each time it resolves the name, to
+// produce the configuration to use as ClientConfig.InProcess.
+func (r *Registry) RegisterBuiltin(name string, server func() *ServerConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[name] = registryEntry{builtin: server}
+}
+
+// Unregister removes the registration of the given name, if any.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, name)
+}
+
+// Names returns the names of all of the registered plugins, in lexical
+// order.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.entries))
+	for name := range r.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsBuiltin returns true if the given name is registered as a plugin that
+// runs in-process.
+func (r *Registry) IsBuiltin(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.entries[name].builtin != nil
+}
+
+// Resolve returns a copy of the given client configuration with either Cmd
+// or InProcess set to run the plugin registered under the given name, for
+// passing to New. It returns an error if no plugin of that name is
+// registered.
+func (r *Registry) Resolve(name string, base ClientConfig) (*ClientConfig, error) {
+	r.mu.RLock()
+	entry, ok := r.entries[name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no plugin named %q is registered", name)
+	}
+
+	config := base
+	if entry.builtin != nil {
+		config.Cmd = nil
+		config.InProcess = entry.builtin()
+	} else {
+		config.Cmd = cloneCmd(entry.cmd)
+		config.InProcess = nil
+	}
+	return &config, nil
+}
+
+func (r *Registry) has(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.entries[name]
+	return ok
+}
@@ -0,0 +1,72 @@
+package rpcplugin
+
+import (
+	"os/exec"
+	"time"
+)
+
+// ProcessLimiter is the interface for objects that apply resource limits
+// to plugin server processes, via ClientConfig.Limiter.
+type ProcessLimiter interface {
+	// LimitCommand is called with the plugin server's command just before
+	// the client starts it, after ClientConfig.WrapCommand, to modify the
+	// command so that the limits apply from the moment the process starts,
+	// such as by launching it through a program that applies the limits to
+	// itself and then executes the original command. The same rules apply
+	// to the changes it makes as for WrapCommand.
+	//
+	// If LimitCommand returns an error then New returns that error without
+	// starting the command. Otherwise, the client calls the returned release
+	// function, if it isn't nil, once the process has exited or has failed
+	// to start.
+	LimitCommand(cmd *exec.Cmd) (release func(), err error)
+}
+
+// ResourceLimits is a ProcessLimiter that applies POSIX resource limits to
+// plugin server processes, and can optionally place them in a dedicated
+// Linux cgroup with memory and CPU caps, so that a misbehaving plugin can't
+// exhaust the resources of the host computer.
+//
+// ResourceLimits is currently implemented only on Linux. On other
+// platforms LimitCommand returns an error if any limits are set.
+//
+// ResourceLimits launches the plugin server through /bin/sh, which sets the
+// resource limits, moves itself into the cgroup, and then executes the
+// original command in its place, so that the plugin server runs within the
+// limits from its first instruction. If the shell can't apply a limit then
+// it exits with an error message on stderr, and so New fails as it would
+// for a plugin server that exits before its handshake. The server receives
+// its command's Path, rather than Args[0], as its first argument.
+type ResourceLimits struct {
+	// CPUTime, AddressSpace, and OpenFiles set the RLIMIT_CPU, RLIMIT_AS,
+	// and RLIMIT_NOFILE resource limits, respectively, for the process.
+	// AddressSpace is in bytes, rounded up to a whole number of kibibytes,
+	// and CPUTime is rounded up to a whole number of seconds. Limits left as
+	// zero are not changed.
+	CPUTime      time.Duration
+	AddressSpace uint64
+	OpenFiles    uint64
+
+	// CgroupParent, if set, is the path of a cgroup v2 directory in which
+	// to create a cgroup for each plugin server process, such as a
+	// delegated subtree like "/sys/fs/cgroup/user.slice/myapp.slice". The
+	// cgroup is removed after the process exits, unless processes the
+	// plugin server started are still running in it.
+	//
+	// The memory and cpu controllers must be enabled for the parent cgroup's
+	// children if MemoryMax or CPUMax are set, respectively.
+	CgroupParent string
+
+	// MemoryMax, if non-zero, is the maximum memory usage in bytes of the
+	// plugin server's cgroup. CPUMax, if non-zero, is the maximum number of
+	// CPUs the cgroup may use, such as 0.5 for half of one CPU. These
+	// require CgroupParent to be set.
+	MemoryMax uint64
+	CPUMax    float64
+}
+
+var _ ProcessLimiter = (*ResourceLimits)(nil)
+
+// cgroupCPUPeriod is the period in microseconds we use for a cgroup's
+// cpu.max setting, which is the kernel's default.
+const cgroupCPUPeriod = 100000
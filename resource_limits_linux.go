@@ -0,0 +1,101 @@
+package rpcplugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LimitCommand implements ProcessLimiter.
+func (l *ResourceLimits) LimitCommand(cmd *exec.Cmd) (func(), error) {
+	if (l.MemoryMax != 0 || l.CPUMax != 0) && l.CgroupParent == "" {
+		return nil, fmt.Errorf("MemoryMax and CPUMax require CgroupParent")
+	}
+
+	// The shell sets both the soft and hard limits when given neither -S
+	// nor -H, so the plugin server can't raise them again.
+	var script []string
+	if l.CPUTime > 0 {
+		secs := uint64((l.CPUTime + time.Second - 1) / time.Second)
+		script = append(script, fmt.Sprintf("ulimit -t %d", secs))
+	}
+	if l.AddressSpace > 0 {
+		script = append(script, fmt.Sprintf("ulimit -v %d", (l.AddressSpace+1023)/1024))
+	}
+	if l.OpenFiles > 0 {
+		script = append(script, fmt.Sprintf("ulimit -n %d", l.OpenFiles))
+	}
+
+	var release func()
+	var shellArgs []string
+	if l.CgroupParent != "" {
+		// The process doesn't exist yet, so we can't name the cgroup after
+		// its pid.
+		dir, err := ioutil.TempDir(l.CgroupParent, "rpcplugin-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cgroup: %s", err)
+		}
+		release = func() {
+			// The kernel refuses to remove a cgroup that still has processes
+			// in it, so this succeeds only once the plugin has exited.
+			os.Remove(dir)
+		}
+		if err := l.configureCgroup(dir); err != nil {
+			release()
+			return nil, err
+		}
+		// The shell's pid becomes the plugin server's once it executes the
+		// original command.
+		script = append(script, `echo $$ >"$1/cgroup.procs"`, "shift")
+		shellArgs = append(shellArgs, dir)
+	}
+	if len(script) == 0 {
+		return nil, nil
+	}
+
+	// The original command's path is relative to cmd.Dir if it has no
+	// separator, but the shell would search PATH for it.
+	path := cmd.Path
+	if !strings.Contains(path, "/") {
+		path = "./" + path
+	}
+	script = append(script, `exec "$@"`)
+	shellArgs = append(shellArgs, path)
+	if len(cmd.Args) > 1 {
+		shellArgs = append(shellArgs, cmd.Args[1:]...)
+	}
+	cmd.Args = append([]string{"sh", "-c", strings.Join(script, " && "), "rpcplugin-limits"}, shellArgs...)
+	cmd.Path = "/bin/sh"
+	return release, nil
+}
+
+func (l *ResourceLimits) configureCgroup(dir string) error {
+	if l.MemoryMax != 0 {
+		if err := writeCgroupFile(dir, "memory.max", strconv.FormatUint(l.MemoryMax, 10)); err != nil {
+			return err
+		}
+	}
+	if l.CPUMax != 0 {
+		quota := int64(l.CPUMax * cgroupCPUPeriod)
+		if quota < 1 {
+			quota = 1
+		}
+		if err := writeCgroupFile(dir, "cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to set cgroup %s: %s", name, err)
+	}
+	return nil
+}
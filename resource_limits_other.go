@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package rpcplugin
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// LimitCommand implements ProcessLimiter.
+func (l *ResourceLimits) LimitCommand(cmd *exec.Cmd) (func(), error) {
+	if *l != (ResourceLimits{}) {
+		return nil, fmt.Errorf("resource limits are not supported on %s", runtime.GOOS)
+	}
+	return nil, nil
+}
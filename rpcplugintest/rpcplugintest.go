@@ -0,0 +1,263 @@
+// Package rpcplugintest provides utilities for testing plugin clients and
+// servers together in a single process, without building and launching
+// a separate plugin server executable.
+//
+// This is intended for authors of application-specific plugin SDKs, who can
+// use it to test that their ServerVersion and ClientVersion implementations
+// work together. The harness runs the plugin server using rpcplugin.Serve in
+// a goroutine, giving it the environment variables the client would give a
+// child process through a context rather than the process environment, and
+// connects the client to it using an in-memory listener. The handshake, the
+// automatic TLS negotiation, and the server's control and health services
+// therefore work as they would for a real plugin server, but anything to do
+// with the server's process, such as its standard streams or a crash, does
+// not, so real plugin executables should still be tested separately.
+package rpcplugintest // import go.rpcplugin.org/rpcplugin/rpcplugintest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/apparentlymart/go-ctxenv/ctxenv"
+	"go.rpcplugin.org/rpcplugin"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Config describes the client and server sides of a plugin protocol to be
+// connected together by function Start.
+type Config struct {
+	// ServerVersions and ClientVersions are the server and client
+	// implementations for each major protocol version, as would be used in
+	// rpcplugin.ServerConfig and rpcplugin.ClientConfig respectively.
+	//
+	// The server selects the greatest version number that both have in
+	// common during the handshake, as it would for a real plugin.
+	ServerVersions map[int]rpcplugin.ServerVersion
+	ClientVersions map[int]rpcplugin.ClientVersion
+
+	// Server and Client, if set, give other settings for the server and
+	// client respectively, such as interceptors or health checking. Start
+	// sets the ProtoVersions fields of both itself, along with the fields
+	// that describe how the two connect, and so Server's Listener,
+	// HandshakeWriter, HandshakeFD, and DevMode fields and Client's Cmd,
+	// Runner, InProcess, and Dial fields must not be set. If Handshake is
+	// unset in either then Start uses a handshake cookie of its own.
+	//
+	// Start doesn't modify the given configurations, but as for
+	// rpcplugin.New the caller must not modify them until the Pair is
+	// closed.
+	Server *rpcplugin.ServerConfig
+	Client *rpcplugin.ClientConfig
+}
+
+// Pair is a plugin server running in the current process, along with a
+// plugin object connected to it.
+type Pair struct {
+	// Plugin is the client-side plugin object, which can be used in the
+	// same way as one returned from rpcplugin.New. Its Close method shuts
+	// the server down as it would a real plugin server, but doesn't report
+	// any error the server returns; use Pair.Close for that.
+	Plugin *rpcplugin.Plugin
+
+	// ProtoVersion is the protocol version the server selected.
+	ProtoVersion int
+
+	server *server
+}
+
+// testHandshake is the handshake configuration Start uses for each side
+// whose configuration doesn't include one. The server receives the cookie
+// only through its context, so it need not be secret.
+var testHandshake = rpcplugin.HandshakeConfig{
+	CookieKey:   "RPCPLUGINTEST_COOKIE",
+	CookieValue: "rpcplugintest",
+}
+
+// bufferSize is the size of the buffer of each in-memory connection to the
+// server.
+const bufferSize = 256 * 1024
+
+// Start launches a plugin server in a background goroutine, and returns a
+// Pair whose Plugin is connected to that server once the server has
+// completed its handshake.
+//
+// The given context is used for the client side, so a
+// plugintrace.ClientTracer attached to it will receive client events. The
+// server's context has the same values, so a plugintrace.ServerTracer
+// attached to it will receive server events, but the server outlives the
+// given context and so isn't stopped if it is canceled.
+//
+// Callers must call Close on the returned Pair once they are finished with
+// it, to stop the server.
+func Start(ctx context.Context, config *Config) (*Pair, error) {
+	var srvConfig rpcplugin.ServerConfig
+	if config.Server != nil {
+		srvConfig = *config.Server
+	}
+	var clientConfig rpcplugin.ClientConfig
+	if config.Client != nil {
+		clientConfig = *config.Client
+	}
+	switch {
+	case srvConfig.Listener != nil:
+		return nil, fmt.Errorf("server config field Listener must be nil, because Start sets it")
+	case srvConfig.HandshakeWriter != nil || srvConfig.HandshakeFD != 0:
+		return nil, fmt.Errorf("server config fields HandshakeWriter and HandshakeFD must be unset, because Start sets them")
+	case srvConfig.DevMode:
+		return nil, fmt.Errorf("server config field DevMode is not supported")
+	case clientConfig.Cmd != nil || clientConfig.InProcess != nil:
+		return nil, fmt.Errorf("client config fields Cmd and InProcess must be nil, because Start runs the server")
+	case clientConfig.Runner != nil || clientConfig.Dial != nil:
+		return nil, fmt.Errorf("client config fields Runner and Dial must be nil, because Start sets them")
+	}
+
+	srv := &server{
+		values:   detachedContext{ctx},
+		listener: listener{bufconn.Listen(bufferSize)},
+	}
+	srvConfig.ProtoVersions = config.ServerVersions
+	srvConfig.Listener = srv.listener
+	// The process's signals and standard streams belong to the test, not
+	// to the server.
+	srvConfig.NoSignalHandlers = true
+	srvConfig.NoStdioRedirect = true
+	if srvConfig.Handshake.CookieKey == "" {
+		srvConfig.Handshake = testHandshake
+	}
+	srv.config = &srvConfig
+
+	clientConfig.ProtoVersions = config.ClientVersions
+	clientConfig.Runner = srv
+	clientConfig.Dial = srv.Dial
+	clientConfig.Transports = []string{"unix"}
+	if clientConfig.Handshake.CookieKey == "" {
+		clientConfig.Handshake = testHandshake
+	}
+
+	plugin, err := rpcplugin.New(ctx, &clientConfig)
+	if err != nil {
+		if srv.done != nil {
+			// The server's own error, if it returned one, is more useful
+			// than the client's report that the server exited.
+			<-srv.done
+			if srv.err != nil {
+				return nil, fmt.Errorf("plugin server failed: %w", srv.err)
+			}
+		}
+		return nil, err
+	}
+
+	return &Pair{
+		Plugin:       plugin,
+		ProtoVersion: plugin.ProtocolVersion().Major,
+		server:       srv,
+	}, nil
+}
+
+// Client is a convenience wrapper around p.Plugin.Client.
+func (p *Pair) Client(ctx context.Context) (protoVersion int, client interface{}, err error) {
+	return p.Plugin.Client(ctx)
+}
+
+// Close shuts the server down, as for p.Plugin.Close, and waits for it to
+// stop. It returns any error from p.Plugin.Close, or otherwise any error
+// the server returned.
+func (p *Pair) Close() error {
+	err := p.Plugin.Close()
+	<-p.server.done
+	if err == nil && p.server.err != nil {
+		err = fmt.Errorf("plugin server failed: %w", p.server.err)
+	}
+	return err
+}
+
+// server is the rpcplugin.ProcessRunner that runs a Pair's plugin server in
+// a goroutine.
+type server struct {
+	config   *rpcplugin.ServerConfig
+	values   context.Context
+	listener listener
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error // set before done is closed
+}
+
+var _ rpcplugin.ProcessRunner = (*server)(nil)
+
+func (s *server) Start(ctx context.Context, env []string, stderr io.Writer) (io.ReadCloser, error) {
+	if s.done != nil {
+		return nil, fmt.Errorf("plugin server already started")
+	}
+	handshakeR, handshakeW := io.Pipe()
+	config := *s.config
+	config.HandshakeWriter = handshakeW
+
+	// The server sees only the variables the client gives it, as a child
+	// process would, rather than those of the test process.
+	srvCtx, cancel := context.WithCancel(ctxenv.WithEnviron(s.values, env))
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	go func() {
+		err := rpcplugin.Serve(srvCtx, &config)
+		if err != nil {
+			fmt.Fprintf(stderr, "plugin server failed: %s\n", err)
+		}
+		s.err = err
+		handshakeW.Close()
+		s.listener.Close()
+		s.cancel()
+		close(s.done)
+	}()
+	return handshakeR, nil
+}
+
+// Signal implements rpcplugin.ProcessRunner. The server runs in a goroutine,
+// so Signal supports only os.Kill, for which it stops the server as soon as
+// any requests in progress have completed or its drain timeout has passed.
+func (s *server) Signal(sig os.Signal) error {
+	if sig != os.Kill {
+		return fmt.Errorf("cannot send signal %s to an in-process plugin server", sig)
+	}
+	s.cancel()
+	return nil
+}
+
+// Wait implements rpcplugin.ProcessRunner. The server isn't a process, and
+// so Wait never returns a process state.
+func (s *server) Wait() (*os.ProcessState, error) {
+	<-s.done
+	return nil, nil
+}
+
+// Dial opens a new in-memory connection to the server, for use as
+// ClientConfig.Dial.
+func (s *server) Dial(ctx context.Context, addr net.Addr) (net.Conn, error) {
+	return s.listener.Dial()
+}
+
+// listener is an in-memory listener that reports a Unix domain socket
+// address, which is a kind the client accepts in the server's handshake.
+// The client never connects to that address, because it connects using
+// server.Dial instead.
+type listener struct {
+	*bufconn.Listener
+}
+
+func (listener) Addr() net.Addr {
+	return &net.UnixAddr{Net: "unix", Name: "rpcplugintest"}
+}
+
+// detachedContext has the values of the context it wraps, but is never
+// canceled.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
@@ -0,0 +1,329 @@
+package rpcplugintest_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.rpcplugin.org/rpcplugin"
+	"go.rpcplugin.org/rpcplugin/example/countplugin1"
+	"go.rpcplugin.org/rpcplugin/rpcplugintest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStart(t *testing.T) {
+	pair := start(t, &rpcplugintest.Config{
+		ServerVersions: map[int]rpcplugin.ServerVersion{1: countServer{}},
+		ClientVersions: map[int]rpcplugin.ClientVersion{1: countClient{}},
+	})
+	if pair.ProtoVersion != 1 {
+		t.Errorf("wrong protocol version %d; want 1", pair.ProtoVersion)
+	}
+	counter := countClientFor(t, pair)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := counter.Count(ctx, &countplugin1.Count_Request{}); err != nil {
+			t.Fatalf("Count failed: %s", err)
+		}
+	}
+	resp, err := counter.GetCount(ctx, &countplugin1.GetCount_Request{})
+	if err != nil {
+		t.Fatalf("GetCount failed: %s", err)
+	}
+	if resp.Count != 2 {
+		t.Errorf("wrong count %d; want 2", resp.Count)
+	}
+	if err := pair.Close(); err != nil {
+		t.Errorf("Close failed: %s", err)
+	}
+}
+
+func TestStartCookie(t *testing.T) {
+	generate, verify := rpcplugin.HMACCookie([]byte("secret"))
+	tests := map[string]struct {
+		client, server rpcplugin.HandshakeConfig
+		wantErr        bool
+	}{
+		"matching value": {
+			client: rpcplugin.HandshakeConfig{CookieKey: "TEST_COOKIE", CookieValue: "a"},
+			server: rpcplugin.HandshakeConfig{CookieKey: "TEST_COOKIE", CookieValue: "a"},
+		},
+		"wrong value": {
+			client:  rpcplugin.HandshakeConfig{CookieKey: "TEST_COOKIE", CookieValue: "a"},
+			server:  rpcplugin.HandshakeConfig{CookieKey: "TEST_COOKIE", CookieValue: "b"},
+			wantErr: true,
+		},
+		"wrong key": {
+			client:  rpcplugin.HandshakeConfig{CookieKey: "TEST_COOKIE", CookieValue: "a"},
+			server:  rpcplugin.HandshakeConfig{CookieKey: "OTHER_COOKIE", CookieValue: "a"},
+			wantErr: true,
+		},
+		"hmac": {
+			client: rpcplugin.HandshakeConfig{CookieKey: "TEST_COOKIE", GenerateCookie: generate},
+			server: rpcplugin.HandshakeConfig{CookieKey: "TEST_COOKIE", VerifyCookie: verify},
+		},
+		"hmac wrong secret": {
+			client: rpcplugin.HandshakeConfig{
+				CookieKey:      "TEST_COOKIE",
+				GenerateCookie: func() (string, error) { return hmacCookie([]byte("other"), time.Now()), nil },
+			},
+			server:  rpcplugin.HandshakeConfig{CookieKey: "TEST_COOKIE", VerifyCookie: verify},
+			wantErr: true,
+		},
+		"hmac recent": {
+			client: rpcplugin.HandshakeConfig{
+				CookieKey:      "TEST_COOKIE",
+				GenerateCookie: func() (string, error) { return hmacCookie([]byte("secret"), time.Now().Add(-4*time.Minute)), nil },
+			},
+			server: rpcplugin.HandshakeConfig{CookieKey: "TEST_COOKIE", VerifyCookie: verify},
+		},
+		"hmac expired": {
+			client: rpcplugin.HandshakeConfig{
+				CookieKey:      "TEST_COOKIE",
+				GenerateCookie: func() (string, error) { return hmacCookie([]byte("secret"), time.Now().Add(-6*time.Minute)), nil },
+			},
+			server:  rpcplugin.HandshakeConfig{CookieKey: "TEST_COOKIE", VerifyCookie: verify},
+			wantErr: true,
+		},
+		"hmac from the future": {
+			client: rpcplugin.HandshakeConfig{
+				CookieKey:      "TEST_COOKIE",
+				GenerateCookie: func() (string, error) { return hmacCookie([]byte("secret"), time.Now().Add(6*time.Minute)), nil },
+			},
+			server:  rpcplugin.HandshakeConfig{CookieKey: "TEST_COOKIE", VerifyCookie: verify},
+			wantErr: true,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pair, err := rpcplugintest.Start(context.Background(), &rpcplugintest.Config{
+				ServerVersions: map[int]rpcplugin.ServerVersion{1: countServer{}},
+				ClientVersions: map[int]rpcplugin.ClientVersion{1: countClient{}},
+				Server:         &rpcplugin.ServerConfig{Handshake: test.server},
+				Client:         &rpcplugin.ClientConfig{Handshake: test.client},
+			})
+			if !test.wantErr {
+				if err != nil {
+					t.Fatalf("Start failed: %s", err)
+				}
+				if err := pair.Close(); err != nil {
+					t.Errorf("Close failed: %s", err)
+				}
+				return
+			}
+			if err == nil {
+				pair.Close()
+				t.Fatalf("Start succeeded; want error")
+			}
+			if !errors.Is(err, rpcplugin.NotChildProcessError) {
+				t.Errorf("wrong error %q; want NotChildProcessError", err)
+			}
+		})
+	}
+}
+
+func TestStartSharedToken(t *testing.T) {
+	t.Run("provided", func(t *testing.T) {
+		pair := start(t, &rpcplugintest.Config{
+			ServerVersions: map[int]rpcplugin.ServerVersion{1: countServer{}},
+			ClientVersions: map[int]rpcplugin.ClientVersion{1: countClient{}},
+			Server:         &rpcplugin.ServerConfig{RequireSharedToken: true},
+			Client:         &rpcplugin.ClientConfig{SharedToken: true},
+		})
+		defer pair.Close()
+		counter := countClientFor(t, pair)
+		if _, err := counter.Count(context.Background(), &countplugin1.Count_Request{}); err != nil {
+			t.Errorf("Count failed: %s", err)
+		}
+	})
+	t.Run("missing", func(t *testing.T) {
+		pair, err := rpcplugintest.Start(context.Background(), &rpcplugintest.Config{
+			ServerVersions: map[int]rpcplugin.ServerVersion{1: countServer{}},
+			ClientVersions: map[int]rpcplugin.ClientVersion{1: countClient{}},
+			Server:         &rpcplugin.ServerConfig{RequireSharedToken: true},
+		})
+		if err == nil {
+			pair.Close()
+			t.Fatalf("Start succeeded; want error")
+		}
+		if !strings.Contains(err.Error(), "shared token") {
+			t.Errorf("wrong error %q; want one about the shared token", err)
+		}
+	})
+	t.Run("call without token", func(t *testing.T) {
+		// The harness's client always sends the token it gave the server, so
+		// we call the interceptor Serve installs directly.
+		interceptor := rpcplugin.SharedTokenUnaryInterceptor("token")
+		_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			t.Fatalf("handler called without a token")
+			return nil, nil
+		})
+		if got, want := status.Code(err), codes.Unauthenticated; got != want {
+			t.Errorf("wrong status code %s; want %s", got, want)
+		}
+	})
+}
+
+func TestStartVersions(t *testing.T) {
+	tests := map[string]struct {
+		server      []int
+		client      []int
+		wantVersion int // zero if Start should fail
+	}{
+		"single":           {[]int{1}, []int{1}, 1},
+		"greatest common":  {[]int{1, 2}, []int{1, 2}, 2},
+		"older client":     {[]int{1, 2}, []int{1}, 1},
+		"older server":     {[]int{1}, []int{1, 2}, 1},
+		"partial overlap":  {[]int{1, 2}, []int{2, 3}, 2},
+		"no common":        {[]int{2}, []int{1}, 0},
+		"no common, split": {[]int{1, 3}, []int{2}, 0},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := &rpcplugintest.Config{
+				ServerVersions: make(map[int]rpcplugin.ServerVersion),
+				ClientVersions: make(map[int]rpcplugin.ClientVersion),
+			}
+			for _, v := range test.server {
+				config.ServerVersions[v] = versionServer{}
+			}
+			for _, v := range test.client {
+				config.ClientVersions[v] = versionClient(v)
+			}
+			pair, err := rpcplugintest.Start(context.Background(), config)
+			if test.wantVersion == 0 {
+				if err == nil {
+					pair.Close()
+					t.Fatalf("Start succeeded with version %d; want error", pair.ProtoVersion)
+				}
+				if !strings.Contains(err.Error(), "does not support any protocol versions") {
+					t.Errorf("wrong error %q; want one about protocol versions", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Start failed: %s", err)
+			}
+			defer pair.Close()
+			if pair.ProtoVersion != test.wantVersion {
+				t.Errorf("wrong protocol version %d; want %d", pair.ProtoVersion, test.wantVersion)
+			}
+			version, client, err := pair.Client(context.Background())
+			if err != nil {
+				t.Fatalf("Client failed: %s", err)
+			}
+			if version != test.wantVersion || client != test.wantVersion {
+				t.Errorf("wrong client %v for version %d; want %d", client, version, test.wantVersion)
+			}
+		})
+	}
+}
+
+func TestStartHealth(t *testing.T) {
+	health := rpcplugin.NewServerHealth()
+	health.SetVersionServing(2, false)
+	pair := start(t, &rpcplugintest.Config{
+		ServerVersions: map[int]rpcplugin.ServerVersion{1: versionServer{}, 2: versionServer{}},
+		ClientVersions: map[int]rpcplugin.ClientVersion{1: versionClient(1), 2: versionClient(2)},
+		Server:         &rpcplugin.ServerConfig{Health: health},
+	})
+	defer pair.Close()
+	ctx := context.Background()
+	checkHealth := func(version int, want bool) {
+		t.Helper()
+		got, err := pair.Plugin.CheckHealth(ctx, version)
+		if err != nil {
+			t.Fatalf("health check for version %d failed: %s", version, err)
+		}
+		if got != want {
+			t.Errorf("version %d serving is %t; want %t", version, got, want)
+		}
+	}
+	checkHealth(1, true)
+	checkHealth(2, false)
+
+	health.SetVersionServing(2, true)
+	checkHealth(2, true)
+	health.SetServing(false)
+	checkHealth(1, false)
+}
+
+// start calls rpcplugintest.Start, failing the test if it fails.
+func start(t *testing.T, config *rpcplugintest.Config) *rpcplugintest.Pair {
+	t.Helper()
+	pair, err := rpcplugintest.Start(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+	return pair
+}
+
+func countClientFor(t *testing.T, pair *rpcplugintest.Pair) countplugin1.CounterClient {
+	t.Helper()
+	_, client, err := pair.Client(context.Background())
+	if err != nil {
+		t.Fatalf("Client failed: %s", err)
+	}
+	return client.(countplugin1.CounterClient)
+}
+
+// hmacCookie returns a cookie in the format rpcplugin.HMACCookie generates,
+// as though generated at the given time.
+func hmacCookie(secret []byte, at time.Time) string {
+	nonce := hex.EncodeToString(make([]byte, 16))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(make([]byte, 16))
+	mac.Write([]byte(timestamp))
+	return nonce + "." + timestamp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+type countServer struct{}
+
+func (countServer) RegisterServer(server *grpc.Server) error {
+	countplugin1.RegisterCounterServer(server, &counter{})
+	return nil
+}
+
+type counter struct {
+	count int64
+}
+
+func (c *counter) Count(ctx context.Context, req *countplugin1.Count_Request) (*countplugin1.Count_Response, error) {
+	c.count++
+	return &countplugin1.Count_Response{}, nil
+}
+
+func (c *counter) GetCount(ctx context.Context, req *countplugin1.GetCount_Request) (*countplugin1.GetCount_Response, error) {
+	return &countplugin1.GetCount_Response{Count: c.count}, nil
+}
+
+type countClient struct{}
+
+func (countClient) ClientProxy(ctx context.Context, conn *grpc.ClientConn) (interface{}, error) {
+	return countplugin1.NewCounterClient(conn), nil
+}
+
+// versionServer is a ServerVersion that registers no services, so that any
+// number of versions can be served together.
+type versionServer struct{}
+
+func (versionServer) RegisterServer(*grpc.Server) error {
+	return nil
+}
+
+// versionClient returns a ClientVersion whose client is its version number,
+// so that tests can tell which version the client was created for.
+func versionClient(version int) rpcplugin.ClientVersion {
+	return rpcplugin.ClientVersionFunc(func(context.Context, *grpc.ClientConn) (interface{}, error) {
+		return version, nil
+	})
+}
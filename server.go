@@ -3,19 +3,25 @@ package rpcplugin
 import (
 	"context"
 	"crypto/tls"
-	"encoding/base64"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/apparentlymart/go-ctxenv/ctxenv"
+	"go.rpcplugin.org/rpcplugin/handshake"
 	"go.rpcplugin.org/rpcplugin/plugintrace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 )
 
 // Serve starts up a plugin server and blocks while serving requests. It
@@ -41,78 +47,254 @@ import (
 // plugins to shutdown via a different channel. This behavior can be overridden
 // in ServerOpts if you need different signal-handling behavior.
 func Serve(ctx context.Context, config *ServerConfig) error {
-	if config.Handshake.CookieKey == "" || config.Handshake.CookieValue == "" {
-		return fmt.Errorf("ServerConfig.Handshake must have non-empty CookieKey and CookieValue")
+	if !config.DevMode && (config.Handshake.CookieKey == "" || (config.Handshake.CookieValue == "" && config.Handshake.VerifyCookie == nil)) {
+		return fmt.Errorf("ServerConfig.Handshake must have non-empty CookieKey and either CookieValue or VerifyCookie")
 	}
-	if !haveHandshakeCookie(ctx, &config.Handshake) {
+	if config.StrictRPCPlugin && config.GoPluginCompat {
+		return fmt.Errorf("ServerConfig.StrictRPCPlugin and ServerConfig.GoPluginCompat are mutually exclusive")
+	}
+	if config.HandshakeWriter != nil && config.HandshakeFD != 0 {
+		return fmt.Errorf("ServerConfig.HandshakeWriter and ServerConfig.HandshakeFD are mutually exclusive")
+	}
+	if err := checkCompressor("Compressor", config.Compressor); err != nil {
+		return err
+	}
+	if err := checkProtoMinorVersions("ProtoMinorVersions", config.ProtoMinorVersions, func(v int) bool {
+		_, ok := config.ProtoVersions[v]
+		return ok
+	}); err != nil {
+		return err
+	}
+	tracer := plugintrace.ContextServerTracer(ctx)
+	if !config.DevMode && !haveHandshakeCookie(ctx, &config.Handshake) {
+		if tracer.HandshakeCookieInvalid != nil {
+			tracer.HandshakeCookieInvalid(ctxenv.Getenv(ctx, config.Handshake.CookieKey) != "")
+		}
 		return NotChildProcessError
 	}
+	if config.StrictRPCPlugin && !config.DevMode {
+		if missing := serverMissingRequiredEnv(ctx); len(missing) != 0 {
+			return &NonCompliantClientError{Missing: missing}
+		}
+	}
+	goPluginCompat := config.goPluginCompat(ctx)
 
-	tracer := plugintrace.ContextServerTracer(ctx)
-	protoVersion, server := negotiateServerProtoVersion(ctx, config.ProtoVersions)
+	var protoVersion int
+	var server ServerVersion
+	var clientVersions []int
+	var protoMinorVersion int
+	if config.DevMode && ctxenv.Getenv(ctx, "PLUGIN_PROTOCOL_VERSIONS") == "" {
+		protoVersion, server = devServerProtoVersion(config.ProtoVersions)
+		protoMinorVersion = config.ProtoMinorVersions[protoVersion]
+	} else {
+		clientMinors := serverClientMinorVersions(ctx)
+		accept := serverVersionAcceptor(config.VersionPolicy, clientMinors, config.ProtoMinorVersions)
+		protoVersion, server, clientVersions = negotiateServerProtoVersion(ctx, config.ProtoVersions, accept)
+
+		// The client can learn which minor version we selected only from
+		// the handshake extensions, so we use minor version zero otherwise.
+		if serverHandshakeV2(ctx) {
+			protoMinorVersion = selectMinorVersion(clientMinors[protoVersion], config.ProtoMinorVersions[protoVersion])
+		}
+	}
 	if server == nil {
-		return fmt.Errorf("plugin does not support any protocol versions supported by the host")
+		serverVersions := make([]int, 0, len(config.ProtoVersions))
+		for v := range config.ProtoVersions {
+			serverVersions = append(serverVersions, v)
+		}
+		sort.Ints(serverVersions)
+		var rejectedVersions []int
+		if config.VersionPolicy != nil {
+			// Any versions in common must have been rejected by the policy.
+			for _, v := range clientVersions {
+				if _, ok := config.ProtoVersions[v]; ok {
+					rejectedVersions = append(rejectedVersions, v)
+				}
+			}
+		}
+		return &NoCommonProtoVersionError{
+			ClientVersions:   clientVersions,
+			ServerVersions:   serverVersions,
+			RejectedVersions: rejectedVersions,
+		}
+	}
+	var servedVersions []int
+	if config.ServeAllVersions {
+		var err error
+		server, servedVersions, err = allServerVersions(config.ProtoVersions)
+		if err != nil {
+			return err
+		}
 	}
 
-	listener, err := serverListen(ctx)
-	if err != nil {
-		return fmt.Errorf("cannot start plugin RPC server: %s", err)
+	listener := config.Listener
+	if listener == nil && config.DevMode {
+		var err error
+		listener, err = serverDevListen(config)
+		if err != nil {
+			return err
+		}
+	}
+	if listener == nil {
+		sock, err := serverUnixSocketConfig(ctx, config)
+		if err != nil {
+			return err
+		}
+		listener, err = serverListen(ctx, sock, serverTCPBindConfig(ctx, config), goPluginCompat, serverListenAll(ctx, config))
+		if err != nil {
+			return fmt.Errorf("cannot start plugin RPC server: %w", err)
+		}
 	}
 	defer listener.Close()
+	var listenAddrs []net.Addr
+	if multi, ok := listener.(*multiListener); ok {
+		listenAddrs = multi.Addrs()
+	}
+	if config.MaxConnections > 0 {
+		listener = newLimitListener(listener, config.MaxConnections)
+	}
+	var watchdog *watchdogListener
+	if config.ConnectTimeout > 0 || config.IdleTimeout > 0 {
+		watchdog = &watchdogListener{
+			Listener:       listener,
+			connectTimeout: config.ConnectTimeout,
+			idleTimeout:    config.IdleTimeout,
+		}
+		listener = watchdog
+	}
+
+	var handshakeExt handshakeExtensions
+	var mux *muxListener
+	if serverMultiplexRequested(ctx) {
+		mux = newMuxListener(listener)
+		listener = mux
+		handshakeExt.Multiplex = multiplexYamux
+	}
+	if serverHandshakeV2(ctx) {
+		handshakeExt.Metadata = config.Metadata
+		handshakeExt.Versions = servedVersions
+		handshakeExt.MinorVersion = protoMinorVersion
+		handshakeExt.Addrs = newHandshakeAddrs(listenAddrs)
+		if set, ok := config.ProtoVersions[protoVersion].(ServerPluginSet); ok {
+			handshakeExt.Plugins = set.names()
+		}
+
+		// The client can learn which capabilities we selected only from
+		// the handshake extensions, so we agree to none otherwise.
+		handshakeExt.Capabilities = serverSelectCapabilities(ctx, config.Capabilities)
+	}
+
+	hsLine := &handshake.Line{
+		ProtoVersion: protoVersion,
+		RPCProtocol:  "grpc",
 
-	var autoCertStr string // only populated if we use automatic certificate negotiation
-	tlsConfig, autoCert, err := serverTLSConfig(ctx, listener.Addr(), config.TLSConfig)
+		// As a concession to go-plugin compatibility we use its non-standard
+		// unpadded base64 encoding when the client seems like it's go-plugin,
+		// or else the certificate won't be parsed correctly when its length
+		// isn't a round 3 bytes.
+		UnpaddedCertificate: goPluginCompat,
+	}
+	tlsConfig, creds, err := serverTLSConfig(ctx, config)
 	if err != nil {
-		return fmt.Errorf("invalid TLS settings: %w", err)
-	}
-	if len(autoCert.Certificate) != 0 {
-		if clientSmellsLikeGoPlugin(ctx) {
-			// As a concession to go-plugin compatibility we use its non-standard
-			// unpadded base64 encoding when the client seems like it's go-plugin,
-			// or else the certificate won't be parsed correctly when its length
-			// isn't a round 3 bytes.
-			autoCertStr = base64.RawStdEncoding.EncodeToString(autoCert.Certificate[0])
-		} else {
-			autoCertStr = base64.StdEncoding.EncodeToString(autoCert.Certificate[0])
+		return &TLSSetupError{Err: err}
+	}
+	auto, _ := creds.(*autoCredentials)
+	if auto != nil {
+		// The certificate is populated only if we use automatic certificate
+		// negotiation.
+		hsLine.Certificate, err = x509.ParseCertificate(auto.Certificate().Certificate[0])
+		if err != nil {
+			return &TLSSetupError{Err: fmt.Errorf("invalid temporary server certificate: %w", err)}
 		}
 	}
 	if tracer.TLSConfig != nil {
-		tracer.TLSConfig(tlsConfig, autoCertStr != "")
+		tracer.TLSConfig(tlsConfig, auto != nil)
 	}
 
-	// While the plugin code is running we redirect os.Stdout and os.Stderr to
-	// some pipes whose data we'll send via the RPC protocol, so that the "real"
-	// stdout and stderr can be reserved for the plugin handshake data.
-	handshakeOut := os.Stdout
-	stdoutR, stdoutW, err := os.Pipe()
+	hostConn, err := dialHostServices(ctx, tlsConfig, creds, config.VerifyPeer, config.Compressor, mux)
 	if err != nil {
-		return fmt.Errorf("failed to create stdout pipe: %s", err)
+		return fmt.Errorf("cannot connect to host services: %s", err)
 	}
-	stderrR, stderrW, err := os.Pipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stdin pipe: %s", err)
+	if hostConn != nil {
+		defer hostConn.Close()
+	}
+
+	unaryInts := config.UnaryInterceptors
+	streamInts := config.StreamInterceptors
+	if config.RecoverPanics {
+		unaryInts = append([]grpc.UnaryServerInterceptor{RecoverPanicsUnaryInterceptor(tracer.HandlerPanicked)}, unaryInts...)
+		streamInts = append([]grpc.StreamServerInterceptor{RecoverPanicsStreamInterceptor(tracer.HandlerPanicked)}, streamInts...)
+	}
+	if token := ctxenv.Getenv(ctx, authTokenEnvName); token != "" {
+		unaryInts = append([]grpc.UnaryServerInterceptor{SharedTokenUnaryInterceptor(token)}, unaryInts...)
+		streamInts = append([]grpc.StreamServerInterceptor{SharedTokenStreamInterceptor(token)}, streamInts...)
+	} else if config.RequireSharedToken {
+		return fmt.Errorf("plugin server requires a shared token, but the client didn't provide one")
+	}
+	if config.TraceCalls && tracer.CallCompleted != nil {
+		// Call tracing is outermost so that it also reports calls that
+		// were rejected for lacking the shared token.
+		unaryInts = append([]grpc.UnaryServerInterceptor{serverCallTraceUnaryInterceptor(tracer.CallCompleted)}, unaryInts...)
+		streamInts = append([]grpc.StreamServerInterceptor{serverCallTraceStreamInterceptor(tracer.CallCompleted)}, streamInts...)
 	}
 
-	oldStdout := os.Stdout
-	oldStderr := os.Stderr
-	os.Stdout = stdoutW
-	os.Stderr = stderrW
-	defer func() {
-		os.Stdout = oldStdout
-		os.Stderr = oldStderr
-	}()
+	// While the plugin code is running we redirect os.Stdout and os.Stderr to
+	// some pipes whose data we'll send via the RPC protocol, so that the "real"
+	// stdout and stderr can be reserved for the plugin handshake data.
+	//
+	// In development mode there is no client reading our stdout, so we leave
+	// it connected to wherever the developer launched us from. We also can't
+	// redirect on platforms without pipes.
+	handshakeOut := config.handshakeWriter()
+	var stdoutR, stderrR *os.File
+	if !config.DevMode && !config.NoStdioRedirect && canRedirectStdio {
+		var stdoutW, stderrW *os.File
+		stdoutR, stdoutW, err = os.Pipe()
+		if err != nil {
+			return fmt.Errorf("failed to create stdout pipe: %s", err)
+		}
+		stderrR, stderrW, err = os.Pipe()
+		if err != nil {
+			return fmt.Errorf("failed to create stdin pipe: %s", err)
+		}
+
+		oldStdout := os.Stdout
+		oldStderr := os.Stderr
+		os.Stdout = stdoutW
+		os.Stderr = stderrW
+		defer func() {
+			os.Stdout = oldStdout
+			os.Stderr = oldStderr
+		}()
+		if tracer.StdioRedirected != nil {
+			tracer.StdioRedirected()
+		}
+	}
 
 	chiCtx, cancel := context.WithCancel(ctx)
 	srvGRC := &serverGRPC{
-		Server: server,
-		TLS:    tlsConfig,
-		Stdout: stdoutR,
-		Stderr: stderrR,
-		Done:   cancel,
-		Tracer: tracer,
+		Server:   server,
+		Common:   config.CommonServices,
+		TLS:      tlsConfig,
+		Auto:     auto,
+		HostConn: hostConn,
+		Stdout:   stdoutR,
+		Stderr:   stderrR,
+		Done:     cancel,
+		Tracer:   tracer,
+		Health:   config.Health,
+
+		Options:            config.grpcServerOptions(),
+		UnaryInterceptors:  unaryInts,
+		StreamInterceptors: streamInts,
+		Reflection:         config.Reflection,
+		Metadata:           config.Metadata,
+		Capabilities:       handshakeExt.Capabilities,
+		ProtoVersion:       ProtocolVersion{Major: protoVersion, Minor: protoMinorVersion},
+		ServedVersions:     servedVersions,
 	}
 	var goPluginClose func()
-	if clientSmellsLikeGoPlugin(ctx) {
+	if goPluginCompat {
 		goPluginClose = cancel
 	}
 	err = srvGRC.Init(goPluginClose)
@@ -120,18 +302,46 @@ func Serve(ctx context.Context, config *ServerConfig) error {
 		return fmt.Errorf("plugin server init failed: %s", err)
 	}
 
+	if config.ExitWithParent {
+		go watchParent(chiCtx, func() {
+			if tracer.ParentExited != nil {
+				tracer.ParentExited()
+			}
+			cancel()
+		})
+	}
+
+	if watchdog != nil {
+		watchdog.expired = func(connected bool, timeout time.Duration) {
+			if tracer.ClientTimeout != nil {
+				tracer.ClientTimeout(connected, timeout)
+			}
+			cancel()
+		}
+		defer watchdog.stop()
+	}
+
 	// By default we eat SIGINT because otherwise we'll tend to get these
 	// when the user tries to interrupt the host program, but we want to let
 	// the host program be in control of when and how we shut down.
+	//
+	// The exception is when the client has isolated us from its console's
+	// interrupts, in which case an interrupt can only be the client asking
+	// us to shut down.
 	if !config.NoSignalHandlers {
 		ch := make(chan os.Signal, 1)
 		signal.Notify(ch, os.Interrupt)
+		interruptShutdown := config.DevMode || serverInterruptShutdown(ctx)
 		go func() {
 			var count int32
 			ign := tracer.InterruptIgnored
 			for {
 				select {
 				case <-ch:
+					if interruptShutdown {
+						cancel()
+						return
+					}
 					newCount := atomic.AddInt32(&count, 1)
 					if ign != nil {
 						ign(int(newCount))
@@ -145,25 +355,49 @@ func Serve(ctx context.Context, config *ServerConfig) error {
 
 	// We must now write the rpcplugin handshake line to real stdout so that the
 	// client (our parent process) knows where to connect.
-	_, err = fmt.Fprintf(handshakeOut, "1|%d|%s|%s|grpc|%s\n",
-		protoVersion,
-		listener.Addr().Network(),
-		listener.Addr().String(),
-		autoCertStr,
-	)
+	hsLine.Addr = listener.Addr()
+	if !handshakeExt.empty() {
+		hsLine.Extensions = json.RawMessage(handshakeExt.encode())
+	}
+	handshakeLine, err := handshake.FormatLine(hsLine)
+	if err != nil {
+		return fmt.Errorf("invalid plugin handshake: %s", err)
+	}
+	if config.DevMode {
+		err = writeDevInstructions(handshakeOut, hsLine, handshakeLine, tlsConfig != nil)
+	} else {
+		_, err = fmt.Fprintln(handshakeOut, handshakeLine)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to print plugin handshake to stdout: %s", err)
+		return fmt.Errorf("failed to print plugin handshake: %s", err)
 	}
 	// We intentionally ignore the error from sync because stdout might be
 	// bound to something that cannot sync.
-	handshakeOut.Sync()
+	if syncer, ok := handshakeOut.(interface{ Sync() error }); ok {
+		syncer.Sync()
+	}
+	if tracer.HandshakeWritten != nil {
+		tracer.HandshakeWritten(handshakeLine)
+	}
 
+	if watchdog != nil {
+		watchdog.start()
+	}
 	go srvGRC.Serve(listener)
 
 	if tracer.Listening != nil {
 		tracer.Listening(listener.Addr(), tlsConfig, protoVersion)
 	}
 	<-chiCtx.Done() // wait for the GRPC handler to signal that it is ready to exit
+
+	// Give any requests still in progress a chance to complete before we
+	// return, because the caller will typically exit immediately after.
+	drainTimeout := config.DrainTimeout
+	if drainTimeout == 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	srvGRC.Stop(drainTimeout)
+
 	if chiCtx.Err() == context.Canceled {
 		// For this particular context, being cancelled is not considered an error.
 		return nil
@@ -184,20 +418,383 @@ type ServerConfig struct {
 	// Server implementation to activate it.
 	ProtoVersions map[int]ServerVersion
 
+	// ProtoMinorVersions optionally gives the greatest minor version the
+	// server supports for each major version in ProtoVersions. Major
+	// versions not in the map have minor version zero.
+	//
+	// The server selects the lesser of its own and the client's greatest
+	// minor version for the negotiated major version, which RPC handlers
+	// can obtain from ContextProtocolVersion.
+	ProtoMinorVersions map[int]int
+
+	// VersionPolicy, if set, is called for each major version the client
+	// and server have in common, from greatest to least, to decide whether
+	// they are compatible given the minor versions each supports. The
+	// server selects the greatest major version for which VersionPolicy
+	// returns true.
+	//
+	// If VersionPolicy is nil, all minor versions of a major version are
+	// compatible with each other.
+	VersionPolicy VersionPolicy
+
+	// CommonServices are additional services to register in the server
+	// regardless of which protocol version is selected, such as
+	// diagnostics services that aren't part of any particular protocol.
+	// They are registered before the selected version's services, in the
+	// given order.
+	CommonServices []ServerVersion
+
+	// ServeAllVersions causes the server to register the services for all
+	// of the versions in ProtoVersions, rather than only the version
+	// selected during negotiation, so that a client can use any of them.
+	// The server still reports the negotiated version in the handshake, and
+	// additionally reports the full set of versions to clients that support
+	// version 2 of the handshake.
+	//
+	// The services of the different versions must have distinct names. Serve
+	// returns an error if any two versions register the same service, which
+	// it detects by first calling the RegisterServer method of each version
+	// with a temporary server that it then discards.
+	ServeAllVersions bool
+
+	// Listener, if set, is an already-open listener that the server will
+	// accept connections from, instead of creating its own listen socket
+	// using the transport negotiation protocol. This can be useful for
+	// servers that have been passed an inherited socket, or for
+	// in-memory listeners used in testing.
+	//
+	// The server reports the listener's address to the client in the
+	// handshake, so its network must be one the client supports. Serve takes
+	// ownership of the listener and closes it before returning.
+	Listener net.Listener
+
+	// UnixSocketMode and UnixSocketGroup, if set, are the permissions and
+	// owning group to give the server's Unix domain socket, if it uses one.
+	// This can allow a client running as a different user to connect to
+	// the socket.
+	//
+	// If these are not set, the server uses the settings the client
+	// requested via its own ClientConfig, if any, or otherwise leaves the
+	// socket accessible only to the user running the server.
+	UnixSocketMode  os.FileMode
+	UnixSocketGroup string
+
+	// UnixSocketDir, if set, is the directory in which the server creates
+	// a temporary directory for its Unix domain socket, such as a tmpfs
+	// mount or a volume shared with a container. If this is not set, the
+	// server uses the directory requested by the client, if any, or
+	// otherwise $XDG_RUNTIME_DIR or the system's temporary directory.
+	UnixSocketDir string
+
+	// TCPBindAddr, if set, is the IP address the server listens on when it
+	// uses the TCP transport, such as "::1" for IPv6-only environments or
+	// another loopback address. If this is not set, the server uses the
+	// address requested by the client, if any, or otherwise 127.0.0.1.
+	//
+	// The server refuses to listen on an address that is not a loopback
+	// address, which would expose it to other hosts, unless
+	// AllowNonLoopbackTCP is set or the client requested that address and
+	// explicitly allowed it. That is intended only for setups where the
+	// client and server run on different hosts, and such servers should
+	// always use TLS.
+	TCPBindAddr         string
+	AllowNonLoopbackTCP bool
+
+	// ListenAllTransports makes the server listen on each of the client's
+	// transports that it can use, rather than only the first, and advertise
+	// all of their addresses so that the client can connect using the first
+	// that it is able to reach. This is for environments where, for
+	// example, a Unix domain socket works for clients on the same host but
+	// TCP is needed to reach the server across a namespace boundary.
+	//
+	// The server also does this if the client requests it. The server can
+	// advertise the additional addresses only to clients that support
+	// version 2 of the handshake, and so it ignores this setting otherwise.
+	ListenAllTransports bool
+
 	// TLSConfig can be assigned a custom function for preparing the TLS
 	// configuration used to authenticate and encrypt the RPC channel. If
 	// no function is assigned, the ad-hoc TLS negotation protocol is used
 	// to automatically establish a single-use key and certificate for each
 	// plugin process.
+	//
+	// The server's certificate may be given either in Certificates or by a
+	// GetCertificate function, which allows the server to select or rotate
+	// its certificate for each connection. The server also presents the
+	// same certificate to the client when it calls host services.
 	TLSConfig func() (*tls.Config, error)
 
+	// Credentials, if set, is a source of TLS credentials for the server,
+	// as an alternative to TLSConfig for applications that keep their
+	// certificates in files or in a secret manager. The server consults the
+	// source for each new connection, so that it uses updated credentials
+	// without restarting.
+	//
+	// Credentials and TLSConfig are mutually exclusive.
+	Credentials CredentialSource
+
+	// TLSPolicy, if set, constrains the TLS protocol versions and
+	// algorithms used for all connections, including those for host
+	// services, whichever way the TLS configuration was produced.
+	TLSPolicy *TLSPolicy
+
+	// AutoCertIssuer, if set, is a certificate authority that signs the
+	// temporary certificate produced by the automatic TLS negotiation
+	// protocol, instead of that certificate being self-signed. It is not
+	// used if TLS is configured explicitly.
+	AutoCertIssuer *CertificateIssuer
+
+	// VerifyPeer, if set, is called with the certificate chain presented by
+	// the client each time it connects, after the chain has passed the
+	// usual verification, so that the server can make additional checks
+	// such as requiring a particular SPIFFE ID or organization. The first
+	// certificate in the chain is the client's own certificate.
+	//
+	// If VerifyPeer returns an error, the connection is rejected. The same
+	// function also checks the certificates presented by the client's
+	// host services, if any.
+	//
+	// VerifyPeer is not used if TLS is disabled.
+	VerifyPeer func(chain []*x509.Certificate) error
+
+	// GRPCServerOptions are additional options for the gRPC server, such as
+	// stats handlers, keepalive policies, or custom codecs.
+	//
+	// The server installs interceptors of its own, so these options must not
+	// include grpc.UnaryInterceptor or grpc.StreamInterceptor. Use the
+	// UnaryInterceptors and StreamInterceptors fields instead.
+	GRPCServerOptions []grpc.ServerOption
+
+	// UnaryInterceptors and StreamInterceptors are interceptors to install
+	// in the gRPC server, which will be called in the given order.
+	UnaryInterceptors  []grpc.UnaryServerInterceptor
+	StreamInterceptors []grpc.StreamServerInterceptor
+
+	// Compressor, if set, is the name of a compressor that the server will
+	// use to compress the messages it sends when calling host services
+	// offered by the client, such as "gzip".
+	//
+	// The server always responds to requests using the compressor the client
+	// used to send them, so this doesn't affect the server's responses to
+	// the client's calls. See ClientConfig.Compressor for more information.
+	Compressor string
+
+	// TraceCalls causes the server to report each RPC call it handles to the
+	// CallCompleted function of the ServerTracer registered in the context
+	// passed to Serve, including the method name, duration, status code, and
+	// message sizes.
+	TraceCalls bool
+
+	// RecoverPanics causes the server to recover from any panic in the
+	// handler for an RPC call, or in UnaryInterceptors or StreamInterceptors,
+	// so that the call fails with an Internal status instead of the panic
+	// terminating the whole plugin process.
+	//
+	// The client receives only a generic error message. The panic value and
+	// stack trace are reported to the HandlerPanicked function of the
+	// ServerTracer registered in the context passed to Serve.
+	RecoverPanics bool
+
+	// RequireSharedToken causes Serve to return an error if the client
+	// didn't provide a shared token via ClientConfig.SharedToken.
+	//
+	// Whenever the client does provide a shared token, the server rejects
+	// any call that doesn't include it, regardless of this setting.
+	RequireSharedToken bool
+
+	// MaxRecvMsgSize and MaxSendMsgSize are the maximum sizes in bytes of
+	// messages the server will accept from clients and send to clients,
+	// respectively. If either is zero, the gRPC default is used, which is
+	// 4MiB for received messages and unlimited for sent messages.
+	//
+	// The rpcplugin client accepts messages of any size, so protocols that
+	// send large messages to the server will typically need to increase
+	// MaxRecvMsgSize.
+	MaxRecvMsgSize, MaxSendMsgSize int
+
+	// MaxConcurrentStreams, if non-zero, limits the number of concurrent
+	// requests each client connection may have in progress.
+	MaxConcurrentStreams uint32
+
+	// MaxConnections, if greater than zero, limits the number of client
+	// connections the server will have open at once. Further connections
+	// will wait until an existing connection is closed.
+	//
+	// Clients using multiplexing make only one connection, regardless of
+	// how many RPC channels they have open.
+	MaxConnections int
+
+	// Keepalive, if set, configures how the server pings idle clients and
+	// closes idle or long-lived connections, so that the server can detect
+	// clients that have gone away.
+	Keepalive *keepalive.ServerParameters
+
+	// KeepaliveEnforcement, if set, configures the policy the server uses
+	// to decide whether to reject keepalive pings from clients.
+	KeepaliveEnforcement *keepalive.EnforcementPolicy
+
+	// Reflection enables the gRPC server reflection service, which allows
+	// generic tools such as grpcurl, and clients using package dynamic, to
+	// discover the services the plugin server offers and call them.
+	//
+	// This is intended for use during development, and it's not recommended
+	// to enable it in plugins distributed to end-users.
+	Reflection bool
+
+	// DrainTimeout is the maximum time the server will wait for requests
+	// in progress to complete when it is shutting down, before it abruptly
+	// terminates them.
+	//
+	// If this is zero, it defaults to five seconds. Set it to a negative
+	// duration to terminate requests immediately.
+	DrainTimeout time.Duration
+
+	// Metadata is an optional description of the plugin server, which the
+	// server sends to clients that support version 2 of the handshake and
+	// also offers via the control service, for clients that didn't receive
+	// it during the handshake.
+	Metadata *PluginMetadata
+
+	// Health, if set, is a ServerHealth created by NewServerHealth, through
+	// which plugin code can report the server's status from before it
+	// starts, such as that it is not serving until it has finished
+	// initializing. Otherwise, the server creates its own, which RPC handlers
+	// can obtain from ContextServerHealth.
+	Health *ServerHealth
+
+	// Capabilities are optional features, named by the application, that
+	// the server supports. The server selects those that the client also
+	// advertised, and the selected set is then available to RPC handlers
+	// from ContextCapabilities.
+	Capabilities []string
+
+	// HandshakeWriter or HandshakeFD, if set, is where the server writes its
+	// handshake line, instead of the real stdout of the process. This is
+	// for applications that already manage the standard I/O handles
+	// themselves or that run Serve inside a larger process, and arrange for
+	// the client to read the handshake from somewhere else.
+	//
+	// If the writer has a method Sync() error, as *os.File does, the server
+	// calls it after writing the handshake. HandshakeFD is a file descriptor
+	// inherited from the parent process, and must not be 0.
+	//
+	// HandshakeWriter and HandshakeFD are mutually exclusive.
+	HandshakeWriter io.Writer
+	HandshakeFD     int
+
+	// ExitWithParent causes the server to shut down, after completing any
+	// requests in progress, if the client process that launched it exits,
+	// so that plugin servers don't linger after their host crashes.
+	//
+	// On Unix systems the server checks for a change to its parent process
+	// once per second, while on Windows it waits on a handle to the parent
+	// process.
+	ExitWithParent bool
+
+	// ConnectTimeout and IdleTimeout cause the server to shut down, after
+	// completing any requests in progress, if no client connects within
+	// ConnectTimeout after the server writes its handshake line, or if all
+	// client connections remain closed for IdleTimeout, respectively. This
+	// prevents a server from lingering if the client gives up on it without
+	// killing it. Zero disables the corresponding timeout.
+	ConnectTimeout time.Duration
+	IdleTimeout    time.Duration
+
+	// DevMode runs the server standalone, such as under a debugger, rather
+	// than as a child process of a plugin client, so that a client can then
+	// connect to it using Attach.
+	//
+	// In development mode the server doesn't require the handshake cookie,
+	// selects the newest protocol version in ProtoVersions unless the
+	// environment specifies otherwise, and listens on DevAddr instead of a
+	// temporary address unless Listener is set. Because there is no client
+	// to negotiate a temporary certificate with, the server uses TLS only if
+	// TLSConfig or Credentials is set. Instead of the handshake line, the
+	// server writes instructions for connecting to it, and it leaves its
+	// standard output and error streams unchanged and shuts down on an
+	// interrupt signal.
+	//
+	// DevMode is intended only for plugin development. A server must never
+	// run in development mode when launched by a host application.
+	DevMode bool
+
+	// DevAddr is the TCP address where a server in development mode listens.
+	// If DevAddr is empty, the server listens on DefaultDevAddr.
+	DevAddr string
+
+	// StrictRPCPlugin disables the adaptations the server otherwise makes
+	// when its client seems to be a HashiCorp go-plugin client rather than
+	// an rpcplugin client, such as encoding its certificate in go-plugin's
+	// non-standard way, offering go-plugin's shutdown service, and
+	// listening only on TCP on Windows, within the port range given by
+	// go-plugin's PLUGIN_MIN_PORT and PLUGIN_MAX_PORT. Instead,
+	// Serve returns a *NonCompliantClientError if the client didn't set the
+	// environment variables the rpcplugin protocol requires.
+	StrictRPCPlugin bool
+
+	// GoPluginCompat makes the server always behave as it otherwise would
+	// only if its client seems to be a HashiCorp go-plugin client, for
+	// servers intended only for hosts that use go-plugin. The server
+	// otherwise detects go-plugin clients by the absence of the
+	// PLUGIN_TRANSPORTS environment variable, which some go-plugin
+	// derivatives do set.
+	//
+	// GoPluginCompat and StrictRPCPlugin are mutually exclusive.
+	GoPluginCompat bool
+
 	// Set NoSignalHandlers to prevent Serve from configuring the handling
 	// of signals for the process. If you do this, you must find some other
 	// way to prevent an interrupt signal to the client process group from also
 	// being recieved by the plugin server processes.
 	NoSignalHandlers bool
+
+	// Set NoStdioRedirect to prevent Serve from redirecting os.Stdout and
+	// os.Stderr while it runs, so that their output doesn't reach the client.
+	// This is for servers that run inside a larger process and write their
+	// handshake to HandshakeWriter, such as those started by package
+	// rpcplugintest, where the process's standard streams aren't the
+	// server's own.
+	NoStdioRedirect bool
 }
 
+// grpcServerOptions returns the options for the gRPC server implied by the
+// configuration, followed by those given explicitly in GRPCServerOptions.
+func (c *ServerConfig) grpcServerOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if c.MaxRecvMsgSize != 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(c.MaxRecvMsgSize))
+	}
+	if c.MaxSendMsgSize != 0 {
+		opts = append(opts, grpc.MaxSendMsgSize(c.MaxSendMsgSize))
+	}
+	if c.MaxConcurrentStreams != 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(c.MaxConcurrentStreams))
+	}
+	if c.Keepalive != nil {
+		opts = append(opts, grpc.KeepaliveParams(*c.Keepalive))
+	}
+	if c.KeepaliveEnforcement != nil {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(*c.KeepaliveEnforcement))
+	}
+	return append(opts, c.GRPCServerOptions...)
+}
+
+// handshakeWriter returns the writer where the server should write its
+// handshake line, which must be called before Serve redirects os.Stdout.
+func (c *ServerConfig) handshakeWriter() io.Writer {
+	switch {
+	case c.HandshakeWriter != nil:
+		return c.HandshakeWriter
+	case c.HandshakeFD != 0:
+		return os.NewFile(uintptr(c.HandshakeFD), "handshake")
+	default:
+		return os.Stdout
+	}
+}
+
+// defaultDrainTimeout is the default value for ServerConfig.DrainTimeout.
+const defaultDrainTimeout = 5 * time.Second
+
 // ForceServerWithoutTLS is a predefined function for use with ServerConfig.TLSConfig
 // which makes a server not use TLS at all. This makes the server non-compliant
 // with the rpcplugin specification, but can be useful for debugging or for
@@ -229,7 +826,95 @@ func (fn ServerVersionFunc) RegisterServer(srv *grpc.Server) error {
 	return fn(srv)
 }
 
-func negotiateServerProtoVersion(ctx context.Context, protoVersions map[int]ServerVersion) (version int, server ServerVersion) {
+// allServerVersions returns a ServerVersion that registers the services of
+// all of the given versions, along with the sorted list of those versions.
+//
+// gRPC treats duplicate service registrations as a fatal error, so when
+// there is more than one version this first registers each version alone in
+// a temporary server in order to detect any conflicts between them.
+func allServerVersions(protoVersions map[int]ServerVersion) (ServerVersion, []int, error) {
+	versions := make([]int, 0, len(protoVersions))
+	for v := range protoVersions {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+
+	checked := len(versions) > 1
+	if checked {
+		owners := make(map[string]int)
+		for _, v := range versions {
+			names, err := registeredServices(protoVersions[v])
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to register server for protocol version %d: %s", v, err)
+			}
+			for _, name := range names {
+				if other, exists := owners[name]; exists {
+					return nil, nil, fmt.Errorf("protocol versions %d and %d both register service %q, so they cannot be served together", other, v, name)
+				}
+				owners[name] = v
+			}
+		}
+	}
+
+	server := ServerVersionFunc(func(srv *grpc.Server) error {
+		for _, v := range versions {
+			err := registerServer(srv, protoVersions[v], checked)
+			if err != nil {
+				return fmt.Errorf("protocol version %d: %s", v, err)
+			}
+		}
+		return nil
+	})
+	return server, versions, nil
+}
+
+// registeredServices returns the names of the services the given
+// ServerVersion registers, by registering it in a temporary server.
+//
+// A ServerPluginSet checks for conflicts between its own plugins at the same
+// time, so that each of them is registered in only one temporary server
+// however deeply the sets are nested.
+func registeredServices(sv ServerVersion) ([]string, error) {
+	if set, ok := sv.(ServerPluginSet); ok {
+		owners, err := set.serviceOwners()
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(owners))
+		for name := range owners {
+			names = append(names, name)
+		}
+		return names, nil
+	}
+
+	tmp := grpc.NewServer()
+	defer tmp.Stop()
+	err := sv.RegisterServer(tmp)
+	if err != nil {
+		return nil, err
+	}
+	info := tmp.GetServiceInfo()
+	names := make([]string, 0, len(info))
+	for name := range info {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// registerServer registers the services of the given ServerVersion in srv.
+// If checked is true then registeredServices has already checked the
+// ServerVersion, and so a ServerPluginSet need not check its plugins again.
+func registerServer(srv *grpc.Server, sv ServerVersion, checked bool) error {
+	if set, ok := sv.(ServerPluginSet); ok && checked {
+		return set.register(srv, true)
+	}
+	return sv.RegisterServer(srv)
+}
+
+// negotiateServerProtoVersion selects the greatest protocol version that
+// the client and server have in common and that the given accept function,
+// if not nil, returns true for.
+func negotiateServerProtoVersion(ctx context.Context, protoVersions map[int]ServerVersion, accept func(int) bool) (version int, server ServerVersion, clientVersions []int) {
 	clientVersionsStr := ctxenv.Getenv(ctx, "PLUGIN_PROTOCOL_VERSIONS")
 	if clientVersionsStr == "" {
 		// Client isn't performing the negotiation protocol propertly, so
@@ -238,19 +923,19 @@ func negotiateServerProtoVersion(ctx context.Context, protoVersions map[int]Serv
 		if trace.InvalidClientHandshakeVersion != nil {
 			trace.InvalidClientHandshakeVersion("") // treat the empty string as a single empty version number
 		}
-		return 0, nil
+		return 0, nil, nil
 	}
 
 	vStrs := strings.Split(clientVersionsStr, ",")
-	clientVersions := make([]int, 0, len(vStrs))
+	clientVersions = make([]int, 0, len(vStrs))
 	for _, vStr := range vStrs {
 		v, err := strconv.Atoi(vStr)
 		if err != nil {
 			trace := plugintrace.ContextServerTracer(ctx)
 			if trace.InvalidClientHandshakeVersion != nil {
 				trace.InvalidClientHandshakeVersion(vStr)
-				continue
 			}
+			continue
 		}
 		clientVersions = append(clientVersions, v)
 	}
@@ -260,8 +945,8 @@ func negotiateServerProtoVersion(ctx context.Context, protoVersions map[int]Serv
 	sort.Sort(sort.Reverse(sort.IntSlice(clientVersions)))
 
 	for _, v := range clientVersions {
-		if server, ok := protoVersions[v]; ok {
-			return v, server
+		if server, ok := protoVersions[v]; ok && (accept == nil || accept(v)) {
+			return v, server, clientVersions
 		}
 	}
 
@@ -270,7 +955,7 @@ func negotiateServerProtoVersion(ctx context.Context, protoVersions map[int]Serv
 	if trace.VersionNegotationFailed != nil {
 		trace.VersionNegotationFailed(clientVersions)
 	}
-	return 0, nil
+	return 0, nil, clientVersions
 }
 
 // clientSmellsLikeGoPlugin returns true if the client hasn't set some of
@@ -286,3 +971,30 @@ func clientSmellsLikeGoPlugin(ctx context.Context) bool {
 	// "unix,tcp" on Unix platforms and just "tcp" on Windows.
 	return ctxenv.Getenv(ctx, "PLUGIN_TRANSPORTS") == ""
 }
+
+// goPluginCompat returns true if the server should make its adaptations for
+// HashiCorp go-plugin clients.
+func (c *ServerConfig) goPluginCompat(ctx context.Context) bool {
+	switch {
+	case c.GoPluginCompat:
+		return true
+	case c.StrictRPCPlugin:
+		return false
+	default:
+		return clientSmellsLikeGoPlugin(ctx)
+	}
+}
+
+// serverMissingRequiredEnv returns the names of any environment variables
+// that the rpcplugin protocol requires the client to set but which are not
+// set, aside from the handshake cookie and protocol versions, which Serve
+// checks separately.
+func serverMissingRequiredEnv(ctx context.Context) []string {
+	var missing []string
+	for _, name := range []string{"PLUGIN_TRANSPORTS"} {
+		if ctxenv.Getenv(ctx, name) == "" {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,57 @@
+package rpcplugin
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// serverContext is information about the plugin server that we make
+// available to the plugin's RPC handlers via their contexts.
+type serverContext struct {
+	hostConn *grpc.ClientConn
+	health   *ServerHealth
+	events   *ServerEvents
+
+	capabilities Capabilities
+	protoVersion ProtocolVersion
+}
+
+type serverCtxKeyType int
+
+const serverCtxKey serverCtxKeyType = 0
+
+// contextServerContext returns the serverContext associated with the given
+// context, or nil if there is none.
+func contextServerContext(ctx context.Context) *serverContext {
+	sc, _ := ctx.Value(serverCtxKey).(*serverContext)
+	return sc
+}
+
+// serverContextUnaryInterceptor and serverContextStreamInterceptor make the
+// given serverContext available to the plugin's RPC handlers.
+func serverContextUnaryInterceptor(sc *serverContext) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(context.WithValue(ctx, serverCtxKey, sc), req)
+	}
+}
+
+func serverContextStreamInterceptor(sc *serverContext) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &ctxServerStream{
+			ServerStream: ss,
+			ctx:          context.WithValue(ss.Context(), serverCtxKey, sc),
+		})
+	}
+}
+
+// ctxServerStream is a grpc.ServerStream that overrides the context of
+// another stream.
+type ctxServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *ctxServerStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,64 @@
+package rpcplugin
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+
+	"go.rpcplugin.org/rpcplugin/handshake"
+)
+
+// DefaultDevAddr is the address where a server in development mode listens
+// if ServerConfig.DevAddr is not set.
+const DefaultDevAddr = "127.0.0.1:7477"
+
+// devServerProtoVersion selects the newest of the given protocol versions,
+// for a server in development mode that has no client to negotiate with.
+func devServerProtoVersion(protoVersions map[int]ServerVersion) (int, ServerVersion) {
+	versions := make([]int, 0, len(protoVersions))
+	for v := range protoVersions {
+		versions = append(versions, v)
+	}
+	if len(versions) == 0 {
+		return 0, nil
+	}
+	sort.Ints(versions)
+	v := versions[len(versions)-1]
+	return v, protoVersions[v]
+}
+
+// serverDevListen opens the listener for a server in development mode.
+func serverDevListen(config *ServerConfig) (net.Listener, error) {
+	addr := config.DevAddr
+	if addr == "" {
+		addr = DefaultDevAddr
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open development mode listener on %s: %s", addr, err)
+	}
+	return l, nil
+}
+
+// writeDevInstructions writes a message to w explaining how to connect a
+// client to a server in development mode, in place of the handshake line
+// the server would normally write. formatted is the formatted handshake line.
+func writeDevInstructions(w io.Writer, line *handshake.Line, formatted string, useTLS bool) error {
+	tlsNote := "without TLS"
+	if useTLS {
+		tlsNote = "with TLS"
+	}
+	_, err := fmt.Fprintf(w, `Plugin server is running in development mode, %s.
+
+To connect a host application to it, use rpcplugin.Attach with:
+    Addr:         %s (%s)
+    ProtoVersion: %d
+
+Or pass the following line to rpcplugin.ParseAttachLine:
+    %s
+
+Press Ctrl+C to stop the server.
+`, tlsNote, line.Addr.String(), line.Addr.Network(), line.ProtoVersion, formatted)
+	return err
+}
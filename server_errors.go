@@ -0,0 +1,106 @@
+package rpcplugin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NoCommonProtoVersionError is the error type returned from Serve if the
+// client and the server don't support any protocol versions in common.
+type NoCommonProtoVersionError struct {
+	// ClientVersions are the protocol versions the client announced support
+	// for, in descending order. It is empty if the client didn't announce
+	// any valid versions, which suggests that the client doesn't implement
+	// the rpcplugin protocol.
+	ClientVersions []int
+
+	// ServerVersions are the protocol versions in ServerConfig.ProtoVersions,
+	// in ascending order.
+	ServerVersions []int
+
+	// RejectedVersions are the protocol versions that the client and server
+	// have in common but which ServerConfig.VersionPolicy rejected, in
+	// descending order.
+	RejectedVersions []int
+}
+
+func (e *NoCommonProtoVersionError) Error() string {
+	if len(e.ClientVersions) == 0 {
+		return "plugin host did not announce any supported protocol versions"
+	}
+	if len(e.RejectedVersions) != 0 {
+		return fmt.Sprintf(
+			"plugin rejected the host's minor versions of all protocol versions in common (%s)",
+			formatVersionList(e.RejectedVersions),
+		)
+	}
+	return fmt.Sprintf(
+		"plugin does not support any protocol versions supported by the host (host supports %s, plugin supports %s)",
+		formatVersionList(e.ClientVersions), formatVersionList(e.ServerVersions),
+	)
+}
+
+// NonCompliantClientError is the error type returned from Serve if
+// ServerConfig.StrictRPCPlugin is set and the client didn't set environment
+// variables that the rpcplugin protocol requires, which suggests that the
+// client implements a different protocol, such as HashiCorp go-plugin.
+type NonCompliantClientError struct {
+	// Missing are the names of the required environment variables that the
+	// client didn't set.
+	Missing []string
+}
+
+func (e *NonCompliantClientError) Error() string {
+	return fmt.Sprintf("plugin host does not implement the rpcplugin protocol: missing %s", strings.Join(e.Missing, ", "))
+}
+
+// NoTransportError is the error type returned from Serve if the server
+// couldn't listen using any of the transport protocols the client supports.
+type NoTransportError struct {
+	// Transports are the transport protocols the server tried, in order.
+	// It is empty if the client supports none of the transport protocols
+	// the server implements.
+	Transports []string
+
+	// Errs are the errors the server encountered trying each of the
+	// protocols in Transports, with corresponding indices.
+	Errs []error
+}
+
+func (e *NoTransportError) Error() string {
+	if len(e.Errs) == 0 {
+		return "unable to negotiate a transport protocol"
+	}
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("unable to negotiate a transport protocol: %s", strings.Join(msgs, "; "))
+}
+
+// TLSSetupError is the error type returned from Serve if the server couldn't
+// prepare its TLS configuration, such as if ServerConfig.TLSConfig returned
+// an error or the client's automatically-negotiated certificate is invalid.
+type TLSSetupError struct {
+	Err error
+}
+
+func (e *TLSSetupError) Error() string {
+	return fmt.Sprintf("invalid TLS settings: %s", e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *TLSSetupError) Unwrap() error {
+	return e.Err
+}
+
+func formatVersionList(versions []int) string {
+	if len(versions) == 0 {
+		return "none"
+	}
+	strs := make([]string, len(versions))
+	for i, v := range versions {
+		strs[i] = fmt.Sprint(v)
+	}
+	return strings.Join(strs, ", ")
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"go.rpcplugin.org/rpcplugin/internal/gopluginshim"
 	"go.rpcplugin.org/rpcplugin/plugintrace"
@@ -12,6 +13,7 @@ import (
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
 // This is the name of the grpc service we use for our internal signalling,
@@ -25,6 +27,44 @@ type serverGRPC struct {
 	Server ServerVersion
 	TLS    *tls.Config
 
+	// Auto is the automatically-negotiated credentials TLS is based on, or
+	// nil if TLS is disabled or configured explicitly.
+	Auto *autoCredentials
+
+	// Common are services to register alongside Server, which don't belong
+	// to any particular protocol version.
+	Common []ServerVersion
+
+	// HostConn is the connection to the host services offered by the client,
+	// or nil if the client doesn't offer any.
+	HostConn *grpc.ClientConn
+
+	// Options, UnaryInterceptors, and StreamInterceptors are additional
+	// settings for the gRPC server, provided by the caller of Serve.
+	Options            []grpc.ServerOption
+	UnaryInterceptors  []grpc.UnaryServerInterceptor
+	StreamInterceptors []grpc.StreamServerInterceptor
+
+	// Reflection enables the gRPC server reflection service.
+	Reflection bool
+
+	// Metadata is the server's description of itself, which it offers via
+	// the control service.
+	Metadata *PluginMetadata
+
+	// Capabilities is the set of capabilities the server agreed with the
+	// client, which RPC handlers can obtain from their contexts.
+	Capabilities Capabilities
+
+	// ProtoVersion is the protocol version the server agreed with the
+	// client, which RPC handlers can obtain from their contexts.
+	ProtoVersion ProtocolVersion
+
+	// ServedVersions are the protocol versions that Server serves, if it
+	// serves more than just ProtoVersion, so that the health service can
+	// report the status of each one.
+	ServedVersions []int
+
 	// These are the reads end of some pipes whose data we'll shuttle over
 	// the RPC channel to the client so it can consume our raw output.
 	Stdout, Stderr io.Reader
@@ -35,40 +75,105 @@ type serverGRPC struct {
 
 	Tracer *plugintrace.ServerTracer
 
+	// Health, if set, is the plugin code's own ServerHealth, from
+	// ServerConfig.Health.
+	Health *ServerHealth
+
 	grpcServer *grpc.Server
+	events     *ServerEvents
 }
 
 func (s *serverGRPC) Init(goPluginClose func()) error {
 	var opts []grpc.ServerOption
+	var creds credentials.TransportCredentials
 	if s.TLS != nil {
-		opts = []grpc.ServerOption{
-			grpc.Creds(credentials.NewTLS(s.TLS)),
-		}
+		creds = newServerTLSCredentials(s.TLS, s.Tracer.TLSHandshake)
+	}
+	if s.Tracer.ClientConnAccepted != nil || s.Tracer.ClientConnClosed != nil {
+		creds = newConnTraceCredentials(creds, s.Tracer.ClientConnAccepted, s.Tracer.ClientConnClosed)
+	}
+	if creds != nil {
+		opts = []grpc.ServerOption{grpc.Creds(creds)}
+	}
+
+	healthCheck := health.NewServer()
+	versions := s.ServedVersions
+	if len(versions) == 0 {
+		versions = []int{s.ProtoVersion.Major}
+	}
+
+	srvHealth := s.Health
+	if srvHealth == nil {
+		srvHealth = NewServerHealth()
+	}
+	srvHealth.bind(healthCheck, versions)
+
+	// Our own interceptors are outermost, so that the caller's interceptors
+	// can see the context values we add.
+	s.events = newServerEvents()
+	sc := &serverContext{
+		hostConn: s.HostConn,
+		health:   srvHealth,
+		events:   s.events,
+
+		capabilities: s.Capabilities,
+		protoVersion: s.ProtoVersion,
 	}
+	calls := newCallCanceler()
+	unaryInts := []grpc.UnaryServerInterceptor{serverContextUnaryInterceptor(sc), callCancelUnaryInterceptor(calls)}
+	streamInts := []grpc.StreamServerInterceptor{serverContextStreamInterceptor(sc), callCancelStreamInterceptor(calls)}
+	unaryInts = append(unaryInts, s.UnaryInterceptors...)
+	streamInts = append(streamInts, s.StreamInterceptors...)
+	opts = append(opts,
+		grpc.UnaryInterceptor(chainUnaryServerInterceptors(unaryInts)),
+		grpc.StreamInterceptor(chainStreamServerInterceptors(streamInts)),
+	)
+	opts = append(opts, s.Options...)
 	s.grpcServer = grpc.NewServer(opts...)
 
 	// Register the health service
 	// This is mandatory because clients use it to detect unresponsive servers.
-	healthCheck := health.NewServer()
-	healthCheck.SetServingStatus(grpcServiceName, grpc_health_v1.HealthCheckResponse_SERVING)
 	grpc_health_v1.RegisterHealthServer(s.grpcServer, healthCheck)
 
+	// The control service allows the client to manage the server itself.
+	registerControlServer(s.grpcServer, &serverControl{
+		auto:     s.Auto,
+		rotated:  s.Tracer.CertificatesRotated,
+		shutdown: s.Done,
+		metadata: s.Metadata,
+		calls:    calls,
+	})
+
+	// The events service allows the plugin to publish events to the client.
+	registerEventsServer(s.grpcServer, serverEventsService{events: s.events})
+
 	// If we think we're running as a client of go-plugin rather than a
 	// true rpcplugin implementation then we'll implement go-plugin's
 	// extra "shutdown" service, since otherwise go-plugin will hang for
 	// 2 seconds when it tries to shut this server down.
-	// (rpcplugin clients just use a signal for this, rather than a special
-	// gRPC service)
+	// (rpcplugin clients use the Shutdown method of the control service
+	// instead.)
 	if goPluginClose != nil {
 		gopluginshim.RegisterGoPluginShutdown(s.grpcServer, goPluginClose)
 	}
 
+	for i, common := range s.Common {
+		err := common.RegisterServer(s.grpcServer)
+		if err != nil {
+			return fmt.Errorf("failed to register common service %d: %s", i, err)
+		}
+	}
+
 	// Let the caller's own service register itself
 	err := s.Server.RegisterServer(s.grpcServer)
 	if err != nil {
 		return fmt.Errorf("failed to register server: %s", err)
 	}
 
+	if s.Reflection {
+		reflection.Register(s.grpcServer)
+	}
+
 	return nil
 }
 
@@ -79,3 +184,49 @@ func (s *serverGRPC) Serve(l net.Listener) {
 		s.Tracer.GRPCServeError(err)
 	}
 }
+
+// Stop gracefully stops the server, waiting up to the given timeout for
+// requests in progress to complete before terminating them.
+func (s *serverGRPC) Stop(timeout time.Duration) {
+	if s.Tracer.DrainStarted != nil {
+		s.Tracer.DrainStarted(timeout)
+	}
+	start := time.Now()
+
+	// Event subscriptions would otherwise last until the drain timeout.
+	s.events.close()
+
+	if s.Tracer.GracefulStopStarted != nil {
+		s.Tracer.GracefulStopStarted()
+	}
+	done := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		if s.Tracer.GracefulStopFinished != nil {
+			s.Tracer.GracefulStopFinished(time.Since(start))
+		}
+		close(done)
+	}()
+
+	forced := false
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		select {
+		case <-done:
+			timer.Stop()
+		case <-timer.C:
+			forced = true
+		}
+	} else {
+		forced = true
+	}
+	if forced {
+		// Stop also causes any ongoing GracefulStop to return.
+		s.grpcServer.Stop()
+		<-done
+	}
+
+	if s.Tracer.DrainFinished != nil {
+		s.Tracer.DrainFinished(time.Since(start), forced)
+	}
+}
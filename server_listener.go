@@ -9,15 +9,34 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/apparentlymart/go-ctxenv/ctxenv"
 	"go.rpcplugin.org/rpcplugin/plugintrace"
 )
 
-func serverTLSConfig(ctx context.Context, addr net.Addr, fn func() (*tls.Config, error)) (*tls.Config, tls.Certificate, error) {
+// serverTLSConfig returns the TLS configuration for the server, which is
+// nil if TLS is disabled. If the configuration is based on credentials that
+// can change over time, such as those produced by the automatic negotiation
+// protocol, then it also returns those credentials.
+func serverTLSConfig(ctx context.Context, config *ServerConfig) (*tls.Config, tlsCredentials, error) {
 	tracer := plugintrace.ContextServerTracer(ctx)
-	if fn != nil {
+	if config.Credentials != nil {
+		if config.TLSConfig != nil {
+			return nil, nil, fmt.Errorf("ServerConfig.Credentials and ServerConfig.TLSConfig are mutually exclusive")
+		}
+		creds := &sourceCredentials{
+			source: config.Credentials,
+			verify: config.VerifyPeer,
+			policy: config.TLSPolicy,
+		}
+		return creds.ServerTLSConfig(), creds, nil
+	}
+	if fn := config.TLSConfig; fn != nil {
 		// If we're given a configuration function, it overrides all of our
 		// usual default behavior so that the calling application can handle
 		// TLS certificate selection/issuance however it wants.
@@ -27,71 +46,125 @@ func serverTLSConfig(ctx context.Context, addr net.Addr, fn func() (*tls.Config,
 			// violates the rpcplugin spec. However, the special config
 			// function ForceServerWithoutTLS _can_ really turn TLS off,
 			// as a pragmatic exception.
-			return nil, tls.Certificate{}, nil
+			return nil, nil, nil
 		}
 		if err == nil && tlsConfig == nil {
 			// Having no TLS config at all is not permitted.
-			return nil, tls.Certificate{}, fmt.Errorf("TLS configuration function returned no TLS configuration")
+			return nil, nil, fmt.Errorf("TLS configuration function returned no TLS configuration")
+		}
+		if err == nil && config.VerifyPeer != nil {
+			tlsConfig = withPeerVerifier(tlsConfig, config.VerifyPeer)
+		}
+		if err == nil && config.TLSPolicy != nil {
+			tlsConfig = withTLSPolicy(tlsConfig, config.TLSPolicy)
 		}
 		if tracer.TLSConfig != nil {
 			tracer.TLSConfig(tlsConfig, false)
 		}
-		return tlsConfig, tls.Certificate{}, err
+		return tlsConfig, nil, err
 	}
 
 	// Automatic temporary certificate setup protocol
 	clientCert := ctxenv.Getenv(ctx, "PLUGIN_CLIENT_CERT")
 	if clientCert == "" {
-		return nil, tls.Certificate{}, fmt.Errorf("PLUGIN_CLIENT_CERT environment variable is not set")
+		if certFile := ctxenv.Getenv(ctx, clientCertFileEnvName); certFile != "" {
+			certPEM, err := ioutil.ReadFile(certFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot read %s: %s", clientCertFileEnvName, err)
+			}
+			clientCert = string(certPEM)
+		}
+	}
+	if clientCert == "" && config.DevMode {
+		// There's no client to negotiate a certificate with in development
+		// mode, so we run without TLS unless explicitly configured.
+		return nil, nil, nil
+	}
+	if clientCert == "" {
+		return nil, nil, fmt.Errorf("neither PLUGIN_CLIENT_CERT nor %s environment variable is set", clientCertFileEnvName)
 	}
 
 	clientCertPool := x509.NewCertPool()
 	if !clientCertPool.AppendCertsFromPEM([]byte(clientCert)) {
-		return nil, tls.Certificate{}, fmt.Errorf("PLUGIN_CLIENT_CERT has invalid PEM certificate chain")
+		return nil, nil, fmt.Errorf("PLUGIN_CLIENT_CERT has invalid PEM certificate chain")
 	}
 
-	serverCert, err := generateCertificate(ctx, "localhost")
+	serverCert, err := generateCertificate(ctx, "localhost", config.AutoCertIssuer)
 	if err != nil {
-		return nil, tls.Certificate{}, fmt.Errorf("cannot create temporary server certificate: %s", err)
+		return nil, nil, fmt.Errorf("cannot create temporary server certificate: %s", err)
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{serverCert},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		ClientCAs:    clientCertPool,
-		MinVersion:   tls.VersionTLS12,
-	}, serverCert, nil
+	auto := newAutoCredentials(serverCert)
+	auto.TrustPeers(clientCertPool)
+	auto.verify = config.VerifyPeer
+	auto.policy = config.TLSPolicy
+	auto.issuer = config.AutoCertIssuer
+	return auto.ServerTLSConfig(), auto, nil
 }
 
-func serverListen(ctx context.Context) (net.Listener, error) {
+// serverListen opens a listener on the first of the client's transports
+// that the server can use, or if all is set then on each of them that the
+// server can use, combined into a single *multiListener if there are more
+// than one.
+func serverListen(ctx context.Context, sock unixSocketConfig, bind tcpBindConfig, goPluginCompat, all bool) (net.Listener, error) {
 	transports := ctxenv.Getenv(ctx, "PLUGIN_TRANSPORTS")
 	if transports == "" {
-		transports = "unix,tcp"
+		transports = defaultServerTransports(goPluginCompat)
 	}
 
+	tracer := plugintrace.ContextServerTracer(ctx)
+	var listeners []net.Listener
+	var errs []error
+	var tried []string
+	var failed string
+	var failedErr error
 	for _, transport := range strings.Split(transports, ",") {
+		if transport != "unix" && transport != "tcp" {
+			continue
+		}
+		if failed != "" && tracer.TransportFallback != nil {
+			tracer.TransportFallback(failed, transport, failedErr)
+		}
+
+		var l net.Listener
+		var err error
 		switch transport {
 		case "unix":
-			l, err := serverListenUnix(ctx)
-			if err == nil {
-				return l, nil
-			}
+			l, err = serverListenUnix(ctx, sock)
 		case "tcp":
-			l, err := serverListenTCP(ctx)
-			if err == nil {
+			l, err = serverListenTCP(ctx, bind, goPluginCompat)
+		}
+		if err == nil {
+			if !all {
 				return l, nil
 			}
+			listeners = append(listeners, l)
+			continue
 		}
+		errs = append(errs, err)
+		tried = append(tried, transport)
+		failed, failedErr = transport, err
+	}
+	switch len(listeners) {
+	case 0:
+		// handled below
+	case 1:
+		return listeners[0], nil
+	default:
+		return newMultiListener(listeners), nil
 	}
 
 	// If we fall out here then we have no suitable transports in common
 	// with the client, so we fail.
-	return nil, fmt.Errorf("unable to negotiate a transport protocol")
+	return nil, &NoTransportError{
+		Transports: tried,
+		Errs:       errs,
+	}
 }
 
-func serverListenUnix(ctx context.Context) (net.Listener, error) {
-	baseDir := ""
-	if runtimeDir := ctxenv.Getenv(ctx, "XDG_RUNTIME_DIR"); runtimeDir != "" && filepath.IsAbs(runtimeDir) {
+func serverListenUnix(ctx context.Context, sock unixSocketConfig) (net.Listener, error) {
+	baseDir := sock.Dir
+	if runtimeDir := ctxenv.Getenv(ctx, "XDG_RUNTIME_DIR"); baseDir == "" && runtimeDir != "" && filepath.IsAbs(runtimeDir) {
 		// If XDG_RUNTIME_DIR is available then we'll prefer it, because its
 		// permissions tend to be more suitable (per the contract for this
 		// environment variable) and it'll get cleaned up on reboot if anything
@@ -107,9 +180,14 @@ func serverListenUnix(ctx context.Context) (net.Listener, error) {
 	socketPath := filepath.Join(socketDir, "server.sock")
 	l, err := net.Listen("unix", socketPath)
 	if err != nil {
-		os.RemoveAll(baseDir)
+		os.RemoveAll(socketDir)
 		return nil, fmt.Errorf("failed to open listener at %s: %s", socketPath, err)
 	}
+	if err := sock.apply(socketDir, socketPath); err != nil {
+		l.Close()
+		os.RemoveAll(socketDir)
+		return nil, err
+	}
 
 	// wrap for cleanup on close
 	return &rmListener{
@@ -118,12 +196,101 @@ func serverListenUnix(ctx context.Context) (net.Listener, error) {
 	}, nil
 }
 
-func serverListenTCP(ctx context.Context) (net.Listener, error) {
-	l, err := net.Listen("tcp", "127.0.0.1:0")
+// defaultServerTransports returns the transports a server tries when the
+// client doesn't set PLUGIN_TRANSPORTS.
+//
+// hashicorp/go-plugin servers always use TCP on Windows, and so clients
+// running in locked-down Windows environments may expect that and have
+// arranged for only the ports in PLUGIN_MIN_PORT to PLUGIN_MAX_PORT to be
+// usable, so we do the same when we're behaving as a go-plugin server.
+func defaultServerTransports(goPluginCompat bool) string {
+	if goPluginCompat && runtime.GOOS == "windows" {
+		return "tcp"
+	}
+	return "unix,tcp"
+}
+
+func serverListenTCP(ctx context.Context, bind tcpBindConfig, goPluginCompat bool) (net.Listener, error) {
+	ip, err := bind.ip()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open listener on 127.0.0.1: %s", err)
+		return nil, err
+	}
+	host := ip.String()
+	minPort, maxPort, err := serverPortRange(ctx, goPluginCompat)
+	if err != nil {
+		return nil, err
+	}
+	if minPort == 0 {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open listener on %s: %s", host, err)
+		}
+		return l, nil
+	}
+
+	for port := minPort; port <= maxPort; port++ {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("no ports available on %s in the range %d to %d", host, minPort, maxPort)
+}
+
+// serverPortRange returns the range of TCP ports the client asked the server
+// to choose from, or zero for both if the client didn't constrain the port.
+//
+// If goPluginCompat is set then serverPortRange interprets the variables in
+// the same way as hashicorp/go-plugin servers, which treat a missing or
+// zero PLUGIN_MIN_PORT as leaving the port unconstrained.
+func serverPortRange(ctx context.Context, goPluginCompat bool) (min, max int, err error) {
+	minStr := ctxenv.Getenv(ctx, "PLUGIN_MIN_PORT")
+	maxStr := ctxenv.Getenv(ctx, "PLUGIN_MAX_PORT")
+	if minStr == "" && maxStr == "" {
+		return 0, 0, nil
+	}
+	if goPluginCompat {
+		return goPluginPortRange(minStr, maxStr)
+	}
+
+	min, err = strconv.Atoi(minStr)
+	if err != nil || min < 1 || min > 65535 {
+		return 0, 0, fmt.Errorf("invalid PLUGIN_MIN_PORT value %q", minStr)
+	}
+	max, err = strconv.Atoi(maxStr)
+	if err != nil || max < 1 || max > 65535 {
+		return 0, 0, fmt.Errorf("invalid PLUGIN_MAX_PORT value %q", maxStr)
+	}
+	if max < min {
+		return 0, 0, fmt.Errorf("PLUGIN_MAX_PORT %d is less than PLUGIN_MIN_PORT %d", max, min)
+	}
+	return min, max, nil
+}
+
+// goPluginPortRange is the part of serverPortRange that interprets the port
+// range as hashicorp/go-plugin servers do.
+func goPluginPortRange(minStr, maxStr string) (min, max int, err error) {
+	if minStr != "" {
+		min, err = strconv.Atoi(minStr)
+		if err != nil || min < 0 || min > 65535 {
+			return 0, 0, fmt.Errorf("invalid PLUGIN_MIN_PORT value %q", minStr)
+		}
+	}
+	if maxStr != "" {
+		max, err = strconv.Atoi(maxStr)
+		if err != nil || max < 0 || max > 65535 {
+			return 0, 0, fmt.Errorf("invalid PLUGIN_MAX_PORT value %q", maxStr)
+		}
+	}
+	if max < min {
+		return 0, 0, fmt.Errorf("PLUGIN_MAX_PORT %d is less than PLUGIN_MIN_PORT %d", max, min)
 	}
-	return l, nil
+	if min == 0 {
+		// go-plugin tries port zero first, which always succeeds in
+		// choosing an arbitrary port.
+		return 0, 0, nil
+	}
+	return min, max, nil
 }
 
 // rmListener is an implementation of net.Listener that forwards most
@@ -142,3 +309,147 @@ func (l *rmListener) Close() error {
 
 	return os.RemoveAll(l.Path)
 }
+
+// limitListener is an implementation of net.Listener that limits the number
+// of connections that can be open at once, by blocking in Accept until an
+// existing connection is closed.
+type limitListener struct {
+	net.Listener
+	sem  chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newLimitListener(l net.Listener, n int) *limitListener {
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, fmt.Errorf("listener is closed")
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitListenerConn{Conn: conn, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+type limitListenerConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// traceListenerConn is a connection that calls a function the first time it
+// is closed.
+type traceListenerConn struct {
+	net.Conn
+	closed func()
+	once   sync.Once
+}
+
+func (c *traceListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.closed)
+	return err
+}
+
+// watchdogListener is an implementation of net.Listener that calls a
+// function if no client connects within a given time after the listener
+// starts, or if all client connections remain closed for a given time.
+type watchdogListener struct {
+	net.Listener
+	connectTimeout time.Duration
+	idleTimeout    time.Duration
+	expired        func(connected bool, timeout time.Duration)
+
+	mu        sync.Mutex
+	active    int
+	connected bool
+	stopped   bool
+	timer     *time.Timer
+}
+
+// start begins the connect timeout, if any. Call start only once the client
+// has been told where to connect.
+func (l *watchdogListener) start() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.connectTimeout > 0 && !l.connected && !l.stopped {
+		l.arm(l.connectTimeout)
+	}
+}
+
+// stop prevents any further calls to the expired function.
+func (l *watchdogListener) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopped = true
+	l.disarm()
+}
+
+func (l *watchdogListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.active++
+	l.connected = true
+	l.disarm()
+	l.mu.Unlock()
+	return &traceListenerConn{Conn: conn, closed: l.connClosed}, nil
+}
+
+func (l *watchdogListener) connClosed() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if l.active == 0 && l.idleTimeout > 0 && !l.stopped {
+		l.arm(l.idleTimeout)
+	}
+}
+
+// arm must be called with l.mu held.
+func (l *watchdogListener) arm(timeout time.Duration) {
+	l.disarm()
+	connected := l.connected
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		l.mu.Lock()
+		// A connection may have arrived while we were waiting for the lock.
+		current := l.timer == timer
+		l.mu.Unlock()
+		if current {
+			l.expired(connected, timeout)
+		}
+	})
+	l.timer = timer
+}
+
+// disarm must be called with l.mu held.
+func (l *watchdogListener) disarm() {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+}
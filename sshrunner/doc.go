@@ -0,0 +1,14 @@
+// Package sshrunner launches rpcplugin plugin servers on remote hosts over
+// SSH, for host applications that need to run a plugin somewhere other than
+// on the local machine.
+//
+// The runner starts the plugin server program in an SSH session, reads the
+// server's handshake from the session's standard output, and then tunnels
+// each RPC connection to the server through a channel forwarded over the
+// same SSH connection, so that the server needs no network exposure beyond
+// the remote host's own loopback interface or Unix domain sockets. The
+// result is an ordinary *rpcplugin.Plugin.
+//
+// This package is a separate Go module so that applications using rpcplugin
+// without SSH do not depend on golang.org/x/crypto/ssh.
+package sshrunner // import go.rpcplugin.org/rpcplugin/sshrunner
@@ -0,0 +1,23 @@
+module go.rpcplugin.org/rpcplugin/sshrunner
+
+go 1.20
+
+replace go.rpcplugin.org/rpcplugin => ..
+
+require (
+	github.com/apparentlymart/go-shquot v0.0.1
+	go.rpcplugin.org/rpcplugin v0.0.0-00010101000000-000000000000
+	golang.org/x/crypto v0.21.0
+)
+
+require (
+	github.com/apparentlymart/go-ctxenv v1.0.0 // indirect
+	github.com/golang/protobuf v1.5.0 // indirect
+	github.com/hashicorp/yamux v0.0.0-20181012175058-2f1d1f20f75d // indirect
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/genproto v0.0.0-20180817151627-c66870c02cf8 // indirect
+	google.golang.org/grpc v1.19.1 // indirect
+	google.golang.org/protobuf v1.28.1 // indirect
+)
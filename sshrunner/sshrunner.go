@@ -0,0 +1,248 @@
+package sshrunner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/apparentlymart/go-shquot/shquot"
+	"go.rpcplugin.org/rpcplugin"
+	"golang.org/x/crypto/ssh"
+)
+
+// Config describes a plugin server program to run on a remote host.
+type Config struct {
+	// Command is the program to run on the remote host, followed by its
+	// arguments. The runner quotes each element for a POSIX shell, because
+	// SSH servers pass the command line to the remote user's shell.
+	Command []string
+
+	// Env gives additional environment variables for the plugin server, in
+	// the same "KEY=value" form as exec.Cmd.Env, whose names must be valid
+	// POSIX shell variable names. The runner sends them, along with the
+	// variables the rpcplugin protocol uses, on the session's standard input
+	// to a shell that exports them before executing the command, rather than
+	// as SSH environment requests, because SSH servers typically accept only
+	// a few variables from clients, or on the command line, where other
+	// users of the remote host could see secrets such as the handshake
+	// cookie. The plugin server's standard input is then empty, as it would
+	// be for a local plugin server.
+	Env []string
+
+	// Handshake, ProtoVersions, and Transports have the same meanings as the
+	// rpcplugin.ClientConfig fields of the same names.
+	Handshake     rpcplugin.HandshakeConfig
+	ProtoVersions map[int]rpcplugin.ClientVersion
+	Transports    []string
+
+	// TraceCalls, Compressor, and DefaultCallTimeout have the same meanings
+	// as the rpcplugin.ClientConfig fields of the same names.
+	TraceCalls         bool
+	Compressor         string
+	DefaultCallTimeout time.Duration
+
+	// Stderr, if set, receives everything the plugin server writes to its
+	// stderr stream. Otherwise, that output is discarded.
+	Stderr io.Writer
+
+	// StartTimeout is the maximum time to wait for the plugin server to
+	// write its handshake. If it is zero, it defaults to one minute.
+	StartTimeout time.Duration
+
+	// ShutdownGrace is how long Close waits for the plugin server to exit
+	// after asking it to shut down, before closing the SSH session
+	// regardless. If it is zero, it defaults to five seconds.
+	ShutdownGrace time.Duration
+}
+
+const defaultShutdownGrace = 5 * time.Second
+
+// New starts the plugin server program described by config on the remote
+// host that client is connected to, and returns an object representing the
+// plugin once the server has completed its handshake.
+//
+// The SSH client must remain open for as long as the plugin is in use.
+// Closing the returned plugin asks the plugin server to shut down and then
+// closes its SSH session, but doesn't close the SSH client.
+//
+// The returned plugin uses automatically-negotiated TLS certificates, in the
+// same way as a plugin started by rpcplugin.New. Applications that need
+// other features of ClientConfig, such as health checking, can instead set
+// ClientConfig.Runner to a Runner and ClientConfig.Dial to its Dial method.
+func New(ctx context.Context, client *ssh.Client, config *Config) (*rpcplugin.Plugin, error) {
+	if len(config.Command) == 0 {
+		return nil, fmt.Errorf("config field Command must not be empty")
+	}
+	shutdownGrace := config.ShutdownGrace
+	if shutdownGrace == 0 {
+		shutdownGrace = defaultShutdownGrace
+	}
+	runner := &Runner{
+		Client:  client,
+		Command: config.Command,
+		Env:     config.Env,
+	}
+	return rpcplugin.New(ctx, &rpcplugin.ClientConfig{
+		Handshake:          config.Handshake,
+		ProtoVersions:      config.ProtoVersions,
+		Transports:         config.Transports,
+		TraceCalls:         config.TraceCalls,
+		Compressor:         config.Compressor,
+		DefaultCallTimeout: config.DefaultCallTimeout,
+		Stderr:             config.Stderr,
+		StartTimeout:       config.StartTimeout,
+		ShutdownGrace:      shutdownGrace,
+		Runner:             runner,
+		Dial:               runner.Dial,
+	})
+}
+
+// Runner is an rpcplugin.ProcessRunner that runs a plugin server program in
+// a session on an SSH connection.
+//
+// A Runner runs its program only once, and so each plugin needs its own.
+type Runner struct {
+	// Client is the SSH connection to the remote host, which must remain
+	// open for as long as the plugin is in use.
+	Client *ssh.Client
+
+	// Command and Env have the same meanings as the Config fields of the
+	// same names.
+	Command []string
+	Env     []string
+
+	session *ssh.Session
+}
+
+var _ rpcplugin.ProcessRunner = (*Runner)(nil)
+
+// Start implements rpcplugin.ProcessRunner.
+func (r *Runner) Start(ctx context.Context, env []string, stderr io.Writer) (io.ReadCloser, error) {
+	if r.session != nil {
+		return nil, fmt.Errorf("plugin server already started")
+	}
+	exports, err := envScript(r.Env, env)
+	if err != nil {
+		return nil, err
+	}
+	// The shell reads the exports from stdin until we close it, and then
+	// executes the command. We use exec in both shells so that neither
+	// remains as the parent of the plugin server, which would then not
+	// receive our signals.
+	args := []string{"sh", "-c", `eval "$(cat)" && exec "$@"`, "rpcplugin-env"}
+	args = append(args, r.Command...)
+
+	session, err := r.Client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SSH session: %w", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to open SSH session stdin: %w", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to open SSH session stdout: %w", err)
+	}
+	session.Stderr = stderr
+	if err := session.Start("exec " + shquot.POSIXShell(args)); err != nil {
+		session.Close()
+		return nil, err
+	}
+	_, err = io.WriteString(stdin, exports)
+	if err == nil {
+		err = stdin.Close()
+	}
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to send plugin server environment: %w", err)
+	}
+	r.session = session
+	return ioutil.NopCloser(stdout), nil
+}
+
+// envScript returns a POSIX shell script that exports the given environment
+// variables, in the "KEY=value" form of exec.Cmd.Env.
+func envScript(envs ...[]string) (string, error) {
+	var buf strings.Builder
+	for _, env := range envs {
+		for _, kv := range env {
+			name, value := kv, ""
+			if i := strings.Index(kv, "="); i >= 0 {
+				name, value = kv[:i], kv[i+1:]
+			}
+			if !validEnvName(name) {
+				return "", fmt.Errorf("invalid environment variable name %q", name)
+			}
+			fmt.Fprintf(&buf, "export %s=%s\n", name, shquot.POSIXShell([]string{value}))
+		}
+	}
+	return buf.String(), nil
+}
+
+// validEnvName returns true if name is a valid POSIX shell variable name.
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Signal implements rpcplugin.ProcessRunner. Because not all SSH servers
+// support signals, Signal terminates the plugin server for os.Kill by also
+// closing its session, which closes the server's standard streams and ends
+// the remote login session.
+func (r *Runner) Signal(sig os.Signal) error {
+	switch sig {
+	case os.Kill:
+		r.session.Signal(ssh.SIGKILL)
+		err := r.session.Close()
+		if err == io.EOF {
+			// The session was already closed because the server exited.
+			err = nil
+		}
+		return err
+	case os.Interrupt:
+		return r.session.Signal(ssh.SIGINT)
+	case syscall.SIGTERM:
+		return r.session.Signal(ssh.SIGTERM)
+	default:
+		return fmt.Errorf("cannot send signal %s over SSH", sig)
+	}
+}
+
+// Wait implements rpcplugin.ProcessRunner. The plugin server doesn't run on
+// the local host, and so Wait never returns a process state.
+func (r *Runner) Wait() (*os.ProcessState, error) {
+	err := r.session.Wait()
+	switch err.(type) {
+	case *ssh.ExitError, *ssh.ExitMissingError:
+		// The server exited, whether successfully or not.
+		err = nil
+	}
+	return nil, err
+}
+
+// Dial connects to an address of the plugin server through the SSH
+// connection, for use as ClientConfig.Dial. Both "tcp" and "unix" addresses
+// are forwarded by the remote SSH server, the latter using the OpenSSH
+// streamlocal extension.
+func (r *Runner) Dial(ctx context.Context, addr net.Addr) (net.Conn, error) {
+	return r.Client.Dial(addr.Network(), addr.String())
+}
@@ -0,0 +1,188 @@
+package rpcplugin
+
+import (
+	"context"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/stats"
+)
+
+// Stats is a summary of the state and activity of a plugin, as returned by
+// Plugin.Stats, for purposes such as status commands and dashboards.
+//
+// The RPC statistics cover all of the calls the client makes to the plugin
+// server, including the health checks and other calls that rpcplugin makes
+// itself. They are not collected for servers using the legacy net/rpc
+// protocol.
+type Stats struct {
+	// StartTime is when the plugin server process started, or when the
+	// plugin was created for a plugin obtained using Attach or running
+	// in-process. Uptime is the time since then, or until the process
+	// exited if it has.
+	StartTime time.Time
+	Uptime    time.Duration
+
+	// Restarts is the number of times a Manager restarted the plugin before
+	// starting the server process this Plugin represents, or zero for a
+	// plugin that no Manager supervises.
+	Restarts int
+
+	// LastExit is the state of the plugin server process if it has exited.
+	// Otherwise, for a plugin that a Manager restarted after an unexpected
+	// exit, it is the state of the process that exited. It is nil if
+	// neither applies.
+	LastExit *os.ProcessState
+
+	// Healthy is the result of Plugin.Healthy.
+	Healthy bool
+
+	// Addr is the address of the plugin server, and ProtoVersion is the
+	// protocol version the client and server agreed to use.
+	Addr         net.Addr
+	ProtoVersion ProtocolVersion
+
+	// RPCsStarted is the number of RPC calls the client has started,
+	// including those still in progress. RPCsSucceeded and RPCsFailed are
+	// the number of calls that have completed without and with an error,
+	// respectively.
+	RPCsStarted, RPCsSucceeded, RPCsFailed uint64
+
+	// BytesSent and BytesReceived are the total sizes of the messages the
+	// client has sent to and received from the plugin server, before any
+	// compression.
+	BytesSent, BytesReceived uint64
+
+	// LatencyP50, LatencyP90, and LatencyP99 are percentiles of the
+	// duration of the most recently completed calls, or zero if no calls
+	// have completed yet.
+	LatencyP50, LatencyP90, LatencyP99 time.Duration
+}
+
+// Stats returns a summary of the plugin's current state and its activity
+// so far.
+func (p *Plugin) Stats() Stats {
+	ret := p.rpcStats.snapshot()
+	ret.StartTime = p.startedAt
+	ret.Uptime = time.Since(p.startedAt)
+	ret.Restarts = p.restarts
+	ret.LastExit = p.lastExit
+	ret.Healthy = p.Healthy()
+	ret.Addr = p.addr
+	ret.ProtoVersion = p.ProtocolVersion()
+	if p.runner != nil {
+		select {
+		case <-p.exit:
+			ret.Uptime = p.exitedAt.Sub(p.startedAt)
+			ret.LastExit = p.exitState
+		default:
+		}
+	}
+	return ret
+}
+
+// statsLatencyWindow is the number of recently-completed calls that
+// rpcStats retains the durations of, for calculating latency percentiles.
+const statsLatencyWindow = 1024
+
+// rpcStats is a gRPC stats handler that collects the RPC statistics
+// reported by Plugin.Stats.
+type rpcStats struct {
+	// These are accessed atomically.
+	started, succeeded, failed uint64
+	bytesSent, bytesReceived   uint64
+
+	mu        sync.Mutex
+	latencies []time.Duration // ring buffer of at most statsLatencyWindow
+	next      int             // index in latencies to overwrite next
+}
+
+var _ stats.Handler = (*rpcStats)(nil)
+
+func newRPCStats() *rpcStats {
+	return &rpcStats{
+		latencies: make([]time.Duration, 0, statsLatencyWindow),
+	}
+}
+
+// TagRPC implements stats.Handler.
+func (s *rpcStats) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+// HandleRPC implements stats.Handler.
+func (s *rpcStats) HandleRPC(ctx context.Context, rs stats.RPCStats) {
+	switch rs := rs.(type) {
+	case *stats.Begin:
+		atomic.AddUint64(&s.started, 1)
+	case *stats.OutPayload:
+		atomic.AddUint64(&s.bytesSent, uint64(rs.Length))
+	case *stats.InPayload:
+		atomic.AddUint64(&s.bytesReceived, uint64(rs.Length))
+	case *stats.End:
+		if rs.Error != nil {
+			atomic.AddUint64(&s.failed, 1)
+		} else {
+			atomic.AddUint64(&s.succeeded, 1)
+		}
+		s.recordLatency(rs.EndTime.Sub(rs.BeginTime))
+	}
+}
+
+// TagConn implements stats.Handler.
+func (s *rpcStats) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn implements stats.Handler.
+func (s *rpcStats) HandleConn(ctx context.Context, cs stats.ConnStats) {}
+
+func (s *rpcStats) recordLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.latencies) < statsLatencyWindow {
+		s.latencies = append(s.latencies, d)
+		return
+	}
+	s.latencies[s.next] = d
+	s.next = (s.next + 1) % statsLatencyWindow
+}
+
+func (s *rpcStats) snapshot() Stats {
+	ret := Stats{
+		RPCsStarted:   atomic.LoadUint64(&s.started),
+		RPCsSucceeded: atomic.LoadUint64(&s.succeeded),
+		RPCsFailed:    atomic.LoadUint64(&s.failed),
+		BytesSent:     atomic.LoadUint64(&s.bytesSent),
+		BytesReceived: atomic.LoadUint64(&s.bytesReceived),
+	}
+
+	s.mu.Lock()
+	latencies := make([]time.Duration, len(s.latencies))
+	copy(latencies, s.latencies)
+	s.mu.Unlock()
+
+	if len(latencies) != 0 {
+		sort.Slice(latencies, func(i, j int) bool {
+			return latencies[i] < latencies[j]
+		})
+		ret.LatencyP50 = percentile(latencies, 50)
+		ret.LatencyP90 = percentile(latencies, 90)
+		ret.LatencyP99 = percentile(latencies, 99)
+	}
+	return ret
+}
+
+// percentile returns the given percentile of the given sorted, non-empty
+// durations, using the nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,281 @@
+// Package statusdetail helps plugin servers return errors with structured
+// details, and helps plugin clients decode those details back into Go
+// values, so that plugin protocols need not flatten everything about an
+// error into its status message.
+//
+// A server RPC handler can return an *Error directly, because it implements
+// the GRPCStatus method that gRPC uses to find the status for an error. The
+// details are sent using the standard message types from package
+// google.golang.org/genproto/googleapis/rpc/errdetails, so clients not
+// written in Go can decode them too.
+//
+// A client then passes the error returned from an RPC call to FromError to
+// recover the same information.
+package statusdetail // import go.rpcplugin.org/rpcplugin/statusdetail
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorInfoDomain identifies the detail message that carries Error.Reason
+// and Error.Metadata.
+//
+// The version of the errdetails package we depend on has no ErrorInfo
+// message, so we send the equivalent fields as a google.protobuf.Struct
+// instead, marked with this domain so we can distinguish it from any other
+// Struct the server might include.
+const errorInfoDomain = "rpcplugin.org"
+
+// Error is an error with a gRPC status code and optional structured
+// details.
+type Error struct {
+	// Code and Message are the gRPC status code and message.
+	Code    codes.Code
+	Message string
+
+	// Reason, if not empty, is an application-defined identifier for the
+	// specific cause of the error, such as "NOT_CONFIGURED", which is more
+	// specific than Code and stable enough for clients to compare against.
+	//
+	// Metadata is optional additional information about the cause, whose
+	// meaning depends on Reason.
+	Reason   string
+	Metadata map[string]string
+
+	// FieldViolations describes problems with specific fields of the
+	// request message.
+	FieldViolations []FieldViolation
+
+	// RetryDelay, if positive, is how long the client should wait before
+	// retrying the same request.
+	RetryDelay time.Duration
+
+	// Other contains any further detail messages, which are sent and
+	// received as-is. FromError also places here any detail messages that
+	// this package does not otherwise represent.
+	Other []proto.Message
+}
+
+// FieldViolation describes a problem with a single field of a request
+// message.
+type FieldViolation struct {
+	// Field is a dot-separated path to the field within the request
+	// message, such as "config.name".
+	Field string
+
+	// Description explains why the field value is not acceptable.
+	Description string
+}
+
+// New returns an error with the given status code and message, and no
+// details yet.
+func New(code codes.Code, msg string) *Error {
+	return &Error{
+		Code:    code,
+		Message: msg,
+	}
+}
+
+// Newf is like New but formats the message as for fmt.Sprintf.
+func Newf(code codes.Code, format string, args ...interface{}) *Error {
+	return New(code, fmt.Sprintf(format, args...))
+}
+
+// WithReason sets the Reason and Metadata fields of the error and returns
+// the same error, for convenient chaining.
+func (e *Error) WithReason(reason string, metadata map[string]string) *Error {
+	e.Reason = reason
+	e.Metadata = metadata
+	return e
+}
+
+// WithFieldViolation adds a field violation to the error and returns the
+// same error, for convenient chaining.
+func (e *Error) WithFieldViolation(field, description string) *Error {
+	e.FieldViolations = append(e.FieldViolations, FieldViolation{
+		Field:       field,
+		Description: description,
+	})
+	return e
+}
+
+// WithRetryDelay sets the RetryDelay field of the error and returns the
+// same error, for convenient chaining.
+func (e *Error) WithRetryDelay(d time.Duration) *Error {
+	e.RetryDelay = d
+	return e
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("rpc error: code = %s desc = %s", e.Code, e.Message)
+	if e.Reason != "" {
+		msg += fmt.Sprintf(" reason = %s", e.Reason)
+	}
+	return msg
+}
+
+// GRPCStatus returns the gRPC status that represents the error, including
+// all of its details.
+//
+// If any of the details cannot be encoded then the returned status has code
+// Internal instead, describing the problem.
+func (e *Error) GRPCStatus() *status.Status {
+	st, err := status.New(e.Code, e.Message).WithDetails(e.details()...)
+	if err != nil {
+		return status.Newf(codes.Internal, "failed to encode error details: %s", err)
+	}
+	return st
+}
+
+func (e *Error) details() []proto.Message {
+	var ret []proto.Message
+	if e.Reason != "" || len(e.Metadata) != 0 {
+		meta := make(map[string]*structpb.Value, len(e.Metadata))
+		for k, v := range e.Metadata {
+			meta[k] = stringValue(v)
+		}
+		ret = append(ret, &structpb.Struct{
+			Fields: map[string]*structpb.Value{
+				"domain":   stringValue(errorInfoDomain),
+				"reason":   stringValue(e.Reason),
+				"metadata": {Kind: &structpb.Value_StructValue{StructValue: &structpb.Struct{Fields: meta}}},
+			},
+		})
+	}
+	if len(e.FieldViolations) != 0 {
+		br := &errdetails.BadRequest{}
+		for _, fv := range e.FieldViolations {
+			br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{
+				Field:       fv.Field,
+				Description: fv.Description,
+			})
+		}
+		ret = append(ret, br)
+	}
+	if e.RetryDelay > 0 {
+		ret = append(ret, &errdetails.RetryInfo{
+			RetryDelay: ptypes.DurationProto(e.RetryDelay),
+		})
+	}
+	return append(ret, e.Other...)
+}
+
+// FromError decodes the gRPC status and details from the given error, which
+// would typically be returned from a call to a plugin server.
+//
+// The second return value is false if the error does not carry a gRPC
+// status at all, in which case the returned error has code Unknown and the
+// error's own message. FromError returns nil, true if the given error is
+// nil.
+func FromError(err error) (*Error, bool) {
+	if err == nil {
+		return nil, true
+	}
+	if e, ok := err.(*Error); ok {
+		return e, true
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return New(codes.Unknown, err.Error()), false
+	}
+	return FromStatus(st), true
+}
+
+// FromStatus decodes the given gRPC status and its details. It returns nil
+// if the status has code OK.
+func FromStatus(st *status.Status) *Error {
+	if st.Code() == codes.OK {
+		return nil
+	}
+	ret := New(st.Code(), st.Message())
+	for _, detail := range st.Details() {
+		switch detail := detail.(type) {
+		case *structpb.Struct:
+			if !ret.decodeErrorInfo(detail) {
+				ret.Other = append(ret.Other, detail)
+			}
+		case *errdetails.BadRequest:
+			for _, fv := range detail.GetFieldViolations() {
+				ret.FieldViolations = append(ret.FieldViolations, FieldViolation{
+					Field:       fv.GetField(),
+					Description: fv.GetDescription(),
+				})
+			}
+		case *errdetails.RetryInfo:
+			if d, err := ptypes.Duration(detail.GetRetryDelay()); err == nil {
+				ret.RetryDelay = d
+			}
+		case proto.Message:
+			ret.Other = append(ret.Other, detail)
+		default:
+			// Details whose types aren't linked into this program come back
+			// as errors, which we can't represent.
+		}
+	}
+	return ret
+}
+
+// decodeErrorInfo populates Reason and Metadata from the given detail if it
+// is one that GRPCStatus would produce for them, returning false otherwise.
+func (e *Error) decodeErrorInfo(s *structpb.Struct) bool {
+	fields := s.GetFields()
+	if fields["domain"].GetStringValue() != errorInfoDomain {
+		return false
+	}
+	e.Reason = fields["reason"].GetStringValue()
+	if meta := fields["metadata"].GetStructValue().GetFields(); len(meta) != 0 {
+		e.Metadata = make(map[string]string, len(meta))
+		for k, v := range meta {
+			e.Metadata[k] = v.GetStringValue()
+		}
+	}
+	return true
+}
+
+// Reason returns the Reason from the given error's details, or an empty
+// string if it has none.
+func Reason(err error) string {
+	if e, _ := FromError(err); e != nil {
+		return e.Reason
+	}
+	return ""
+}
+
+// RetryDelay returns the delay the server requested before retrying the
+// call that returned the given error, and whether the server requested a
+// retry at all.
+func RetryDelay(err error) (time.Duration, bool) {
+	if e, _ := FromError(err); e != nil && e.RetryDelay > 0 {
+		return e.RetryDelay, true
+	}
+	return 0, false
+}
+
+// FieldViolations returns the field violations from the given error's
+// details, sorted by field path.
+func FieldViolations(err error) []FieldViolation {
+	e, _ := FromError(err)
+	if e == nil || len(e.FieldViolations) == 0 {
+		return nil
+	}
+	ret := make([]FieldViolation, len(e.FieldViolations))
+	copy(ret, e.FieldViolations)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Field < ret[j].Field
+	})
+	return ret
+}
+
+func stringValue(s string) *structpb.Value {
+	return &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: s}}
+}
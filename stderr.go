@@ -0,0 +1,168 @@
+package rpcplugin
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultStderrBufferSize is the default for ClientConfig.StderrBufferSize.
+const defaultStderrBufferSize = 16 * 1024
+
+// stderrDrainTimeout is how long the client waits, after the plugin server
+// process exits, for the rest of its stderr output. The wait is normally
+// very short, but a descendant process of the server could hold the stderr
+// pipe open indefinitely.
+const stderrDrainTimeout = time.Second
+
+// stderrCapture copies the stderr output of a plugin server process to the
+// caller's writer while retaining the most recent output in a ring buffer.
+type stderrCapture struct {
+	r, w *os.File
+	dst  io.Writer
+	done chan struct{}
+
+	mu    sync.Mutex
+	buf   []byte
+	start int
+	full  bool
+}
+
+func newStderrCapture(dst io.Writer, size int) (*stderrCapture, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	return &stderrCapture{
+		r:    r,
+		w:    w,
+		dst:  dst,
+		done: make(chan struct{}),
+		buf:  make([]byte, 0, size),
+	}, nil
+}
+
+// File returns the file to use as the child process's stderr.
+func (c *stderrCapture) File() *os.File {
+	return c.w
+}
+
+// Start begins copying output, once the child process has started.
+func (c *stderrCapture) Start() {
+	// The child has its own copy of the write end of the pipe, so we must
+	// close ours in order to see the end of its output.
+	c.w.Close()
+	c.startCopy()
+}
+
+// StartShared begins copying output written to the pipe by a ProcessRunner
+// within the client process, once it has started. The caller must call
+// CloseWriter once the runner has finished writing.
+func (c *stderrCapture) StartShared() {
+	c.startCopy()
+}
+
+// CloseWriter closes the write end of the pipe after StartShared.
+func (c *stderrCapture) CloseWriter() {
+	c.w.Close()
+}
+
+func (c *stderrCapture) startCopy() {
+	go func() {
+		defer close(c.done)
+		defer c.r.Close()
+		dst := c.dst
+		buf := make([]byte, 4096)
+		for {
+			n, err := c.r.Read(buf)
+			if n > 0 {
+				c.record(buf[:n])
+				// If the caller's writer fails we keep reading anyway, so
+				// that the child won't block writing to its stderr.
+				if dst != nil {
+					if _, err := dst.Write(buf[:n]); err != nil {
+						dst = nil
+					}
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Abort releases the pipe if the child process couldn't start.
+func (c *stderrCapture) Abort() {
+	c.w.Close()
+	c.r.Close()
+	close(c.done)
+}
+
+// Wait waits for the end of the child's output, for up to the given time.
+func (c *stderrCapture) Wait(timeout time.Duration) {
+	select {
+	case <-c.done:
+	case <-time.After(timeout):
+	}
+}
+
+func (c *stderrCapture) record(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	size := cap(c.buf)
+	if len(p) > size {
+		p = p[len(p)-size:]
+	}
+	if !c.full {
+		free := size - len(c.buf)
+		if len(p) <= free {
+			c.buf = append(c.buf, p...)
+			return
+		}
+		c.buf = append(c.buf, p[:free]...)
+		p = p[free:]
+		c.full = true
+	}
+	// Once the buffer is full, start is the position of the oldest byte,
+	// which is where we overwrite next.
+	for len(p) > 0 {
+		n := copy(c.buf[c.start:], p)
+		p = p[n:]
+		c.start = (c.start + n) % size
+	}
+}
+
+// Bytes returns a copy of the retained output, oldest first.
+func (c *stderrCapture) Bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := make([]byte, 0, len(c.buf))
+	ret = append(ret, c.buf[c.start:]...)
+	return append(ret, c.buf[:c.start]...)
+}
+
+// LastStderr returns the most recent output the plugin server process
+// wrote to its stderr, up to ClientConfig.StderrBufferSize bytes, even if
+// ClientConfig.Stderr was nil. This is often the most useful explanation
+// of why a plugin server crashed.
+//
+// LastStderr returns nil if the client isn't retaining stderr output, or
+// for a plugin obtained using Attach.
+func (p *Plugin) LastStderr() []byte {
+	if p.stderr == nil {
+		return nil
+	}
+	return p.stderr.Bytes()
+}
+
+// lastLine returns the last non-empty line of the given output.
+func lastLine(output []byte) string {
+	output = bytes.TrimRight(output, "\r\n\t ")
+	if i := bytes.LastIndexByte(output, '\n'); i >= 0 {
+		output = output[i+1:]
+	}
+	return string(bytes.TrimSpace(output))
+}
@@ -0,0 +1,8 @@
+//go:build !wasip1
+// +build !wasip1
+
+package rpcplugin
+
+// canRedirectStdio is true if Serve can redirect os.Stdout and os.Stderr
+// through pipes while the plugin code is running.
+const canRedirectStdio = true
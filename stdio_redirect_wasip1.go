@@ -0,0 +1,12 @@
+//go:build wasip1
+// +build wasip1
+
+package rpcplugin
+
+// canRedirectStdio is true if Serve can redirect os.Stdout and os.Stderr
+// through pipes while the plugin code is running.
+//
+// WASI has no pipes, so a server compiled to WebAssembly leaves its stdio
+// as it is, and anything the plugin code writes to os.Stdout goes wherever
+// the handshake went.
+const canRedirectStdio = false
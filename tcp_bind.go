@@ -0,0 +1,81 @@
+package rpcplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/apparentlymart/go-ctxenv/ctxenv"
+)
+
+// tcpBindAddrEnvName is the environment variable the client uses to tell
+// the server which IP address to listen on when it uses the TCP transport,
+// overriding the default of 127.0.0.1.
+//
+// Because listening on an address other than a loopback address exposes the
+// server to other hosts, the server refuses such an address unless the
+// variable named by tcpBindNonLoopbackEnvName is also set to "1", or unless
+// the server's own configuration allows it.
+const (
+	tcpBindAddrEnvName        = "PLUGIN_TCP_BIND_ADDR"
+	tcpBindNonLoopbackEnvName = "PLUGIN_TCP_BIND_NON_LOOPBACK"
+)
+
+// defaultTCPBindAddr is the address servers listen on by default when they
+// use the TCP transport.
+var defaultTCPBindAddr = net.IPv4(127, 0, 0, 1)
+
+// tcpBindConfig describes which address an RPC server listens on when it
+// uses the TCP transport.
+type tcpBindConfig struct {
+	// Addr is the IP address to listen on, or empty to use the default.
+	Addr string
+
+	// AllowNonLoopback must be set if Addr is not a loopback address.
+	AllowNonLoopback bool
+}
+
+// environ returns the environment variables that ask a server to listen in
+// the way described by the receiver.
+func (c tcpBindConfig) environ() []string {
+	var ret []string
+	if c.Addr != "" {
+		ret = append(ret, fmt.Sprintf("%s=%s", tcpBindAddrEnvName, c.Addr))
+	}
+	if c.AllowNonLoopback {
+		ret = append(ret, fmt.Sprintf("%s=1", tcpBindNonLoopbackEnvName))
+	}
+	return ret
+}
+
+// ip returns the address to listen on, or an error if the address is not
+// valid or is not a loopback address and that isn't allowed.
+func (c tcpBindConfig) ip() (net.IP, error) {
+	if c.Addr == "" {
+		return defaultTCPBindAddr, nil
+	}
+	ip := net.ParseIP(c.Addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid TCP bind address %q: must be an IP address", c.Addr)
+	}
+	if !ip.IsLoopback() && !c.AllowNonLoopback {
+		return nil, fmt.Errorf("TCP bind address %s is not a loopback address, which must be explicitly allowed", ip)
+	}
+	return ip, nil
+}
+
+// serverTCPBindConfig returns the configuration for a server's TCP listener,
+// using the settings from the server's own configuration if present or
+// otherwise those requested by the client.
+func serverTCPBindConfig(ctx context.Context, config *ServerConfig) tcpBindConfig {
+	if config.TCPBindAddr != "" {
+		return tcpBindConfig{
+			Addr:             config.TCPBindAddr,
+			AllowNonLoopback: config.AllowNonLoopbackTCP,
+		}
+	}
+	return tcpBindConfig{
+		Addr:             ctxenv.Getenv(ctx, tcpBindAddrEnvName),
+		AllowNonLoopback: config.AllowNonLoopbackTCP || ctxenv.Getenv(ctx, tcpBindNonLoopbackEnvName) == "1",
+	}
+}
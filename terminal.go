@@ -0,0 +1,153 @@
+package rpcplugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apparentlymart/go-ctxenv/ctxenv"
+)
+
+// terminalFDEnvName is the environment variable that tells the server the
+// file descriptor number of its pseudo-terminal, for ClientConfig.Terminal.
+const terminalFDEnvName = "PLUGIN_TERMINAL_FD"
+
+// Terminal configures a pseudo-terminal for a plugin server process, via
+// ClientConfig.Terminal, for plugins that wrap interactive programs which
+// expect to be connected to a terminal.
+//
+// The plugin server's stdout remains reserved for the handshake, so the
+// terminal is an additional file that the server obtains using
+// ServerTerminal. A server would typically run the interactive program as
+// its own child process, with the terminal as that program's stdin, stdout
+// and stderr.
+//
+// Terminals are currently supported only on Linux. On other platforms New
+// returns an error if ClientConfig.Terminal is set.
+type Terminal struct {
+	// Input, if set, provides the data to send to the terminal as if typed
+	// by a user, such as os.Stdin for an application that is itself running
+	// in a terminal.
+	//
+	// The client stops reading from Input only when Input returns an error
+	// or the terminal is closed, so a call to Input's Read method that is
+	// waiting for data at that time may still consume some.
+	Input io.Reader
+
+	// Output, if set, receives the data that programs write to the terminal.
+	// If it is nil, the output is discarded.
+	Output io.Writer
+
+	// Rows and Cols are the initial size of the terminal, in characters. If
+	// both are zero, the size is left unset. Use Plugin.ResizeTerminal to
+	// change the size later.
+	Rows, Cols uint16
+}
+
+// clientTerminal is the client's side of the pseudo-terminal created for
+// ClientConfig.Terminal.
+type clientTerminal struct {
+	master, slave *os.File
+	config        *Terminal
+	done          chan struct{}
+}
+
+func newClientTerminal(config *Terminal) (*clientTerminal, error) {
+	master, slave, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+	if config.Rows != 0 || config.Cols != 0 {
+		if err := setPTYSize(master, config.Rows, config.Cols); err != nil {
+			master.Close()
+			slave.Close()
+			return nil, err
+		}
+	}
+	return &clientTerminal{
+		master: master,
+		slave:  slave,
+		config: config,
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// File returns the file to pass to the child process as its terminal.
+func (t *clientTerminal) File() *os.File {
+	return t.slave
+}
+
+// Start begins copying data to and from the terminal, once the child process
+// has started.
+func (t *clientTerminal) Start() {
+	// As with stderr, the child has its own copy of the terminal, so we must
+	// close ours in order to see the end of its output.
+	t.slave.Close()
+	if t.config.Input != nil {
+		go io.Copy(t.master, t.config.Input)
+	}
+	go func() {
+		defer close(t.done)
+		dst := t.config.Output
+		if dst == nil {
+			dst = ioutil.Discard
+		}
+		// Reading from the master returns an error once no process has the
+		// terminal open anymore, which is the expected way for this to end.
+		io.Copy(dst, t.master)
+	}()
+}
+
+// Abort releases the terminal if the child process couldn't start.
+func (t *clientTerminal) Abort() {
+	t.slave.Close()
+	t.master.Close()
+	close(t.done)
+}
+
+// Close waits for the end of the terminal output, for up to the given time,
+// and then closes the terminal.
+func (t *clientTerminal) Close(timeout time.Duration) {
+	select {
+	case <-t.done:
+	case <-time.After(timeout):
+	}
+	t.master.Close()
+}
+
+// ResizeTerminal changes the size of the plugin server's terminal, in
+// characters, which also sends SIGWINCH to the terminal's foreground process
+// group. It returns an error if ClientConfig.Terminal was not set.
+func (p *Plugin) ResizeTerminal(rows, cols uint16) error {
+	if p.terminal == nil {
+		return fmt.Errorf("plugin has no terminal")
+	}
+	return setPTYSize(p.terminal.master, rows, cols)
+}
+
+var serverTerminal struct {
+	once sync.Once
+	file *os.File
+}
+
+// ServerTerminal returns the pseudo-terminal the client allocated for the
+// plugin server, if the client's configuration had Terminal set, or nil
+// otherwise.
+//
+// All calls return the same file, which remains open for the life of the
+// server process unless the caller closes it.
+func ServerTerminal(ctx context.Context) *os.File {
+	serverTerminal.once.Do(func() {
+		fd, err := strconv.Atoi(ctxenv.Getenv(ctx, terminalFDEnvName))
+		if err != nil || fd < 3 {
+			return
+		}
+		serverTerminal.file = os.NewFile(uintptr(fd), "/dev/tty")
+	})
+	return serverTerminal.file
+}
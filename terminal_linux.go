@@ -0,0 +1,66 @@
+package rpcplugin
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// openPTY allocates a new pseudo-terminal, returning its master and slave
+// sides.
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot allocate terminal: %w", err)
+	}
+	var unlock int32
+	var num uint32
+	err = ptyIoctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock))
+	if err == nil {
+		err = ptyIoctl(master, syscall.TIOCGPTN, unsafe.Pointer(&num))
+	}
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("cannot allocate terminal: %w", err)
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", num), os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("cannot open terminal: %w", err)
+	}
+	return master, slave, nil
+}
+
+// setPTYSize sets the size of the pseudo-terminal whose master side is the
+// given file.
+func setPTYSize(master *os.File, rows, cols uint16) error {
+	ws := struct {
+		Row, Col, XPixel, YPixel uint16
+	}{Row: rows, Col: cols}
+	if err := ptyIoctl(master, syscall.TIOCSWINSZ, unsafe.Pointer(&ws)); err != nil {
+		return fmt.Errorf("cannot resize terminal: %w", err)
+	}
+	return nil
+}
+
+// ptyIoctl performs an ioctl on the given file without using its Fd method,
+// which would switch it to blocking mode and so prevent Close from
+// interrupting the goroutine copying its output.
+func ptyIoctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
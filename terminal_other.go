@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package rpcplugin
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func openPTY() (master, slave *os.File, err error) {
+	return nil, nil, fmt.Errorf("terminals are not supported on %s", runtime.GOOS)
+}
+
+func setPTYSize(master *os.File, rows, cols uint16) error {
+	return fmt.Errorf("terminals are not supported on %s", runtime.GOOS)
+}
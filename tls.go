@@ -3,22 +3,72 @@ package rpcplugin
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"math/big"
+	"os"
+	"sync/atomic"
 	"time"
 )
 
+// clientCertFileEnvName is the environment variable the client uses to pass
+// its automatically-negotiated certificate to the server in a file, as an
+// alternative to passing it directly in PLUGIN_CLIENT_CERT.
+const clientCertFileEnvName = "PLUGIN_CLIENT_CERT_FILE"
+
+// writeClientCertFile writes the given PEM-encoded certificate to a new
+// temporary file readable only by the current user, and returns its path.
+func writeClientCertFile(certPEM []byte) (string, error) {
+	f, err := ioutil.TempFile("", "rpcplugin-client-cert")
+	if err != nil {
+		return "", fmt.Errorf("failed to create client certificate file: %s", err)
+	}
+	_, err = f.Write(certPEM)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write client certificate file: %s", err)
+	}
+	return f.Name(), nil
+}
+
+// CertificateIssuer is a certificate authority that signs the temporary
+// certificates produced by the automatic TLS negotiation protocol, instead
+// of those certificates being self-signed.
+//
+// The temporary certificates are still pinned exactly by the other end of the
+// connection, but an issuer allows that other end to make additional checks
+// of the certificate chain using a VerifyPeer function. Because the issuer's
+// key is a crypto.Signer, it can be held in a hardware security module or a
+// cloud key management service.
+type CertificateIssuer struct {
+	// Certificate is the certificate of the issuing authority, which will
+	// be included in the certificate chain presented to the other end.
+	Certificate *x509.Certificate
+
+	// Signer is the issuing authority's private key.
+	Signer crypto.Signer
+}
+
 // generateCertificate generates a temporary certificate for plugin
-// authentication.
-func generateCertificate(ctx context.Context, host string) (tls.Certificate, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+// authentication. If issuer is nil the certificate is self-signed, and
+// otherwise it is signed by the given issuer.
+//
+// The certificate uses an ECDSA P-256 key, because generating such a key is
+// far faster than generating an RSA key of comparable strength, and every
+// plugin launch generates at least two of these.
+func generateCertificate(ctx context.Context, host string, issuer *CertificateIssuer) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return tls.Certificate{}, err
 	}
@@ -39,7 +89,7 @@ func generateCertificate(ctx context.Context, host string) (tls.Certificate, err
 			x509.ExtKeyUsageClientAuth,
 			x509.ExtKeyUsageServerAuth,
 		},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement | x509.KeyUsageCertSign,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement | x509.KeyUsageCertSign,
 		BasicConstraintsValid: true,
 		SerialNumber:          sn,
 		NotBefore:             time.Now().Add(-30 * time.Second),
@@ -47,17 +97,38 @@ func generateCertificate(ctx context.Context, host string) (tls.Certificate, err
 		IsCA:                  true,
 	}
 
-	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	parent := template
+	var signer crypto.Signer = key
+	var chain [][]byte
+	if issuer != nil {
+		// A certificate issued by a real authority is just a leaf, and
+		// must not outlive its issuer.
+		template.IsCA = false
+		template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement
+		if template.NotAfter.After(issuer.Certificate.NotAfter) {
+			template.NotAfter = issuer.Certificate.NotAfter
+		}
+		parent = issuer.Certificate
+		signer = issuer.Signer
+		chain = append(chain, issuer.Certificate.Raw)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
 	if err != nil {
 		return tls.Certificate{}, err
 	}
 
 	var certOut bytes.Buffer
-	if err := pem.Encode(&certOut, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
-		return tls.Certificate{}, err
+	for _, certDER := range append([][]byte{der}, chain...) {
+		if err := pem.Encode(&certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certDER}); err != nil {
+			return tls.Certificate{}, err
+		}
 	}
 
-	keyBytes := x509.MarshalPKCS1PrivateKey(key)
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
 
 	var keyOut bytes.Buffer
 	if err := pem.Encode(&keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}); err != nil {
@@ -75,18 +146,193 @@ func generateCertificate(ctx context.Context, host string) (tls.Certificate, err
 	return cert, nil
 }
 
-func decodeRawBase64Cert(src string) (*x509.Certificate, error) {
-	asn1, err := base64.StdEncoding.DecodeString(src)
-	if err != nil {
-		// We'll also try RawStdEncoding, because that's what HashiCorp's
-		// go-plugin uses and so this is more compatible. Support for
-		// RawStdEncoding is not a required part of rpcplugin, so not all
-		// implementations will support it.
-		asn1, err = base64.RawStdEncoding.DecodeString(src)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse plugin server's temporary certificate: %s", err)
+// autoCredentials are the credentials established by the automatic TLS
+// negotiation protocol: a temporary certificate for this end of the
+// connection and the certificate pool used to authenticate the other end.
+//
+// Both can be replaced while connections are active, so that long-lived
+// plugins can rotate their temporary certificates. The TLS configurations
+// produced by an autoCredentials object always use the current values.
+type autoCredentials struct {
+	cert  atomic.Value // *tls.Certificate
+	peers atomic.Value // *x509.CertPool
+
+	// verify is an optional additional check of the peer's certificate
+	// chain, policy optionally constrains the TLS parameters, and issuer
+	// optionally signs new certificates during rotation. These must be set
+	// before the credentials are first used.
+	verify func([]*x509.Certificate) error
+	policy *TLSPolicy
+	issuer *CertificateIssuer
+}
+
+func newAutoCredentials(cert tls.Certificate) *autoCredentials {
+	ret := &autoCredentials{}
+	ret.SetCertificate(cert)
+	return ret
+}
+
+// Certificate returns the current certificate.
+func (c *autoCredentials) Certificate() *tls.Certificate {
+	return c.cert.Load().(*tls.Certificate)
+}
+
+// SetCertificate replaces the current certificate, for use in any TLS
+// handshakes that begin after it returns.
+func (c *autoCredentials) SetCertificate(cert tls.Certificate) {
+	c.cert.Store(&cert)
+}
+
+// TrustPeers replaces the pool of certificates that the other end of the
+// connection may present.
+func (c *autoCredentials) TrustPeers(pool *x509.CertPool) {
+	c.peers.Store(pool)
+}
+
+func (c *autoCredentials) verifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	pool, _ := c.peers.Load().(*x509.CertPool)
+	if pool == nil {
+		return fmt.Errorf("plugin handshake is not yet complete")
+	}
+	return verifyPeerCertChain(rawCerts, pool, c.verify)
+}
+
+// ClientTLSConfig returns a TLS configuration for the client end of a
+// connection using the receiver's credentials.
+func (c *autoCredentials) ClientTLSConfig() *tls.Config {
+	ret := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.Certificate(), nil
+		},
+
+		// The peer certificate is a self-signed temporary certificate that
+		// we pin exactly, so we verify it ourselves instead of using the
+		// standard verification that would also check the host name.
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: c.verifyPeer,
+	}
+	c.policy.apply(ret)
+	return ret
+}
+
+// ServerTLSConfig returns a TLS configuration for the server end of a
+// connection using the receiver's credentials.
+func (c *autoCredentials) ServerTLSConfig() *tls.Config {
+	ret := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.Certificate(), nil
+		},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: c.verifyPeer,
+	}
+	c.policy.apply(ret)
+	return ret
+}
+
+// clientCertAsServerCert returns a GetCertificate function that presents
+// the certificate selected by the GetClientCertificate function of the given
+// configuration, so that a custom client configuration can also serve as
+// the server configuration for HostServices. It returns nil if the
+// configuration has no GetClientCertificate function.
+func clientCertAsServerCert(config *tls.Config) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	get := config.GetClientCertificate
+	if get == nil {
+		return nil
+	}
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return get(&tls.CertificateRequestInfo{
+			SignatureSchemes: hello.SignatureSchemes,
+		})
+	}
+}
+
+// serverCertAsClientCert is the opposite of clientCertAsServerCert, for
+// using a custom server configuration as the client configuration when a
+// plugin calls HostServices.
+func serverCertAsClientCert(config *tls.Config) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	get := config.GetCertificate
+	if get == nil {
+		return nil
+	}
+	return func(req *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return get(&tls.ClientHelloInfo{
+			SignatureSchemes: req.SignatureSchemes,
+		})
+	}
+}
+
+// withPeerVerifier returns a copy of the given TLS configuration that calls
+// the given function with the peer's certificate chain to make additional
+// checks after any verification the configuration already specifies.
+func withPeerVerifier(config *tls.Config, verify func([]*x509.Certificate) error) *tls.Config {
+	ret := config.Clone()
+	next := config.VerifyPeerCertificate
+	ret.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if next != nil {
+			if err := next(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("invalid peer certificate: %s", err)
+			}
+			certs[i] = cert
 		}
+		if len(certs) == 0 {
+			return fmt.Errorf("peer did not present a certificate")
+		}
+		return verify(certs)
+	}
+	return ret
+}
+
+// TLSPolicy constrains the TLS protocol parameters that a client or server
+// will negotiate, regardless of where its TLS configuration came from.
+//
+// The zero value of TLSPolicy applies no additional constraints, leaving
+// TLS 1.2 as the minimum version for automatically-negotiated credentials
+// and the default settings of package crypto/tls otherwise.
+type TLSPolicy struct {
+	// MinVersion is the minimum TLS version to accept, such as
+	// tls.VersionTLS13.
+	MinVersion uint16
+
+	// CipherSuites, if set, restricts the cipher suites that may be used
+	// with TLS 1.2. Package crypto/tls does not allow the cipher suites for
+	// TLS 1.3 to be configured.
+	CipherSuites []uint16
+
+	// CurvePreferences, if set, restricts the elliptic curves that may be
+	// used for key exchange, in order of preference.
+	CurvePreferences []tls.CurveID
+}
+
+// apply modifies the given configuration in-place to conform to the
+// receiver's constraints.
+func (p *TLSPolicy) apply(config *tls.Config) {
+	if p == nil {
+		return
 	}
+	if p.MinVersion > config.MinVersion {
+		config.MinVersion = p.MinVersion
+	}
+	if p.CipherSuites != nil {
+		config.CipherSuites = p.CipherSuites
+	}
+	if p.CurvePreferences != nil {
+		config.CurvePreferences = p.CurvePreferences
+	}
+}
 
-	return x509.ParseCertificate([]byte(asn1))
+// withTLSPolicy returns a copy of the given configuration that conforms to
+// the given policy.
+func withTLSPolicy(config *tls.Config, policy *TLSPolicy) *tls.Config {
+	ret := config.Clone()
+	policy.apply(ret)
+	return ret
 }
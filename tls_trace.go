@@ -0,0 +1,85 @@
+package rpcplugin
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"go.rpcplugin.org/rpcplugin/plugintrace"
+	"google.golang.org/grpc/credentials"
+)
+
+// tracedTLSCredentials wraps gRPC TLS transport credentials to report the
+// negotiated parameters of each successful handshake to a tracer, and to
+// mark client handshake failures as permanent.
+type tracedTLSCredentials struct {
+	credentials.TransportCredentials
+
+	// At most one of client and server is set, depending on which side of
+	// the connection these credentials are for.
+	client func(info *plugintrace.TLSInfo)
+	server func(remoteAddr net.Addr, info *plugintrace.TLSInfo)
+}
+
+// newClientTLSCredentials returns gRPC transport credentials for the given
+// client TLS configuration which report each handshake to the given
+// function, if it is not nil.
+//
+// The client's handshake failures are reported to gRPC as permanent, so that
+// a blocking dial returns them rather than retrying until its context ends.
+// A plugin server whose certificate the client rejects once will not present
+// a different one.
+func newClientTLSCredentials(config *tls.Config, report func(*plugintrace.TLSInfo)) credentials.TransportCredentials {
+	return &tracedTLSCredentials{TransportCredentials: credentials.NewTLS(config), client: report}
+}
+
+// newServerTLSCredentials is the server equivalent of
+// newClientTLSCredentials.
+func newServerTLSCredentials(config *tls.Config, report func(net.Addr, *plugintrace.TLSInfo)) credentials.TransportCredentials {
+	creds := credentials.NewTLS(config)
+	if report == nil {
+		return creds
+	}
+	return &tracedTLSCredentials{TransportCredentials: creds, server: report}
+}
+
+func (c *tracedTLSCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, authInfo, err := c.TransportCredentials.ClientHandshake(ctx, authority, rawConn)
+	if err != nil {
+		return nil, nil, tlsHandshakeError{err}
+	}
+	if c.client != nil {
+		if info, ok := authInfo.(credentials.TLSInfo); ok {
+			c.client(plugintrace.NewTLSInfo(&info.State))
+		}
+	}
+	return conn, authInfo, err
+}
+
+func (c *tracedTLSCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, authInfo, err := c.TransportCredentials.ServerHandshake(rawConn)
+	if err == nil && c.server != nil {
+		if info, ok := authInfo.(credentials.TLSInfo); ok {
+			c.server(rawConn.RemoteAddr(), plugintrace.NewTLSInfo(&info.State))
+		}
+	}
+	return conn, authInfo, err
+}
+
+func (c *tracedTLSCredentials) Clone() credentials.TransportCredentials {
+	return &tracedTLSCredentials{
+		TransportCredentials: c.TransportCredentials.Clone(),
+		client:               c.client,
+		server:               c.server,
+	}
+}
+
+// tlsHandshakeError is a client TLS handshake failure. gRPC treats any error
+// without a Temporary method as temporary, and retries it.
+type tlsHandshakeError struct {
+	err error
+}
+
+func (e tlsHandshakeError) Error() string   { return e.err.Error() }
+func (e tlsHandshakeError) Unwrap() error   { return e.err }
+func (e tlsHandshakeError) Temporary() bool { return false }
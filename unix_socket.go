@@ -0,0 +1,140 @@
+package rpcplugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/apparentlymart/go-ctxenv/ctxenv"
+)
+
+// unixSocketModeEnvName and unixSocketGroupEnvName are the environment
+// variables the client uses to tell the server what permissions and owning
+// group to give the Unix domain socket it creates, for situations where the
+// client and server run as different users.
+//
+// The mode is given as an octal number, and the group as either a group
+// name or a numeric group id.
+const (
+	unixSocketModeEnvName  = "PLUGIN_UNIX_SOCKET_MODE"
+	unixSocketGroupEnvName = "PLUGIN_UNIX_SOCKET_GROUP"
+)
+
+// unixSocketDirEnvName is the environment variable the client uses to tell
+// the server which directory to create its Unix domain socket in, overriding
+// the default selection of a temporary directory.
+const unixSocketDirEnvName = "PLUGIN_UNIX_SOCKET_DIR"
+
+// unixSocketConfig describes how to create a Unix domain socket for an RPC
+// server.
+type unixSocketConfig struct {
+	// Dir is the directory in which to create the socket's own temporary
+	// directory, or empty to use the default location.
+	Dir string
+
+	// Mode is the permissions to give the socket, or zero to leave the
+	// socket with its default permissions.
+	Mode os.FileMode
+
+	// Group is the name or numeric id of the group that should own the
+	// socket, or empty to leave the socket owned by the current group.
+	Group string
+}
+
+// environ returns the environment variables that ask a server to create its
+// socket in the way described by the receiver.
+func (c unixSocketConfig) environ() []string {
+	var ret []string
+	if c.Dir != "" {
+		ret = append(ret, fmt.Sprintf("%s=%s", unixSocketDirEnvName, c.Dir))
+	}
+	if c.Mode != 0 {
+		ret = append(ret, fmt.Sprintf("%s=%04o", unixSocketModeEnvName, c.Mode.Perm()))
+	}
+	if c.Group != "" {
+		ret = append(ret, fmt.Sprintf("%s=%s", unixSocketGroupEnvName, c.Group))
+	}
+	return ret
+}
+
+// serverUnixSocketConfig returns the configuration for a server's Unix domain
+// socket, using the settings from the server's own configuration if present
+// or otherwise those requested by the client.
+func serverUnixSocketConfig(ctx context.Context, config *ServerConfig) (unixSocketConfig, error) {
+	ret := unixSocketConfig{
+		Dir:   config.UnixSocketDir,
+		Mode:  config.UnixSocketMode,
+		Group: config.UnixSocketGroup,
+	}
+	if ret.Dir == "" {
+		ret.Dir = ctxenv.Getenv(ctx, unixSocketDirEnvName)
+	}
+	if ret.Mode == 0 {
+		if modeStr := ctxenv.Getenv(ctx, unixSocketModeEnvName); modeStr != "" {
+			mode, err := strconv.ParseUint(modeStr, 8, 32)
+			if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+				return ret, fmt.Errorf("invalid %s value %q", unixSocketModeEnvName, modeStr)
+			}
+			ret.Mode = os.FileMode(mode)
+		}
+	}
+	if ret.Group == "" {
+		ret.Group = ctxenv.Getenv(ctx, unixSocketGroupEnvName)
+	}
+	return ret, nil
+}
+
+// apply sets the permissions and ownership of a newly-created socket and
+// the directory containing it.
+//
+// The directory gets only the "search" permission for any class of user
+// that the socket mode grants access to, which is sufficient to connect to
+// the socket without allowing its siblings to be listed.
+func (c unixSocketConfig) apply(socketDir, socketPath string) error {
+	if c.Mode != 0 {
+		dirMode := os.FileMode(0700)
+		if c.Mode&0070 != 0 {
+			dirMode |= 0010
+		}
+		if c.Mode&0007 != 0 {
+			dirMode |= 0001
+		}
+		if err := os.Chmod(socketDir, dirMode); err != nil {
+			return fmt.Errorf("failed to set permissions for %s: %s", socketDir, err)
+		}
+		if err := os.Chmod(socketPath, c.Mode.Perm()); err != nil {
+			return fmt.Errorf("failed to set permissions for %s: %s", socketPath, err)
+		}
+	}
+	if c.Group != "" {
+		gid, err := lookupGroupID(c.Group)
+		if err != nil {
+			return err
+		}
+		for _, path := range []string{socketDir, socketPath} {
+			if err := os.Chown(path, -1, gid); err != nil {
+				return fmt.Errorf("failed to set group for %s: %s", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// lookupGroupID returns the numeric id of the given group, which can be
+// given either as a name or as a number.
+func lookupGroupID(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, fmt.Errorf("cannot find group %q: %s", group, err)
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, fmt.Errorf("group %q has non-numeric id %q", group, g.Gid)
+	}
+	return gid, nil
+}
@@ -0,0 +1,28 @@
+// Package wasmrunner runs rpcplugin plugin servers compiled to WebAssembly
+// for WASI, using the wazero runtime, so that a host application can offer
+// plugins that are sandboxed and portable across platforms alongside native
+// plugin executables.
+//
+// The runner executes the plugin server's WebAssembly module within the
+// host application's own process. WASI offers a module no way to listen for
+// network connections, so the server writes its handshake to its stdout as
+// usual and then exchanges all of its RPC traffic with the client over its
+// stdin and stdout, multiplexed as for ClientConfig.Multiplex. The plugin
+// server must therefore use the listener from package
+// go.rpcplugin.org/rpcplugin/wasmrunner/guest, for example:
+//
+//	listener, err := guest.Listener()
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	err = rpcplugin.Serve(ctx, &rpcplugin.ServerConfig{
+//		Handshake:     handshake,
+//		ProtoVersions: protoVersions,
+//		Listener:      listener,
+//	})
+//
+// and be built with GOOS=wasip1 and GOARCH=wasm.
+//
+// This package is a separate Go module so that applications using rpcplugin
+// without WebAssembly do not depend on wazero.
+package wasmrunner // import go.rpcplugin.org/rpcplugin/wasmrunner
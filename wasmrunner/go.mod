@@ -0,0 +1,23 @@
+module go.rpcplugin.org/rpcplugin/wasmrunner
+
+go 1.21
+
+replace go.rpcplugin.org/rpcplugin => ..
+
+require (
+	github.com/tetratelabs/wazero v1.7.3
+	go.rpcplugin.org/rpcplugin v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/apparentlymart/go-ctxenv v1.0.0 // indirect
+	github.com/apparentlymart/go-shquot v0.0.1 // indirect
+	github.com/golang/protobuf v1.5.0 // indirect
+	github.com/hashicorp/yamux v0.0.0-20181012175058-2f1d1f20f75d // indirect
+	golang.org/x/net v0.0.0-20180826012351-8a410e7b638d // indirect
+	golang.org/x/sys v0.0.0-20180830151530-49385e6e1522 // indirect
+	golang.org/x/text v0.3.0 // indirect
+	google.golang.org/genproto v0.0.0-20180817151627-c66870c02cf8 // indirect
+	google.golang.org/grpc v1.19.1 // indirect
+	google.golang.org/protobuf v1.28.1 // indirect
+)
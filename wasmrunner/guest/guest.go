@@ -0,0 +1,137 @@
+// Package guest provides the plugin server side of package wasmrunner, for
+// plugin servers compiled to WebAssembly for WASI.
+//
+// A plugin server running under wasmrunner exchanges its RPC traffic with
+// the client over its stdin and stdout, rather than over a socket, using
+// the listener that Listener returns. This package doesn't depend on wazero,
+// and so adds nothing to the plugin server beyond rpcplugin itself.
+package guest // import go.rpcplugin.org/rpcplugin/wasmrunner/guest
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Listener returns a listener whose only connection is the plugin server's
+// stdin and stdout, for use as rpcplugin.ServerConfig.Listener in a plugin
+// server started by wasmrunner.
+//
+// The listener returns the connection from its first call to Accept, which
+// happens after the server has written its handshake to stdout. From then
+// on stdout carries RPC traffic, so Accept also sets os.Stdout to os.Stderr
+// so that anything else the plugin writes to os.Stdout goes to its stderr
+// instead. Later calls to Accept block until the connection or the listener
+// is closed, and then return an error, so that the server exits once the
+// client disconnects.
+func Listener() (net.Listener, error) {
+	stdin, err := openStdin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stdin: %w", err)
+	}
+	return &stdioListener{
+		conn: &stdioConn{
+			stdin:  stdin,
+			stdout: os.Stdout,
+			closed: make(chan struct{}),
+		},
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// stdioAddr is the address of the stdio listener. It claims the "unix"
+// network because the server reports its address in the handshake, where the
+// client accepts only the transports that the rpcplugin protocol defines.
+// The client never dials it.
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "unix" }
+func (stdioAddr) String() string  { return "stdio" }
+
+type stdioListener struct {
+	conn     *stdioConn
+	accepted bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *stdioListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		select {
+		case <-l.closed:
+		default:
+			l.accepted = true
+			os.Stdout = os.Stderr
+			return l.conn, nil
+		}
+	}
+	select {
+	case <-l.conn.closed:
+		return nil, fmt.Errorf("client disconnected")
+	case <-l.closed:
+		return nil, fmt.Errorf("listener is closed")
+	}
+}
+
+func (l *stdioListener) Addr() net.Addr {
+	return stdioAddr{}
+}
+
+func (l *stdioListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+// stdioConn is the connection over stdin and stdout.
+type stdioConn struct {
+	stdin, stdout *os.File
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *stdioConn) Read(p []byte) (int, error) {
+	return c.stdin.Read(p)
+}
+
+func (c *stdioConn) Write(p []byte) (int, error) {
+	return c.stdout.Write(p)
+}
+
+func (c *stdioConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.stdin.Close()
+		if closeErr := c.stdout.Close(); err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
+
+func (c *stdioConn) LocalAddr() net.Addr {
+	return stdioAddr{}
+}
+
+func (c *stdioConn) RemoteAddr() net.Addr {
+	return stdioAddr{}
+}
+
+func (c *stdioConn) SetDeadline(t time.Time) error {
+	if err := c.stdin.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.stdout.SetWriteDeadline(t)
+}
+
+func (c *stdioConn) SetReadDeadline(t time.Time) error {
+	return c.stdin.SetReadDeadline(t)
+}
+
+func (c *stdioConn) SetWriteDeadline(t time.Time) error {
+	return c.stdout.SetWriteDeadline(t)
+}
@@ -0,0 +1,13 @@
+//go:build !unix && !wasip1
+// +build !unix,!wasip1
+
+package guest
+
+import "os"
+
+// openStdin returns stdin. Only WebAssembly modules need special handling,
+// and we use the same handling on Unix systems so that plugin servers can be
+// tested natively.
+func openStdin() (*os.File, error) {
+	return os.Stdin, nil
+}
@@ -0,0 +1,21 @@
+//go:build unix || wasip1
+// +build unix wasip1
+
+package guest
+
+import (
+	"os"
+	"syscall"
+)
+
+// openStdin returns stdin in non-blocking mode, so that the Go runtime
+// polls it. Otherwise, a WebAssembly module, which has only one thread,
+// would be blocked entirely while it waits for the client to send
+// something, and closing the connection would not interrupt a read in
+// progress.
+func openStdin() (*os.File, error) {
+	if err := syscall.SetNonblock(0, true); err != nil {
+		return nil, err
+	}
+	return os.NewFile(0, "/dev/stdin"), nil
+}
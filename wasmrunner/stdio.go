@@ -0,0 +1,219 @@
+package wasmrunner
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero/sys"
+	"go.rpcplugin.org/rpcplugin"
+)
+
+// instance is the rpcplugin.ProcessRunner for one plugin server running
+// from a Runner's module.
+type instance struct {
+	runner *Runner
+
+	streams *stdio
+	cancel  context.CancelFunc
+	exited  chan struct{}
+
+	mu     sync.Mutex
+	dialed bool
+}
+
+var _ rpcplugin.ProcessRunner = (*instance)(nil)
+
+func (i *instance) Start(ctx context.Context, env []string, stderr io.Writer) (io.ReadCloser, error) {
+	if i.streams != nil {
+		return nil, fmt.Errorf("plugin server already started")
+	}
+	streams, err := newStdio(stderr)
+	if err != nil {
+		return nil, err
+	}
+	// The module outlives the given context, which is only for New.
+	modCtx, cancel := context.WithCancel(context.Background())
+	module, err := i.runner.runtime.InstantiateModule(modCtx, i.runner.module, i.runner.moduleConfig(env, streams))
+	if err != nil {
+		cancel()
+		streams.Close()
+		return nil, fmt.Errorf("failed to instantiate plugin module: %w", err)
+	}
+	start := module.ExportedFunction("_start")
+	if start == nil {
+		cancel()
+		module.Close(context.Background())
+		streams.Close()
+		return nil, fmt.Errorf("plugin module has no _start function")
+	}
+
+	i.streams = streams
+	i.cancel = cancel
+	i.exited = make(chan struct{})
+	handshake := streams.splitHandshake()
+	go func() {
+		_, err := start.Call(modCtx)
+		var exitErr *sys.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			// The module trapped, and the error is the closest thing it
+			// has to a crash report, so we include it in its stderr.
+			fmt.Fprintf(stderr, "plugin module failed: %s\n", err)
+		}
+		module.Close(context.Background())
+		cancel()
+		streams.Close()
+		close(i.exited)
+	}()
+	return handshake, nil
+}
+
+// Signal implements rpcplugin.ProcessRunner. The module can only be
+// terminated, so Signal returns an error for any signal other than os.Kill.
+func (i *instance) Signal(sig os.Signal) error {
+	if sig != os.Kill {
+		return fmt.Errorf("cannot send signal %s to a WebAssembly module", sig)
+	}
+	i.cancel()
+	// The module might be blocked reading stdin, where it doesn't notice
+	// the cancellation until the read returns.
+	i.streams.stdinW.Close()
+	return nil
+}
+
+// Wait implements rpcplugin.ProcessRunner. The plugin server isn't a
+// process, and so Wait never returns a process state.
+func (i *instance) Wait() (*os.ProcessState, error) {
+	<-i.exited
+	return nil, nil
+}
+
+// Dial returns the connection to the plugin server over its stdin and
+// stdout, for use as ClientConfig.Dial. There is only one such connection,
+// so Dial returns an error if it is called again.
+func (i *instance) Dial(ctx context.Context, addr net.Addr) (net.Conn, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.dialed {
+		return nil, fmt.Errorf("the plugin server's stdio carries only one connection")
+	}
+	i.dialed = true
+	return &stdioConn{streams: i.streams}, nil
+}
+
+// stdio is the host side of a module's standard streams.
+//
+// Stdin is an *os.File, rather than an arbitrary reader, so that wazero can
+// poll it on behalf of a module that waits for it in non-blocking mode.
+type stdio struct {
+	stdinR, stdinW *os.File
+	stdoutW        *io.PipeWriter
+	stdout         *bufio.Reader
+	stderr         io.Writer
+
+	closeOnce sync.Once
+}
+
+func newStdio(stderr io.Writer) (*stdio, error) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
+	stdoutR, stdoutW := io.Pipe()
+	return &stdio{
+		stdinR:  stdinR,
+		stdinW:  stdinW,
+		stdoutW: stdoutW,
+		stdout:  bufio.NewReader(stdoutR),
+		stderr:  stderr,
+	}, nil
+}
+
+// splitHandshake returns a reader for the module's stdout up to and
+// including its handshake line, which the client reads as it would from a
+// child process. The rest of stdout remains for the connection.
+func (s *stdio) splitHandshake() io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		defer w.Close()
+		for {
+			line, err := s.stdout.ReadString('\n')
+			if _, werr := io.WriteString(w, line); werr != nil || err != nil {
+				return
+			}
+			// All handshake lines begin with the version of the handshake
+			// line format, which is always 1. Anything before it is
+			// preamble the client will skip.
+			if strings.HasPrefix(strings.TrimSpace(line), "1|") {
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// Close closes the host side of the streams, once the module has exited.
+func (s *stdio) Close() {
+	s.closeOnce.Do(func() {
+		s.stdinR.Close()
+		s.stdinW.Close()
+		s.stdoutW.Close()
+	})
+}
+
+// stdioConn is the client's connection over a module's stdin and stdout.
+type stdioConn struct {
+	streams *stdio
+}
+
+// stdioAddr is the address of both ends of a stdioConn.
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+func (c *stdioConn) Read(p []byte) (int, error) {
+	return c.streams.stdout.Read(p)
+}
+
+func (c *stdioConn) Write(p []byte) (int, error) {
+	return c.streams.stdinW.Write(p)
+}
+
+// Close closes the module's stdin, which tells the plugin server that the
+// client has disconnected.
+func (c *stdioConn) Close() error {
+	return c.streams.stdinW.Close()
+}
+
+func (c *stdioConn) LocalAddr() net.Addr {
+	return stdioAddr{}
+}
+
+func (c *stdioConn) RemoteAddr() net.Addr {
+	return stdioAddr{}
+}
+
+// The connection doesn't support read deadlines, because the rest of the
+// module's stdout is buffered for the connection once the handshake has been
+// read. The client's multiplexing doesn't use deadlines on the connection
+// itself.
+
+func (c *stdioConn) SetDeadline(t time.Time) error {
+	return fmt.Errorf("deadlines are not supported")
+}
+
+func (c *stdioConn) SetReadDeadline(t time.Time) error {
+	return fmt.Errorf("deadlines are not supported")
+}
+
+func (c *stdioConn) SetWriteDeadline(t time.Time) error {
+	return c.streams.stdinW.SetWriteDeadline(t)
+}
@@ -0,0 +1,161 @@
+package wasmrunner
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"go.rpcplugin.org/rpcplugin"
+)
+
+// Config describes how to run a plugin server's WebAssembly module.
+type Config struct {
+	// Args gives the command line arguments for the plugin server, not
+	// including the program name, which is always "plugin".
+	Args []string
+
+	// Env gives environment variables for the plugin server, in the
+	// "KEY=value" form of exec.Cmd.Env, in addition to those of the
+	// rpcplugin protocol. The module doesn't inherit the environment of the
+	// host application.
+	Env []string
+
+	// FS, if set, gives the plugin server access to files. Otherwise, the
+	// module has no filesystem at all.
+	FS wazero.FSConfig
+
+	// MemoryLimitPages, if set, limits the memory of the module to the
+	// given number of 64KiB pages.
+	MemoryLimitPages uint32
+}
+
+// Runner runs plugin servers from a compiled WebAssembly module.
+//
+// A Runner can start any number of plugin servers from the same module,
+// each of which has its own memory. Call Close once the Runner is no longer
+// needed, to release the compiled module.
+type Runner struct {
+	runtime wazero.Runtime
+	module  wazero.CompiledModule
+	config  Config
+}
+
+// NewRunner compiles the given WebAssembly module, which must be a WASI
+// command module such as those built by Go with GOOS=wasip1 and
+// GOARCH=wasm, and returns a Runner for running it as a plugin server.
+//
+// The given context is used only for compiling the module.
+func NewRunner(ctx context.Context, wasm []byte, config *Config) (*Runner, error) {
+	rtConfig := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if config.MemoryLimitPages != 0 {
+		rtConfig = rtConfig.WithMemoryLimitPages(config.MemoryLimitPages)
+	}
+	runtime := wazero.NewRuntimeWithConfig(ctx, rtConfig)
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to instantiate WASI: %w", err)
+	}
+	module, err := runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to compile plugin module: %w", err)
+	}
+	return &Runner{
+		runtime: runtime,
+		module:  module,
+		config:  *config,
+	}, nil
+}
+
+// New starts a plugin server from the runner's module, using the given
+// configuration for everything other than launching the server, and returns
+// an object representing the plugin once the server has completed its
+// handshake.
+//
+// The runner sets config.Runner and config.Dial itself, so they must be nil,
+// as must config.Cmd and config.InProcess. It also enables config.Multiplex,
+// because the server's stdin and stdout can carry only one connection, and
+// restricts config.Transports to "unix", the network the guest listener
+// reports. config.GoPluginCompat and config.ClientCertFile are not
+// supported.
+//
+// As for rpcplugin.New, the caller must no longer access or modify config
+// once it has been passed to New.
+func (r *Runner) New(ctx context.Context, config *rpcplugin.ClientConfig) (*rpcplugin.Plugin, error) {
+	switch {
+	case config.Cmd != nil:
+		return nil, fmt.Errorf("config field Cmd must be nil, because the runner runs the plugin server")
+	case config.InProcess != nil:
+		return nil, fmt.Errorf("config field InProcess is not supported for WebAssembly modules")
+	case config.Runner != nil:
+		return nil, fmt.Errorf("config field Runner must be nil, because the runner sets it")
+	case config.Dial != nil:
+		return nil, fmt.Errorf("config field Dial must be nil, because the runner sets it")
+	case config.GoPluginCompat:
+		return nil, fmt.Errorf("config field GoPluginCompat is not supported for WebAssembly modules")
+	case config.ClientCertFile:
+		return nil, fmt.Errorf("config field ClientCertFile is not supported for WebAssembly modules")
+	}
+	inst := &instance{runner: r}
+	config.Runner = inst
+	config.Dial = inst.Dial
+	config.Multiplex = true
+	config.Transports = []string{"unix"}
+	return rpcplugin.New(ctx, config)
+}
+
+// Close releases the compiled module and terminates any plugin servers
+// that are still running from it.
+func (r *Runner) Close(ctx context.Context) error {
+	return r.runtime.Close(ctx)
+}
+
+// moduleConfig returns the configuration for a new instance of the module,
+// with the given protocol environment variables and standard streams.
+func (r *Runner) moduleConfig(env []string, streams *stdio) wazero.ModuleConfig {
+	args := append([]string{"plugin"}, r.config.Args...)
+	ret := wazero.NewModuleConfig().
+		// Each instance must be anonymous so that they can run at the
+		// same time.
+		WithName("").
+		WithArgs(args...).
+		WithStdin(streams.stdinR).
+		WithStdout(streams.stdoutW).
+		WithStderr(streams.stderr).
+		// The module needs real clocks and randomness for TLS, rather
+		// than wazero's deterministic defaults.
+		WithSysWalltime().
+		WithSysNanotime().
+		WithSysNanosleep().
+		WithRandSource(rand.Reader).
+		// We call _start ourselves, after instantiation has succeeded.
+		WithStartFunctions()
+	if r.config.FS != nil {
+		ret = ret.WithFSConfig(r.config.FS)
+	}
+	// Modules differ in which of any duplicate variables they use, so the
+	// protocol's variables replace any of the same names in Config.Env.
+	protocol := make(map[string]bool, len(env))
+	for _, kv := range env {
+		k, v := splitEnv(kv)
+		protocol[k] = true
+		ret = ret.WithEnv(k, v)
+	}
+	for _, kv := range r.config.Env {
+		k, v := splitEnv(kv)
+		if !protocol[k] {
+			ret = ret.WithEnv(k, v)
+		}
+	}
+	return ret
+}
+
+func splitEnv(kv string) (string, string) {
+	if i := strings.Index(kv, "="); i >= 0 {
+		return kv[:i], kv[i+1:]
+	}
+	return kv, ""
+}